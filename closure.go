@@ -1,10 +1,75 @@
 package golua
 
 import (
+	"fmt"
 	"golua/compiler"
+	"math"
+	"reflect"
 )
 
-func newLuaClosure(proto *compiler.FunctionProto) *LuaClosure {
+// a function prototype prepared for the VM, its code is decoded and
+// its constants are converted to values once when the chunk is loaded
+type luaProto struct {
+	*compiler.FunctionProto
+	code   []luaInst
+	consts []value
+	protos []*luaProto
+	caches []fieldCache // inline caches of the code, see luaInst.ic
+	cover  *protoCover  // execution counts, see StartCoverage
+}
+
+func newLuaProto(fp *compiler.FunctionProto) *luaProto {
+	p := &luaProto{
+		FunctionProto: fp,
+		code:          decodeCode(fp.Code),
+		consts:        make([]value, len(fp.Constants)),
+		protos:        make([]*luaProto, len(fp.Protos)),
+	}
+	for i, c := range fp.Constants {
+		switch x := c.(type) {
+		case nil:
+			p.consts[i] = nilValue
+		case bool:
+			p.consts[i] = boolValue(x)
+		case string:
+			p.consts[i] = value{o: LuaString(x)}
+		case int:
+			p.consts[i] = numberValue(float64(x))
+		case int64:
+			p.consts[i] = numberValue(float64(x))
+		case float64:
+			p.consts[i] = numberValue(x)
+		default:
+			panic(fmt.Errorf("const type:%v error", reflect.TypeOf(c).Name()))
+		}
+	}
+	for i, sub := range fp.Protos {
+		p.protos[i] = newLuaProto(sub)
+	}
+	p.addCaches()
+	return p
+}
+
+// gives an inline cache to every table lookup with a constant string key
+func (p *luaProto) addCaches() {
+	for pc := range p.code {
+		i := &p.code[pc]
+		switch i.op {
+		case compiler.OP_GETTABUP, compiler.OP_GETTABLE, compiler.OP_SELF:
+		default:
+			continue
+		}
+		if i.c >= 0 || len(p.caches) == math.MaxUint16 {
+			continue
+		}
+		if key, ok := p.consts[^i.c].o.(LuaString); ok {
+			p.caches = append(p.caches, fieldCache{key: string(key)})
+			i.ic = uint16(len(p.caches))
+		}
+	}
+}
+
+func newLuaClosure(proto *luaProto) *LuaClosure {
 	c := &LuaClosure{proto: proto}
 	if nUpvals := len(proto.Upvalues); nUpvals > 0 {
 		c.upvals = make([]*upvalue, nUpvals)
@@ -73,8 +73,9 @@ type FunctionProto struct {
 	DbgUpvalues        []string
 }
 
+// lua-5.3.4/src/lfunc.c#luaF_getlocalname()
 func (fp *FunctionProto) LocalName(regno, pc int) (string, bool) {
-	for i := 0; i < len(fp.DbgLocVars) && fp.DbgLocVars[i].StartPC < pc; i++ {
+	for i := 0; i < len(fp.DbgLocVars) && fp.DbgLocVars[i].StartPC <= pc; i++ {
 		if pc < fp.DbgLocVars[i].EndPC {
 			regno--
 			if regno == 0 {
@@ -90,9 +91,9 @@ type Upvalue struct {
 	Idx     byte
 }
 
+// binary chunks are told apart by their first char, as lua_load does
 func isBinaryChunk(data []byte) bool {
-	return len(data) > 4 &&
-		string(data[:4]) == LUA_SIGNATURE
+	return len(data) > 0 && data[0] == LUA_SIGNATURE[0]
 }
 
 func undump(data []byte) *FunctionProto {
@@ -101,3 +102,13 @@ func undump(data []byte) *FunctionProto {
 	reader.readByte() // size_upvalues
 	return reader.readProto("")
 }
+
+// Dump encodes fp as a binary chunk, which Compile loads back.
+// lua-5.3.4/src/ldump.c#luaU_dump()
+func Dump(fp *FunctionProto) []byte {
+	writer := &writer{}
+	writer.writeHeader()
+	writer.writeByte(byte(len(fp.Upvalues))) // size_upvalues
+	writer.writeProto(fp, "")
+	return writer.data
+}
@@ -149,6 +149,9 @@ func (this *Lexer) NextIdentifier() (line int, token string) {
 func (this *Lexer) NextTokenOfKind(kind int) (line int, token string) {
 	line, _kind, token := this.NextToken()
 	if kind != _kind {
+		if _kind == TOKEN_EOF {
+			this.error("syntax error near %s", token)
+		}
 		this.error("syntax error near '%s'", token)
 	}
 	return line, token
@@ -166,7 +169,7 @@ func (this *Lexer) NextToken() (line, kind int, token string) {
 
 	this.skipWhiteSpaces()
 	if len(this.chunk) == 0 {
-		return this.line, TOKEN_EOF, "EOF"
+		return this.line, TOKEN_EOF, "<eof>"
 	}
 
 	switch this.chunk[0] {
@@ -319,10 +322,44 @@ func (this *Lexer) test(s string) bool {
 
 func (this *Lexer) error(f string, a ...interface{}) {
 	err := fmt.Sprintf(f, a...)
-	err = fmt.Sprintf("%s:%d: %s", this.chunkName, this.line, err)
+	err = fmt.Sprintf("%s:%d: %s", ChunkID(this.chunkName), this.line, err)
 	panic(err)
 }
 
+const idSize = 60 // LUA_IDSIZE
+
+// ChunkID returns a printable version of a chunk name, as used in messages
+// lua-5.3.4/src/lobject.c#luaO_chunkid()
+func ChunkID(source string) string {
+	const bufflen = idSize - 1
+	if strings.HasPrefix(source, "=") { /* 'literal' source */
+		if len(source) <= idSize {
+			return source[1:]
+		}
+		return source[1 : bufflen+1] /* truncate it */
+	}
+	if strings.HasPrefix(source, "@") { /* file name */
+		if len(source) <= idSize {
+			return source[1:]
+		}
+		return "..." + source[len(source)-bufflen+3:] /* get last part */
+	}
+	/* string; format as [string "source"] */
+	const pre, post, dots = `[string "`, `"]`, "..."
+	avail := bufflen - len(pre) - len(post) - len(dots)
+	nl := strings.IndexByte(source, '\n')
+	if len(source) < avail && nl < 0 { /* small one-line source? */
+		return pre + source + post
+	}
+	if nl >= 0 { /* stop at first newline */
+		source = source[:nl]
+	}
+	if len(source) > avail {
+		source = source[:avail]
+	}
+	return pre + source + dots + post
+}
+
 func (this *Lexer) skipWhiteSpaces() {
 	for len(this.chunk) > 0 {
 		if this.test("--") {
@@ -384,7 +421,7 @@ func (this *Lexer) scanLongString() string {
 	closingLongBracket := strings.Replace(openingLongBracket, "[", "]", -1)
 	closingLongBracketIdx := strings.Index(this.chunk, closingLongBracket)
 	if closingLongBracketIdx < 0 {
-		this.error("unfinished long string or comment")
+		this.error("unfinished long string or comment near <eof>")
 	}
 
 	str := this.chunk[len(openingLongBracket):closingLongBracketIdx]
@@ -3,8 +3,12 @@ package compiler
 import (
 	"math"
 	"encoding/binary"
+	"errors"
 )
 
+// the panic of a reader whose data ends before what it announces
+var ErrTruncated = errors.New("truncated precompiled chunk")
+
 type reader struct {
 	data []byte
 }
@@ -33,6 +37,16 @@ func (self *reader) readUint64() uint64 {
 	return i
 }
 
+// reads the length of a list whose elements take at least size bytes,
+// so that a corrupt length cannot make a huge list
+func (self *reader) readCount(size int) int {
+	n := self.readUint32()
+	if uint64(n)*uint64(size) > uint64(len(self.data)) {
+		panic(ErrTruncated)
+	}
+	return int(n)
+}
+
 func (self *reader) readLuaInteger() int64 {
 	return int64(self.readUint64())
 }
@@ -112,7 +126,7 @@ func (self *reader) readProto(parentSource string) *FunctionProto {
 }
 
 func (self *reader) readCode() []uint32 {
-	code := make([]uint32, self.readUint32())
+	code := make([]uint32, self.readCount(4))
 	for i := range code {
 		code[i] = self.readUint32()
 	}
@@ -120,7 +134,7 @@ func (self *reader) readCode() []uint32 {
 }
 
 func (self *reader) readConstants() []interface{} {
-	constants := make([]interface{}, self.readUint32())
+	constants := make([]interface{}, self.readCount(1))
 	for i := range constants {
 		constants[i] = self.readConstant()
 	}
@@ -145,7 +159,7 @@ func (self *reader) readConstant() interface{} {
 }
 
 func (self *reader) readUpvalues() []Upvalue {
-	upvalues := make([]Upvalue, self.readUint32())
+	upvalues := make([]Upvalue, self.readCount(2))
 	for i := range upvalues {
 		upvalues[i] = Upvalue{
 			Instack: self.readByte(),
@@ -156,7 +170,7 @@ func (self *reader) readUpvalues() []Upvalue {
 }
 
 func (self *reader) readProtos(parentSource string) []*FunctionProto {
-	protos := make([]*FunctionProto, self.readUint32())
+	protos := make([]*FunctionProto, self.readCount(40))
 	for i := range protos {
 		protos[i] = self.readProto(parentSource)
 	}
@@ -164,7 +178,7 @@ func (self *reader) readProtos(parentSource string) []*FunctionProto {
 }
 
 func (self *reader) readLineInfo() []uint32 {
-	lineInfo := make([]uint32, self.readUint32())
+	lineInfo := make([]uint32, self.readCount(4))
 	for i := range lineInfo {
 		lineInfo[i] = self.readUint32()
 	}
@@ -172,7 +186,7 @@ func (self *reader) readLineInfo() []uint32 {
 }
 
 func (self *reader) readLocVars() []DbgLocVar {
-	locVars := make([]DbgLocVar, self.readUint32())
+	locVars := make([]DbgLocVar, self.readCount(9))
 	for i := range locVars {
 		locVars[i] = DbgLocVar{
 			VarName: self.readString(),
@@ -184,7 +198,7 @@ func (self *reader) readLocVars() []DbgLocVar {
 }
 
 func (self *reader) readUpvalueNames() []string {
-	names := make([]string, self.readUint32())
+	names := make([]string, self.readCount(1))
 	for i := range names {
 		names[i] = self.readString()
 	}
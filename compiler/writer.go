@@ -0,0 +1,167 @@
+package compiler
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// writes binary chunks that reader reads back
+type writer struct {
+	data []byte
+}
+
+func (self *writer) writeByte(b byte) {
+	self.data = append(self.data, b)
+}
+
+func (self *writer) writeBytes(bytes []byte) {
+	self.data = append(self.data, bytes...)
+}
+
+func (self *writer) writeUint32(i uint32) {
+	self.data = binary.LittleEndian.AppendUint32(self.data, i)
+}
+
+func (self *writer) writeUint64(i uint64) {
+	self.data = binary.LittleEndian.AppendUint64(self.data, i)
+}
+
+func (self *writer) writeLuaInteger(i int64) {
+	self.writeUint64(uint64(i))
+}
+
+func (self *writer) writeLuaNumber(n float64) {
+	self.writeUint64(math.Float64bits(n))
+}
+
+// lua-5.3.4/src/ldump.c#DumpString()
+func (self *writer) writeString(s string) {
+	size := uint64(len(s)) + 1 /* include trailing '\0' */
+	if size < 0xFF {
+		self.writeByte(byte(size))
+	} else {
+		self.writeByte(0xFF)
+		self.writeUint64(size)
+	}
+	self.writeBytes([]byte(s))
+}
+
+// lua-5.3.4/src/ldump.c#DumpHeader()
+func (self *writer) writeHeader() {
+	self.writeBytes([]byte(LUA_SIGNATURE))
+	self.writeByte(LUAC_VERSION)
+	self.writeByte(LUAC_FORMAT)
+	self.writeBytes([]byte(LUAC_DATA))
+	self.writeByte(CINT_SIZE)
+	self.writeByte(CSIZET_SIZE)
+	self.writeByte(INSTRUCTION_SIZE)
+	self.writeByte(LUA_INTEGER_SIZE)
+	self.writeByte(LUA_NUMBER_SIZE)
+	self.writeLuaInteger(LUAC_INT)
+	self.writeLuaNumber(LUAC_NUM)
+}
+
+// lua-5.3.4/src/ldump.c#DumpFunction()
+func (self *writer) writeProto(fp *FunctionProto, parentSource string) {
+	if fp.Source == parentSource {
+		self.writeString("") /* same as its parent */
+	} else {
+		self.writeString(fp.Source)
+	}
+	self.writeUint32(fp.LineDefined)
+	self.writeUint32(fp.LastLineDefined)
+	self.writeByte(fp.NumParams)
+	self.writeByte(fp.IsVararg)
+	self.writeByte(fp.MaxStackSize)
+	self.writeCode(fp.Code)
+	self.writeConstants(fp.Constants)
+	self.writeUpvalues(fp.Upvalues)
+	self.writeProtos(fp.Protos, fp.Source)
+	self.writeLineInfo(fp.DbgSourcePositions)
+	self.writeLocVars(fp.DbgLocVars)
+	self.writeUpvalueNames(fp.DbgUpvalues)
+}
+
+func (self *writer) writeCode(code []uint32) {
+	self.writeUint32(uint32(len(code)))
+	for _, i := range code {
+		self.writeUint32(i)
+	}
+}
+
+func (self *writer) writeConstants(constants []interface{}) {
+	self.writeUint32(uint32(len(constants)))
+	for _, c := range constants {
+		self.writeConstant(c)
+	}
+}
+
+func (self *writer) writeConstant(c interface{}) {
+	switch x := c.(type) {
+	case nil:
+		self.writeByte(TAG_NIL)
+	case bool:
+		self.writeByte(TAG_BOOLEAN)
+		if x {
+			self.writeByte(1)
+		} else {
+			self.writeByte(0)
+		}
+	case int:
+		self.writeByte(TAG_INTEGER)
+		self.writeLuaInteger(int64(x))
+	case int64:
+		self.writeByte(TAG_INTEGER)
+		self.writeLuaInteger(x)
+	case float64:
+		self.writeByte(TAG_NUMBER)
+		self.writeLuaNumber(x)
+	case string:
+		if len(x) < 40 { /* LUAI_MAXSHORTLEN */
+			self.writeByte(TAG_SHORT_STR)
+		} else {
+			self.writeByte(TAG_LONG_STR)
+		}
+		self.writeString(x)
+	default:
+		panic("corrupted!") // todo
+	}
+}
+
+func (self *writer) writeUpvalues(upvalues []Upvalue) {
+	self.writeUint32(uint32(len(upvalues)))
+	for _, uv := range upvalues {
+		self.writeByte(uv.Instack)
+		self.writeByte(uv.Idx)
+	}
+}
+
+func (self *writer) writeProtos(protos []*FunctionProto, parentSource string) {
+	self.writeUint32(uint32(len(protos)))
+	for _, p := range protos {
+		self.writeProto(p, parentSource)
+	}
+}
+
+func (self *writer) writeLineInfo(lineInfo []uint32) {
+	self.writeUint32(uint32(len(lineInfo)))
+	for _, line := range lineInfo {
+		self.writeUint32(line)
+	}
+}
+
+func (self *writer) writeLocVars(locVars []DbgLocVar) {
+	self.writeUint32(uint32(len(locVars)))
+	for _, v := range locVars {
+		self.writeString(v.VarName)
+		self.writeUint32(uint32(v.StartPC))
+		self.writeUint32(uint32(v.EndPC))
+	}
+}
+
+func (self *writer) writeUpvalueNames(names []string) {
+	self.writeUint32(uint32(len(names)))
+	for _, name := range names {
+		self.writeString(name)
+	}
+}
@@ -0,0 +1,235 @@
+package golua
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// Coverage holds the line coverage collected by a LuaState between
+// StartCoverage and StopCoverage. Lines are keyed by chunk name, that is
+// the file name for chunks loaded from files.
+type Coverage struct {
+	files map[string]*coverFile
+	fsys  fs.FS // where the chunks were loaded from
+}
+
+type coverFile struct {
+	source string // as in FunctionProto.Source
+	protos []*protoCover
+}
+
+// execution counts of the instructions of a prototype
+type protoCover struct {
+	c     *Coverage
+	proto *luaProto
+	hits  []uint32
+}
+
+// StartCoverage makes the state count the executed lines of every chunk
+// loaded or run from now on, including coroutines created later.
+func (ls *LuaState) StartCoverage() {
+	if ls.cover == nil {
+		ls.cover = &Coverage{files: map[string]*coverFile{}, fsys: ls.fsys}
+	}
+	ls.setHook(hookCoverage)
+}
+
+// StopCoverage stops collecting coverage and returns what was collected,
+// nil if StartCoverage wasn't called.
+func (ls *LuaState) StopCoverage() *Coverage {
+	c := ls.cover
+	ls.clearHook(hookCoverage)
+	ls.cover = nil
+	return c
+}
+
+// registers p and its nested functions, so that functions that never run
+// show up as not covered
+func (c *Coverage) add(p *luaProto) {
+	if p.cover != nil && p.cover.c == c {
+		return
+	}
+	p.cover = &protoCover{c: c, proto: p, hits: make([]uint32, len(p.code))}
+	name := chunkSourceName(p.Source)
+	f := c.files[name]
+	if f == nil {
+		f = &coverFile{source: p.Source}
+		c.files[name] = f
+	}
+	f.protos = append(f.protos, p.cover)
+	for _, sub := range p.protos {
+		c.add(sub)
+	}
+}
+
+// counts the instruction being executed by stack
+func (c *Coverage) hit(stack *luaStack) {
+	p := stack.closure.proto
+	if p.cover == nil || p.cover.c != c {
+		c.add(p)
+	}
+	p.cover.hits[stack.pc-1]++
+}
+
+// Files returns the names of the covered chunks, sorted.
+func (c *Coverage) Files() []string {
+	names := make([]string, 0, len(c.files))
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lines returns the execution count of every executable line of a chunk.
+// The count of a line is the one of its most executed instruction, lines
+// missing from the map hold no code.
+func (c *Coverage) Lines(file string) map[int]int {
+	lines := map[int]int{}
+	f := c.files[file]
+	if f == nil {
+		return lines
+	}
+	for _, pc := range f.protos {
+		for i, line := range pc.proto.DbgSourcePositions {
+			if i >= len(pc.hits) {
+				break
+			}
+			n := int(pc.hits[i])
+			if old, ok := lines[int(line)]; !ok || n > old {
+				lines[int(line)] = n
+			}
+		}
+	}
+	return lines
+}
+
+func sortedLines(lines map[int]int) []int {
+	keys := make([]int, 0, len(lines))
+	for line := range lines {
+		keys = append(keys, line)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// WriteLcov writes the coverage as an lcov tracefile, as read by genhtml
+// and most coverage services.
+func (c *Coverage) WriteLcov(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, name := range c.Files() {
+		lines := c.Lines(name)
+		hit := 0
+		fmt.Fprintf(bw, "TN:\nSF:%s\n", name)
+		for _, line := range sortedLines(lines) {
+			n := lines[line]
+			if n > 0 {
+				hit++
+			}
+			fmt.Fprintf(bw, "DA:%d,%d\n", line, n)
+		}
+		fmt.Fprintf(bw, "LF:%d\nLH:%d\nend_of_record\n", len(lines), hit)
+	}
+	return bw.Flush()
+}
+
+// the text of a chunk, read back from its file unless it was loaded from
+// a string
+func (c *Coverage) text(f *coverFile) (string, bool) {
+	if strings.HasPrefix(f.source, "@") {
+		data, err := fs.ReadFile(c.fsys, fsName(c.fsys, f.source[1:]))
+		return string(data), err == nil
+	}
+	if strings.HasPrefix(f.source, "=") {
+		return "", false
+	}
+	return f.source, true
+}
+
+// WriteHTML writes the coverage as a standalone HTML page in the style of
+// `go tool cover -html`: executed lines green, lines never executed red.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString(coverHTMLHead)
+	names := c.Files()
+	bw.WriteString("<select id=\"files\">\n")
+	for i, name := range names {
+		lines := c.Lines(name)
+		hit := 0
+		for _, n := range lines {
+			if n > 0 {
+				hit++
+			}
+		}
+		pct := 100.0
+		if len(lines) > 0 {
+			pct = float64(hit) * 100 / float64(len(lines))
+		}
+		fmt.Fprintf(bw, "<option value=\"file%d\">%s (%.1f%%)</option>\n", i, html.EscapeString(name), pct)
+	}
+	bw.WriteString("</select>\n<span class=\"cov0\">not covered</span> <span class=\"cov1\">covered</span>\n</div>\n<div id=\"content\">\n")
+	for i, name := range names {
+		lines := c.Lines(name)
+		display := "none"
+		if i == 0 {
+			display = "block"
+		}
+		fmt.Fprintf(bw, "<pre class=\"file\" id=\"file%d\" style=\"display: %s\">", i, display)
+		text, ok := c.text(c.files[name])
+		if !ok {
+			bw.WriteString("source not available\n")
+		}
+		for no, src := range strings.Split(text, "\n") {
+			src = html.EscapeString(strings.TrimRight(src, "\r"))
+			if n, ok := lines[no+1]; !ok {
+				fmt.Fprintf(bw, "%s\n", src)
+			} else if n == 0 {
+				fmt.Fprintf(bw, "<span class=\"cov0\" title=\"0\">%s</span>\n", src)
+			} else {
+				fmt.Fprintf(bw, "<span class=\"cov1\" title=\"%d\">%s</span>\n", n, src)
+			}
+		}
+		bw.WriteString("</pre>\n")
+	}
+	bw.WriteString(coverHTMLTail)
+	return bw.Flush()
+}
+
+const coverHTMLHead = `<!DOCTYPE html>
+<html>
+<head>
+<meta http-equiv="Content-Type" content="text/html; charset=utf-8">
+<title>lua coverage</title>
+<style>
+body { background: black; color: rgb(80, 80, 80); }
+body, pre, #legend span { font-family: Menlo, monospace; font-weight: bold; }
+#topbar { background: black; position: fixed; top: 0; left: 0; right: 0; height: 42px; border-bottom: 1px solid rgb(80, 80, 80); }
+#topbar select { margin: 10px; }
+#content { margin-top: 50px; }
+.cov0 { color: rgb(192, 0, 0); }
+.cov1 { color: rgb(44, 212, 149); }
+</style>
+</head>
+<body>
+<div id="topbar">
+`
+
+const coverHTMLTail = `</div>
+<script>
+var files = document.getElementById('files');
+var visible = document.getElementById('file0');
+files.addEventListener('change', function() {
+	if (visible) { visible.style.display = 'none'; }
+	visible = document.getElementById(files.value);
+	visible.style.display = 'block';
+	window.scrollTo(0, 0);
+}, false);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,163 @@
+// Package dap implements a Debug Adapter Protocol server for golua, so that
+// editors can set breakpoints in Lua scripts, step through them and inspect
+// their variables.
+// https://microsoft.github.io/debug-adapter-protocol/specification
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/* base protocol */
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+// reads the content of the next message
+func readMessage(r *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			if length >= 0 {
+				break
+			}
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 && line[:i] == "Content-Length" {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("bad header %q", line)
+			}
+		}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func writeMessage(w io.Writer, msg interface{}) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+/* types */
+
+type capabilities struct {
+	SupportsConfigurationDoneRequest bool `json:"supportsConfigurationDoneRequest"`
+	SupportsConditionalBreakpoints   bool `json:"supportsConditionalBreakpoints"`
+	SupportsEvaluateForHovers        bool `json:"supportsEvaluateForHovers"`
+	SupportsTerminateRequest         bool `json:"supportsTerminateRequest"`
+}
+
+type source struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type sourceBreakpoint struct {
+	Line      int    `json:"line"`
+	Condition string `json:"condition,omitempty"`
+}
+
+type breakpoint struct {
+	Verified bool    `json:"verified"`
+	Line     int     `json:"line"`
+	Source   *source `json:"source,omitempty"`
+}
+
+type stackFrame struct {
+	ID     int     `json:"id"`
+	Name   string  `json:"name"`
+	Source *source `json:"source,omitempty"`
+	Line   int     `json:"line"`
+	Column int     `json:"column"`
+}
+
+type scope struct {
+	Name               string `json:"name"`
+	VariablesReference int    `json:"variablesReference"`
+	Expensive          bool   `json:"expensive"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type thread struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+/* arguments */
+
+type launchArguments struct {
+	Program     string `json:"program"`
+	StopOnEntry bool   `json:"stopOnEntry"`
+	NoDebug     bool   `json:"noDebug"`
+}
+
+type setBreakpointsArguments struct {
+	Source      source             `json:"source"`
+	Breakpoints []sourceBreakpoint `json:"breakpoints"`
+}
+
+type stackTraceArguments struct {
+	StartFrame int `json:"startFrame"`
+	Levels     int `json:"levels"`
+}
+
+type scopesArguments struct {
+	FrameID int `json:"frameId"`
+}
+
+type variablesArguments struct {
+	VariablesReference int `json:"variablesReference"`
+}
+
+type evaluateArguments struct {
+	Expression string `json:"expression"`
+	FrameID    int    `json:"frameId"`
+	Context    string `json:"context"`
+}
@@ -0,0 +1,687 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golua"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/* stepping modes */
+const (
+	stepNone = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+const threadID = 1
+
+// a debug session of one client
+type session struct {
+	ls      *golua.LuaState
+	program string // launched when the launch request names no program
+	globals *golua.LuaTable
+	in      *bufio.Reader
+
+	wmu    sync.Mutex // guards out, seq and closed
+	out    io.Writer
+	seq    int
+	closed bool
+
+	mu          sync.Mutex                // guards the fields below, shared with the hook
+	breakpoints map[string]map[int]string // path -> line -> condition
+	step        int
+	stepDepth   int
+	entry       bool // stop on the first line
+	pause       bool
+	terminating bool
+	stopped     bool
+
+	/* owned by the interpreter, valid while stopped */
+	cur   *golua.LuaState // the thread that stopped
+	cmds  chan func()     // work to run while stopped, nil resumes
+	refs  []func() []variable
+	paths map[string]string // chunk name -> absolute path
+
+	launch     launchArguments
+	configured bool
+	running    bool
+}
+
+// Serve runs a debug session with the client connected through r and w,
+// running scripts in ls. program is the script launched when the client's
+// launch request doesn't name one. Serve returns when the client
+// disconnects.
+func Serve(ls *golua.LuaState, r io.Reader, w io.Writer, program string) error {
+	s := &session{
+		ls:          ls,
+		program:     program,
+		in:          bufio.NewReader(r),
+		out:         w,
+		breakpoints: map[string]map[int]string{},
+		cmds:        make(chan func()),
+		paths:       map[string]string{},
+	}
+	return s.serve()
+}
+
+// ListenAndServe waits for a client on the TCP address addr and serves it.
+func ListenAndServe(ls *golua.LuaState, addr, program string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "dap: listening on %v\n", ln.Addr())
+	conn, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return Serve(ls, conn, conn, program)
+}
+
+func (s *session) serve() error {
+	defer s.close()
+	for {
+		data, err := s.readRequest()
+		if err != nil {
+			s.terminate()
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			return err
+		}
+		body, err := s.dispatch(&req)
+		resp := &response{
+			Type:       "response",
+			RequestSeq: req.Seq,
+			Success:    err == nil,
+			Command:    req.Command,
+			Body:       body,
+		}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		s.send(resp)
+		switch req.Command {
+		case "initialize":
+			s.sendEvent("initialized", nil)
+		case "launch":
+			if s.configured {
+				s.run()
+			}
+		case "configurationDone":
+			s.configured = true
+			s.run()
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+func (s *session) readRequest() ([]byte, error) {
+	return readMessage(s.in)
+}
+
+func (s *session) send(msg interface{}) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.closed {
+		return
+	}
+	s.seq++
+	switch m := msg.(type) {
+	case *response:
+		m.Seq = s.seq
+	case *event:
+		m.Seq = s.seq
+	}
+	writeMessage(s.out, msg)
+}
+
+func (s *session) sendEvent(name string, body interface{}) {
+	s.send(&event{Type: "event", Event: name, Body: body})
+}
+
+func (s *session) output(category, text string) {
+	s.sendEvent("output", map[string]string{"category": category, "output": text})
+}
+
+func (s *session) close() {
+	s.wmu.Lock()
+	s.closed = true
+	s.wmu.Unlock()
+}
+
+func (s *session) dispatch(req *request) (interface{}, error) {
+	switch req.Command {
+	case "initialize":
+		return &capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsConditionalBreakpoints:   true,
+			SupportsEvaluateForHovers:        true,
+			SupportsTerminateRequest:         true,
+		}, nil
+	case "launch":
+		if err := json.Unmarshal(req.Arguments, &s.launch); err != nil {
+			return nil, err
+		}
+		if s.launch.Program == "" {
+			s.launch.Program = s.program
+		}
+		if s.launch.Program == "" {
+			return nil, errors.New("no program to launch")
+		}
+		s.mu.Lock()
+		s.entry = s.launch.StopOnEntry
+		s.mu.Unlock()
+		return nil, nil
+	case "setBreakpoints":
+		var args setBreakpointsArguments
+		if err := json.Unmarshal(req.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(&args), nil
+	case "setExceptionBreakpoints", "configurationDone":
+		return nil, nil
+	case "threads":
+		return map[string][]thread{"threads": {{threadID, "main"}}}, nil
+	case "stackTrace":
+		var args stackTraceArguments
+		json.Unmarshal(req.Arguments, &args)
+		var frames []stackFrame
+		if err := s.whileStopped(func() { frames = s.stackTrace(&args) }); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		var args scopesArguments
+		json.Unmarshal(req.Arguments, &args)
+		var scopes []scope
+		if err := s.whileStopped(func() { scopes = s.scopes(args.FrameID - 1) }); err != nil {
+			return nil, err
+		}
+		return map[string][]scope{"scopes": scopes}, nil
+	case "variables":
+		var args variablesArguments
+		json.Unmarshal(req.Arguments, &args)
+		vars := []variable{}
+		if err := s.whileStopped(func() {
+			if n := args.VariablesReference; n > 0 && n <= len(s.refs) {
+				vars = s.refs[n-1]()
+			}
+		}); err != nil {
+			return nil, err
+		}
+		return map[string][]variable{"variables": vars}, nil
+	case "evaluate":
+		var args evaluateArguments
+		json.Unmarshal(req.Arguments, &args)
+		var result variable
+		var err error
+		level := args.FrameID - 1
+		if level < 0 {
+			level = 0
+		}
+		if err2 := s.whileStopped(func() {
+			var v golua.LuaValue
+			if v, err = s.evaluate(s.cur, level, args.Expression); err == nil {
+				result = s.variable("", v)
+			}
+		}); err2 != nil {
+			return nil, err2
+		}
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": result.Value, "type": result.Type,
+			"variablesReference": result.VariablesReference}, nil
+	case "continue":
+		return map[string]bool{"allThreadsContinued": true}, s.resume(stepNone)
+	case "next":
+		return nil, s.resume(stepOver)
+	case "stepIn":
+		return nil, s.resume(stepIn)
+	case "stepOut":
+		return nil, s.resume(stepOut)
+	case "pause":
+		s.mu.Lock()
+		s.pause = true
+		s.mu.Unlock()
+		return nil, nil
+	case "terminate", "disconnect":
+		s.terminate()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+// absolute path of the file a chunk was loaded from, "" if it wasn't
+func (s *session) sourcePath(chunkName string) string {
+	if path, ok := s.paths[chunkName]; ok {
+		return path
+	}
+	path := ""
+	if strings.HasPrefix(chunkName, "@") {
+		if abs, err := filepath.Abs(chunkName[1:]); err == nil {
+			path = abs
+		}
+	}
+	s.paths[chunkName] = path
+	return path
+}
+
+func (s *session) setBreakpoints(args *setBreakpointsArguments) map[string][]breakpoint {
+	path, err := filepath.Abs(args.Source.Path)
+	if err != nil {
+		path = args.Source.Path
+	}
+	lines := map[int]string{}
+	bps := []breakpoint{}
+	for _, b := range args.Breakpoints {
+		lines[b.Line] = b.Condition
+		bps = append(bps, breakpoint{Verified: true, Line: b.Line, Source: &args.Source})
+	}
+	s.mu.Lock()
+	s.breakpoints[path] = lines
+	s.mu.Unlock()
+	return map[string][]breakpoint{"breakpoints": bps}
+}
+
+// starts the program, once the client is configured
+func (s *session) run() {
+	if s.running || s.launch.Program == "" {
+		return
+	}
+	s.running = true
+	s.redirectPrint()
+	if !s.launch.NoDebug {
+		s.ls.SetHook(s.hook, golua.LUA_MASKLINE, 0)
+	}
+	go func() {
+		exitCode := 0
+		var err error
+		if s.ls.LoadFile(s.launch.Program) != golua.LUA_OK {
+			err = errors.New(s.ls.CheckString(-1))
+		} else {
+			err = s.ls.PCall(0, 0, 0)
+		}
+		if err != nil {
+			s.output("stderr", err.Error()+"\n")
+			exitCode = 1
+		}
+		s.ls.SetHook(nil, 0, 0)
+		s.sendEvent("exited", map[string]int{"exitCode": exitCode})
+		s.sendEvent("terminated", nil)
+	}()
+}
+
+// replaces print, whose output would mix with the protocol on stdio, with
+// one sending output events
+func (s *session) redirectPrint() {
+	s.ls.LoadString(`
+		local output = ...
+		local select, tostring, concat = select, tostring, table.concat
+		function print(...)
+			local t = {}
+			for i = 1, select('#', ...) do t[i] = tostring((select(i, ...))) end
+			output(concat(t, "\t") .. "\n")
+		end
+		return _ENV
+	`)
+	s.ls.PushGoFunction(func(ls *golua.LuaState) int {
+		s.output("stdout", ls.CheckString(1))
+		return 0
+	})
+	if err := s.ls.PCall(1, 1, 0); err != nil {
+		s.output("stderr", err.Error()+"\n")
+		return
+	}
+	s.globals, _ = s.ls.CheckAny(-1).(*golua.LuaTable)
+	s.ls.Pop(1)
+}
+
+// number of active functions
+func depth(ls *golua.LuaState) int {
+	n := 0
+	for ls.GetInfo(n) != nil {
+		n++
+	}
+	return n
+}
+
+// the line hook, decides whether to stop
+func (s *session) hook(ls *golua.LuaState, event, line int) {
+	info := ls.GetInfo(0)
+	path := s.sourcePath(info.Source)
+	s.mu.Lock()
+	if s.terminating {
+		s.mu.Unlock()
+		ls.Error2("debug session terminated")
+		return
+	}
+	reason := ""
+	switch {
+	case s.entry:
+		reason = "entry"
+	case s.pause:
+		reason = "pause"
+	case s.step == stepIn:
+		reason = "step"
+	case s.step == stepOver && depth(ls) <= s.stepDepth:
+		reason = "step"
+	case s.step == stepOut && depth(ls) < s.stepDepth:
+		reason = "step"
+	}
+	cond, isBreakpoint := s.breakpoints[path][line]
+	s.mu.Unlock()
+	if reason == "" && isBreakpoint {
+		if cond == "" {
+			reason = "breakpoint"
+		} else if v, err := s.evaluate(ls, 0, cond); err != nil {
+			s.output("stderr", fmt.Sprintf("breakpoint condition %q: %v\n", cond, err))
+		} else if v != golua.LuaNil && v != golua.LuaFalse {
+			reason = "breakpoint"
+		}
+	}
+	if reason != "" {
+		s.stop(ls, reason)
+	}
+}
+
+// reports the stop and serves the client until it resumes
+func (s *session) stop(ls *golua.LuaState, reason string) {
+	s.mu.Lock()
+	s.entry, s.pause, s.step = false, false, stepNone
+	s.stopped = true
+	s.mu.Unlock()
+	s.cur = ls
+	s.sendEvent("stopped", map[string]interface{}{
+		"reason": reason, "threadId": threadID, "allThreadsStopped": true})
+	for f := range s.cmds {
+		if f == nil {
+			break
+		}
+		f()
+	}
+	s.refs = nil
+	s.cur = nil
+}
+
+// runs f on the interpreter while it is stopped
+func (s *session) whileStopped(f func()) error {
+	s.mu.Lock()
+	stopped := s.stopped
+	s.mu.Unlock()
+	if !stopped {
+		return errors.New("the program is not stopped")
+	}
+	done := make(chan struct{})
+	s.cmds <- func() {
+		defer close(done)
+		f()
+	}
+	<-done
+	return nil
+}
+
+func (s *session) resume(step int) error {
+	if step == stepOver || step == stepOut {
+		if err := s.whileStopped(func() { s.stepDepth = depth(s.cur) }); err != nil {
+			return err
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.stopped {
+		return errors.New("the program is not stopped")
+	}
+	s.step = step
+	s.stopped = false
+	s.cmds <- nil
+	return nil
+}
+
+// stops the program at its next line
+func (s *session) terminate() {
+	s.mu.Lock()
+	s.terminating = true
+	s.breakpoints = map[string]map[int]string{}
+	stopped := s.stopped
+	s.stopped = false
+	s.mu.Unlock()
+	if stopped {
+		s.cmds <- nil
+	}
+}
+
+func (s *session) stackTrace(args *stackTraceArguments) []stackFrame {
+	frames := []stackFrame{}
+	for level := args.StartFrame; ; level++ {
+		if args.Levels > 0 && len(frames) == args.Levels {
+			break
+		}
+		info := s.cur.GetInfo(level)
+		if info == nil {
+			break
+		}
+		frame := stackFrame{ID: level + 1, Name: info.Name, Line: info.CurrentLine, Column: 1}
+		switch {
+		case info.What == "main":
+			frame.Name = "main chunk"
+		case frame.Name == "" && info.What == "Go":
+			frame.Name = "?"
+		case frame.Name == "":
+			frame.Name = fmt.Sprintf("function <%v:%v>", info.ShortSrc, info.LineDefined)
+		}
+		if info.What == "Go" {
+			frame.Name += " [Go]"
+			frame.Line = 0
+		} else if path := s.sourcePath(info.Source); path != "" {
+			frame.Source = &source{Name: filepath.Base(path), Path: path}
+		} else {
+			frame.Source = &source{Name: info.ShortSrc}
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func (s *session) newRef(vars func() []variable) int {
+	s.refs = append(s.refs, vars)
+	return len(s.refs)
+}
+
+func (s *session) scopes(level int) []scope {
+	ls := s.cur
+	info := ls.GetInfo(level)
+	if info == nil {
+		return []scope{}
+	}
+	locals := s.newRef(func() []variable {
+		vars := []variable{}
+		for n := 1; ; n++ {
+			name, v := ls.GetLocal(level, n)
+			if name == "" {
+				break
+			}
+			if !strings.HasPrefix(name, "(") { /* temporaries */
+				vars = append(vars, s.variable(name, v))
+			}
+		}
+		return vars
+	})
+	upvalues := s.newRef(func() []variable {
+		vars := []variable{}
+		for n := 1; ; n++ {
+			name, v, ok := ls.GetUpvalue(info.Func, n)
+			if !ok {
+				break
+			}
+			vars = append(vars, s.variable(name, v))
+		}
+		return vars
+	})
+	return []scope{{"Locals", locals, false}, {"Upvalues", upvalues, false}}
+}
+
+func typeName(v golua.LuaValue) string {
+	if v.Type() == golua.LUA_TCLOSURE {
+		return "function"
+	}
+	return v.Type().String()
+}
+
+func (s *session) variable(name string, v golua.LuaValue) variable {
+	if v == nil {
+		v = golua.LuaNil
+	}
+	vr := variable{Name: name, Type: typeName(v)}
+	switch x := v.(type) {
+	case golua.LuaString:
+		vr.Value = strconv.Quote(string(x))
+	case *golua.LuaTable:
+		vr.Value = fmt.Sprintf("table: %p", x)
+		vr.VariablesReference = s.newRef(func() []variable { return s.fields(x) })
+	case *golua.LuaClosure:
+		vr.Value = fmt.Sprintf("function: %p", x)
+	default:
+		vr.Value = v.String()
+	}
+	return vr
+}
+
+// the fields of a table, array items first
+func (s *session) fields(t *golua.LuaTable) []variable {
+	type field struct {
+		k, v golua.LuaValue
+	}
+	var fields []field
+	t.ForEach(func(k, v golua.LuaValue) {
+		fields = append(fields, field{k, v})
+	})
+	sort.SliceStable(fields, func(i, j int) bool {
+		a, b := fields[i].k, fields[j].k
+		if a.Type() != b.Type() {
+			return a.Type() == golua.LUA_TNUMBER
+		}
+		switch x := a.(type) {
+		case golua.LuaNumber:
+			return x < b.(golua.LuaNumber)
+		case golua.LuaString:
+			return x < b.(golua.LuaString)
+		}
+		return false
+	})
+	vars := make([]variable, len(fields))
+	for i, f := range fields {
+		name := f.k.String()
+		if _, ok := f.k.(golua.LuaString); !ok {
+			name = "[" + name + "]"
+		}
+		vars[i] = s.variable(name, f.v)
+	}
+	return vars
+}
+
+// evaluates an expression, or runs a statement, in the scope of the
+// function running at the given level: names resolve to its locals, then
+// its upvalues, then globals
+func (s *session) evaluate(ls *golua.LuaState, level int, expr string) (golua.LuaValue, error) {
+	base := depth(ls)
+	/* levels shift as the chunk and the metamethods run */
+	frame := func(ls *golua.LuaState) int { return level + depth(ls) - base }
+	lookup := func(ls *golua.LuaState, name string) (get func() golua.LuaValue, set func(golua.LuaValue)) {
+		lvl := frame(ls)
+		info := ls.GetInfo(lvl)
+		local := 0
+		for n := 1; ; n++ {
+			lname, _ := ls.GetLocal(lvl, n)
+			if lname == "" {
+				break
+			}
+			if lname == name {
+				local = n /* the innermost one */
+			}
+		}
+		if local > 0 {
+			return func() golua.LuaValue { _, v := ls.GetLocal(lvl, local); return v },
+				func(v golua.LuaValue) { ls.SetLocal(lvl, local, v) }
+		}
+		for n := 1; info != nil; n++ {
+			uname, _, ok := ls.GetUpvalue(info.Func, n)
+			if !ok {
+				break
+			}
+			if uname == name {
+				return func() golua.LuaValue { _, v, _ := ls.GetUpvalue(info.Func, n); return v },
+					func(v golua.LuaValue) { ls.SetUpvalue(info.Func, n, v) }
+			}
+		}
+		g := s.globals
+		if g == nil {
+			return func() golua.LuaValue { return golua.LuaNil }, func(golua.LuaValue) {}
+		}
+		key := golua.LuaString(name)
+		return func() golua.LuaValue { return g.Get(key) },
+			func(v golua.LuaValue) { g.Set(key, v) }
+	}
+
+	mt := s.newTable(ls)
+	mt.Set(golua.LuaString("__index"), s.goFunction(ls, func(ls *golua.LuaState) int {
+		get, _ := lookup(ls, ls.CheckString(2))
+		ls.Push(get())
+		return 1
+	}))
+	mt.Set(golua.LuaString("__newindex"), s.goFunction(ls, func(ls *golua.LuaState) int {
+		_, set := lookup(ls, ls.CheckString(2))
+		set(ls.CheckAny(3))
+		return 0
+	}))
+	env := s.newTable(ls)
+	golua.SetMetatable(ls, env, mt)
+
+	if ls.LoadWithEnv([]byte("return "+expr), "=(eval)", "t", env) != golua.LUA_OK {
+		ls.Pop(1) /* not an expression, try a statement */
+		if ls.LoadWithEnv([]byte(expr), "=(eval)", "t", env) != golua.LUA_OK {
+			err := errors.New(ls.CheckString(-1))
+			ls.Pop(1)
+			return nil, err
+		}
+	}
+	if err := ls.PCall(0, 1, 0); err != nil {
+		return nil, err
+	}
+	v := ls.CheckAny(-1)
+	ls.Pop(1)
+	return v, nil
+}
+
+// a new table, made on ls and popped right away
+func (s *session) newTable(ls *golua.LuaState) *golua.LuaTable {
+	t := ls.NewTable()
+	ls.Pop(1)
+	return t
+}
+
+func (s *session) goFunction(ls *golua.LuaState, f golua.GoFunction) golua.LuaValue {
+	ls.PushGoFunction(f)
+	c := ls.CheckAny(-1)
+	ls.Pop(1)
+	return c
+}
@@ -0,0 +1,509 @@
+package golua
+
+import (
+	"fmt"
+	. "golua/compiler"
+)
+
+// Returns information about the function running at the given level:
+// level 0 is the current running function, level n+1 is the function
+// that called level n. Returns nil if level is greater than the stack depth.
+// http://www.lua.org/manual/5.3/manual.html#lua_getinfo
+// lua-5.3.4/src/ldebug.c#lua_getinfo()
+func (ls *LuaState) GetInfo(level int) *DebugInfo {
+	if level < 0 {
+		return nil
+	}
+	dbg := ls.getDebug(level)
+	if dbg == nil || dbg.stack.closure == nil {
+		return nil
+	}
+	ls.funcInfo(dbg, dbg.stack.closure)
+	return dbg
+}
+
+// Returns information about a function that need not be running, the
+// fields that depend on a call (Name, CurrentLine) are left empty.
+// Returns nil if f isn't a function.
+// http://www.lua.org/manual/5.3/manual.html#lua_getinfo
+func (ls *LuaState) GetFuncInfo(f LuaValue) *DebugInfo {
+	c, ok := f.(*LuaClosure)
+	if !ok {
+		return nil
+	}
+	dbg := &DebugInfo{}
+	ls.funcInfo(dbg, c)
+	return dbg
+}
+
+// lua-5.3.4/src/ldebug.c#auxgetinfo()
+func (ls *LuaState) funcInfo(dbg *DebugInfo, c *LuaClosure) {
+	stack := dbg.stack
+	dbg.Func = c
+	dbg.NUpvalues = len(c.upvals)
+	if p := c.proto; p != nil {
+		dbg.Source = p.Source
+		dbg.LineDefined = int(p.LineDefined)
+		dbg.LastLineDefined = int(p.LastLineDefined)
+		dbg.What = "Lua"
+		if p.LineDefined == 0 {
+			dbg.What = "main"
+		}
+		dbg.CurrentLine = -1
+		if stack != nil {
+			dbg.CurrentLine = currentLine(stack)
+		}
+		dbg.NParams = int(p.NumParams)
+		dbg.IsVararg = p.IsVararg == 1
+	} else {
+		dbg.Source = "=[G]"
+		dbg.What = "Go"
+		dbg.CurrentLine = -1
+		dbg.LineDefined = -1
+		dbg.LastLineDefined = -1
+		dbg.IsVararg = true
+	}
+	dbg.ShortSrc = ChunkID(dbg.Source)
+	if stack != nil {
+		dbg.NameWhat, dbg.Name = getFuncName(stack)
+	}
+}
+
+// line of the instruction being executed by a Lua frame
+// lua-5.3.4/src/ldebug.c#currentline()
+func currentLine(stack *luaStack) int {
+	pc := stack.pc - 1
+	if pc < 0 {
+		return -1
+	}
+	return int(stack.closure.proto.DbgSourcePositions[pc])
+}
+
+// finds local n of a frame, Lua frames number their varargs -1, -2...
+// lua-5.3.4/src/ldebug.c#findlocal()
+func (ls *LuaState) findLocalSlot(stack *luaStack, n int) (string, *value) {
+	c := stack.closure
+	if c == nil {
+		return "", nil
+	}
+	if c.proto != nil && n < 0 { /* access to vararg values? */
+		if -n <= len(stack.varargs) {
+			return "(*vararg)", &stack.varargs[-n-1]
+		}
+		return "", nil
+	}
+	name := ""
+	if c.proto != nil {
+		name, _ = c.proto.LocalName(n, stack.pc-1)
+	}
+	if name == "" { /* no 'standard' name? */
+		if n < 1 || n > stack.top { /* no name and no valid slot */
+			return "", nil
+		}
+		if c.proto != nil {
+			name = "(*temporary)"
+		} else {
+			name = "(*Go temporary)"
+		}
+	}
+	return name, &stack.slots[n-1]
+}
+
+// Returns the name and value of local variable n of the function running
+// at the given level, or "" if there is no such local. Parameters and
+// active locals come first in order of declaration, then temporaries,
+// varargs are numbered -1, -2...
+// http://www.lua.org/manual/5.3/manual.html#lua_getlocal
+// lua-5.3.4/src/ldebug.c#lua_getlocal()
+func (ls *LuaState) GetLocal(level, n int) (string, LuaValue) {
+	if level < 0 {
+		return "", nil
+	}
+	dbg := ls.getDebug(level)
+	if dbg == nil {
+		return "", nil
+	}
+	name, slot := ls.findLocalSlot(dbg.stack, n)
+	if slot == nil {
+		return "", nil
+	}
+	return name, slot.luaValue()
+}
+
+// Sets the value of a local variable of the function running at the given
+// level and returns its name, or "" if there is no such local.
+// http://www.lua.org/manual/5.3/manual.html#lua_setlocal
+// lua-5.3.4/src/ldebug.c#lua_setlocal()
+func (ls *LuaState) SetLocal(level, n int, v LuaValue) string {
+	if level < 0 {
+		return ""
+	}
+	dbg := ls.getDebug(level)
+	if dbg == nil {
+		return ""
+	}
+	name, slot := ls.findLocalSlot(dbg.stack, n)
+	if slot == nil {
+		return ""
+	}
+	*slot = valueOf(v)
+	return name
+}
+
+// lua-5.3.4/src/lapi.c#aux_upvalue()
+func upvalueSlot(f LuaValue, n int) (string, *upvalue) {
+	c, ok := f.(*LuaClosure)
+	if !ok || n < 1 || n > len(c.upvals) {
+		return "", nil
+	}
+	uv := c.upvals[n-1]
+	if uv == nil {
+		return "", nil
+	}
+	if c.proto == nil {
+		return "", uv
+	}
+	if n > len(c.proto.DbgUpvalues) {
+		return "(*no name)", uv
+	}
+	return c.proto.DbgUpvalues[n-1], uv
+}
+
+// Returns the name and value of upvalue n of closure f. Upvalues of Go
+// functions have empty names. ok is false if there is no such upvalue.
+// http://www.lua.org/manual/5.3/manual.html#lua_getupvalue
+func (ls *LuaState) GetUpvalue(f LuaValue, n int) (name string, v LuaValue, ok bool) {
+	name, uv := upvalueSlot(f, n)
+	if uv == nil {
+		return "", nil, false
+	}
+	return name, uv.val.luaValue(), true
+}
+
+// Sets the value of upvalue n of closure f and returns its name.
+// http://www.lua.org/manual/5.3/manual.html#lua_setupvalue
+func (ls *LuaState) SetUpvalue(f LuaValue, n int, v LuaValue) (string, bool) {
+	name, uv := upvalueSlot(f, n)
+	if uv == nil {
+		return "", false
+	}
+	*uv.val = valueOf(v)
+	return name, true
+}
+
+// Returns a unique identifier for upvalue n of closure f, closures sharing
+// an upvalue get the same identifier. Returns nil if there is no such
+// upvalue.
+// http://www.lua.org/manual/5.3/manual.html#lua_upvalueid
+func (ls *LuaState) UpvalueID(f LuaValue, n int) LuaValue {
+	_, uv := upvalueSlot(f, n)
+	if uv == nil {
+		return nil
+	}
+	if uv.id == nil {
+		uv.id = &LuaUserData{}
+	}
+	return uv.id
+}
+
+// Makes upvalue n1 of Lua closure f1 refer to upvalue n2 of closure f2.
+// http://www.lua.org/manual/5.3/manual.html#lua_upvaluejoin
+func (ls *LuaState) UpvalueJoin(f1 LuaValue, n1 int, f2 LuaValue, n2 int) {
+	_, uv1 := upvalueSlot(f1, n1)
+	_, uv2 := upvalueSlot(f2, n2)
+	if uv1 == nil || uv2 == nil {
+		panic("invalid upvalue index")
+	}
+	f1.(*LuaClosure).upvals[n1-1] = uv2
+}
+
+/* symbolic execution */
+
+const LUA_ENV = "_ENV"
+
+// lua-5.3.4/src/ldebug.c#upvalname()
+func upvalName(p *luaProto, uv int) string {
+	if uv < len(p.DbgUpvalues) && p.DbgUpvalues[uv] != "" {
+		return p.DbgUpvalues[uv]
+	}
+	return "?"
+}
+
+// name of the key c of a table access at pc, c is a decoded RK operand
+// lua-5.3.4/src/ldebug.c#kname()
+func kName(p *luaProto, pc int, c int32) string {
+	if c < 0 { /* is 'c' a constant? */
+		if s, ok := p.consts[^c].o.(LuaString); ok { /* literal constant? */
+			return string(s) /* it is its own name */
+		}
+		/* else no reasonable name found */
+	} else { /* 'c' is a register */
+		if what, name := getObjName(p, pc, int(c)); what == "constant" {
+			return name /* found a constant name */
+		}
+		/* else no reasonable name found */
+	}
+	return "?" /* no reasonable name found */
+}
+
+func filterPC(pc, jmptarget int) int {
+	if pc < jmptarget { /* is code conditional (inside a jump)? */
+		return -1 /* cannot know who sets that register */
+	}
+	return pc /* current position sets that register */
+}
+
+// finds the last instruction before lastpc that modified register reg
+// lua-5.3.4/src/ldebug.c#findsetreg()
+func findSetReg(p *luaProto, lastpc, reg int) int {
+	setreg := -1   /* keep last instruction that changed 'reg' */
+	jmptarget := 0 /* any code before this address is conditional */
+	for pc := 0; pc < lastpc; pc++ {
+		i := p.code[pc]
+		a := int(i.a)
+		switch i.op {
+		case OP_LOADNIL:
+			if a <= reg && reg <= a+int(i.b) { /* set registers from 'a' to 'a+b' */
+				setreg = filterPC(pc, jmptarget)
+			}
+		case OP_TFORCALL:
+			if reg >= a+2 { /* affect all regs above its base */
+				setreg = filterPC(pc, jmptarget)
+			}
+		case OP_CALL, OP_TAILCALL:
+			if reg >= a { /* affect all registers above base */
+				setreg = filterPC(pc, jmptarget)
+			}
+		case OP_JMP:
+			dest := pc + 1 + int(i.b)
+			/* jump is forward and do not skip 'lastpc'? */
+			if pc < dest && dest <= lastpc && dest > jmptarget {
+				jmptarget = dest /* update 'jmptarget' */
+			}
+		default:
+			if opcodes[i.op].setAFlag == 1 && reg == a { /* any instruction that set A */
+				setreg = filterPC(pc, jmptarget)
+			}
+		}
+	}
+	return setreg
+}
+
+// describes the value register reg holds at lastpc, what is "local",
+// "global", "field", "upvalue", "constant" or "method", or "" if no
+// reasonable name can be found
+// lua-5.3.4/src/ldebug.c#getobjname()
+func getObjName(p *luaProto, lastpc, reg int) (what, name string) {
+	if name, ok := p.LocalName(reg+1, lastpc); ok { /* is a local? */
+		return "local", name
+	}
+	/* else try symbolic execution */
+	pc := findSetReg(p, lastpc, reg)
+	if pc == -1 { /* could not find instruction */
+		return "", ""
+	}
+	i := p.code[pc]
+	switch i.op {
+	case OP_MOVE:
+		if b := int(i.b); b < int(i.a) { /* move from 'b' to 'a' */
+			return getObjName(p, pc, b) /* get name for 'b' */
+		}
+	case OP_GETTABUP, OP_GETTABLE:
+		var vn string /* name of indexed variable */
+		if i.op == OP_GETTABLE {
+			vn, _ = p.LocalName(int(i.b)+1, pc)
+		} else {
+			vn = upvalName(p, int(i.b))
+		}
+		if vn == LUA_ENV {
+			return "global", kName(p, pc, i.c)
+		}
+		return "field", kName(p, pc, i.c)
+	case OP_GETUPVAL:
+		return "upvalue", upvalName(p, int(i.b))
+	case OP_LOADK, OP_LOADKX:
+		b := int(i.b)
+		if i.op == OP_LOADKX {
+			b = int(p.code[pc+1].a)
+		}
+		if s, ok := p.consts[b].o.(LuaString); ok {
+			return "constant", string(s)
+		}
+	case OP_SELF:
+		return "method", kName(p, pc, i.c)
+	}
+	return "", "" /* could not find reasonable name */
+}
+
+// names the function running in stack after the instruction that called
+// it, the caller must be a Lua function
+// lua-5.3.4/src/ldebug.c#funcnamefromcode()
+func funcNameFromCode(caller *luaStack) (what, name string) {
+	p := caller.closure.proto
+	pc := caller.pc - 1 /* calling instruction index */
+	if pc < 0 {
+		return "", ""
+	}
+	i := p.code[pc] /* calling instruction */
+	var tm string
+	switch i.op {
+	case OP_CALL, OP_TAILCALL: /* get function name */
+		return getObjName(p, pc, int(i.a))
+	case OP_TFORCALL: /* for iterator */
+		return "for iterator", "for iterator"
+	/* all other instructions can call only through metamethods */
+	case OP_SELF, OP_GETTABUP, OP_GETTABLE:
+		tm = "__index"
+	case OP_SETTABUP, OP_SETTABLE:
+		tm = "__newindex"
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR, OP_UNM, OP_BNOT:
+		tm = operators[int(i.op)-OP_ADD].metamethod
+	case OP_LEN:
+		tm = "__len"
+	case OP_CONCAT:
+		tm = "__concat"
+	case OP_EQ:
+		tm = "__eq"
+	case OP_LT:
+		tm = "__lt"
+	case OP_LE:
+		tm = "__le"
+	default: /* other instructions cannot call a function */
+		return "", ""
+	}
+	return "metamethod", tm
+}
+
+// lua-5.3.4/src/ldebug.c#getfuncname()
+func getFuncName(stack *luaStack) (what, name string) {
+	if stack.tailCall > 0 || stack.prev == nil {
+		return "", ""
+	}
+	if c := stack.prev.closure; c != nil && c.proto != nil {
+		return funcNameFromCode(stack.prev)
+	}
+	return "", ""
+}
+
+/* runtime errors */
+
+// describes where the value v that an error is about comes from, if the
+// current instruction takes it from a variable
+// lua-5.3.4/src/ldebug.c#varinfo()
+func (ls *LuaState) varInfo(v value) string {
+	stack := ls.stack
+	if stack.closure == nil || stack.closure.proto == nil || stack.pc < 1 {
+		return ""
+	}
+	p := stack.closure.proto
+	pc := stack.pc - 1
+	i := p.code[pc]
+	isReg := func(r int32) bool {
+		return r >= 0 && int(r) < len(stack.slots) && rawEquals(stack.slots[r], v)
+	}
+	isUpval := func(n int32) bool {
+		return rawEquals(*stack.closure.upvals[n].val, v)
+	}
+	what, name := "", ""
+	switch i.op {
+	case OP_GETTABUP:
+		if isUpval(i.b) {
+			what, name = "upvalue", upvalName(p, int(i.b))
+		}
+	case OP_SETTABUP:
+		if isUpval(i.a) {
+			what, name = "upvalue", upvalName(p, int(i.a))
+		}
+	case OP_GETTABLE, OP_SELF, OP_UNM, OP_BNOT, OP_LEN:
+		if isReg(i.b) {
+			what, name = getObjName(p, pc, int(i.b))
+		}
+	case OP_SETTABLE, OP_CALL, OP_TAILCALL, OP_TFORCALL:
+		if isReg(i.a) {
+			what, name = getObjName(p, pc, int(i.a))
+		}
+	case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+		OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+		if isReg(i.b) {
+			what, name = getObjName(p, pc, int(i.b))
+		} else if isReg(i.c) {
+			what, name = getObjName(p, pc, int(i.c))
+		}
+	case OP_CONCAT: /* operands are concatenated from the right */
+		for r := i.c; r >= i.b; r-- {
+			if isReg(r) {
+				what, name = getObjName(p, pc, int(r))
+				break
+			}
+		}
+	}
+	if what == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%s '%s')", what, name)
+}
+
+// type name of v for error messages, honouring __name
+// lua-5.3.4/src/ltm.c#luaT_objtypename()
+func (ls *LuaState) objTypeName(v value) string {
+	switch v.o.(type) {
+	case *LuaTable, *LuaUserData:
+		if name, ok := GetMetafield(ls, v.o, "__name").(LuaString); ok {
+			return string(name)
+		}
+	}
+	return v.valueType().String()
+}
+
+// raises an error with the position of the current Lua function
+// lua-5.3.4/src/ldebug.c#luaG_runerror()
+func (ls *LuaState) runError(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if stack := ls.stack; stack.closure != nil && stack.closure.proto != nil { /* if Lua function, add source:line information */
+		msg = fmt.Sprintf("%s:%d: %s", ChunkID(stack.closure.proto.Source), currentLine(stack), msg)
+	}
+	panic(LuaString(msg))
+}
+
+// lua-5.3.4/src/ldebug.c#luaG_typeerror()
+func (ls *LuaState) opTypeError(v value, op string) {
+	ls.runError("attempt to %s a %s value%s", op, ls.objTypeName(v), ls.varInfo(v))
+}
+
+// lua-5.3.4/src/ldebug.c#luaG_concaterror()
+func (ls *LuaState) concatError(p1, p2 value) {
+	if _, ok := p1.o.(LuaString); ok || p1.isNumber() {
+		p1 = p2
+	}
+	ls.opTypeError(p1, "concatenate")
+}
+
+// error for arithmetic or bitwise operands, at least one of them is bad
+// lua-5.3.4/src/ldebug.c#luaG_opinterror()
+func (ls *LuaState) opIntError(p1, p2 value, msg string) {
+	if _, ok := p1.toFloat(); !ok { /* first operand is wrong? */
+		p2 = p1 /* now second is wrong too */
+	}
+	ls.opTypeError(p2, msg)
+}
+
+// error when both values are convertible to numbers, but not to integers
+// lua-5.3.4/src/ldebug.c#luaG_tointerror()
+func (ls *LuaState) toIntError(p1, p2 value) {
+	if _, ok := p1.toInteger(); !ok {
+		p2 = p1
+	}
+	ls.runError("number%s has no integer representation", ls.varInfo(p2))
+}
+
+// lua-5.3.4/src/ldebug.c#luaG_ordererror()
+func (ls *LuaState) orderError(p1, p2 value) {
+	t1 := ls.objTypeName(p1)
+	t2 := ls.objTypeName(p2)
+	if t1 == t2 {
+		ls.runError("attempt to compare two %s values", t1)
+	} else {
+		ls.runError("attempt to compare %s with %s", t1, t2)
+	}
+}
@@ -0,0 +1,123 @@
+package golua
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+)
+
+// A CommandHook makes the process that runs a command of os.execute or
+// io.popen. It can veto the command by returning an error, which scripts
+// get like a failure to start the command, or change how it runs: the
+// program, the directory, the environment. Streams left nil get the
+// standard files, apart from the pipe of io.popen. os.execute() without a
+// command asks for an empty one to learn whether commands can run at all.
+type CommandHook func(command string) (*exec.Cmd, error)
+
+// ShellCommand is the default CommandHook, it runs command with
+// "/bin/sh -c", or "cmd /C" on Windows, as system(3) does.
+func ShellCommand(command string) (*exec.Cmd, error) {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command), nil
+	}
+	return exec.Command("/bin/sh", "-c", command), nil
+}
+
+// SetCommandHook makes h run the commands of the state, nil restores
+// ShellCommand. Coroutines created afterwards share it.
+func (ls *LuaState) SetCommandHook(h CommandHook) {
+	ls.cmdHook = h
+}
+
+func (ls *LuaState) command(command string) (*exec.Cmd, error) {
+	if ls.cmdHook != nil {
+		return ls.cmdHook(command)
+	}
+	return ShellCommand(command)
+}
+
+// whether a command processor is available, system(NULL)
+func (ls *LuaState) canExecute() bool {
+	cmd, err := ls.command("")
+	return err == nil && cmd != nil && cmd.Err == nil
+}
+
+// system(3)
+func (ls *LuaState) system(command string) error {
+	cmd, err := ls.command(command)
+	if err != nil {
+		return err
+	}
+	stdFiles(cmd)
+	return cmd.Run()
+}
+
+func stdFiles(cmd *exec.Cmd) {
+	if cmd.Stdin == nil {
+		cmd.Stdin = os.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+}
+
+// popen(3), mode is "r" or "w"
+func (ls *LuaState) popen(command, mode string) (*pipeFile, error) {
+	cmd, err := ls.command(command)
+	if err != nil {
+		return nil, err
+	}
+	f := &pipeFile{cmd: cmd}
+	if mode == "r" {
+		f.r, err = cmd.StdoutPipe()
+	} else {
+		f.w, err = cmd.StdinPipe()
+	}
+	if err != nil {
+		return nil, err
+	}
+	stdFiles(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// the file of io.popen, a pipe from or to a running command
+type pipeFile struct {
+	r    io.ReadCloser  // mode "r"
+	w    io.WriteCloser // mode "w"
+	cmd  *exec.Cmd
+	stat error // how the command ended, see luaExecResult
+}
+
+func (f *pipeFile) Read(b []byte) (int, error) {
+	if f.r == nil {
+		return 0, syscall.EBADF
+	}
+	return f.r.Read(b)
+}
+
+func (f *pipeFile) Write(b []byte) (int, error) {
+	if f.w == nil {
+		return 0, syscall.EBADF
+	}
+	return f.w.Write(b)
+}
+
+// Close closes the pipe and waits for the command to end, pclose
+func (f *pipeFile) Close() error {
+	var err error
+	if f.r != nil {
+		err = f.r.Close()
+	} else {
+		err = f.w.Close()
+	}
+	f.stat = f.cmd.Wait()
+	return err
+}
@@ -0,0 +1,189 @@
+package golua
+
+import (
+	"sync/atomic"
+)
+
+/* event codes */
+const (
+	LUA_HOOKCALL = iota
+	LUA_HOOKRET
+	LUA_HOOKLINE
+	LUA_HOOKCOUNT
+	LUA_HOOKTAILCALL
+)
+
+/* event masks */
+const (
+	LUA_MASKCALL  = 1 << LUA_HOOKCALL
+	LUA_MASKRET   = 1 << LUA_HOOKRET
+	LUA_MASKLINE  = 1 << LUA_HOOKLINE
+	LUA_MASKCOUNT = 1 << LUA_HOOKCOUNT
+)
+
+/* bits of LuaState.hookMask, polled by execute() before each instruction */
+const (
+	hookSample   = 1 << iota // the profiler asks for a sample of the call stack
+	hookCoverage             // count every instruction, see StartCoverage
+	hookCall                 // LUA_MASKCALL
+	hookRet                  // LUA_MASKRET
+	hookLine                 // LUA_MASKLINE
+	hookCount                // LUA_MASKCOUNT
+)
+
+const hookUser = hookCall | hookRet | hookLine | hookCount
+
+// Hook is a debug hook, see SetHook. line is the new line for
+// LUA_HOOKLINE events and -1 otherwise.
+type Hook func(ls *LuaState, event, line int)
+
+// Sets the debugging hook function. mask is a combination of LUA_MASK*
+// bits; with LUA_MASKCOUNT the hook is called every count instructions.
+// A nil f or zero mask turns the hook off. Threads created afterwards
+// inherit the hook. While the hook runs, it is disabled.
+// http://www.lua.org/manual/5.3/manual.html#lua_sethook
+// lua-5.3.4/src/ldebug.c#lua_sethook()
+func (ls *LuaState) SetHook(f Hook, mask, count int) {
+	if f == nil || mask == 0 {
+		f, mask = nil, 0
+	}
+	bits := int32(0)
+	if mask&LUA_MASKCALL != 0 {
+		bits |= hookCall
+	}
+	if mask&LUA_MASKRET != 0 {
+		bits |= hookRet
+	}
+	if mask&LUA_MASKLINE != 0 {
+		bits |= hookLine
+	}
+	if mask&LUA_MASKCOUNT != 0 && count > 0 {
+		bits |= hookCount
+	}
+	ls.hookFunc = f
+	ls.baseHookCount = count
+	ls.hookCounter = count
+	ls.clearHook(hookUser &^ bits)
+	ls.setHook(bits)
+}
+
+// Returns the current hook function, mask and count.
+// http://www.lua.org/manual/5.3/manual.html#lua_gethook
+func (ls *LuaState) GetHook() (Hook, int, int) {
+	bits := atomic.LoadInt32(&ls.hookMask)
+	mask := 0
+	if bits&hookCall != 0 {
+		mask |= LUA_MASKCALL
+	}
+	if bits&hookRet != 0 {
+		mask |= LUA_MASKRET
+	}
+	if bits&hookLine != 0 {
+		mask |= LUA_MASKLINE
+	}
+	if bits&hookCount != 0 {
+		mask |= LUA_MASKCOUNT
+	}
+	return ls.hookFunc, mask, ls.baseHookCount
+}
+
+// copies the hooks of ls to a new thread
+// lua-5.3.4/src/lstate.c#lua_newthread()
+func (ls *LuaState) inheritHooks(t *LuaState) {
+	t.hookFunc = ls.hookFunc
+	t.baseHookCount = ls.baseHookCount
+	t.hookCounter = ls.baseHookCount
+	t.setHook(atomic.LoadInt32(&ls.hookMask) & hookUser)
+	if ls.cover != nil {
+		t.cover = ls.cover
+		t.setHook(hookCoverage)
+	}
+}
+
+func (ls *LuaState) setHook(bits int32) {
+	for {
+		old := atomic.LoadInt32(&ls.hookMask)
+		if atomic.CompareAndSwapInt32(&ls.hookMask, old, old|bits) {
+			return
+		}
+	}
+}
+
+func (ls *LuaState) clearHook(bits int32) {
+	for {
+		old := atomic.LoadInt32(&ls.hookMask)
+		if atomic.CompareAndSwapInt32(&ls.hookMask, old, old&^bits) {
+			return
+		}
+	}
+}
+
+// called by execute() when some bit of hookMask is set
+func (ls *LuaState) hook() {
+	mask := atomic.LoadInt32(&ls.hookMask)
+	if mask&hookSample != 0 {
+		ls.clearHook(hookSample)
+		if p := ls.prof; p != nil {
+			p.tick(ls)
+		}
+	}
+	if mask&hookCoverage != 0 {
+		if c := ls.cover; c != nil {
+			c.hit(ls.stack)
+		}
+	}
+	if mask&(hookLine|hookCount) != 0 {
+		ls.traceExec(mask)
+	}
+}
+
+// calls the count and line hooks before an instruction
+// lua-5.3.4/src/ldebug.c#luaG_traceexec()
+func (ls *LuaState) traceExec(mask int32) {
+	if mask&hookCount != 0 {
+		ls.hookCounter--
+		if ls.hookCounter <= 0 {
+			ls.hookCounter = ls.baseHookCount
+			ls.callHook(LUA_HOOKCOUNT, -1)
+		}
+	}
+	if mask&hookLine != 0 {
+		stack := ls.stack
+		lines := stack.closure.proto.DbgSourcePositions
+		pc := stack.pc - 1
+		oldpc := stack.oldpc
+		stack.oldpc = pc
+		/* a new function, a backward jump or a new line */
+		if pc == 0 || pc <= oldpc || lines[pc] != lines[oldpc] {
+			ls.callHook(LUA_HOOKLINE, int(lines[pc]))
+		}
+	}
+}
+
+// calls the call hook for the frame just pushed, or the return hook for
+// the frame about to be popped
+func (ls *LuaState) callFrameHook(event int) {
+	bit := int32(hookCall)
+	if event == LUA_HOOKRET {
+		bit = hookRet
+	}
+	if atomic.LoadInt32(&ls.hookMask)&bit != 0 {
+		ls.callHook(event, -1)
+	}
+}
+
+// lua-5.3.4/src/ldo.c#luaD_hook()
+func (ls *LuaState) callHook(event, line int) {
+	f := ls.hookFunc
+	if f == nil || ls.inHook {
+		return
+	}
+	ls.inHook = true /* cannot call hooks inside a hook */
+	defer func() { ls.inHook = false }()
+	stack := ls.stack
+	top := stack.top
+	f(ls, event, line)
+	if stack.top > top { /* whatever the hook left */
+		stack.drop(stack.top - top)
+	}
+}
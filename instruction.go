@@ -1,11 +1,9 @@
 package golua
 
 import (
-	. "luago/compiler"
+	. "golua/compiler"
 )
 
-const MAXARG_Bx = 1<<18 - 1       // 262143
-const MAXARG_sBx = MAXARG_Bx >> 1 // 131071
 
 /*
  31       22       13       5    0
@@ -73,6 +71,52 @@ func (inst Instruction) Execute(ls *LuaState) {
 	}
 }
 
+/*
+** luaInst is an instruction with its operands decoded once, when the
+** prototype is loaded. Bx and sBx are kept in b. RK operands that refer
+** to a constant are stored as ^index, registers as their index.
+** Lookups with a constant string key get an inline cache, ic is its
+** index in luaProto.caches plus one.
+ */
+type luaInst struct {
+	op      uint8
+	ic      uint16
+	a, b, c int32
+}
+
+func decodeCode(code []uint32) []luaInst {
+	decoded := make([]luaInst, len(code))
+	for pc, i := range code {
+		decoded[pc] = Instruction(i).decode()
+	}
+	return decoded
+}
+
+func (inst Instruction) decode() luaInst {
+	d := luaInst{op: uint8(inst.Opcode())}
+	switch inst.OpMode() {
+	case IABC:
+		a, b, c := inst.ABC()
+		d.a, d.b, d.c = int32(a), rkOperand(b, inst.BMode()), rkOperand(c, inst.CMode())
+	case IABx:
+		a, bx := inst.ABx()
+		d.a, d.b = int32(a), int32(bx)
+	case IAsBx:
+		a, sbx := inst.AsBx()
+		d.a, d.b = int32(a), int32(sbx)
+	case IAx:
+		d.a = int32(inst.Ax())
+	}
+	return d
+}
+
+func rkOperand(x int, mode byte) int32 {
+	if mode == OpArgK && x > 0xFF {
+		return ^int32(x & 0xFF) // constant
+	}
+	return int32(x)
+}
+
 type opcode struct {
 	testFlag byte // operator is a test (next instruction must be a jump)
 	setAFlag byte // instruction set register A
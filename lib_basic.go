@@ -93,9 +93,9 @@ func baseError(ls *LuaState) int {
 	level := int(luaOptInteger(ls, 2, 1))
 	luaSetTop(ls, 1)
 	if luaType(ls, 1) == LUA_TSTRING && level > 0 {
-		// ls.Where(level) /* add extra information */
-		// luaPushValue(ls, 1)
-		// luaConcat(ls, 2)
+		ls.Push(LuaString(ls.where(level, false))) /* add extra information */
+		luaPushValue(ls, 1)
+		luaConcat(ls, 2)
 	}
 	return ls.Error()
 }
@@ -176,26 +176,62 @@ func baseNext(ls *LuaState) int {
 // lua-5.3.4/src/lbaselib.c#luaB_load()
 func baseLoad(ls *LuaState) int {
 	var status int
-	chunk, isStr := luaToStringX(ls, 1)
-	//mode := luaOptString(ls, 3, "bt")
+	s, isStr := luaToStringX(ls, 1)
+	mode := luaOptString(ls, 3, "bt")
 	env := 0 /* 'env' index or 0 if no 'env' */
 	if !luaIsNone(ls, 4) {
 		env = 4
 	}
 	if isStr { /* loading a string? */
-		chunkname := luaOptString(ls, 2, chunk)
-		status = ls.Load([]byte(chunk), chunkname)
+		chunkname := luaOptString(ls, 2, s)
+		status = ls.load([]byte(s), chunkname, mode)
 	} else { /* loading from a reader function */
-		panic("loading from a reader function") // todo
+		chunkname := luaOptString(ls, 2, "=(load)")
+		luaCheckType(ls, 1, LUA_TCLOSURE)
+		var chunk []byte
+		if chunk, status = genericReader(ls); status == LUA_OK {
+			status = ls.load(chunk, chunkname, mode)
+		}
 	}
 	return loadAux(ls, status, env)
 }
 
+// reads the chunk of load from the reader function at 1, calling it
+// until it returns nil or an empty string. On errors the status is not
+// LUA_OK and the message is on top of the stack.
+// lua-5.3.4/src/lbaselib.c#generic_reader()
+func genericReader(ls *LuaState) ([]byte, int) {
+	var chunk []byte
+	for {
+		luaCheckStack2(ls, 2, "too many nested functions")
+		luaPushValue(ls, 1) /* get function */
+		if err := ls.PCall(0, 1, 0); err != nil { /* call it */
+			ls.Push(err.(*LuaError).Value)
+			return nil, LUA_ERRRUN
+		}
+		if luaIsNil(ls, -1) {
+			luaPop(ls, 1) /* pop result */
+			return chunk, LUA_OK
+		} else if !luaIsString(ls, -1) {
+			luaPop(ls, 1)
+			ls.Push(LuaString("reader function must return a string"))
+			return nil, LUA_ERRRUN
+		}
+		piece := luaToString(ls, -1)
+		luaPop(ls, 1)
+		if piece == "" {
+			return chunk, LUA_OK
+		}
+		chunk = append(chunk, piece...)
+	}
+}
+
 // lua-5.3.4/src/lbaselib.c#load_aux()
 func loadAux(ls *LuaState, status, envIdx int) int {
 	if status == LUA_OK {
 		if envIdx != 0 { /* 'env' parameter? */
-			panic("todo!")
+			/* environment for loaded function, set as 1st upvalue */
+			ls.SetUpvalue(ls.CheckAny(-1), 1, ls.CheckAny(envIdx))
 		}
 		return 1
 	} else { /* error (message is on top of the stack) */
@@ -210,12 +246,12 @@ func loadAux(ls *LuaState, status, envIdx int) int {
 // lua-5.3.4/src/lbaselib.c#luaB_loadfile()
 func baseLoadFile(ls *LuaState) int {
 	fname := luaOptString(ls, 1, "")
-	//mode := luaOptString(ls, 1, "bt")
+	mode := luaOptString(ls, 2, "bt")
 	env := 0 /* 'env' index or 0 if no 'env' */
 	if !luaIsNone(ls, 3) {
 		env = 3
 	}
-	status := ls.LoadFileX(fname)
+	status := ls.LoadFileX(fname, mode)
 	return loadAux(ls, status, env)
 }
 
@@ -236,8 +272,12 @@ func baseDoFile(ls *LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-pcall
 func basePCall(ls *LuaState) int {
 	nArgs := luaGetTop(ls) - 1
-	err := ls.PCall(nArgs, -1, 0)
-	ls.Push(LuaBool(err == nil))
+	if err := ls.PCall(nArgs, -1, 0); err != nil {
+		ls.Push(LuaFalse)
+		ls.Push(err.(*LuaError).Value)
+		return 2
+	}
+	ls.Push(LuaTrue)
 	luaInsert(ls, 1)
 	return luaGetTop(ls)
 }
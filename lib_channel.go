@@ -0,0 +1,381 @@
+package golua
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const LUA_CHANNEL = "channel"
+
+var channelFuncs = map[string]GoFunction{
+	"make":    chanMake,
+	"select":  chanSelect,
+	"send":    chanSend,
+	"receive": chanReceive,
+	"close":   chanClose,
+}
+
+func OpenChannelLib(ls *LuaState) int {
+	ls.NewLib(channelFuncs)
+	pushChannelMeta(ls)
+	luaPop(ls, 1)
+	return 1
+}
+
+// pushes the metatable of channels, made on first use so that hosts can
+// push channels without the library
+func pushChannelMeta(ls *LuaState) {
+	if luaNewMetatable(ls, LUA_CHANNEL) {
+		luaPushValue(ls, -1)
+		luaSetField(ls, -2, "__index") /* metatable.__index = metatable */
+		ls.SetFuncs(FuncReg{           /* methods for channels */
+			"send":       chanSend,
+			"receive":    chanReceive,
+			"close":      chanClose,
+			"__len":      chanLen,
+			"__eq":       chanEq,
+			"__tostring": chanToString,
+		}, 0)
+	}
+}
+
+// PushChannel pushes ch, a Go channel of any element type, as a channel
+// of the channel library. Values cross it converted: booleans, numbers
+// and strings to and from the Go kinds, []byte as strings, channels as
+// channels and other Go values as userdata. A chan LuaValue or chan
+// interface{} carries any Lua value, the latter with Lua values as their
+// plain Go values where there is one.
+func (ls *LuaState) PushChannel(ch interface{}) {
+	if reflect.TypeOf(ch).Kind() != reflect.Chan {
+		panic(fmt.Sprintf("PushChannel: %T is not a channel", ch))
+	}
+	ls.Push(&LuaUserData{Value: ch})
+	pushChannelMeta(ls)
+	luaSetMetatable(ls, -2)
+}
+
+func checkChannel(ls *LuaState, arg int) reflect.Value {
+	return reflect.ValueOf(luaCheckUData(ls, arg, LUA_CHANNEL).Value)
+}
+
+// the channel of v, a value of a select case
+func toChannel(ls *LuaState, v LuaValue) (reflect.Value, bool) {
+	ud, ok := v.(*LuaUserData)
+	if !ok || ud.Metatable == nil {
+		return reflect.Value{}, false
+	}
+	if mt, ok := ls.registry.Get(LuaString(LUA_CHANNEL)).(*LuaTable); !ok || mt != ud.Metatable {
+		return reflect.Value{}, false
+	}
+	return reflect.ValueOf(ud.Value), true
+}
+
+var luaValueType = reflect.TypeOf((*LuaValue)(nil)).Elem()
+
+// pushes x, received from a channel
+func pushGoValue(ls *LuaState, x reflect.Value) {
+	for x.Kind() == reflect.Interface && !x.IsNil() {
+		if v, ok := x.Interface().(LuaValue); ok {
+			ls.Push(v)
+			return
+		}
+		x = x.Elem()
+	}
+	switch x.Kind() {
+	case reflect.Invalid, reflect.Interface:
+		ls.Push(LuaNil)
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Func, reflect.Chan:
+		if x.IsNil() {
+			ls.Push(LuaNil)
+		} else if x.Kind() == reflect.Chan {
+			ls.PushChannel(x.Interface())
+		} else {
+			pushGoObject(ls, x)
+		}
+	case reflect.Bool:
+		ls.Push(LuaBool(x.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		ls.Push(LuaNumber(x.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		ls.Push(LuaNumber(x.Uint()))
+	case reflect.Float32, reflect.Float64:
+		ls.Push(LuaNumber(x.Float()))
+	case reflect.String:
+		ls.Push(LuaString(x.String()))
+	default:
+		pushGoObject(ls, x)
+	}
+}
+
+// pushes x as the Lua value it is or as userdata
+func pushGoObject(ls *LuaState, x reflect.Value) {
+	if x.Kind() == reflect.Slice && x.Type().Elem().Kind() == reflect.Uint8 {
+		ls.Push(LuaString(x.Bytes()))
+	} else if v, ok := x.Interface().(LuaValue); ok {
+		ls.Push(v)
+	} else {
+		ls.Push(&LuaUserData{Value: x.Interface()})
+	}
+}
+
+// converts v to a value of type t for sending on a channel
+func toGoValue(v LuaValue, t reflect.Type) (reflect.Value, bool) {
+	if t == luaValueType {
+		return reflect.ValueOf(&v).Elem(), true
+	}
+	if t.Kind() == reflect.Interface && t.NumMethod() == 0 {
+		switch x := v.(type) {
+		case *LuaNilType:
+			return reflect.Zero(t), true
+		case LuaBool:
+			return reflect.ValueOf(bool(x)), true
+		case LuaNumber:
+			return reflect.ValueOf(float64(x)), true
+		case LuaString:
+			return reflect.ValueOf(string(x)), true
+		case *LuaUserData:
+			if x.Value != nil {
+				return reflect.ValueOf(x.Value), true
+			}
+		}
+		return reflect.ValueOf(v), true
+	}
+	x := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Bool:
+		b, ok := v.(LuaBool)
+		x.SetBool(bool(b))
+		return x, ok
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, ok := v.(LuaNumber); ok {
+			i, ok := floatToInteger(n)
+			if ok && !x.OverflowInt(i) {
+				x.SetInt(i)
+				return x, true
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if n, ok := v.(LuaNumber); ok {
+			i, ok := floatToInteger(n)
+			if ok && i >= 0 && !x.OverflowUint(uint64(i)) {
+				x.SetUint(uint64(i))
+				return x, true
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		if n, ok := v.(LuaNumber); ok {
+			x.SetFloat(float64(n))
+			return x, true
+		}
+	case reflect.String:
+		if s, ok := v.(LuaString); ok {
+			x.SetString(string(s))
+			return x, true
+		}
+	case reflect.Slice:
+		if s, ok := v.(LuaString); ok && t.Elem().Kind() == reflect.Uint8 {
+			x.SetBytes([]byte(s))
+			return x, true
+		}
+	}
+	if ud, ok := v.(*LuaUserData); ok && ud.Value != nil &&
+		reflect.TypeOf(ud.Value).AssignableTo(t) {
+		return reflect.ValueOf(ud.Value), true
+	}
+	if t.Kind() == reflect.Interface && reflect.TypeOf(v).Implements(t) {
+		return reflect.ValueOf(v), true
+	}
+	return x, false
+}
+
+// converts v, argument arg or in it, for sending on ch, argument chArg
+// or in it
+func checkSendValue(ls *LuaState, ch reflect.Value, chArg, arg int, v LuaValue) reflect.Value {
+	if ch.Type().ChanDir()&reflect.SendDir == 0 {
+		ls.ArgError(chArg, "send on receive-only channel")
+	}
+	x, ok := toGoValue(v, ch.Type().Elem())
+	if !ok {
+		ls.ArgError(arg, fmt.Sprintf("cannot send %s on %s", v.Type(), ch.Type()))
+	}
+	return x
+}
+
+func checkReceive(ls *LuaState, ch reflect.Value, arg int) {
+	if ch.Type().ChanDir()&reflect.RecvDir == 0 {
+		ls.ArgError(arg, "receive from send-only channel")
+	}
+}
+
+// runs op and returns the message of its panic, like that of sending on
+// a closed channel
+func channelOp(op func()) (msg string) {
+	defer func() {
+		if r := recover(); r != nil {
+			msg = fmt.Sprint(r)
+		}
+	}()
+	op()
+	return ""
+}
+
+// reflect.Select that gives up, choosing -1, once quit is closed
+func selectOrQuit(cases []reflect.SelectCase, quit <-chan struct{}) (int, reflect.Value, bool) {
+	if quit == nil {
+		return reflect.Select(cases)
+	}
+	n := len(cases)
+	cases = append(cases[:n:n], reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(quit)})
+	chosen, x, ok := reflect.Select(cases)
+	if chosen == n {
+		return -1, reflect.Value{}, false
+	}
+	return chosen, x, ok
+}
+
+// channel.make ([size])
+func chanMake(ls *LuaState) int {
+	size := luaOptInteger(ls, 1, 0)
+	ls.ArgCheck(size >= 0 && size <= 1<<31-1, 1, "size out of range")
+	ls.PushChannel(make(chan LuaValue, size))
+	return 1
+}
+
+// channel.send (ch, v)
+// ch:send (v)
+func chanSend(ls *LuaState) int {
+	ch := checkChannel(ls, 1)
+	x := checkSendValue(ls, ch, 1, 2, ls.CheckAny(2))
+	var msg string
+	sent := false
+	if msg = channelOp(func() { sent = ch.TrySend(x) }); !sent && msg == "" {
+		ls.block(func(quit <-chan struct{}) {
+			msg = channelOp(func() {
+				selectOrQuit([]reflect.SelectCase{{Dir: reflect.SelectSend, Chan: ch, Send: x}}, quit)
+			})
+		})
+	}
+	if msg != "" {
+		ls.Error2("%s", msg)
+	}
+	return 0
+}
+
+// channel.receive (ch)
+// ch:receive ()
+// returns the value and true, or nil and false once ch is closed and empty
+func chanReceive(ls *LuaState) int {
+	ch := checkChannel(ls, 1)
+	checkReceive(ls, ch, 1)
+	x, ok := ch.TryRecv()
+	if !x.IsValid() && !ok {
+		ls.block(func(quit <-chan struct{}) {
+			_, x, ok = selectOrQuit([]reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}}, quit)
+		})
+	}
+	if ok {
+		pushGoValue(ls, x)
+	} else {
+		ls.Push(LuaNil)
+	}
+	ls.Push(LuaBool(ok))
+	return 2
+}
+
+// channel.close (ch)
+// ch:close ()
+func chanClose(ls *LuaState) int {
+	ch := checkChannel(ls, 1)
+	if ch.Type().ChanDir()&reflect.SendDir == 0 {
+		ls.ArgError(1, "close of receive-only channel")
+	}
+	if msg := channelOp(ch.Close); msg != "" {
+		ls.Error2("%s", msg)
+	}
+	return 0
+}
+
+// channel.select (case1, ···)
+// Each case is a table: {"|<-", ch} receives from ch, {"<-|", ch, v}
+// sends v on ch and {"default"} is taken when no other case is ready.
+// Returns the number of the case taken, then, for a receive, the value
+// and whether it was received.
+func chanSelect(ls *LuaState) int {
+	n := luaGetTop(ls)
+	ls.ArgCheck(n > 0, 1, "select case expected")
+	cases := make([]reflect.SelectCase, n)
+	hasDefault := false
+	for i := 1; i <= n; i++ {
+		tb := ls.CheckTable(i)
+		dir, _ := tb.Get(LuaNumber(1)).(LuaString)
+		if dir == "default" {
+			ls.ArgCheck(!hasDefault, i, "multiple defaults in select")
+			hasDefault = true
+			cases[i-1].Dir = reflect.SelectDefault
+			continue
+		}
+		ch, ok := toChannel(ls, tb.Get(LuaNumber(2)))
+		switch {
+		case dir != "|<-" && dir != "<-|":
+			ls.ArgError(i, "invalid select case")
+		case !ok:
+			ls.ArgError(i, "channel expected in select case")
+		case dir == "|<-":
+			checkReceive(ls, ch, i)
+			cases[i-1] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: ch}
+		default:
+			x := checkSendValue(ls, ch, i, i, tb.Get(LuaNumber(3)))
+			cases[i-1] = reflect.SelectCase{Dir: reflect.SelectSend, Chan: ch, Send: x}
+		}
+	}
+
+	var chosen int
+	var x reflect.Value
+	var ok bool
+	var msg string
+	if hasDefault {
+		msg = channelOp(func() { chosen, x, ok = reflect.Select(cases) })
+	} else {
+		/* try without blocking first */
+		try := append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+		msg = channelOp(func() { chosen, x, ok = reflect.Select(try) })
+		if msg == "" && chosen == n {
+			ls.block(func(quit <-chan struct{}) {
+				msg = channelOp(func() { chosen, x, ok = selectOrQuit(cases, quit) })
+			})
+		}
+	}
+	if msg != "" {
+		ls.Error2("%s", msg)
+	}
+
+	ls.Push(LuaNumber(chosen + 1))
+	if cases[chosen].Dir != reflect.SelectRecv {
+		return 1
+	}
+	if ok {
+		pushGoValue(ls, x)
+	} else {
+		ls.Push(LuaNil)
+	}
+	ls.Push(LuaBool(ok))
+	return 3
+}
+
+func chanLen(ls *LuaState) int {
+	ls.Push(LuaNumber(checkChannel(ls, 1).Len()))
+	return 1
+}
+
+// channels pushed apart are equal when they are the same Go channel
+func chanEq(ls *LuaState) int {
+	a, ok1 := toChannel(ls, ls.CheckAny(1))
+	b, ok2 := toChannel(ls, ls.CheckAny(2))
+	ls.Push(LuaBool(ok1 && ok2 && a.Pointer() == b.Pointer()))
+	return 1
+}
+
+func chanToString(ls *LuaState) int {
+	ls.Push(LuaString(fmt.Sprintf("channel (0x%x)", checkChannel(ls, 1).Pointer())))
+	return 1
+}
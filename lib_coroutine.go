@@ -30,6 +30,12 @@ func OpenCoroutineLib(ls *LuaState) int {
 // [-?, +?, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_resume
 func luaResume(lsTo *LuaState, lsFrom *LuaState, nArgs int) int {
+	lsTo.nCcalls = lsFrom.nCcalls + 1 /* a resume nests like a call from Go */
+	if lsTo.nCcalls >= LUAI_MAXCCALLS {
+		luaPop(lsTo, nArgs)
+		lsTo.stack.push(LuaString("C stack overflow"))
+		return LUA_ERRRUN
+	}
 	if lsFrom.coChan == nil {
 		lsFrom.coChan = make(chan int)
 	}
@@ -39,10 +45,12 @@ func luaResume(lsTo *LuaState, lsFrom *LuaState, nArgs int) int {
 		lsTo.coChan = make(chan int)
 		lsTo.coCaller = lsFrom
 		go func() {
-			if lsTo.PCall(nArgs, -1, 0) != nil {
+			if err := lsTo.PCall(nArgs, -1, 0); err != nil {
+				lsTo.coStatus = LUA_ERRRUN
+				lsTo.coErr = err.(*LuaError)
+				lsTo.stack.push(lsTo.coErr.Value) /* error message */
+			} else {
 				lsTo.coStatus = LUA_OK
-			}else {
-				lsTo.coStatus = LUA_ERRERR
 			}
 
 			lsFrom.coChan <- 1
@@ -0,0 +1,400 @@
+package golua
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var dbFuncs = map[string]GoFunction{
+	"debug":        dbDebug,
+	"getuservalue": dbGetUserValue,
+	"gethook":      dbGetHook,
+	"getinfo":      dbGetInfo,
+	"getlocal":     dbGetLocal,
+	"getregistry":  dbGetRegistry,
+	"getmetatable": dbGetMetatable,
+	"getupvalue":   dbGetUpvalue,
+	"upvaluejoin":  dbUpvalueJoin,
+	"upvalueid":    dbUpvalueId,
+	"setuservalue": dbSetUserValue,
+	"sethook":      dbSetHook,
+	"setlocal":     dbSetLocal,
+	"setmetatable": dbSetMetatable,
+	"setupvalue":   dbSetUpvalue,
+	"traceback":    dbTraceback,
+}
+
+// key, in the registry, of the table of Lua hook functions by thread
+const hookKey = LuaString("_HKEY")
+
+var hookNames = [...]string{"call", "return", "line", "count", "tail call"}
+
+func OpenDebugLib(ls *LuaState) int {
+	ls.NewLib(dbFuncs)
+	return 1
+}
+
+// debug.getregistry ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getregistry
+// lua-5.3.4/src/ldblib.c#db_getregistry()
+func dbGetRegistry(ls *LuaState) int {
+	ls.Push(ls.registry)
+	return 1
+}
+
+// debug.getmetatable (value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getmetatable
+// lua-5.3.4/src/ldblib.c#db_getmetatable()
+func dbGetMetatable(ls *LuaState) int {
+	ls.CheckAny(1)
+	if !luaGetMetatable(ls, 1) {
+		ls.Push(LuaNil) /* no metatable */
+	}
+	return 1
+}
+
+// debug.setmetatable (value, table)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setmetatable
+// lua-5.3.4/src/ldblib.c#db_setmetatable()
+func dbSetMetatable(ls *LuaState) int {
+	t := luaType(ls, 2)
+	ls.ArgCheck(t == LUA_TNIL || t == LUA_TTABLE, 2, "nil or table expected")
+	luaSetTop(ls, 2)
+	luaSetMetatable(ls, 1)
+	return 1 /* return 1st argument */
+}
+
+// debug.getuservalue (u)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getuservalue
+// lua-5.3.4/src/ldblib.c#db_getuservalue()
+func dbGetUserValue(ls *LuaState) int {
+	if u, ok := ls.CheckAny(1).(*LuaUserData); ok && u.Env != nil {
+		ls.Push(u.Env)
+	} else {
+		ls.Push(LuaNil)
+	}
+	return 1
+}
+
+// debug.setuservalue (udata, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setuservalue
+// lua-5.3.4/src/ldblib.c#db_setuservalue()
+func dbSetUserValue(ls *LuaState) int {
+	u := ls.CheckUserData(1)
+	luaCheckTypes(ls, 2, LUA_TNIL, LUA_TTABLE)
+	u.Env, _ = ls.CheckAny(2).(*LuaTable)
+	luaSetTop(ls, 1)
+	return 1
+}
+
+// the thread an optional first argument names, and the number of
+// arguments to skip
+// lua-5.3.4/src/ldblib.c#getthread()
+func getThread(ls *LuaState) (int, *LuaState) {
+	if t := luaToThread(ls, 1); t != nil {
+		return 1, t
+	}
+	return 0, ls
+}
+
+// debug.getinfo ([thread,] f [, what])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getinfo
+// lua-5.3.4/src/ldblib.c#db_getinfo()
+func dbGetInfo(ls *LuaState) int {
+	arg, ls1 := getThread(ls)
+	options := luaOptString(ls, arg+2, "flnStu")
+	var dbg *DebugInfo
+	if luaIsFunction(ls, arg+1) { /* info about a function? */
+		dbg = ls.GetFuncInfo(ls.CheckAny(arg + 1))
+	} else { /* stack level */
+		dbg = ls1.GetInfo(int(ls.CheckInteger(arg + 1)))
+		if dbg == nil { /* level out of range */
+			ls.Push(LuaNil)
+			return 1
+		}
+	}
+	for _, o := range options {
+		if !strings.ContainsRune("SlnutfL", o) {
+			return ls.ArgError(arg+2, "invalid option")
+		}
+	}
+	t := newLuaTable(0, 16)
+	set := func(k string, v LuaValue) { t.Set(LuaString(k), v) }
+	if strings.ContainsRune(options, 'S') {
+		set("source", LuaString(dbg.Source))
+		set("short_src", LuaString(dbg.ShortSrc))
+		set("linedefined", LuaNumber(dbg.LineDefined))
+		set("lastlinedefined", LuaNumber(dbg.LastLineDefined))
+		set("what", LuaString(dbg.What))
+	}
+	if strings.ContainsRune(options, 'l') {
+		set("currentline", LuaNumber(dbg.CurrentLine))
+	}
+	if strings.ContainsRune(options, 'u') {
+		set("nups", LuaNumber(dbg.NUpvalues))
+		set("nparams", LuaNumber(dbg.NParams))
+		set("isvararg", LuaBool(dbg.IsVararg))
+	}
+	if strings.ContainsRune(options, 'n') && dbg.Name != "" {
+		set("name", LuaString(dbg.Name))
+		set("namewhat", LuaString(dbg.NameWhat))
+	} else if strings.ContainsRune(options, 'n') {
+		set("namewhat", LuaString(""))
+	}
+	if strings.ContainsRune(options, 't') {
+		set("istailcall", LuaBool(dbg.stack != nil && dbg.stack.tailCall > 0))
+	}
+	if strings.ContainsRune(options, 'L') {
+		if p := dbg.Func.(*LuaClosure).proto; p != nil {
+			lines := newLuaTable(0, len(p.DbgSourcePositions))
+			for _, line := range p.DbgSourcePositions {
+				lines.Set(LuaNumber(line), LuaTrue)
+			}
+			set("activelines", lines)
+		}
+	}
+	if strings.ContainsRune(options, 'f') {
+		set("func", dbg.Func)
+	}
+	ls.Push(t)
+	return 1
+}
+
+// debug.getlocal ([thread,] f, local)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getlocal
+// lua-5.3.4/src/ldblib.c#db_getlocal()
+func dbGetLocal(ls *LuaState) int {
+	arg, ls1 := getThread(ls)
+	nvar := int(ls.CheckInteger(arg + 2)) /* local-variable index */
+	if luaIsFunction(ls, arg+1) {         /* function argument? */
+		name := ""
+		if p := ls.CheckClosure(arg + 1).proto; p != nil {
+			name, _ = p.LocalName(nvar, 0) /* only parameters */
+		}
+		if name == "" {
+			ls.Push(LuaNil)
+		} else {
+			ls.Push(LuaString(name))
+		}
+		return 1
+	}
+	level := int(ls.CheckInteger(arg + 1))
+	if ls1.GetInfo(level) == nil { /* out of range? */
+		return ls.ArgError(arg+1, "level out of range")
+	}
+	name, v := ls1.GetLocal(level, nvar)
+	if name == "" { /* no name (nor value) */
+		ls.Push(LuaNil)
+		return 1
+	}
+	ls.Push(LuaString(name))
+	ls.Push(v)
+	return 2
+}
+
+// debug.setlocal ([thread,] level, local, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setlocal
+// lua-5.3.4/src/ldblib.c#db_setlocal()
+func dbSetLocal(ls *LuaState) int {
+	arg, ls1 := getThread(ls)
+	level := int(ls.CheckInteger(arg + 1))
+	nvar := int(ls.CheckInteger(arg + 2))
+	v := ls.CheckAny(arg + 3)
+	if ls1.GetInfo(level) == nil { /* out of range? */
+		return ls.ArgError(arg+1, "level out of range")
+	}
+	if name := ls1.SetLocal(level, nvar, v); name != "" {
+		ls.Push(LuaString(name))
+	} else {
+		ls.Push(LuaNil)
+	}
+	return 1
+}
+
+// debug.getupvalue (f, up)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.getupvalue
+// lua-5.3.4/src/ldblib.c#db_getupvalue()
+func dbGetUpvalue(ls *LuaState) int {
+	n := int(ls.CheckInteger(2))
+	luaCheckType(ls, 1, LUA_TCLOSURE)
+	name, v, ok := ls.GetUpvalue(ls.CheckAny(1), n)
+	if !ok {
+		return 0
+	}
+	ls.Push(LuaString(name))
+	ls.Push(v)
+	return 2
+}
+
+// debug.setupvalue (f, up, value)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.setupvalue
+// lua-5.3.4/src/ldblib.c#db_setupvalue()
+func dbSetUpvalue(ls *LuaState) int {
+	v := ls.CheckAny(3)
+	n := int(ls.CheckInteger(2))
+	luaCheckType(ls, 1, LUA_TCLOSURE)
+	name, ok := ls.SetUpvalue(ls.CheckAny(1), n, v)
+	if !ok {
+		return 0
+	}
+	ls.Push(LuaString(name))
+	return 1
+}
+
+// checks that argument argnup is a valid upvalue index of function argf
+// lua-5.3.4/src/ldblib.c#checkupval()
+func checkUpval(ls *LuaState, argf, argnup int) int {
+	nup := int(ls.CheckInteger(argnup))
+	luaCheckType(ls, argf, LUA_TCLOSURE)
+	_, _, ok := ls.GetUpvalue(ls.CheckAny(argf), nup)
+	ls.ArgCheck(ok, argnup, "invalid upvalue index")
+	return nup
+}
+
+// debug.upvalueid (f, n)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.upvalueid
+// lua-5.3.4/src/ldblib.c#db_upvalueid()
+func dbUpvalueId(ls *LuaState) int {
+	n := checkUpval(ls, 1, 2)
+	ls.Push(ls.UpvalueID(ls.CheckAny(1), n))
+	return 1
+}
+
+// debug.upvaluejoin (f1, n1, f2, n2)
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.upvaluejoin
+// lua-5.3.4/src/ldblib.c#db_upvaluejoin()
+func dbUpvalueJoin(ls *LuaState) int {
+	n1 := checkUpval(ls, 1, 2)
+	n2 := checkUpval(ls, 3, 4)
+	ls.ArgCheck(!luaIsGoFunction(ls, 1), 1, "Lua function expected")
+	ls.ArgCheck(!luaIsGoFunction(ls, 3), 3, "Lua function expected")
+	ls.UpvalueJoin(ls.CheckAny(1), n1, ls.CheckAny(3), n2)
+	return 0
+}
+
+// debug.sethook ([thread,] hook, mask [, count])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.sethook
+// lua-5.3.4/src/ldblib.c#db_sethook()
+func dbSetHook(ls *LuaState) int {
+	arg, ls1 := getThread(ls)
+	hooks, _ := ls.registry.Get(hookKey).(*LuaTable)
+	if hooks == nil {
+		hooks = newLuaTable(0, 1)
+		ls.registry.Set(hookKey, hooks)
+	}
+	if luaIsNoneOrNil(ls, arg+1) { /* no hook? */
+		ls1.SetHook(nil, 0, 0)
+		hooks.Set(ls1, LuaNil)
+		return 0
+	}
+	smask := ls.CheckString(arg + 2)
+	luaCheckType(ls, arg+1, LUA_TCLOSURE)
+	count := int(luaOptInteger(ls, arg+3, 0))
+	mask := 0
+	if strings.IndexByte(smask, 'c') >= 0 {
+		mask |= LUA_MASKCALL
+	}
+	if strings.IndexByte(smask, 'r') >= 0 {
+		mask |= LUA_MASKRET
+	}
+	if strings.IndexByte(smask, 'l') >= 0 {
+		mask |= LUA_MASKLINE
+	}
+	if count > 0 {
+		mask |= LUA_MASKCOUNT
+	}
+	fn := ls.CheckAny(arg + 1)
+	hooks.Set(ls1, fn)
+	ls1.SetHook(func(ls *LuaState, event, line int) {
+		ls.stack.push(fn)
+		ls.stack.push(LuaString(hookNames[event]))
+		if line >= 0 {
+			ls.stack.push(LuaNumber(line))
+		} else {
+			ls.stack.push(LuaNil)
+		}
+		ls.Call(2, 0)
+	}, mask, count)
+	return 0
+}
+
+// debug.gethook ([thread])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.gethook
+// lua-5.3.4/src/ldblib.c#db_gethook()
+func dbGetHook(ls *LuaState) int {
+	_, ls1 := getThread(ls)
+	hook, mask, count := ls1.GetHook()
+	if hook == nil { /* no hook? */
+		ls.Push(LuaNil)
+		return 1
+	}
+	fn := LuaValue(LuaString("external hook"))
+	if hooks, ok := ls.registry.Get(hookKey).(*LuaTable); ok {
+		if f := hooks.Get(ls1); f != LuaNil {
+			fn = f
+		}
+	}
+	smask := ""
+	if mask&LUA_MASKCALL != 0 {
+		smask += "c"
+	}
+	if mask&LUA_MASKRET != 0 {
+		smask += "r"
+	}
+	if mask&LUA_MASKLINE != 0 {
+		smask += "l"
+	}
+	ls.Push(fn)
+	ls.Push(LuaString(smask))
+	ls.Push(LuaNumber(count))
+	return 3
+}
+
+// debug.debug ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.debug
+// lua-5.3.4/src/ldblib.c#db_debug()
+func dbDebug(ls *LuaState) int {
+	r := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "lua_debug> ")
+		line, err := r.ReadString('\n')
+		if err != nil || strings.TrimSpace(line) == "cont" {
+			return 0
+		}
+		ls.PushGoFunction(func(ls *LuaState) int {
+			if ls.Load([]byte(line), "=(debug command)") != LUA_OK {
+				return ls.Error()
+			}
+			ls.Call(0, 0)
+			return 0
+		})
+		if err := ls.PCall(0, 0, 0); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+// debug.traceback ([thread,] [message [, level]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-debug.traceback
+// lua-5.3.4/src/ldblib.c#db_traceback()
+func dbTraceback(ls *LuaState) int {
+	arg, ls1 := getThread(ls)
+	if !luaIsNoneOrNil(ls, arg+1) && !luaIsString(ls, arg+1) {
+		luaPushValue(ls, arg+1) /* return non-string message untouched */
+		return 1
+	}
+	msg := luaOptString(ls, arg+1, "")
+	level := int64(0)
+	if ls1 == ls {
+		level = 1 /* skip traceback itself */
+	}
+	level = luaOptInteger(ls, arg+2, level)
+	tb := ls1.stackTrace(int(level))
+	if msg != "" {
+		tb = msg + "\n" + tb
+	}
+	ls.Push(LuaString(tb))
+	return 1
+}
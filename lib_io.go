@@ -0,0 +1,847 @@
+package golua
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+const LUA_FILEHANDLE = "FILE*"
+const LUAL_BUFFERSIZE = 8192
+
+const (
+	IO_PREFIX = "_IO_"
+	IO_INPUT  = IO_PREFIX + "input"
+	IO_OUTPUT = IO_PREFIX + "output"
+)
+
+const L_MAXLENNUM = 200 /* maximum length of a numeral */
+const MAXARGLINE = 250  /* maximum number of arguments to 'lines' */
+
+var ioFuncs = map[string]GoFunction{
+	"close":   ioClose,
+	"flush":   ioFlush,
+	"input":   ioInput,
+	"lines":   ioLines,
+	"open":    ioOpen,
+	"output":  ioOutput,
+	"popen":   ioPOpen,
+	"read":    ioRead,
+	"tmpfile": ioTmpFile,
+	"type":    ioType,
+	"write":   ioWrite,
+}
+
+// methods for file handles
+var fileFuncs = map[string]GoFunction{
+	"close":      fClose,
+	"flush":      fFlush,
+	"lines":      fLines,
+	"read":       fRead,
+	"seek":       fSeek,
+	"setvbuf":    fSetVBuf,
+	"write":      fWrite,
+	"__gc":       fGC,
+	"__tostring": fToString,
+}
+
+func OpenIOLib(ls *LuaState) int {
+	ls.NewLib(ioFuncs) /* new module */
+	createMeta(ls)
+	/* create (and set) default files */
+	createStdFile(ls, os.Stdin, IO_INPUT, "stdin")
+	createStdFile(ls, os.Stdout, IO_OUTPUT, "stdout")
+	createStdFile(ls, os.Stderr, "", "stderr")
+	return 1
+}
+
+// lua-5.3.4/src/liolib.c#createmeta()
+func createMeta(ls *LuaState) {
+	luaNewMetatable(ls, LUA_FILEHANDLE) /* create metatable for file handles */
+	luaPushValue(ls, -1)                /* push metatable */
+	luaSetField(ls, -2, "__index")      /* metatable.__index = metatable */
+	ls.SetFuncs(fileFuncs, 0)           /* add file methods to new metatable */
+	luaPop(ls, 1)                       /* pop new metatable */
+}
+
+// lua-5.3.4/src/liolib.c#createstdfile()
+func createStdFile(ls *LuaState, f *os.File, k, fname string) {
+	p := newPreFile(ls)
+	p.f = f
+	p.closef = ioNoClose
+	if f != os.Stdin {
+		p.setvbuf(_IONBF, 0) /* keep in step with 'print' */
+	}
+	if k != "" {
+		luaPushValue(ls, -1)
+		luaSetField(ls, LUA_REGISTRYINDEX, k) /* add file to registry */
+	}
+	luaSetField(ls, -2, fname) /* add file to module */
+}
+
+/*
+** {======================================================
+** Streams
+** =======================================================
+ */
+
+const (
+	_IONBF = iota /* unbuffered */
+	_IOFBF        /* fully buffered */
+	_IOLBF        /* line buffered */
+)
+
+// the value of file handles, a buffered stream over the underlying file
+// lua-5.3.4/src/lauxlib.h#luaL_Stream
+type luaStream struct {
+	f      io.Closer     // underlying file; an io.Reader, io.Writer and/or io.Seeker
+	r      *bufio.Reader // read buffer, made on the first read
+	w      *bufio.Writer // write buffer, nil when unbuffered
+	lbf    bool          // flush writes at each newline
+	err    error         // error indicator of the last read, see ferror
+	closef GoFunction    // to close stream (nil for closed streams)
+}
+
+func (p *luaStream) isClosed() bool {
+	return p.closef == nil
+}
+
+// reader flushes pending writes and returns the read buffer
+func (p *luaStream) reader() *bufio.Reader {
+	if p.w != nil {
+		p.w.Flush()
+	}
+	if p.r == nil {
+		r, _ := p.f.(io.Reader)
+		if r == nil {
+			r = badFile{}
+		}
+		p.r = bufio.NewReaderSize(r, LUAL_BUFFERSIZE)
+	}
+	return p.r
+}
+
+// dropReads gives back the read-ahead, so that writes go where reads stopped
+func (p *luaStream) dropReads() {
+	if p.r != nil && p.r.Buffered() > 0 {
+		if s, ok := p.f.(io.Seeker); ok {
+			s.Seek(-int64(p.r.Buffered()), io.SeekCurrent)
+			p.r = nil
+		}
+	}
+}
+
+func (p *luaStream) write(s string) error {
+	p.dropReads()
+	if p.w != nil {
+		if _, err := p.w.WriteString(s); err != nil {
+			return err
+		}
+		if p.lbf && strings.IndexByte(s, '\n') >= 0 {
+			return p.w.Flush()
+		}
+		return nil
+	}
+	w, _ := p.f.(io.Writer)
+	if w == nil {
+		w = badFile{}
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func (p *luaStream) flush() error {
+	if p.w != nil {
+		return p.w.Flush()
+	}
+	return nil
+}
+
+func (p *luaStream) seek(offset int64, whence int) (int64, error) {
+	if err := p.flush(); err != nil {
+		return 0, err
+	}
+	s, ok := p.f.(io.Seeker)
+	if !ok {
+		return 0, syscall.ESPIPE
+	}
+	if p.r != nil {
+		if whence == io.SeekCurrent {
+			offset -= int64(p.r.Buffered())
+		}
+		p.r = nil
+	}
+	return s.Seek(offset, whence)
+}
+
+func (p *luaStream) setvbuf(mode int, size int) error {
+	if err := p.flush(); err != nil {
+		return err
+	}
+	p.w, p.lbf = nil, mode == _IOLBF
+	if mode != _IONBF {
+		w, _ := p.f.(io.Writer)
+		if w == nil {
+			w = badFile{}
+		}
+		p.w = bufio.NewWriterSize(w, size)
+	}
+	return nil
+}
+
+func (p *luaStream) close() error {
+	err := p.flush()
+	if err2 := p.f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// the side of a file that was not opened, like reading a "w" file
+type badFile struct{}
+
+func (badFile) Read([]byte) (int, error)  { return 0, syscall.EBADF }
+func (badFile) Write([]byte) (int, error) { return 0, syscall.EBADF }
+
+/* }====================================================== */
+
+// lua-5.3.4/src/liolib.c#tolstream
+func toLStream(ls *LuaState) *luaStream {
+	return luaCheckUData(ls, 1, LUA_FILEHANDLE).Value.(*luaStream)
+}
+
+// lua-5.3.4/src/liolib.c#tofile()
+func toFile(ls *LuaState) *luaStream {
+	p := toLStream(ls)
+	if p.isClosed() {
+		ls.Error2("attempt to use a closed file")
+	}
+	return p
+}
+
+// When creating file handles, always creates a 'closed' file handle
+// before opening the actual file; so, if there is a memory error, the
+// handle is in a consistent state.
+// lua-5.3.4/src/liolib.c#newprefile()
+func newPreFile(ls *LuaState) *luaStream {
+	p := &luaStream{} /* mark file handle as 'closed' */
+	ls.Push(&LuaUserData{Value: p})
+	luaSetMetatable2(ls, LUA_FILEHANDLE)
+	return p
+}
+
+// lua-5.3.4/src/liolib.c#newfile()
+func newFile(ls *LuaState) *luaStream {
+	p := newPreFile(ls)
+	p.closef = ioFClose
+	runtime.SetFinalizer(p, (*luaStream).finalize)
+	return p
+}
+
+// files that become garbage are closed like '__gc' would
+func (p *luaStream) finalize() {
+	if !p.isClosed() && p.f != nil {
+		p.closef = nil
+		p.close()
+	}
+}
+
+// Calls the 'close' function from a file handle.
+// lua-5.3.4/src/liolib.c#aux_close()
+func auxClose(ls *LuaState) int {
+	p := toLStream(ls)
+	cf := p.closef
+	p.closef = nil /* mark stream as closed */
+	return cf(ls)  /* close it */
+}
+
+// Function to close regular files.
+// lua-5.3.4/src/liolib.c#io_fclose()
+func ioFClose(ls *LuaState) int {
+	p := toLStream(ls)
+	return luaFileResult(ls, p.close(), "")
+}
+
+// Function to (not) close the standard files stdin, stdout, and stderr.
+// lua-5.3.4/src/liolib.c#io_noclose()
+func ioNoClose(ls *LuaState) int {
+	p := toLStream(ls)
+	p.closef = ioNoClose /* keep file opened */
+	ls.Push(LuaNil)
+	ls.Push(LuaString("cannot close standard file"))
+	return 2
+}
+
+// Check whether 'mode' matches '[rwa]%+?b*'.
+// lua-5.3.4/src/liolib.c#l_checkmode()
+func checkMode(mode string) bool {
+	if mode == "" || strings.IndexByte("rwa", mode[0]) < 0 {
+		return false
+	}
+	mode = mode[1:]
+	if mode != "" && mode[0] == '+' { /* skip if char is '+' */
+		mode = mode[1:]
+	}
+	return strings.Trim(mode, "b") == "" /* check extensions */
+}
+
+// fopen, in the file system of the state
+func openFile(ls *LuaState, filename, mode string) (fs.File, error) {
+	var flag int
+	switch mode[0] {
+	case 'r':
+		flag = os.O_RDONLY
+	case 'w':
+		flag = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case 'a':
+		flag = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	if strings.IndexByte(mode, '+') >= 0 {
+		flag = flag&^os.O_WRONLY | os.O_RDWR
+	}
+	return ls.openFile(filename, flag, 0666)
+}
+
+// function to open a file in the given mode and raise an error on failure
+// lua-5.3.4/src/liolib.c#opencheckfile()
+func openCheckFile(ls *LuaState, fname, mode string) {
+	p := newFile(ls)
+	f, err := openFile(ls, fname, mode)
+	if err != nil {
+		msg, _ := errorString(err)
+		ls.Error2("cannot open file '%s' (%s)", fname, msg)
+	}
+	p.initFile(f)
+}
+
+func (p *luaStream) initFile(f io.Closer) {
+	p.f = f
+	p.setvbuf(_IOFBF, LUAL_BUFFERSIZE)
+}
+
+// io.close ([file])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.close
+// lua-5.3.4/src/liolib.c#io_close()
+func ioClose(ls *LuaState) int {
+	if luaIsNone(ls, 1) { /* no argument? */
+		luaGetField(ls, LUA_REGISTRYINDEX, IO_OUTPUT) /* use standard output */
+	}
+	return fClose(ls)
+}
+
+// io.flush ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.flush
+// lua-5.3.4/src/liolib.c#io_flush()
+func ioFlush(ls *LuaState) int {
+	return luaFileResult(ls, getIOFile(ls, IO_OUTPUT).flush(), "")
+}
+
+// io.input ([file])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.input
+// lua-5.3.4/src/liolib.c#io_input()
+func ioInput(ls *LuaState) int {
+	return gIOFile(ls, IO_INPUT, "r")
+}
+
+// io.output ([file])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.output
+// lua-5.3.4/src/liolib.c#io_output()
+func ioOutput(ls *LuaState) int {
+	return gIOFile(ls, IO_OUTPUT, "w")
+}
+
+// lua-5.3.4/src/liolib.c#g_iofile()
+func gIOFile(ls *LuaState, f, mode string) int {
+	if !luaIsNoneOrNil(ls, 1) {
+		if filename, ok := luaToStringX(ls, 1); ok {
+			openCheckFile(ls, filename, mode)
+		} else {
+			toFile(ls) /* check that it's a valid file handle */
+			luaPushValue(ls, 1)
+		}
+		luaSetField(ls, LUA_REGISTRYINDEX, f)
+	}
+	/* return current value */
+	luaGetField(ls, LUA_REGISTRYINDEX, f)
+	return 1
+}
+
+// lua-5.3.4/src/liolib.c#getiofile()
+func getIOFile(ls *LuaState, findex string) *luaStream {
+	luaGetField(ls, LUA_REGISTRYINDEX, findex)
+	p := ls.stack.get(-1).(*LuaUserData).Value.(*luaStream)
+	if p.isClosed() {
+		ls.Error2("standard %s file is closed", findex[len(IO_PREFIX):])
+	}
+	return p
+}
+
+// io.lines ([filename, ···])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.lines
+// lua-5.3.4/src/liolib.c#io_lines()
+func ioLines(ls *LuaState) int {
+	var toClose bool
+	if luaIsNone(ls, 1) {
+		ls.Push(LuaNil) /* at least one argument */
+	}
+	if luaIsNil(ls, 1) { /* no file name? */
+		luaGetField(ls, LUA_REGISTRYINDEX, IO_INPUT) /* get default input */
+		luaReplace(ls, 1)                            /* put it at index 1 */
+		toFile(ls)                                   /* check that it's a valid file handle */
+		toClose = false                              /* do not close it after iteration */
+	} else { /* open a new file */
+		filename := ls.CheckString(1)
+		openCheckFile(ls, filename, "r")
+		luaReplace(ls, 1) /* put file at index 1 */
+		toClose = true    /* close it after iteration */
+	}
+	auxLines(ls, toClose) /* push iteration function */
+	return 1
+}
+
+// io.open (filename [, mode])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.open
+// lua-5.3.4/src/liolib.c#io_open()
+func ioOpen(ls *LuaState) int {
+	filename := ls.CheckString(1)
+	mode := luaOptString(ls, 2, "r")
+	p := newFile(ls)
+	ls.ArgCheck(checkMode(mode), 2, "invalid mode")
+	f, err := openFile(ls, filename, mode)
+	if err != nil {
+		return luaFileResult(ls, err, filename)
+	}
+	p.initFile(f)
+	return 1
+}
+
+// io.popen (prog [, mode])
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.popen
+// lua-5.3.4/src/liolib.c#io_popen()
+func ioPOpen(ls *LuaState) int {
+	filename := ls.CheckString(1)
+	mode := luaOptString(ls, 2, "r")
+	p := newPreFile(ls)
+	ls.ArgCheck(mode == "r" || mode == "w", 2, "invalid mode")
+	f, err := ls.popen(filename, mode)
+	if err != nil {
+		return luaFileResult(ls, err, filename)
+	}
+	p.initFile(f)
+	p.closef = ioPClose
+	runtime.SetFinalizer(p, (*luaStream).finalize)
+	return 1
+}
+
+// lua-5.3.4/src/liolib.c#io_pclose()
+func ioPClose(ls *LuaState) int {
+	p := toLStream(ls)
+	p.close()
+	return luaExecResult(ls, p.f.(*pipeFile).stat)
+}
+
+// io.read (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.read
+// lua-5.3.4/src/liolib.c#io_read()
+func ioRead(ls *LuaState) int {
+	return gRead(ls, getIOFile(ls, IO_INPUT), 1)
+}
+
+// io.tmpfile ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.tmpfile
+// lua-5.3.4/src/liolib.c#io_tmpfile()
+func ioTmpFile(ls *LuaState) int {
+	p := newFile(ls)
+	f, err := ls.tmpFile()
+	if err != nil {
+		return luaFileResult(ls, err, "")
+	}
+	p.initFile(f)
+	return 1
+}
+
+// io.type (obj)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.type
+// lua-5.3.4/src/liolib.c#io_type()
+func ioType(ls *LuaState) int {
+	ls.CheckAny(1)
+	if u := luaTestUData(ls, 1, LUA_FILEHANDLE); u == nil {
+		ls.Push(LuaNil) /* not a file */
+	} else if u.Value.(*luaStream).isClosed() {
+		ls.Push(LuaString("closed file"))
+	} else {
+		ls.Push(LuaString("file"))
+	}
+	return 1
+}
+
+// io.write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-io.write
+// lua-5.3.4/src/liolib.c#io_write()
+func ioWrite(ls *LuaState) int {
+	return gWrite(ls, getIOFile(ls, IO_OUTPUT), 1)
+}
+
+// file:close ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:close
+// lua-5.3.4/src/liolib.c#f_close()
+func fClose(ls *LuaState) int {
+	toFile(ls) /* make sure argument is an open stream */
+	return auxClose(ls)
+}
+
+// file:flush ()
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:flush
+// lua-5.3.4/src/liolib.c#f_flush()
+func fFlush(ls *LuaState) int {
+	return luaFileResult(ls, toFile(ls).flush(), "")
+}
+
+// file:lines (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:lines
+// lua-5.3.4/src/liolib.c#f_lines()
+func fLines(ls *LuaState) int {
+	toFile(ls) /* check that it's a valid file handle */
+	auxLines(ls, false)
+	return 1
+}
+
+// file:read (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:read
+// lua-5.3.4/src/liolib.c#f_read()
+func fRead(ls *LuaState) int {
+	return gRead(ls, toFile(ls), 2)
+}
+
+// file:seek ([whence [, offset]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:seek
+// lua-5.3.4/src/liolib.c#f_seek()
+func fSeek(ls *LuaState) int {
+	mode := []int{io.SeekStart, io.SeekCurrent, io.SeekEnd}
+	p := toFile(ls)
+	op := luaCheckOption(ls, 2, "cur", []string{"set", "cur", "end"})
+	offset := luaOptInteger(ls, 3, 0)
+	pos, err := p.seek(offset, mode[op])
+	if err != nil {
+		return luaFileResult(ls, err, "") /* error */
+	}
+	ls.Push(LuaNumber(pos))
+	return 1
+}
+
+// file:setvbuf (mode [, size])
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:setvbuf
+// lua-5.3.4/src/liolib.c#f_setvbuf()
+func fSetVBuf(ls *LuaState) int {
+	mode := []int{_IONBF, _IOFBF, _IOLBF}
+	p := toFile(ls)
+	op := luaCheckOption(ls, 2, "", []string{"no", "full", "line"})
+	sz := luaOptInteger(ls, 3, LUAL_BUFFERSIZE)
+	ls.ArgCheck(sz > 0 && sz <= 1<<30, 3, "invalid buffer size")
+	return luaFileResult(ls, p.setvbuf(mode[op], int(sz)), "")
+}
+
+// file:write (···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-file:write
+// lua-5.3.4/src/liolib.c#f_write()
+func fWrite(ls *LuaState) int {
+	p := toFile(ls)
+	luaPushValue(ls, 1) /* push file at the stack top (to be returned) */
+	return gWrite(ls, p, 2)
+}
+
+// lua-5.3.4/src/liolib.c#f_gc()
+func fGC(ls *LuaState) int {
+	p := toLStream(ls)
+	if !p.isClosed() && p.f != nil {
+		auxClose(ls) /* ignore closed and incompletely open files */
+	}
+	return 0
+}
+
+// lua-5.3.4/src/liolib.c#f_tostring()
+func fToString(ls *LuaState) int {
+	p := toLStream(ls)
+	if p.isClosed() {
+		ls.Push(LuaString("file (closed)"))
+	} else {
+		luaPushFString(ls, "file (%p)", p)
+	}
+	return 1
+}
+
+// lua-5.3.4/src/liolib.c#aux_lines()
+func auxLines(ls *LuaState, toClose bool) {
+	n := luaGetTop(ls) - 1 /* number of arguments to read */
+	ls.ArgCheck(n <= MAXARGLINE, MAXARGLINE+2, "too many arguments")
+	ls.Push(LuaNumber(n))     /* number of arguments to read */
+	ls.Push(LuaBool(toClose)) /* close/not close file when finished */
+	luaRotate(ls, 2, 2)       /* move 'n' and 'toClose' to their positions */
+	ls.PushGoClosure(ioReadLine, 3+n)
+}
+
+// Iteration function for 'lines'.
+// lua-5.3.4/src/liolib.c#io_readline()
+func ioReadLine(ls *LuaState) int {
+	p := ls.stack.get(luaUpvalueIndex(1)).(*LuaUserData).Value.(*luaStream)
+	n := int(luaToInteger(ls, luaUpvalueIndex(2)))
+	if p.isClosed() { /* file is already closed? */
+		return ls.Error2("file is already closed")
+	}
+	luaSetTop(ls, 1)
+	luaCheckStack2(ls, n, "too many arguments")
+	for i := 1; i <= n; i++ { /* push arguments to 'gRead' */
+		luaPushValue(ls, luaUpvalueIndex(3+i))
+	}
+	n = gRead(ls, p, 2)       /* 'n' is number of results */
+	if luaToBoolean(ls, -n) { /* read at least one value? */
+		return n /* return them */
+	}
+	/* first result is nil: EOF or error */
+	if n > 1 { /* is there error information? */
+		/* 2nd result is error message */
+		return ls.Error2("%s", luaToString(ls, -n+1))
+	}
+	if luaToBoolean(ls, luaUpvalueIndex(3)) { /* generate error? */
+		luaSetTop(ls, 0)
+		luaPushValue(ls, luaUpvalueIndex(1))
+		auxClose(ls) /* close it */
+	}
+	return 0
+}
+
+/*
+** {======================================================
+** READ
+** =======================================================
+ */
+
+// auxiliary structure used by 'readNumber'
+// lua-5.3.4/src/liolib.c#RN
+type rn struct {
+	r    *bufio.Reader
+	c    int    /* current character (look ahead), -1 at EOF */
+	buff []byte /* numeral being read */
+	over bool   /* numeral too long */
+}
+
+func (rn *rn) getc() {
+	if b, err := rn.r.ReadByte(); err == nil {
+		rn.c = int(b)
+	} else {
+		rn.c = -1
+	}
+}
+
+// Add current char to buffer (if not out of space) and read next one
+// lua-5.3.4/src/liolib.c#nextc()
+func (rn *rn) nextc() bool {
+	if len(rn.buff) >= L_MAXLENNUM { /* buffer overflow? */
+		rn.over = true /* invalidate result */
+		return false   /* fail */
+	}
+	rn.buff = append(rn.buff, byte(rn.c)) /* save current char */
+	rn.getc()                             /* read next one */
+	return true
+}
+
+// Accept current char if it is in 'set' (of size 2)
+// lua-5.3.4/src/liolib.c#test2()
+func (rn *rn) test2(set string) bool {
+	if rn.c == int(set[0]) || rn.c == int(set[1]) {
+		return rn.nextc()
+	}
+	return false
+}
+
+// Read a sequence of (hex)digits
+// lua-5.3.4/src/liolib.c#readdigits()
+func (rn *rn) readDigits(hex bool) int {
+	count := 0
+	for (hex && isxdigit(rn.c) || !hex && isdigit(rn.c)) && rn.nextc() {
+		count++
+	}
+	return count
+}
+
+func isdigit(c int) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isxdigit(c int) bool {
+	return isdigit(c) || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isspace(c int) bool {
+	return c == ' ' || c >= '\t' && c <= '\r'
+}
+
+// Read a number: first reads a valid prefix of a numeral into a buffer.
+// Then it calls 'luaStringToNumber' to check whether the format is
+// correct and to convert it to a Lua number
+// lua-5.3.4/src/liolib.c#read_number()
+func readNumber(ls *LuaState, p *luaStream) bool {
+	rn := &rn{r: p.reader()}
+	count := 0
+	hex := false
+	for rn.getc(); isspace(rn.c); rn.getc() { /* skip spaces */
+	}
+	rn.test2("-+") /* optional signal */
+	if rn.test2("00") {
+		if rn.test2("xX") {
+			hex = true /* numeral is hexadecimal */
+		} else {
+			count = 1 /* count initial '0' as a valid digit */
+		}
+	}
+	count += rn.readDigits(hex) /* integral part */
+	if rn.test2("..") {         /* decimal point? */
+		count += rn.readDigits(hex) /* fractional part */
+	}
+	exp := "eE"
+	if hex {
+		exp = "pP"
+	}
+	if count > 0 && rn.test2(exp) { /* exponent mark? */
+		rn.test2("-+")       /* exponent signal */
+		rn.readDigits(false) /* exponent digits */
+	}
+	if rn.c != -1 {
+		rn.r.UnreadByte() /* unread look-ahead char */
+	}
+	if !rn.over && luaStringToNumber(ls, string(rn.buff)) {
+		return true /* ok */
+	}
+	/* invalid format */
+	ls.Push(LuaNil) /* "result" to be removed */
+	return false    /* read fails */
+}
+
+// lua-5.3.4/src/liolib.c#test_eof()
+func testEOF(ls *LuaState, p *luaStream) bool {
+	_, err := p.reader().Peek(1)
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	ls.Push(LuaString(""))
+	return err == nil
+}
+
+// lua-5.3.4/src/liolib.c#read_line()
+func readLine(ls *LuaState, p *luaStream, chop bool) bool {
+	line, err := p.reader().ReadString('\n')
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	ok := len(line) > 0 /* read at least a newline or a char? */
+	if chop && strings.HasSuffix(line, "\n") {
+		line = line[:len(line)-1] /* remove newline */
+	}
+	ls.Push(LuaString(line))
+	return ok
+}
+
+// lua-5.3.4/src/liolib.c#read_all()
+func readAll(ls *LuaState, p *luaStream) {
+	data, err := ioutil.ReadAll(p.reader())
+	if err != nil {
+		p.err = err
+	}
+	ls.Push(LuaString(data))
+}
+
+// lua-5.3.4/src/liolib.c#read_chars()
+func readChars(ls *LuaState, p *luaStream, n int64) bool {
+	var b strings.Builder
+	nr, err := io.CopyN(&b, p.reader(), n) /* try to read 'n' chars */
+	if err != nil && err != io.EOF {
+		p.err = err
+	}
+	ls.Push(LuaString(b.String()))
+	return nr > 0 /* true iff read something */
+}
+
+// lua-5.3.4/src/liolib.c#g_read()
+func gRead(ls *LuaState, p *luaStream, first int) int {
+	nargs := luaGetTop(ls) - 1
+	success := true
+	n := first
+	p.err = nil     /* clearerr */
+	if nargs == 0 { /* no arguments? */
+		success = readLine(ls, p, true)
+		n = first + 1 /* to return 1 result */
+	} else { /* ensure stack space for all results and for auxlib's buffer */
+		luaCheckStack2(ls, nargs+LUA_MINSTACK, "too many arguments")
+		for n = first; nargs > 0 && success; n, nargs = n+1, nargs-1 {
+			if luaType(ls, n) == LUA_TNUMBER {
+				l := ls.CheckInteger(n)
+				if l == 0 {
+					success = testEOF(ls, p)
+				} else {
+					success = readChars(ls, p, l)
+				}
+			} else {
+				format := ls.CheckString(n)
+				format = strings.TrimPrefix(format, "*") /* skip optional '*' (for compatibility) */
+				if format == "" {
+					return ls.ArgError(n, "invalid format")
+				}
+				switch format[0] {
+				case 'n': /* number */
+					success = readNumber(ls, p)
+				case 'l': /* line */
+					success = readLine(ls, p, true)
+				case 'L': /* line with end-of-line */
+					success = readLine(ls, p, false)
+				case 'a': /* file */
+					readAll(ls, p) /* read entire file */
+					success = true /* always success */
+				default:
+					return ls.ArgError(n, "invalid format")
+				}
+			}
+		}
+	}
+	if p.err != nil {
+		return luaFileResult(ls, p.err, "")
+	}
+	if !success {
+		luaPop(ls, 1)   /* remove last result */
+		ls.Push(LuaNil) /* push nil instead */
+	}
+	return n - first
+}
+
+/* }====================================================== */
+
+// lua-5.3.4/src/liolib.c#g_write()
+func gWrite(ls *LuaState, p *luaStream, arg int) int {
+	nargs := luaGetTop(ls) - arg
+	var err error
+	for ; nargs > 0; arg, nargs = arg+1, nargs-1 {
+		var s string
+		if luaType(ls, arg) == LUA_TNUMBER {
+			/* optimization: could be done exactly as for strings */
+			if luaIsInteger(ls, arg) {
+				s = fmt.Sprintf("%d", luaToInteger(ls, arg))
+			} else {
+				s = fmt.Sprintf("%.14g", luaToNumber(ls, arg))
+			}
+		} else {
+			s = ls.CheckString(arg)
+		}
+		if err == nil {
+			err = p.write(s)
+		}
+	}
+	if err == nil {
+		return 1 /* file handle already on stack top */
+	}
+	return luaFileResult(ls, err, "")
+}
@@ -0,0 +1,844 @@
+package golua
+
+import (
+	"bytes"
+	"fmt"
+	"golua/number"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+/*
+** The json library follows the API of lua-cjson 2.1: json.encode,
+** json.decode, json.null, json.new and the encode_* / decode_* settings,
+** plus the empty-array markers of the OpenResty fork. It is not opened by
+** OpenLibs, a host that wants it opens it next to the others:
+**
+**	ls.OpenLibs()
+**	ls.RequireF("json", golua.OpenJSONLib, true)
+**	ls.Pop(1)
+ */
+
+// JSONNull is json.null, the value of JSON null inside decoded arrays and
+// objects; json.encode writes it as null.
+var JSONNull = &LuaUserData{Value: "json.null"}
+
+// jsonEmptyArray is json.empty_array, which json.encode writes as [].
+var jsonEmptyArray = &LuaUserData{Value: "json.empty_array"}
+
+const (
+	_JSON_DEFAULT_SPARSE_CONVERT = false
+	_JSON_DEFAULT_SPARSE_RATIO   = 2
+	_JSON_DEFAULT_SPARSE_SAFE    = 10
+	_JSON_DEFAULT_MAX_DEPTH      = 1000
+	_JSON_DEFAULT_PRECISION      = 14
+)
+
+/* encode_invalid_numbers settings */
+const (
+	_JSON_INVALID_OFF = iota
+	_JSON_INVALID_ON
+	_JSON_INVALID_NULL
+)
+
+// the settings of one json module, changed by its encode_* and decode_*
+// functions
+type jsonConfig struct {
+	sparseConvert      bool
+	sparseRatio        int
+	sparseSafe         int
+	encodeMaxDepth     int
+	decodeMaxDepth     int
+	precision          int  // significant digits of non-integral numbers
+	integers           bool // write integral numbers in full
+	encodeInvalid      int
+	decodeInvalid      bool
+	emptyTableAsObject bool
+	escapeSlash        bool
+	sortKeys           bool
+	indent             string // "": compact output
+	keepBuffer         bool   // accepted for compatibility only
+	arrayWithArrayMT   bool
+	arrayMT            *LuaTable // tables with it are always arrays
+	objectMT           *LuaTable // tables with it are always objects
+}
+
+func newJSONConfig(arrayMT, objectMT *LuaTable) *jsonConfig {
+	return &jsonConfig{
+		sparseConvert:      _JSON_DEFAULT_SPARSE_CONVERT,
+		sparseRatio:        _JSON_DEFAULT_SPARSE_RATIO,
+		sparseSafe:         _JSON_DEFAULT_SPARSE_SAFE,
+		encodeMaxDepth:     _JSON_DEFAULT_MAX_DEPTH,
+		decodeMaxDepth:     _JSON_DEFAULT_MAX_DEPTH,
+		precision:          _JSON_DEFAULT_PRECISION,
+		integers:           true,
+		encodeInvalid:      _JSON_INVALID_OFF,
+		decodeInvalid:      true,
+		emptyTableAsObject: true,
+		escapeSlash:        true,
+		keepBuffer:         true,
+		arrayMT:            arrayMT,
+		objectMT:           objectMT,
+	}
+}
+
+// OpenJSONLib opens the json library, see the top of lib_json.go.
+func OpenJSONLib(ls *LuaState) int {
+	pushJSONModule(ls, newJSONConfig(newLuaTable(0, 0), newLuaTable(0, 0)))
+	return 1
+}
+
+// pushes a module table whose functions share cfg
+// lua-cjson-2.1.0/lua_cjson.c#lua_cjson_new()
+func pushJSONModule(ls *LuaState, cfg *jsonConfig) {
+	ls.NewLib(FuncReg{
+		"encode": func(ls *LuaState) int { return jsonEncode(ls, cfg) },
+		"decode": func(ls *LuaState) int { return jsonDecode(ls, cfg) },
+		"encode_sparse_array": func(ls *LuaState) int {
+			jsonArgInit(ls, 3)
+			jsonBoolOption(ls, 1, &cfg.sparseConvert)
+			jsonIntegerOption(ls, 2, &cfg.sparseRatio, 0, math.MaxInt32)
+			jsonIntegerOption(ls, 3, &cfg.sparseSafe, 0, math.MaxInt32)
+			return 3
+		},
+		"encode_max_depth": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonIntegerOption(ls, 1, &cfg.encodeMaxDepth, 1, math.MaxInt32)
+		},
+		"decode_max_depth": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonIntegerOption(ls, 1, &cfg.decodeMaxDepth, 1, math.MaxInt32)
+		},
+		"encode_number_precision": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonIntegerOption(ls, 1, &cfg.precision, 1, 16)
+		},
+		"encode_integers": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.integers)
+		},
+		"encode_keep_buffer": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.keepBuffer)
+		},
+		"encode_invalid_numbers": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonEnumOption(ls, 1, &cfg.encodeInvalid, []string{"off", "on", "null"})
+		},
+		"decode_invalid_numbers": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.decodeInvalid)
+		},
+		"encode_empty_table_as_object": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.emptyTableAsObject)
+		},
+		"encode_escape_forward_slash": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.escapeSlash)
+		},
+		"encode_sort_keys": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.sortKeys)
+		},
+		"encode_indent": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			if !luaIsNoneOrNil(ls, 1) {
+				cfg.indent = ls.CheckString(1)
+			}
+			ls.Push(LuaString(cfg.indent))
+			return 1
+		},
+		"decode_array_with_array_mt": func(ls *LuaState) int {
+			jsonArgInit(ls, 1)
+			return jsonBoolOption(ls, 1, &cfg.arrayWithArrayMT)
+		},
+		"new": func(ls *LuaState) int {
+			pushJSONModule(ls, newJSONConfig(cfg.arrayMT, cfg.objectMT))
+			return 1
+		},
+	})
+	ls.Push(JSONNull)
+	luaSetField(ls, -2, "null")
+	ls.Push(jsonEmptyArray)
+	luaSetField(ls, -2, "empty_array")
+	ls.Push(cfg.arrayMT)
+	luaSetField(ls, -2, "array_mt")
+	ls.Push(cfg.objectMT)
+	luaSetField(ls, -2, "object_mt")
+	ls.Push(LuaString("json"))
+	luaSetField(ls, -2, "_NAME")
+	ls.Push(LuaString("2.1.0"))
+	luaSetField(ls, -2, "_VERSION")
+}
+
+/* settings */
+
+// checks the number of arguments and fills the missing ones with nil, so
+// that results pushed by the options come after them
+// lua-cjson-2.1.0/lua_cjson.c#json_arg_init()
+func jsonArgInit(ls *LuaState, args int) {
+	ls.ArgCheck(luaGetTop(ls) <= args, args+1, "found too many arguments")
+	for luaGetTop(ls) < args {
+		ls.Push(LuaNil)
+	}
+}
+
+// sets *setting from an integer argument in [min, max], if given, and
+// pushes the setting
+// lua-cjson-2.1.0/lua_cjson.c#json_integer_option()
+func jsonIntegerOption(ls *LuaState, arg int, setting *int, min, max int) int {
+	if !luaIsNoneOrNil(ls, arg) {
+		value := ls.CheckInteger(arg)
+		if value < int64(min) || value > int64(max) {
+			ls.Error2("bad argument #%d (%d out of range %d-%d)", arg, value, min, max)
+		}
+		*setting = int(value)
+	}
+	ls.Push(LuaNumber(*setting))
+	return 1
+}
+
+// sets *setting from a boolean or one of options, if given, and pushes the
+// setting; true stands for options[1]
+// lua-cjson-2.1.0/lua_cjson.c#json_enum_option()
+func jsonEnumOption(ls *LuaState, arg int, setting *int, options []string) int {
+	if !luaIsNoneOrNil(ls, arg) {
+		if luaIsBoolean(ls, arg) {
+			*setting = 0
+			if luaToBoolean(ls, arg) {
+				*setting = 1
+			}
+		} else {
+			*setting = luaCheckOption(ls, arg, "", options)
+		}
+	}
+	if *setting <= 1 {
+		ls.Push(LuaBool(*setting == 1))
+	} else {
+		ls.Push(LuaString(options[*setting]))
+	}
+	return 1
+}
+
+// jsonEnumOption for on/off settings
+func jsonBoolOption(ls *LuaState, arg int, setting *bool) int {
+	i := 0
+	if *setting {
+		i = 1
+	}
+	jsonEnumOption(ls, arg, &i, []string{"off", "on"})
+	*setting = i == 1
+	return 1
+}
+
+/* encoding */
+
+type jsonEncoder struct {
+	ls      *LuaState
+	cfg     *jsonConfig
+	b       bytes.Buffer
+	visited map[*LuaTable]bool // tables being encoded
+}
+
+// json.encode (value)
+// lua-cjson-2.1.0/lua_cjson.c#json_encode()
+func jsonEncode(ls *LuaState, cfg *jsonConfig) int {
+	ls.ArgCheck(luaGetTop(ls) == 1, 1, "expected 1 argument")
+	e := &jsonEncoder{ls: ls, cfg: cfg, visited: map[*LuaTable]bool{}}
+	e.encode(valueOf(ls.CheckAny(1)), 0)
+	ls.Push(LuaString(e.b.String()))
+	return 1
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_encode_exception()
+func (e *jsonEncoder) error(v value, reason string) {
+	e.ls.Error2("Cannot serialise %s: %s", v.valueType().String(), reason)
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_append_data()
+func (e *jsonEncoder) encode(v value, depth int) {
+	switch x := v.o.(type) {
+	case nil:
+		e.b.WriteString("null")
+	case LuaBool:
+		if x {
+			e.b.WriteString("true")
+		} else {
+			e.b.WriteString("false")
+		}
+	case *numberTag:
+		e.encodeNumber(v)
+	case LuaString:
+		e.encodeString(string(x))
+	case *LuaTable:
+		e.encodeTable(x, v, depth+1)
+	case *LuaUserData:
+		switch x {
+		case JSONNull:
+			e.b.WriteString("null")
+		case jsonEmptyArray:
+			e.b.WriteString("[]")
+		default:
+			e.error(v, "type not supported")
+		}
+	default:
+		e.error(v, "type not supported")
+	}
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_append_number()
+func (e *jsonEncoder) encodeNumber(v value) {
+	n := v.n
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		switch e.cfg.encodeInvalid {
+		case _JSON_INVALID_OFF:
+			e.error(v, "must not be NaN or Infinity")
+		case _JSON_INVALID_NULL:
+			e.b.WriteString("null")
+			return
+		}
+		/* write what strtod() reads back */
+		if math.IsNaN(n) {
+			e.b.WriteString("nan")
+		} else if n > 0 {
+			e.b.WriteString("inf")
+		} else {
+			e.b.WriteString("-inf")
+		}
+		return
+	}
+	if e.cfg.integers {
+		if i, ok := number.FloatToInteger(n); ok {
+			e.b.WriteString(strconv.FormatInt(i, 10))
+			return
+		}
+	}
+	e.b.WriteString(strconv.FormatFloat(n, 'g', e.cfg.precision, 64))
+}
+
+var jsonCharEscape = func() [256]string {
+	var esc [256]string
+	for c := 0; c < 0x20; c++ {
+		esc[c] = fmt.Sprintf("\\u%04x", c)
+	}
+	esc['\b'], esc['\f'], esc['\n'], esc['\r'], esc['\t'] = "\\b", "\\f", "\\n", "\\r", "\\t"
+	esc['"'], esc['\\'], esc[0x7f] = "\\\"", "\\\\", "\\u007f"
+	return esc
+}()
+
+// lua-cjson-2.1.0/lua_cjson.c#json_append_string()
+func (e *jsonEncoder) encodeString(s string) {
+	e.b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if esc := jsonCharEscape[c]; esc != "" {
+			e.b.WriteString(esc)
+		} else if c == '/' && e.cfg.escapeSlash {
+			e.b.WriteString("\\/")
+		} else {
+			e.b.WriteByte(c)
+		}
+	}
+	e.b.WriteByte('"')
+}
+
+// writes a newline and the indentation of depth when pretty printing
+func (e *jsonEncoder) newline(depth int) {
+	if e.cfg.indent != "" {
+		e.b.WriteByte('\n')
+		for i := 0; i < depth; i++ {
+			e.b.WriteString(e.cfg.indent)
+		}
+	}
+}
+
+func (e *jsonEncoder) encodeTable(tb *LuaTable, v value, depth int) {
+	if depth > e.cfg.encodeMaxDepth {
+		e.ls.Error2("Cannot serialise, excessive nesting (%d)", depth)
+	}
+	if e.visited[tb] {
+		e.error(v, "reference cycle")
+	}
+	e.visited[tb] = true
+	defer delete(e.visited, tb)
+
+	var n int
+	switch tb.metatable {
+	case nil:
+		n = e.arrayLength(tb, v)
+	case e.cfg.arrayMT:
+		n = tb.Len()
+	case e.cfg.objectMT:
+		n = -1
+	default:
+		n = e.arrayLength(tb, v)
+	}
+	if n == 0 && tb.metatable != e.cfg.arrayMT && e.cfg.emptyTableAsObject {
+		n = -1 /* empty tables are objects unless marked */
+	}
+	if n >= 0 {
+		e.encodeArray(tb, n, depth)
+	} else {
+		e.encodeObject(tb, v, depth)
+	}
+}
+
+// returns the length of tb if it is an array, or -1. Tables with integer
+// keys only are arrays, the array part makes this quick for the common
+// ones; excessively sparse arrays are objects or errors
+// lua-cjson-2.1.0/lua_cjson.c#lua_array_length()
+func (e *jsonEncoder) arrayLength(tb *LuaTable, v value) int {
+	max, items := 0, 0
+	for i, x := range tb.arr {
+		if !x.isNil() {
+			max = i + 1
+			items++
+		}
+	}
+	for _, node := range tb.node {
+		if node.key.isNil() || node.val.isNil() {
+			continue
+		}
+		if !node.key.isNumber() {
+			return -1 /* not an array */
+		}
+		k, ok := number.FloatToInteger(node.key.n)
+		if !ok || k < 1 || k > math.MaxInt32 {
+			return -1
+		}
+		if int(k) > max {
+			max = int(k)
+		}
+		items++
+	}
+	/* encode excessively sparse arrays as objects (if enabled) */
+	if e.cfg.sparseRatio > 0 && max > items*e.cfg.sparseRatio && max > e.cfg.sparseSafe {
+		if !e.cfg.sparseConvert {
+			e.error(v, "excessively sparse array")
+		}
+		return -1
+	}
+	return max
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_append_array()
+func (e *jsonEncoder) encodeArray(tb *LuaTable, n int, depth int) {
+	if n == 0 {
+		e.b.WriteString("[]")
+		return
+	}
+	e.b.WriteByte('[')
+	for i := 1; i <= n; i++ {
+		if i > 1 {
+			e.b.WriteByte(',')
+		}
+		e.newline(depth)
+		e.encode(tb.getNum(float64(i)), depth)
+	}
+	e.newline(depth - 1)
+	e.b.WriteByte(']')
+}
+
+type jsonField struct {
+	key string
+	val value
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_append_object()
+func (e *jsonEncoder) encodeObject(tb *LuaTable, v value, depth int) {
+	var fields []jsonField
+	for k, x, _ := tb.nextKey(nilValue); !k.isNil(); k, x, _ = tb.nextKey(k) {
+		var key string
+		switch kk := k.o.(type) {
+		case LuaString:
+			key = string(kk)
+		case *numberTag:
+			var ke jsonEncoder
+			ke.ls, ke.cfg = e.ls, e.cfg
+			ke.encodeNumber(k)
+			key = ke.b.String()
+		default:
+			e.error(k, "table key must be a number or string")
+		}
+		fields = append(fields, jsonField{key, x})
+	}
+	if len(fields) == 0 {
+		e.b.WriteString("{}")
+		return
+	}
+	if e.cfg.sortKeys {
+		sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	}
+	e.b.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			e.b.WriteByte(',')
+		}
+		e.newline(depth)
+		e.encodeString(f.key)
+		e.b.WriteByte(':')
+		if e.cfg.indent != "" {
+			e.b.WriteByte(' ')
+		}
+		e.encode(f.val, depth)
+	}
+	e.newline(depth - 1)
+	e.b.WriteByte('}')
+}
+
+/* decoding */
+
+const (
+	_JSON_T_OBJ_BEGIN = iota
+	_JSON_T_OBJ_END
+	_JSON_T_ARR_BEGIN
+	_JSON_T_ARR_END
+	_JSON_T_STRING
+	_JSON_T_NUMBER
+	_JSON_T_BOOLEAN
+	_JSON_T_NULL
+	_JSON_T_COLON
+	_JSON_T_COMMA
+	_JSON_T_END
+	_JSON_T_ERROR
+)
+
+var jsonTokenNames = [...]string{
+	"T_OBJ_BEGIN", "T_OBJ_END", "T_ARR_BEGIN", "T_ARR_END", "T_STRING",
+	"T_NUMBER", "T_BOOLEAN", "T_NULL", "T_COLON", "T_COMMA", "T_END",
+	"T_ERROR",
+}
+
+type jsonToken struct {
+	typ   int
+	index int    // position of the token in the input, from 0
+	str   string // T_STRING: the string; T_ERROR: the message
+	num   float64
+	bool  bool
+}
+
+type jsonDecoder struct {
+	ls    *LuaState
+	cfg   *jsonConfig
+	data  string
+	pos   int
+	depth int
+}
+
+// json.decode (string)
+// lua-cjson-2.1.0/lua_cjson.c#json_decode()
+func jsonDecode(ls *LuaState, cfg *jsonConfig) int {
+	ls.ArgCheck(luaGetTop(ls) == 1, 1, "expected 1 argument")
+	d := &jsonDecoder{ls: ls, cfg: cfg, data: ls.CheckString(1)}
+	v := d.value(d.next())
+	/* ensure there is no more input left */
+	if tok := d.next(); tok.typ != _JSON_T_END {
+		d.error("the end", tok)
+	}
+	ls.Push(v.luaValue())
+	return 1
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_throw_parse_error()
+func (d *jsonDecoder) error(exp string, tok jsonToken) {
+	found := jsonTokenNames[tok.typ]
+	if tok.typ == _JSON_T_ERROR {
+		found = tok.str
+	}
+	d.ls.Error2("Expected %s but found %s at character %d", exp, found, tok.index+1)
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_decode_descend()
+func (d *jsonDecoder) descend(tok jsonToken) {
+	d.depth++
+	if d.depth > d.cfg.decodeMaxDepth {
+		d.ls.Error2("Found too many nested data structures (%d) at character %d",
+			d.depth, tok.index+1)
+	}
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_process_value()
+func (d *jsonDecoder) value(tok jsonToken) value {
+	switch tok.typ {
+	case _JSON_T_STRING:
+		return value{o: LuaString(tok.str)}
+	case _JSON_T_NUMBER:
+		return numberValue(tok.num)
+	case _JSON_T_BOOLEAN:
+		return boolValue(tok.bool)
+	case _JSON_T_NULL:
+		return value{o: JSONNull}
+	case _JSON_T_OBJ_BEGIN:
+		return d.object(tok)
+	case _JSON_T_ARR_BEGIN:
+		return d.array(tok)
+	}
+	d.error("value", tok)
+	return nilValue
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_parse_object_context()
+func (d *jsonDecoder) object(tok jsonToken) value {
+	d.descend(tok)
+	tb := newLuaTable(0, 0)
+	tok = d.next()
+	if tok.typ == _JSON_T_OBJ_END { /* handle empty objects */
+		d.depth--
+		return value{o: tb}
+	}
+	for {
+		if tok.typ != _JSON_T_STRING {
+			d.error("object key string", tok)
+		}
+		key := tok.str
+		if tok = d.next(); tok.typ != _JSON_T_COLON {
+			d.error("colon", tok)
+		}
+		tb.set(value{o: LuaString(key)}, d.value(d.next()))
+		tok = d.next()
+		if tok.typ == _JSON_T_OBJ_END {
+			d.depth--
+			return value{o: tb}
+		}
+		if tok.typ != _JSON_T_COMMA {
+			d.error("comma or object end", tok)
+		}
+		tok = d.next()
+	}
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_parse_array_context()
+func (d *jsonDecoder) array(tok jsonToken) value {
+	d.descend(tok)
+	tb := newLuaTable(0, 0)
+	if d.cfg.arrayWithArrayMT {
+		tb.metatable = d.cfg.arrayMT
+	}
+	tok = d.next()
+	if tok.typ == _JSON_T_ARR_END { /* handle empty arrays */
+		d.depth--
+		return value{o: tb}
+	}
+	for i := 1; ; i++ {
+		tb.set(numberValue(float64(i)), d.value(tok))
+		tok = d.next()
+		if tok.typ == _JSON_T_ARR_END {
+			d.depth--
+			return value{o: tb}
+		}
+		if tok.typ != _JSON_T_COMMA {
+			d.error("comma or array end", tok)
+		}
+		tok = d.next()
+	}
+}
+
+// lua-cjson-2.1.0/lua_cjson.c#json_next_token()
+func (d *jsonDecoder) next() jsonToken {
+	for d.pos < len(d.data) && isJSONSpace(d.data[d.pos]) {
+		d.pos++
+	}
+	tok := jsonToken{index: d.pos}
+	if d.pos == len(d.data) {
+		tok.typ = _JSON_T_END
+		return tok
+	}
+	switch c := d.data[d.pos]; c {
+	case '{':
+		tok.typ = _JSON_T_OBJ_BEGIN
+	case '}':
+		tok.typ = _JSON_T_OBJ_END
+	case '[':
+		tok.typ = _JSON_T_ARR_BEGIN
+	case ']':
+		tok.typ = _JSON_T_ARR_END
+	case ':':
+		tok.typ = _JSON_T_COLON
+	case ',':
+		tok.typ = _JSON_T_COMMA
+	case '"':
+		d.string(&tok)
+		return tok
+	default:
+		switch {
+		case c == '-' || isdigit(int(c)):
+			d.number(&tok)
+		case d.hasPrefix("true"):
+			tok.typ, tok.bool = _JSON_T_BOOLEAN, true
+			d.pos += 3
+		case d.hasPrefix("false"):
+			tok.typ = _JSON_T_BOOLEAN
+			d.pos += 4
+		case d.hasPrefix("null"):
+			tok.typ = _JSON_T_NULL
+			d.pos += 3
+		case d.cfg.decodeInvalid && (d.hasPrefix("inf") || d.hasPrefix("nan")):
+			d.number(&tok)
+		default:
+			tok.typ, tok.str = _JSON_T_ERROR, "invalid token"
+		}
+		if tok.typ == _JSON_T_ERROR {
+			return tok
+		}
+	}
+	d.pos++
+	return tok
+}
+
+func (d *jsonDecoder) hasPrefix(s string) bool {
+	return len(d.data)-d.pos >= len(s) && d.data[d.pos:d.pos+len(s)] == s
+}
+
+func isJSONSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// scans a number, leaving pos on its last character; JSON numbers only
+// unless decode_invalid_numbers allows what strtod() reads, as cjson does
+// lua-cjson-2.1.0/lua_cjson.c#json_next_number_token()
+func (d *jsonDecoder) number(tok *jsonToken) {
+	start := d.pos
+	end := start
+	for end < len(d.data) && (isalnum(int(d.data[end])) ||
+		d.data[end] == '.' || d.data[end] == '-' || d.data[end] == '+') {
+		end++
+	}
+	s := d.data[start:end]
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil && !isRangeError(err) || !d.cfg.decodeInvalid && !isJSONNumber(s) {
+		tok.typ, tok.str = _JSON_T_ERROR, "invalid number"
+		return
+	}
+	tok.typ, tok.num = _JSON_T_NUMBER, n
+	d.pos = end - 1
+}
+
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
+}
+
+// reports whether s is -?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?
+func isJSONNumber(s string) bool {
+	i := 0
+	digits := func() int {
+		j := i
+		for i < len(s) && isdigit(int(s[i])) {
+			i++
+		}
+		return i - j
+	}
+	if i < len(s) && s[i] == '-' {
+		i++
+	}
+	if i < len(s) && s[i] == '0' {
+		i++
+	} else if digits() == 0 {
+		return false
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		if digits() == 0 {
+			return false
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return i == len(s)
+}
+
+var jsonUnescape = [256]byte{
+	'"': '"', '\\': '\\', '/': '/', 'b': '\b', 'f': '\f', 'n': '\n',
+	'r': '\r', 't': '\t',
+}
+
+// scans a string, leaving pos after its closing quote
+// lua-cjson-2.1.0/lua_cjson.c#json_next_string_token()
+func (d *jsonDecoder) string(tok *jsonToken) {
+	var b bytes.Buffer
+	d.pos++ /* skip '"' */
+	for {
+		if d.pos >= len(d.data) {
+			tok.typ, tok.str = _JSON_T_ERROR, "unexpected end of string"
+			return
+		}
+		c := d.data[d.pos]
+		if c == '"' {
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			d.pos++
+			continue
+		}
+		if d.pos+1 >= len(d.data) {
+			tok.typ, tok.str = _JSON_T_ERROR, "unexpected end of string"
+			return
+		}
+		esc := d.data[d.pos+1]
+		if esc == 'u' {
+			r, n := d.unicodeEscape(d.pos)
+			if n < 0 {
+				tok.index = d.pos /* report the escape */
+				tok.typ, tok.str = _JSON_T_ERROR, "invalid unicode escape code"
+				return
+			}
+			var buf [utf8.UTFMax]byte
+			b.Write(buf[:utf8.EncodeRune(buf[:], r)])
+			d.pos += n
+			continue
+		}
+		if jsonUnescape[esc] == 0 {
+			tok.index = d.pos
+			tok.typ, tok.str = _JSON_T_ERROR, "invalid escape code"
+			return
+		}
+		b.WriteByte(jsonUnescape[esc])
+		d.pos += 2
+	}
+	d.pos++ /* skip '"' */
+	tok.typ, tok.str = _JSON_T_STRING, b.String()
+}
+
+// decodes the \uXXXX escape at i, or a surrogate pair of two of them, and
+// returns the rune and the length of the escapes, or -1
+// lua-cjson-2.1.0/lua_cjson.c#json_append_unicode_escape()
+func (d *jsonDecoder) unicodeEscape(i int) (rune, int) {
+	hex := func(i int) (rune, bool) {
+		if i+6 > len(d.data) || d.data[i] != '\\' || d.data[i+1] != 'u' {
+			return 0, false
+		}
+		n, err := strconv.ParseUint(d.data[i+2:i+6], 16, 16)
+		return rune(n), err == nil
+	}
+	r, ok := hex(i)
+	if !ok {
+		return 0, -1
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, 6
+	}
+	if r >= 0xdc00 { /* a lone low surrogate */
+		return 0, -1
+	}
+	r2, ok := hex(i + 6)
+	if !ok {
+		return 0, -1
+	}
+	r = utf16.DecodeRune(r, r2)
+	if r == utf8.RuneError {
+		return 0, -1
+	}
+	return r, 12
+}
@@ -2,7 +2,6 @@ package golua
 
 import (
 	"math"
-	"math/rand"
 	"golua/number"
 )
 
@@ -53,17 +52,22 @@ func OpenMathLib(ls *LuaState) int {
 /* pseudo-random numbers */
 
 // math.random ([m [, n]])
-// http://www.lua.org/manual/5.3/manual.html#pdf-math.random
-// lua-5.3.4/src/lmathlib.c#math_random()
+// http://www.lua.org/manual/5.4/manual.html#pdf-math.random
+// lua-5.4.6/src/lmathlib.c#math_random()
 func mathRandom(ls *LuaState) int {
 	var low, up int64
+	rv := ls.rand.Uint64() /* next pseudo-random value */
 	switch luaGetTop(ls) { /* check number of arguments */
 	case 0: /* no arguments */
-		ls.Push(LuaNumber(rand.Float64())) /* Number between 0 and 1 */
+		ls.Push(LuaNumber(i2d(rv))) /* float between 0 and 1 */
 		return 1
 	case 1: /* only upper limit */
 		low = 1
 		up = ls.CheckInteger(1)
+		if up == 0 { /* single 0 as argument? */
+			ls.Push(LuaNumber(int64(rv))) /* full random integer */
+			return 1
+		}
 	case 2: /* lower and upper limits */
 		low = ls.CheckInteger(1)
 		up = ls.CheckInteger(2)
@@ -73,23 +77,27 @@ func mathRandom(ls *LuaState) int {
 
 	/* random integer in the interval [low, up] */
 	ls.ArgCheck(low <= up, 1, "interval is empty")
-	ls.ArgCheck(low >= 0 || up <= math.MaxInt64+low, 1,
-		"interval too large")
-	if up-low == math.MaxInt64 {
-		ls.Push(LuaNumber(low + rand.Int63()))
-	} else {
-		ls.Push(LuaNumber(low + rand.Int63n(up-low+1)))
-	}
+	/* project random integer into the interval [0, up - low] */
+	p := project(rv, uint64(up)-uint64(low), ls.rand)
+	ls.Push(LuaNumber(int64(p + uint64(low))))
 	return 1
 }
 
-// math.randomseed (x)
-// http://www.lua.org/manual/5.3/manual.html#pdf-math.randomseed
-// lua-5.3.4/src/lmathlib.c#math_randomseed()
+// math.randomseed ([x [, y]])
+// http://www.lua.org/manual/5.4/manual.html#pdf-math.randomseed
+// lua-5.4.6/src/lmathlib.c#math_randomseed()
 func mathRandomSeed(ls *LuaState) int {
-	x := ls.CheckNumber(1)
-	rand.Seed(int64(x))
-	return 0
+	var n1, n2 uint64
+	if luaIsNone(ls, 1) {
+		n1, n2 = randSeed(ls, ls.rand)
+	} else {
+		n1 = uint64(ls.CheckInteger(1))
+		n2 = uint64(luaOptInteger(ls, 2, 0))
+		ls.rand.Seed(n1, n2)
+	}
+	ls.Push(LuaNumber(int64(n1)))
+	ls.Push(LuaNumber(int64(n2)))
+	return 2
 }
 
 /* max & min */
@@ -1,7 +1,11 @@
 package golua
 
 import (
+	"bytes"
+	"fmt"
+	"math"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -48,27 +52,31 @@ func osDiffTime(ls *LuaState) int {
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.time
 // lua-5.3.4/src/loslib.c#os_time()
 func osTime(ls *LuaState) int {
+	var t int64
 	if luaIsNoneOrNil(ls, 1) { /* called without args? */
-		t := time.Now().Unix() /* get current time */
-		ls.Push(LuaNumber(t))
+		t = time.Now().Unix() /* get current time */
 	} else {
 		luaCheckType(ls, 1, LUA_TTABLE)
-		sec := _getField(ls, "sec", 0)
-		min := _getField(ls, "min", 0)
-		hour := _getField(ls, "hour", 12)
-		day := _getField(ls, "day", -1)
-		month := _getField(ls, "month", -1)
-		year := _getField(ls, "year", -1)
-		// todo: isdst
-		t := time.Date(year, time.Month(month), day,
-			hour, min, sec, 0, time.Local).Unix()
-		ls.Push(LuaNumber(t))
+		luaSetTop(ls, 1) /* make sure table is at the top */
+		sec := _getField(ls, "sec", 0, 0)
+		min := _getField(ls, "min", 0, 0)
+		hour := _getField(ls, "hour", 12, 0)
+		day := _getField(ls, "day", -1, 0)
+		month := _getField(ls, "month", -1, 1)
+		year := _getField(ls, "year", -1, 1900)
+		isdst := _getBoolField(ls, "isdst")
+		t = mktime(year+1900, month+1, day, hour, min, sec, isdst)
+		setAllFields(ls, time.Unix(t, 0)) /* update fields with normalized values */
 	}
+	ls.Push(LuaNumber(t))
 	return 1
 }
 
+/* maximum value for date fields (to avoid arithmetic overflows with 'int') */
+const _MAXDATEFIELD = math.MaxInt32 / 2
+
 // lua-5.3.4/src/loslib.c#getfield()
-func _getField(ls *LuaState, key string, dft int64) int {
+func _getField(ls *LuaState, key string, dft, delta int64) int {
 	t := luaGetField(ls, -1, key) /* get field and its type */
 	res, isNum := luaToIntegerX(ls, -1)
 	if !isNum { /* field is not an integer? */
@@ -78,79 +86,238 @@ func _getField(ls *LuaState, key string, dft int64) int {
 			return ls.Error2("field '%s' missing in date table", key)
 		}
 		res = dft
+	} else {
+		if !(-_MAXDATEFIELD <= res && res <= _MAXDATEFIELD) {
+			return ls.Error2("field '%s' is out-of-bound", key)
+		}
+		res -= delta
 	}
 	luaPop(ls, 1)
 	return int(res)
 }
 
+// returns -1 for an absent field, as C leaves 'tm_isdst' undefined
+// lua-5.3.4/src/loslib.c#getboolfield()
+func _getBoolField(ls *LuaState, key string) int {
+	res := -1
+	if luaGetField(ls, -1, key) != LUA_TNIL {
+		res = 0
+		if luaToBoolean(ls, -1) {
+			res = 1
+		}
+	}
+	luaPop(ls, 1)
+	return res
+}
+
+// the local time of the fields, normalized as C's mktime() does: fields
+// out of their ranges carry into the next ones, and a daylight saving
+// flag that does not hold at that time shifts the result by an hour
+func mktime(year, month, day, hour, min, sec, isdst int) int64 {
+	t := time.Date(year, time.Month(month), day, hour, min, sec, 0, time.Local)
+	if isdst > 0 && !t.IsDST() {
+		t = t.Add(-time.Hour)
+	} else if isdst == 0 && t.IsDST() {
+		t = t.Add(time.Hour)
+	}
+	return t.Unix()
+}
+
+// lua-5.3.4/src/loslib.c#l_checktime()
+func _checkTime(ls *LuaState, arg int) time.Time {
+	return time.Unix(ls.CheckInteger(arg), 0)
+}
+
 // os.date ([format [, time]])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.date
 // lua-5.3.4/src/loslib.c#os_date()
 func osDate(ls *LuaState) int {
-	format := luaOptString(ls, 1, "%c")
-	var t time.Time
-	if luaIsInteger(ls, 2) {
-		t = time.Unix(luaToInteger(ls, 2), 0)
-	} else {
-		t = time.Now()
+	s := luaOptString(ls, 1, "%c")
+	t := time.Now()
+	if !luaIsNoneOrNil(ls, 2) {
+		t = _checkTime(ls, 2)
 	}
-
-	if format != "" && format[0] == '!' { /* UTC? */
-		format = format[1:] /* skip '!' */
+	if strings.HasPrefix(s, "!") { /* UTC? */
 		t = t.In(time.UTC)
+		s = s[1:] /* skip '!' */
 	}
-
-	if format == "*t" {
+	if s == "*t" {
 		ls.createTable(0, 9) /* 9 = number of fields */
-		_setField(ls, "sec", t.Second())
-		_setField(ls, "min", t.Minute())
-		_setField(ls, "hour", t.Hour())
-		_setField(ls, "day", t.Day())
-		_setField(ls, "month", int(t.Month()))
-		_setField(ls, "year", t.Year())
-		_setField(ls, "wday", int(t.Weekday())+1)
-		_setField(ls, "yday", t.YearDay())
-	} else if format == "%c" {
-		ls.Push(LuaString(t.Format(time.ANSIC)))
+		setAllFields(ls, t)
 	} else {
-		ls.Push(LuaString(format)) // TODO
+		var b bytes.Buffer
+		for len(s) > 0 {
+			if s[0] != '%' { /* not a conversion specifier? */
+				b.WriteByte(s[0])
+				s = s[1:]
+			} else {
+				var cc string
+				cc, s = checkOption(ls, s[1:]) /* skip '%' */
+				strftime(&b, cc, t)
+			}
+		}
+		ls.Push(LuaString(b.String()))
 	}
-
 	return 1
 }
 
+// lua-5.3.4/src/loslib.c#setallfields()
+func setAllFields(ls *LuaState, t time.Time) {
+	_setField(ls, "sec", t.Second())
+	_setField(ls, "min", t.Minute())
+	_setField(ls, "hour", t.Hour())
+	_setField(ls, "day", t.Day())
+	_setField(ls, "month", int(t.Month()))
+	_setField(ls, "year", t.Year())
+	_setField(ls, "wday", int(t.Weekday())+1)
+	_setField(ls, "yday", t.YearDay())
+	ls.Push(LuaBool(t.IsDST()))
+	luaSetField(ls, -2, "isdst")
+}
+
 func _setField(ls *LuaState, key string, value int) {
 	ls.Push(LuaNumber(value))
 	luaSetField(ls, -2, key)
 }
 
+/* options for ISO C 99 and POSIX, one-char options before two-char ones */
+const _STRFTIMEOPTIONS = "aAbBcCdDeFgGhHIjmMnprRStTuUVwWxXyYzZ%" +
+	"||" + "EcECExEXEyEY" + "OdOeOHOIOmOMOSOuOUOVOwOWOy"
+
+// returns the conversion specifier at the start of conv and the rest of
+// the format
+// lua-5.3.4/src/loslib.c#checkoption()
+func checkOption(ls *LuaState, conv string) (string, string) {
+	option := _STRFTIMEOPTIONS
+	oplen := 1 /* length of options being checked */
+	for len(option) > 0 && oplen <= len(conv) {
+		if option[0] == '|' { /* next block? */
+			oplen++ /* will check options with next length (+1) */
+		} else if conv[:oplen] == option[:oplen] { /* match? */
+			return conv[:oplen], conv[oplen:]
+		}
+		option = option[oplen:]
+	}
+	ls.ArgError(1, fmt.Sprintf("invalid conversion specifier '%%%s'", conv))
+	return "", conv
+}
+
+var _dayNames = [...]string{"Sunday", "Monday", "Tuesday", "Wednesday",
+	"Thursday", "Friday", "Saturday"}
+var _monthNames = [...]string{"January", "February", "March", "April",
+	"May", "June", "July", "August", "September", "October", "November",
+	"December"}
+
+// writes t as the conversion specifier cc (without its '%') does in the
+// "C" locale, where the E and O modifiers change nothing
+func strftime(b *bytes.Buffer, cc string, t time.Time) {
+	if len(cc) == 2 {
+		cc = cc[1:] /* skip modifier */
+	}
+	switch cc[0] {
+	case 'a':
+		b.WriteString(_dayNames[t.Weekday()][:3])
+	case 'A':
+		b.WriteString(_dayNames[t.Weekday()])
+	case 'b', 'h':
+		b.WriteString(_monthNames[t.Month()-1][:3])
+	case 'B':
+		b.WriteString(_monthNames[t.Month()-1])
+	case 'c':
+		fmt.Fprintf(b, "%s %s %2d %02d:%02d:%02d %d",
+			_dayNames[t.Weekday()][:3], _monthNames[t.Month()-1][:3],
+			t.Day(), t.Hour(), t.Minute(), t.Second(), t.Year())
+	case 'C':
+		fmt.Fprintf(b, "%02d", t.Year()/100)
+	case 'd':
+		fmt.Fprintf(b, "%02d", t.Day())
+	case 'D', 'x':
+		fmt.Fprintf(b, "%02d/%02d/%02d", t.Month(), t.Day(), t.Year()%100)
+	case 'e':
+		fmt.Fprintf(b, "%2d", t.Day())
+	case 'F':
+		fmt.Fprintf(b, "%d-%02d-%02d", t.Year(), t.Month(), t.Day())
+	case 'g':
+		year, _ := t.ISOWeek()
+		fmt.Fprintf(b, "%02d", year%100)
+	case 'G':
+		year, _ := t.ISOWeek()
+		fmt.Fprintf(b, "%d", year)
+	case 'H':
+		fmt.Fprintf(b, "%02d", t.Hour())
+	case 'I':
+		fmt.Fprintf(b, "%02d", (t.Hour()+11)%12+1)
+	case 'j':
+		fmt.Fprintf(b, "%03d", t.YearDay())
+	case 'm':
+		fmt.Fprintf(b, "%02d", t.Month())
+	case 'M':
+		fmt.Fprintf(b, "%02d", t.Minute())
+	case 'n':
+		b.WriteByte('\n')
+	case 'p':
+		if t.Hour() < 12 {
+			b.WriteString("AM")
+		} else {
+			b.WriteString("PM")
+		}
+	case 'r':
+		strftime(b, "I", t)
+		fmt.Fprintf(b, ":%02d:%02d ", t.Minute(), t.Second())
+		strftime(b, "p", t)
+	case 'R':
+		fmt.Fprintf(b, "%02d:%02d", t.Hour(), t.Minute())
+	case 'S':
+		fmt.Fprintf(b, "%02d", t.Second())
+	case 't':
+		b.WriteByte('\t')
+	case 'T', 'X':
+		fmt.Fprintf(b, "%02d:%02d:%02d", t.Hour(), t.Minute(), t.Second())
+	case 'u':
+		fmt.Fprintf(b, "%d", (int(t.Weekday())+6)%7+1)
+	case 'U': /* weeks starting on the first Sunday */
+		fmt.Fprintf(b, "%02d", (t.YearDay()+6-int(t.Weekday()))/7)
+	case 'V':
+		_, week := t.ISOWeek()
+		fmt.Fprintf(b, "%02d", week)
+	case 'w':
+		fmt.Fprintf(b, "%d", t.Weekday())
+	case 'W': /* weeks starting on the first Monday */
+		fmt.Fprintf(b, "%02d", (t.YearDay()+6-(int(t.Weekday())+6)%7)/7)
+	case 'y':
+		fmt.Fprintf(b, "%02d", t.Year()%100)
+	case 'Y':
+		fmt.Fprintf(b, "%d", t.Year())
+	case 'z':
+		_, offset := t.Zone()
+		sign := '+'
+		if offset < 0 {
+			sign, offset = '-', -offset
+		}
+		fmt.Fprintf(b, "%c%02d%02d", sign, offset/3600, offset/60%60)
+	case 'Z':
+		name, _ := t.Zone()
+		b.WriteString(name)
+	case '%':
+		b.WriteByte('%')
+	}
+}
+
 // os.remove (filename)
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.remove
+// lua-5.3.4/src/loslib.c#os_remove()
 func osRemove(ls *LuaState) int {
 	filename := ls.CheckString(1)
-	if err := os.Remove(filename); err != nil {
-		ls.Push(LuaNil)
-		ls.Push(LuaString(err.Error()))
-		return 2
-	} else {
-		ls.Push(LuaTrue)
-		return 1
-	}
+	return luaFileResult(ls, ls.removeFile(filename), filename)
 }
 
 // os.rename (oldname, newname)
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.rename
+// lua-5.3.4/src/loslib.c#os_rename()
 func osRename(ls *LuaState) int {
 	oldName := ls.CheckString(1)
 	newName := ls.CheckString(2)
-	if err := os.Rename(oldName, newName); err != nil {
-		ls.Push(LuaNil)
-		ls.Push(LuaString(err.Error()))
-		return 2
-	} else {
-		ls.Push(LuaTrue)
-		return 1
-	}
+	return luaFileResult(ls, ls.renameFile(oldName, newName), oldName)
 }
 
 // os.tmpname ()
@@ -174,8 +341,14 @@ func osGetEnv(ls *LuaState) int {
 
 // os.execute ([command])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.execute
+// lua-5.3.4/src/loslib.c#os_execute()
 func osExecute(ls *LuaState) int {
-	panic("todo: osExecute!")
+	if luaIsNoneOrNil(ls, 1) { /* no command? */
+		ls.Push(LuaBool(ls.canExecute())) /* true if there is a shell */
+		return 1
+	}
+	cmd := ls.CheckString(1)
+	return luaExecResult(ls, ls.system(cmd))
 }
 
 // os.exit ([code [, close]])
@@ -200,6 +373,17 @@ func osExit(ls *LuaState) int {
 
 // os.setlocale (locale [, category])
 // http://www.lua.org/manual/5.3/manual.html#pdf-os.setlocale
+// lua-5.3.4/src/loslib.c#os_setlocale()
 func osSetLocale(ls *LuaState) int {
-	panic("todo: osSetLocale!")
+	catNames := []string{"all", "collate", "ctype", "monetary", "numeric", "time"}
+	l := luaOptString(ls, 1, "")
+	luaCheckOption(ls, 2, "all", catNames)
+	/* only the "C" locale exists, it is also the native one */
+	switch l {
+	case "", "C", "POSIX":
+		ls.Push(LuaString("C"))
+	default:
+		ls.Push(LuaNil)
+	}
+	return 1
 }
@@ -89,7 +89,7 @@ func luaSearcher(ls *LuaState) int {
 		ls.Error2("'package.path' must be a string")
 	}
 
-	filename, errMsg := _searchPath(name, path, ".", LUA_DIRSEP)
+	filename, errMsg := _searchPath(ls, name, path, ".", LUA_DIRSEP)
 	if errMsg != "" {
 		ls.Push(LuaString(errMsg))
 		return 1
@@ -112,7 +112,7 @@ func pkgSearchPath(ls *LuaState) int {
 	path := ls.CheckString(2)
 	sep := luaOptString(ls, 3, ".")
 	rep := luaOptString(ls, 4, LUA_DIRSEP)
-	if filename, errMsg := _searchPath(name, path, sep, rep); errMsg == "" {
+	if filename, errMsg := _searchPath(ls, name, path, sep, rep); errMsg == "" {
 		ls.Push(LuaString(filename))
 		return 1
 	} else {
@@ -122,14 +122,14 @@ func pkgSearchPath(ls *LuaState) int {
 	}
 }
 
-func _searchPath(name, path, sep, dirSep string) (filename, errMsg string) {
+func _searchPath(ls *LuaState, name, path, sep, dirSep string) (filename, errMsg string) {
 	if sep != "" {
 		name = strings.Replace(name, sep, dirSep, -1)
 	}
 
 	for _, filename := range strings.Split(path, LUA_PATH_SEP) {
 		filename = strings.Replace(filename, LUA_PATH_MARK, name, -1)
-		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		if ls.readable(filename) {
 			return filename, ""
 		}
 		errMsg += "\n\tno file '" + filename + "'"
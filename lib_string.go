@@ -1,9 +1,11 @@
 package golua
 
 import (
+	"encoding/binary"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
-	"regexp"
 )
 
 var strLib = map[string]GoFunction{
@@ -200,322 +202,806 @@ func strDump(ls *LuaState) int {
 
 /* PACK/UNPACK */
 
+/* value used for padding */
+const LUAL_PACKPADBYTE = 0x00
+
+/* maximum size for the binary representation of an integer */
+const MAXINTSIZE = 16
+
+/* number of bits in a character */
+const NB = 8
+
+/* mask for one character (NB 1's) */
+const MC = (1 << NB) - 1
+
+/* size of a lua_Integer */
+const SZINT = 8
+
+/* maximum alignment, that of double, void* and lua_Integer */
+const MAXALIGN = 8
+
+/* sizes of lengths and results are kept in an 'int' */
+const MAXSIZE = math.MaxInt32
+
+var nativeLittle = binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+
+// information to pack/unpack stuff
+// lua-5.3.4/src/lstrlib.c#Header
+type packHeader struct {
+	ls       *LuaState
+	isLittle bool
+	maxAlign int
+}
+
+// options for pack/unpack
+// lua-5.3.4/src/lstrlib.c#KOption
+type kOption int
+
+const (
+	kInt       kOption = iota /* signed integers */
+	kUint                     /* unsigned integers */
+	kFloat                    /* floating-point numbers */
+	kChar                     /* fixed-length strings */
+	kString                   /* strings with prefixed length */
+	kZstr                     /* zero-terminated strings */
+	kPadding                  /* padding */
+	kPaddAlign                /* padding for alignment */
+	kNop                      /* no-op (configuration or spaces) */
+)
+
+// lua-5.3.4/src/lstrlib.c#initheader()
+func (h *packHeader) init(ls *LuaState) {
+	h.ls = ls
+	h.isLittle = nativeLittle
+	h.maxAlign = 1
+}
+
+// Read an integer numeral from string 'fmt' or return 'df' if
+// there is no numeral
+// lua-5.3.4/src/lstrlib.c#getnum()
+func getNum(fmt *string, df int) int {
+	if *fmt == "" || !isdigit(int((*fmt)[0])) { /* no number? */
+		return df /* return default value */
+	}
+	a := 0
+	for {
+		a = a*10 + int((*fmt)[0]-'0')
+		*fmt = (*fmt)[1:]
+		if *fmt == "" || !isdigit(int((*fmt)[0])) || a > (MAXSIZE-9)/10 {
+			return a
+		}
+	}
+}
+
+// Read an integer numeral and raises an error if it is larger
+// than the maximum size for integers.
+// lua-5.3.4/src/lstrlib.c#getnumlimit()
+func (h *packHeader) getNumLimit(fmt *string, df int) int {
+	sz := getNum(fmt, df)
+	if sz > MAXINTSIZE || sz <= 0 {
+		h.ls.Error2("integral size (%d) out of limits [1,%d]", sz, MAXINTSIZE)
+	}
+	return sz
+}
+
+// Read and classify next option. 'size' is filled with option's size.
+// lua-5.3.4/src/lstrlib.c#getoption()
+func (h *packHeader) getOption(fmt *string) (opt kOption, size int) {
+	c := (*fmt)[0]
+	*fmt = (*fmt)[1:]
+	switch c {
+	case 'b':
+		return kInt, 1
+	case 'B':
+		return kUint, 1
+	case 'h':
+		return kInt, 2
+	case 'H':
+		return kUint, 2
+	case 'l', 'j':
+		return kInt, 8
+	case 'L', 'J', 'T':
+		return kUint, 8
+	case 'f':
+		return kFloat, 4
+	case 'd', 'n':
+		return kFloat, 8
+	case 'i':
+		return kInt, h.getNumLimit(fmt, 4)
+	case 'I':
+		return kUint, h.getNumLimit(fmt, 4)
+	case 's':
+		return kString, h.getNumLimit(fmt, 8)
+	case 'c':
+		size = getNum(fmt, -1)
+		if size == -1 {
+			h.ls.Error2("missing size for format option 'c'")
+		}
+		return kChar, size
+	case 'z':
+		return kZstr, 0
+	case 'x':
+		return kPadding, 1
+	case 'X':
+		return kPaddAlign, 0
+	case ' ':
+	case '<':
+		h.isLittle = true
+	case '>':
+		h.isLittle = false
+	case '=':
+		h.isLittle = nativeLittle
+	case '!':
+		h.maxAlign = h.getNumLimit(fmt, MAXALIGN)
+	default:
+		h.ls.Error2("invalid format option '%c'", c)
+	}
+	return kNop, 0
+}
+
+// Read, classify, and fill other details about the next option.
+// 'size' is its size, 'ntoalign' the number of padding bytes needed
+// to align it, given the current size 'totalSize' of the result.
+// lua-5.3.4/src/lstrlib.c#getdetails()
+func (h *packHeader) getDetails(totalSize int, fmt *string) (opt kOption, size, ntoalign int) {
+	opt, size = h.getOption(fmt)
+	align := size /* usually, alignment follows size */
+	if opt == kPaddAlign { /* 'X' gets alignment from following option */
+		if *fmt == "" {
+			h.ls.ArgError(1, "invalid next option for option 'X'")
+		} else if opt, align = h.getOption(fmt); opt == kChar || align == 0 {
+			h.ls.ArgError(1, "invalid next option for option 'X'")
+		}
+		opt = kPaddAlign
+	}
+	if align <= 1 || opt == kChar { /* need no alignment? */
+		return opt, size, 0
+	}
+	if align > h.maxAlign { /* enforce maximum alignment */
+		align = h.maxAlign
+	}
+	if align&(align-1) != 0 { /* is 'align' not a power of 2? */
+		h.ls.ArgError(1, "format asks for alignment not power of 2")
+	}
+	ntoalign = (align - totalSize&(align-1)) & (align - 1)
+	return opt, size, ntoalign
+}
+
+// Pack integer 'n' with 'size' bytes and 'isLittle' endianness.
+// The final 'if' handles the case when 'size' is larger than
+// the size of a Lua integer, correcting the extra sign-extension
+// bytes if necessary (by default they would be zeros).
+// lua-5.3.4/src/lstrlib.c#packint()
+func packInt(b []byte, n uint64, isLittle bool, size int, neg bool) []byte {
+	buff := make([]byte, size)
+	for i := 0; i < size; i++ {
+		var c byte
+		if i < SZINT {
+			c = byte(n & MC)
+			n >>= NB
+		} else if neg { /* negative number need sign extension? */
+			c = MC
+		}
+		if isLittle {
+			buff[i] = c
+		} else {
+			buff[size-1-i] = c
+		}
+	}
+	return append(b, buff...)
+}
+
+// the byte order of floats, instead of copywithendian()
+func byteOrder(isLittle bool) binary.ByteOrder {
+	if isLittle {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+// string.pack (fmt, v1, v2, ···)
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.pack
+// lua-5.3.4/src/lstrlib.c#str_pack()
+func strPack(ls *LuaState) int {
+	var h packHeader
+	fmt := ls.CheckString(1) /* format string */
+	arg := 1                 /* current argument to pack */
+	totalSize := 0           /* accumulate total size of result */
+	var b []byte
+	h.init(ls)
+	for fmt != "" {
+		opt, size, ntoalign := h.getDetails(totalSize, &fmt)
+		totalSize += ntoalign + size
+		for ; ntoalign > 0; ntoalign-- {
+			b = append(b, LUAL_PACKPADBYTE) /* fill alignment */
+		}
+		arg++
+		switch opt {
+		case kInt: /* signed integers */
+			n := ls.CheckInteger(arg)
+			if size < SZINT { /* need overflow check? */
+				lim := int64(1) << uint(size*NB-1)
+				ls.ArgCheck(-lim <= n && n < lim, arg, "integer overflow")
+			}
+			b = packInt(b, uint64(n), h.isLittle, size, n < 0)
+		case kUint: /* unsigned integers */
+			n := ls.CheckInteger(arg)
+			if size < SZINT { /* need overflow check? */
+				ls.ArgCheck(uint64(n) < uint64(1)<<uint(size*NB), arg, "unsigned overflow")
+			}
+			b = packInt(b, uint64(n), h.isLittle, size, false)
+		case kFloat: /* floating-point options */
+			n := ls.CheckNumber(arg) /* get argument */
+			u := make([]byte, size)
+			if size == 4 {
+				byteOrder(h.isLittle).PutUint32(u, math.Float32bits(float32(n)))
+			} else {
+				byteOrder(h.isLittle).PutUint64(u, math.Float64bits(n))
+			}
+			b = append(b, u...)
+		case kChar: /* fixed-size string */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(len(s) <= size, arg, "string longer than given size")
+			b = append(b, s...) /* add string */
+			for l := len(s); l < size; l++ { /* pad extra space */
+				b = append(b, LUAL_PACKPADBYTE)
+			}
+		case kString: /* strings with length count */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(size >= 8 || uint64(len(s)) < uint64(1)<<uint(size*NB),
+				arg, "string length does not fit in given size")
+			b = packInt(b, uint64(len(s)), h.isLittle, size, false) /* pack length */
+			b = append(b, s...)
+			totalSize += len(s)
+		case kZstr: /* zero-terminated string */
+			s := ls.CheckString(arg)
+			ls.ArgCheck(strings.IndexByte(s, 0) < 0, arg, "string contains zeros")
+			b = append(b, s...)
+			b = append(b, 0) /* add zero at the end */
+			totalSize += len(s) + 1
+		case kPadding:
+			b = append(b, LUAL_PACKPADBYTE)
+			arg-- /* undo increment */
+		case kPaddAlign, kNop:
+			arg-- /* undo increment */
+		}
+	}
+	ls.Push(LuaString(b))
+	return 1
+}
+
 // string.packsize (fmt)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.packsize
+// lua-5.3.4/src/lstrlib.c#str_packsize()
 func strPackSize(ls *LuaState) int {
-	fmt := ls.CheckString(1)
-	if fmt == "j" {
-		ls.Push(LuaNumber(8)) // todo
-	} else {
-		panic("todo: strPackSize!")
+	var h packHeader
+	fmt := ls.CheckString(1) /* format string */
+	totalSize := 0           /* accumulate total size of result */
+	h.init(ls)
+	for fmt != "" {
+		opt, size, ntoalign := h.getDetails(totalSize, &fmt)
+		size += ntoalign /* total space used by option */
+		ls.ArgCheck(totalSize <= MAXSIZE-size, 1, "format result too large")
+		totalSize += size
+		if opt == kString || opt == kZstr {
+			ls.ArgError(1, "variable-length format")
+		}
 	}
+	ls.Push(LuaNumber(totalSize))
 	return 1
 }
 
-// string.pack (fmt, v1, v2, ···)
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.pack
-func strPack(ls *LuaState) int {
-	panic("todo: strPack!")
+// Unpack an integer with 'size' bytes and 'isLittle' endianness.
+// If size is smaller than the size of a Lua integer and integer
+// is signed, must do sign extension (propagating the sign to the
+// higher bits); if size is larger than the size of a Lua integer,
+// it must check the unread bytes to see whether they do not cause an
+// overflow.
+// lua-5.3.4/src/lstrlib.c#unpackint()
+func unpackInt(ls *LuaState, str string, isLittle bool, size int, isSigned bool) int64 {
+	var res uint64
+	limit := size
+	if limit > SZINT {
+		limit = SZINT
+	}
+	for i := limit - 1; i >= 0; i-- {
+		res <<= NB
+		if isLittle {
+			res |= uint64(str[i])
+		} else {
+			res |= uint64(str[size-1-i])
+		}
+	}
+	if size < SZINT { /* real size smaller than lua_Integer? */
+		if isSigned { /* needs sign extension? */
+			mask := uint64(1) << uint(size*NB-1)
+			res = (res ^ mask) - mask /* do sign extension */
+		}
+	} else if size > SZINT { /* must check unread bytes */
+		var mask byte
+		if isSigned && int64(res) < 0 {
+			mask = MC
+		}
+		for i := limit; i < size; i++ {
+			c := str[i]
+			if !isLittle {
+				c = str[size-1-i]
+			}
+			if c != mask {
+				ls.Error2("%d-byte integer does not fit into Lua Integer", size)
+			}
+		}
+	}
+	return int64(res)
 }
 
 // string.unpack (fmt, s [, pos])
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.unpack
+// lua-5.3.4/src/lstrlib.c#str_unpack()
 func strUnpack(ls *LuaState) int {
-	panic("todo: strUnpack!")
+	var h packHeader
+	fmt := ls.CheckString(1)
+	data := ls.CheckString(2)
+	ld := len(data)
+	pos := posRelat(luaOptInteger(ls, 3, 1), ld) - 1
+	n := 0 /* number of results */
+	ls.ArgCheck(pos >= 0 && pos <= ld, 3, "initial position out of string")
+	h.init(ls)
+	for fmt != "" {
+		opt, size, ntoalign := h.getDetails(pos, &fmt)
+		if pos+ntoalign+size > ld {
+			ls.ArgError(2, "data string too short")
+		}
+		pos += ntoalign /* skip alignment */
+		/* stack space for item + next position */
+		luaCheckStack2(ls, 2, "too many results")
+		n++
+		switch opt {
+		case kInt, kUint:
+			res := unpackInt(ls, data[pos:], h.isLittle, size, opt == kInt)
+			ls.Push(LuaNumber(res))
+		case kFloat:
+			u := []byte(data[pos : pos+size])
+			if size == 4 {
+				ls.Push(LuaNumber(math.Float32frombits(byteOrder(h.isLittle).Uint32(u))))
+			} else {
+				ls.Push(LuaNumber(math.Float64frombits(byteOrder(h.isLittle).Uint64(u))))
+			}
+		case kChar:
+			ls.Push(LuaString(data[pos : pos+size]))
+		case kString:
+			l := uint64(unpackInt(ls, data[pos:], h.isLittle, size, false))
+			ls.ArgCheck(l <= uint64(ld-pos-size), 2, "data string too short")
+			ls.Push(LuaString(data[pos+size : pos+size+int(l)]))
+			pos += int(l) /* skip string */
+		case kZstr:
+			l := strings.IndexByte(data[pos:], 0)
+			ls.ArgCheck(l >= 0, 2, "unfinished string for format 'z'")
+			ls.Push(LuaString(data[pos : pos+l]))
+			pos += l + 1 /* skip string plus final '\0' */
+		case kPaddAlign, kPadding, kNop:
+			n-- /* undo increment */
+		}
+		pos += size
+	}
+	ls.Push(LuaNumber(pos + 1)) /* next position */
+	return n + 1
 }
 
 /* STRING FORMAT */
 
+/* escape character of formats and patterns */
+const L_ESC = '%'
+
+/* valid flags in a format specification */
+const L_FMTFLAGS = "-+ #0"
+
 // string.format (formatstring, ···)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.format
+// lua-5.3.4/src/lstrlib.c#str_format()
 func strFormat(ls *LuaState) int {
-	fmtStr := ls.CheckString(1)
-	if len(fmtStr) <= 1 || strings.IndexByte(fmtStr, '%') < 0 {
-		ls.Push(LuaString(fmtStr))
-		return 1
-	}
-
-	argIdx := 1
-	arr := parseFmtStr(fmtStr)
-	for i, s := range arr {
-		if s[0] == '%' {
-			if s == "%%" {
-				arr[i] = "%"
+	top := luaGetTop(ls)
+	arg := 1
+	strfrmt := ls.CheckString(arg)
+	var b strings.Builder
+	for i := 0; i < len(strfrmt); {
+		if strfrmt[i] != L_ESC {
+			b.WriteByte(strfrmt[i])
+			i++
+			continue
+		}
+		if i++; i < len(strfrmt) && strfrmt[i] == L_ESC {
+			b.WriteByte(L_ESC) /* %% */
+			i++
+			continue
+		}
+		/* format item */
+		form := scanFormat(ls, strfrmt[i:])
+		i += len(form.form) - 1
+		var conv byte
+		if i < len(strfrmt) {
+			conv = strfrmt[i]
+			i++
+		}
+		if conv == 0 || strings.IndexByte("cdiuoxXaAeEfgGqs", conv) < 0 {
+			/* also treats cases 'pnLlh' and '%' with modifiers */
+			return ls.Error2("invalid option '%s' to 'format'", form.form+string(conv))
+		}
+		if arg++; arg > top {
+			ls.ArgError(arg, "no value")
+		}
+		switch conv {
+		case 'c':
+			b.WriteString(form.pad(string([]byte{byte(ls.CheckInteger(arg))}), false))
+		case 'd', 'i':
+			n := ls.CheckInteger(arg)
+			b.WriteString(fmt.Sprintf(form.form+"d", n))
+		case 'u':
+			n := ls.CheckInteger(arg)
+			b.WriteString(fmt.Sprintf(form.unsigned()+"d", uint64(n)))
+		case 'o', 'x', 'X':
+			n := ls.CheckInteger(arg)
+			b.WriteString(fmt.Sprintf(form.unsigned()+string(conv), uint64(n)))
+		case 'a', 'A':
+			b.WriteString(form.hexFloat(ls.CheckNumber(arg), conv == 'A'))
+		case 'e', 'E', 'f', 'g', 'G':
+			b.WriteString(form.float(ls.CheckNumber(arg), conv))
+		case 'q':
+			addLiteral(ls, &b, arg)
+		case 's':
+			s := luaToString2(ls, arg)
+			if form.form == "%" { /* no modifiers? */
+				b.WriteString(s) /* keep entire string */
 			} else {
-				argIdx += 1
-				arr[i] = _fmtArg(s, ls, argIdx)
+				ls.ArgCheck(strings.IndexByte(s, 0) < 0, arg, "string contains zeros")
+				if form.prec < 0 && len(s) >= 100 {
+					/* no precision and string is too long to be formatted */
+					b.WriteString(s) /* keep entire string */
+				} else { /* format the string */
+					if form.prec >= 0 && len(s) > form.prec {
+						s = s[:form.prec]
+					}
+					b.WriteString(form.pad(s, false))
+				}
 			}
+			luaPop(ls, 1) /* remove result from 'luaToString2' */
 		}
 	}
-
-	ls.Push(LuaString(strings.Join(arr, "")))
+	ls.Push(LuaString(b.String()))
 	return 1
 }
 
-func _fmtArg(tag string, ls *LuaState, argIdx int) string {
-	switch tag[len(tag)-1] { // specifier
-	case 'c': // character
-		return string([]byte{byte(luaToInteger(ls, argIdx))})
-	case 'i':
-		tag = tag[:len(tag)-1] + "d" // %i -> %d
-		return fmt.Sprintf(tag, luaToInteger(ls, argIdx))
-	case 'd', 'o': // integer, octal
-		return fmt.Sprintf(tag, luaToInteger(ls, argIdx))
-	case 'u': // unsigned integer
-		tag = tag[:len(tag)-1] + "d" // %u -> %d
-		return fmt.Sprintf(tag, uint(luaToInteger(ls, argIdx)))
-	case 'x', 'X': // hex integer
-		return fmt.Sprintf(tag, uint(luaToInteger(ls, argIdx)))
-	case 'f': // float
-		return fmt.Sprintf(tag, luaToNumber(ls, argIdx))
-	case 's', 'q': // string
-		return fmt.Sprintf(tag, luaToString2(ls, argIdx))
-	default:
-		panic("todo! tag=" + tag)
-	}
-}
-
-/* PATTERN MATCHING */
-
-// string.find (s, pattern [, init [, plain]])
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.find
-func strFind(ls *LuaState) int {
-	s := ls.CheckString(1)
-	sLen := len(s)
-	pattern := ls.CheckString(2)
-	init := posRelat(luaOptInteger(ls, 3, 1), sLen)
-	if init < 1 {
-		init = 1
-	} else if init > sLen+1 { /* start after string's end? */
-		ls.Push(LuaNil)
-		return 1
+// a conversion specification without its conversion character,
+// '%[flags][width][.precision]'
+type fmtSpec struct {
+	form  string
+	flags string
+	width int
+	prec  int // -1 if absent
+}
+
+// lua-5.3.4/src/lstrlib.c#scanformat()
+func scanFormat(ls *LuaState, strfrmt string) fmtSpec {
+	spec := fmtSpec{prec: -1}
+	p := 0
+	digit := func() bool { return p < len(strfrmt) && isdigit(int(strfrmt[p])) }
+	for p < len(strfrmt) && strings.IndexByte(L_FMTFLAGS, strfrmt[p]) >= 0 {
+		p++ /* skip flags */
+	}
+	if p > len(L_FMTFLAGS) {
+		ls.Error2("invalid format (repeated flags)")
+	}
+	spec.flags = strfrmt[:p]
+	for n := 0; n < 2 && digit(); n++ { /* skip width (2 digits at most) */
+		spec.width = spec.width*10 + int(strfrmt[p]-'0')
+		p++
+	}
+	if p < len(strfrmt) && strfrmt[p] == '.' {
+		p++
+		spec.prec = 0
+		for n := 0; n < 2 && digit(); n++ { /* skip precision (2 digits at most) */
+			spec.prec = spec.prec*10 + int(strfrmt[p]-'0')
+			p++
+		}
 	}
-	plain := luaToBoolean(ls, 4)
-
-	start, end := find(s, pattern, init, plain)
-
-	if start < 0 {
-		ls.Push(LuaNil)
-		return 1
+	if digit() {
+		ls.Error2("invalid format (width or precision too long)")
 	}
-	ls.Push(LuaNumber(start))
-	ls.Push(LuaNumber(end))
-	return 2
+	spec.form = "%" + strfrmt[:p]
+	return spec
 }
 
-// string.match (s, pattern [, init])
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.match
-func strMatch(ls *LuaState) int {
-	s := ls.CheckString(1)
-	sLen := len(s)
-	pattern := ls.CheckString(2)
-	init := posRelat(luaOptInteger(ls, 3, 1), sLen)
-	if init < 1 {
-		init = 1
-	} else if init > sLen+1 { /* start after string's end? */
-		ls.Push(LuaNil)
-		return 1
-	}
+func (spec fmtSpec) hasFlag(flag byte) bool {
+	return strings.IndexByte(spec.flags, flag) >= 0
+}
 
-	captures := match(s, pattern, init)
+// the form without the sign flags, that C ignores for unsigned conversions
+func (spec fmtSpec) unsigned() string {
+	return strings.NewReplacer("+", "", " ", "").Replace(spec.form)
+}
 
-	if captures == nil {
-		ls.Push(LuaNil)
-		return 1
-	} else {
-		for i := 0; i < len(captures); i += 2 {
-			capture := s[captures[i]:captures[i+1]]
-			ls.Push(LuaString(capture))
+// pads s to the field width, with zeros after its sign or "0x" prefix
+// if 'zeros' allows it and the '0' flag asks for them
+func (spec fmtSpec) pad(s string, zeros bool) string {
+	n := spec.width - len(s)
+	switch {
+	case n <= 0:
+		return s
+	case spec.hasFlag('-'):
+		return s + strings.Repeat(" ", n)
+	case zeros && spec.hasFlag('0'):
+		i := 0
+		if i < len(s) && (s[i] == '-' || s[i] == '+' || s[i] == ' ') {
+			i++
+		}
+		if strings.HasPrefix(strings.ToLower(s[i:]), "0x") {
+			i += 2
 		}
-		return len(captures) / 2
+		return s[:i] + strings.Repeat("0", n) + s[i:]
+	default:
+		return strings.Repeat(" ", n) + s
 	}
 }
 
-// string.gsub (s, pattern, repl [, n])
-// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
-func strGsub(ls *LuaState) int {
-	str := ls.CheckString(1)
-	pattern := ls.CheckString(2)
-	luaCheckTypes(ls, 3, LUA_TSTRING, LUA_TTABLE, LUA_TCLOSURE)
-	repl := ls.CheckAny(3) // todo
-	limit := int(luaOptInteger(ls, 4, -1))
-
-	mds, err := Find(pattern, unsafeFastStringToReadOnlyBytes(str), 0, limit)
-	if err != nil {
-		ls.Error2(err.Error())
-	}
-	if len(mds) == 0 {
-		luaSetTop(ls, 1)
-		ls.Push(LuaNumber(0))
-		return 2
-	}
-
-	switch lv := repl.(type) {
-	case LuaString:
-		ls.Push(LuaString(strGsubStr(ls, str, lv.String(), mds)))
-	case *LuaTable:
-		ls.Push(LuaString(strGsubTable(ls, str, lv, mds)))
-	case *LuaClosure:
-		ret := strGsubClosure(ls, str, lv, mds)
-		ls.Push(LuaString(ret))
-	default:
-		fmt.Printf("gsub default:%v lv:%+v\n", repl.String(), lv)
-		ls.Push(LuaString(""))
+func (spec fmtSpec) sign(n float64) string {
+	switch {
+	case math.Signbit(n):
+		return "-"
+	case spec.hasFlag('+'):
+		return "+"
+	case spec.hasFlag(' '):
+		return " "
 	}
-	ls.Push(LuaNumber(len(mds)))
-	return 2
+	return ""
 }
 
-type replaceInfo struct {
-	Indicies []int
-	String   string
+// '%e', '%f' and '%g' as printf writes them
+func (spec fmtSpec) float(n float64, conv byte) string {
+	if math.IsInf(n, 0) || math.IsNaN(n) {
+		s := "inf"
+		if math.IsNaN(n) {
+			s = "nan"
+		}
+		if conv == 'E' || conv == 'G' {
+			s = strings.ToUpper(s)
+		}
+		return spec.pad(spec.sign(n)+s, false)
+	}
+	form := spec.form
+	if spec.prec < 0 && (conv == 'g' || conv == 'G') {
+		form += ".6" /* C's default, not the shortest representation */
+	}
+	return fmt.Sprintf(form+string(conv), n)
 }
 
-func checkCaptureIndex(ls *LuaState, m *MatchData, idx int) {
-	if idx <= 2 {
-		return
+// '%a' of C99
+// lua-5.3.4/src/lobject.c#lua_number2strx()
+func (spec fmtSpec) hexFloat(n float64, upper bool) string {
+	var s string
+	switch {
+	case math.IsInf(n, 0):
+		s = "inf"
+	case math.IsNaN(n):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(math.Abs(n), 'x', spec.prec, 64)
+		/* C writes the exponent with as few digits as needed */
+		if i := strings.IndexByte(s, 'p'); len(s) == i+4 && s[i+2] == '0' {
+			s = s[:i+2] + s[i+3:]
+		}
 	}
-	if idx >= m.CaptureLength() {
-		ls.Error2("invalid capture index")
+	if upper {
+		s = strings.ToUpper(s)
 	}
+	return spec.pad(spec.sign(n)+s, !math.IsInf(n, 0) && !math.IsNaN(n))
 }
 
-func capturedString(ls *LuaState, m *MatchData, str string, idx int) string {
-	checkCaptureIndex(ls, m, idx)
-	if idx >= m.CaptureLength() && idx == 2 {
-		idx = 0
+// lua-5.3.4/src/lstrlib.c#addquoted()
+func addQuoted(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' || c == '\n' {
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		} else if c < ' ' || c == 0x7f { /* iscntrl */
+			if i+1 < len(s) && isdigit(int(s[i+1])) {
+				fmt.Fprintf(b, "\\%03d", c)
+			} else {
+				fmt.Fprintf(b, "\\%d", c)
+			}
+		} else {
+			b.WriteByte(c)
+		}
 	}
-	if m.IsPosCapture(idx) {
-		return fmt.Sprint(m.Capture(idx))
-	} else {
-		return str[m.Capture(idx):m.Capture(idx+1)]
-	}
-}
-
-func strGsubDoReplace(str string, info []replaceInfo) string {
-	offset := 0
-	buf := []byte(str)
-	for _, replace := range info {
-		oldlen := len(buf)
-		b1 := append([]byte(""), buf[0:offset+replace.Indicies[0]]...)
-		b2 := []byte("")
-		index2 := offset + replace.Indicies[1]
-		if index2 <= len(buf) {
-			b2 = append(b2, buf[index2:len(buf)]...)
-		}
-		buf = append(b1, replace.String...)
-		buf = append(buf, b2...)
-		offset += len(buf) - oldlen
-	}
-	return string(buf)
-}
-
-func strGsubStr(ls *LuaState, str string, repl string, matches []*MatchData) string {
-	infoList := make([]replaceInfo, 0, len(matches))
-	for _, match := range matches {
-		start, end := match.Capture(0), match.Capture(1)
-		sc := newFlagScanner('%', "", "", repl)
-		for c, eos := sc.Next(); !eos; c, eos = sc.Next() {
-			if !sc.ChangeFlag {
-				if sc.HasFlag {
-					if c >= '0' && c <= '9' {
-						sc.AppendString(capturedString(ls, match, str, 2*(int(c)-48)))
-					} else {
-						sc.AppendChar('%')
-						sc.AppendChar(c)
-					}
-					sc.HasFlag = false
-				} else {
-					sc.AppendChar(c)
-				}
+	b.WriteByte('"')
+}
+
+// Serialize a floating-point number in such a way that it can be
+// scanned back by Lua. Use hexadecimal format for "common" numbers
+// (to preserve precision); inf, -inf, and NaN are handled separately.
+// lua-5.3.5/src/lstrlib.c#quotefloat()
+func quoteFloat(n float64) string {
+	switch {
+	case math.IsInf(n, 1):
+		return "1e9999"
+	case math.IsInf(n, -1):
+		return "-1e9999"
+	case math.IsNaN(n):
+		return "(0/0)"
+	}
+	return fmtSpec{form: "%", prec: -1}.hexFloat(n, false)
+}
+
+// lua-5.3.4/src/lstrlib.c#addliteral()
+func addLiteral(ls *LuaState, b *strings.Builder, arg int) {
+	switch luaType(ls, arg) {
+	case LUA_TSTRING:
+		addQuoted(b, luaToString(ls, arg))
+	case LUA_TNUMBER:
+		if !luaIsInteger(ls, arg) { /* float? */
+			b.WriteString(quoteFloat(luaToNumber(ls, arg))) /* write as hexa ('%a') */
+		} else { /* integers */
+			n := luaToInteger(ls, arg)
+			if n == math.MinInt64 { /* corner case? */
+				fmt.Fprintf(b, "0x%x", uint64(n)) /* use hexa */
+			} else {
+				fmt.Fprintf(b, "%d", n) /* else use default format */
 			}
 		}
-		infoList = append(infoList, replaceInfo{[]int{start, end}, sc.String()})
+	case LUA_TNIL, LUA_TBOOLEAN:
+		b.WriteString(luaToString2(ls, arg))
+		luaPop(ls, 1)
+	default:
+		ls.ArgError(arg, "value has no literal form")
 	}
+}
+
+/* PATTERN MATCHING */
 
-	return strGsubDoReplace(str, infoList)
+// lua-5.3.4/src/lstrlib.c#push_onecapture()
+func pushOneCapture(ms *matchState, i, s, e int) {
+	if str, p, pos := ms.getCapture(i, s, e); pos {
+		ms.ls.Push(LuaNumber(p))
+	} else {
+		ms.ls.Push(LuaString(str))
+	}
 }
 
-func strGsubTable(ls *LuaState, str string, repl *LuaTable, matches []*MatchData) string {
-	infoList := make([]replaceInfo, 0, len(matches))
-	for _, match := range matches {
-		idx := 0
-		if match.CaptureLength() > 2 { // has captures
-			idx = 2
-		}
-		var value LuaValue
-		if match.IsPosCapture(idx) {
-			value = GetValueField(ls, repl, LuaString(match.Capture(idx)))
-		} else {
-			value = GetValueField(ls, repl, LuaString(str[match.Capture(idx):match.Capture(idx+1)]))
-		}
-		switch sv := value.(type) {
-		case LuaString:
-			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, string(sv)})
-		}
+// lua-5.3.4/src/lstrlib.c#push_captures()
+func pushCaptures(ms *matchState, s, e int) int {
+	nlevels := ms.nlevels(s)
+	luaCheckStack2(ms.ls, nlevels, "too many captures")
+	for i := 0; i < nlevels; i++ {
+		pushOneCapture(ms, i, s, e)
 	}
-	return strGsubDoReplace(str, infoList)
+	return nlevels /* number of strings pushed */
 }
 
-func strGsubClosure(ls *LuaState, str string, repl *LuaClosure, matches []*MatchData) string {
-	infoList := make([]replaceInfo, 0, len(matches))
-	for _, match := range matches {
-		start, end := match.Capture(0), match.Capture(1)
-		ls.Push(repl)
-		nargs := 0
-		if match.CaptureLength() > 2 { // has captures
-			for i := 2; i < match.CaptureLength(); i += 2 {
-				if match.IsPosCapture(i) {
-					ls.Push(LuaString(match.Capture(i)))
-				} else {
-					ls.Push(LuaString(capturedString(ls, match, str, i)))
-				}
-				nargs++
-			}
-		} else {
-			ls.Push(LuaString(capturedString(ls, match, str, 0)))
-			nargs++
+// lua-5.3.4/src/lstrlib.c#str_find_aux()
+func strFindAux(ls *LuaState, find bool) int {
+	s := ls.CheckString(1)
+	p := ls.CheckString(2)
+	init := posRelat(luaOptInteger(ls, 3, 1), len(s))
+	if init < 1 {
+		init = 1
+	} else if init > len(s)+1 { /* start after string's end? */
+		ls.Push(LuaNil) /* cannot find anything */
+		return 1
+	}
+	/* explicit request or no special characters? */
+	if find && (luaToBoolean(ls, 4) || nospecials(p)) {
+		/* do a plain search */
+		if s2 := strings.Index(s[init-1:], p); s2 >= 0 {
+			ls.Push(LuaNumber(s2 + init))
+			ls.Push(LuaNumber(s2 + init - 1 + len(p)))
+			return 2
 		}
-		ls.Call(nargs, 1)
-		ret := ls.stack.pop()
-		switch sret := ret.(type) {
-		case LuaString:
-			infoList = append(infoList, replaceInfo{[]int{start, end}, string(sret)})
+	} else {
+		pat := ls.cachedPattern(p)
+		ms := pat.newMatchState(ls, s)
+		if s1, res := ms.find(init-1, pat.anchor); s1 != -1 {
+			if find {
+				ls.Push(LuaNumber(s1 + 1)) /* start */
+				ls.Push(LuaNumber(res))    /* end */
+				return pushCaptures(ms, -1, 0) + 2
+			}
+			return pushCaptures(ms, s1, res)
 		}
 	}
-	return strGsubDoReplace(str, infoList)
+	ls.Push(LuaNil) /* not found */
+	return 1
 }
 
-type strMatchData struct {
-	str     string
-	pos     int
-	matches []*MatchData
+// string.find (s, pattern [, init [, plain]])
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.find
+// lua-5.3.4/src/lstrlib.c#str_find()
+func strFind(ls *LuaState) int {
+	return strFindAux(ls, true)
+}
+
+// string.match (s, pattern [, init])
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.match
+// lua-5.3.4/src/lstrlib.c#str_match()
+func strMatch(ls *LuaState) int {
+	return strFindAux(ls, false)
 }
 
 // string.gmatch (s, pattern)
 // http://www.lua.org/manual/5.3/manual.html#pdf-string.gmatch
+// lua-5.3.4/src/lstrlib.c#gmatch()
 func strGmatch(ls *LuaState) int {
 	s := ls.CheckString(1)
-	pattern := ls.CheckString(2)
-
+	p := ls.CheckString(2)
+	ms := ls.cachedPattern(p).newMatchState(ls, s) /* '^' is no anchor here */
+	src, lastmatch := 0, -1 /* current position, end of last match */
 	gmatchAux := func(ls *LuaState) int {
-		captures := match(s, pattern, 1)
-		if captures != nil {
-			for i := 0; i < len(captures); i += 2 {
-				capture := s[captures[i]:captures[i+1]]
-				ls.Push(LuaString(capture))
+		ms.ls = ls
+		for ; src <= len(s); src++ {
+			ms.reprepstate()
+			if e := ms.match(src, 0); e != -1 && e != lastmatch {
+				start := src
+				src, lastmatch = e, e
+				return pushCaptures(ms, start, e)
 			}
-			s = s[captures[len(captures)-1]:]
-			return len(captures) / 2
-		} else {
-			return 0
 		}
+		return 0 /* not found */
 	}
-
 	ls.PushGoFunction(gmatchAux)
 	return 1
 }
 
+// lua-5.3.4/src/lstrlib.c#add_value()
+func addValue(ms *matchState, b *strings.Builder, s, e int, tr LuaValueType) {
+	ls := ms.ls
+	switch tr {
+	case LUA_TCLOSURE:
+		luaPushValue(ls, 3)
+		n := pushCaptures(ms, s, e)
+		ls.Call(n, 1)
+	case LUA_TTABLE:
+		pushOneCapture(ms, 0, s, e)
+		luaGetTable(ls, 3)
+	default: /* LUA_TNUMBER or LUA_TSTRING */
+		ms.addS(b, luaToString(ls, 3), s, e)
+		return
+	}
+	if !luaToBoolean(ls, -1) { /* nil or false? */
+		b.WriteString(ms.src[s:e]) /* keep original text */
+	} else if !luaIsString(ls, -1) {
+		ls.Error2("invalid replacement value (a %s)", luaTypeName2(ls, -1))
+	} else {
+		b.WriteString(luaToString(ls, -1)) /* add result to accumulator */
+	}
+	luaPop(ls, 1)
+}
+
+// string.gsub (s, pattern, repl [, n])
+// http://www.lua.org/manual/5.3/manual.html#pdf-string.gsub
+// lua-5.3.4/src/lstrlib.c#str_gsub()
+func strGsub(ls *LuaState) int {
+	src := ls.CheckString(1) /* subject */
+	p := ls.CheckString(2)   /* pattern */
+	tr := luaType(ls, 3)     /* replacement type */
+	maxS := luaOptInteger(ls, 4, int64(len(src)+1)) /* max replacements */
+	ls.ArgCheck(tr == LUA_TNUMBER || tr == LUA_TSTRING ||
+		tr == LUA_TCLOSURE || tr == LUA_TTABLE, 3,
+		"string/function/table expected")
+	b := &strings.Builder{}
+	pat := ls.cachedPattern(p)
+	ms := pat.newMatchState(ls, src)
+	copied := 0 /* end of the subject copied to b */
+	n := ms.gsub(pat.anchor, maxS, func(s, e int) {
+		b.WriteString(src[copied:s])
+		addValue(ms, b, s, e, tr) /* add replacement to buffer */
+		copied = e
+	})
+	b.WriteString(src[copied:])
+	ls.Push(LuaString(b.String()))
+	ls.Push(LuaNumber(n)) /* number of substitutions */
+	return 2
+}
+
 /* helper */
 
 /* translate a relative string position: negative means back from end */
@@ -529,168 +1015,3 @@ func posRelat(pos int64, _len int) int {
 		return _len + _pos + 1
 	}
 }
-
-// tag = %[flags][width][.precision]specifier
-var tagPattern = regexp.MustCompile(`%[ #+-0]?[0-9]*(\.[0-9]+)?[cdeEfgGioqsuxX%]`)
-
-func parseFmtStr(fmt string) []string {
-	if fmt == "" || strings.IndexByte(fmt, '%') < 0 {
-		return []string{fmt}
-	}
-
-	parsed := make([]string, 0, len(fmt)/2)
-	for {
-		if fmt == "" {
-			break
-		}
-
-		loc := tagPattern.FindStringIndex(fmt)
-		if loc == nil {
-			parsed = append(parsed, fmt)
-			break
-		}
-
-		head := fmt[:loc[0]]
-		tag := fmt[loc[0]:loc[1]]
-		tail := fmt[loc[1]:]
-
-		if head != "" {
-			parsed = append(parsed, head)
-		}
-		parsed = append(parsed, tag)
-		fmt = tail
-	}
-	return parsed
-}
-
-func find(s, pattern string, init int, plain bool) (start, end int) {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
-	}
-
-	if plain {
-		start = strings.Index(tail, pattern)
-		end = start + len(pattern) - 1
-	} else {
-		re, err := _compile(pattern)
-		if err != "" {
-			panic(err) // todo
-		} else {
-			loc := re.FindStringIndex(tail)
-			if loc == nil {
-				start, end = -1, -1
-			} else {
-				start, end = loc[0], loc[1]-1
-			}
-		}
-	}
-	if start >= 0 {
-		start += len(s) - len(tail) + 1
-		end += len(s) - len(tail) + 1
-	}
-
-	return
-}
-
-func match(s, pattern string, init int) []int {
-	tail := s
-	if init > 1 {
-		tail = s[init-1:]
-	}
-
-	re, err := _compile(pattern)
-	if err != "" {
-		panic(err) // todo
-	} else {
-		found := re.FindStringSubmatchIndex(tail)
-		if len(found) > 2 {
-			return found[2:]
-		} else {
-			return found
-		}
-	}
-}
-
-//func strGsubStr(L *LState, str string, repl string, matches []*pm.MatchData) string {
-//	infoList := make([]replaceInfo, 0, len(matches))
-//	for _, match := range matches {
-//		start, end := match.Capture(0), match.Capture(1)
-//		sc := newFlagScanner('%', "", "", repl)
-//		for c, eos := sc.Next(); !eos; c, eos = sc.Next() {
-//			if !sc.ChangeFlag {
-//				if sc.HasFlag {
-//					if c >= '0' && c <= '9' {
-//						sc.AppendString(capturedString(L, match, str, 2*(int(c)-48)))
-//					} else {
-//						sc.AppendChar('%')
-//						sc.AppendChar(c)
-//					}
-//					sc.HasFlag = false
-//				} else {
-//					sc.AppendChar(c)
-//				}
-//			}
-//		}
-//		infoList = append(infoList, replaceInfo{[]int{start, end}, sc.String()})
-//	}
-//
-//	return strGsubDoReplace(str, infoList)
-//}
-//
-//func strGsubTable(L *LState, str string, repl *LTable, matches []*pm.MatchData) string {
-//	infoList := make([]replaceInfo, 0, len(matches))
-//	for _, match := range matches {
-//		idx := 0
-//		if match.CaptureLength() > 2 { // has captures
-//			idx = 2
-//		}
-//		var value LValue
-//		if match.IsPosCapture(idx) {
-//			value = L.GetTable(repl, LNumber(match.Capture(idx)))
-//		} else {
-//			value = L.GetField(repl, str[match.Capture(idx):match.Capture(idx+1)])
-//		}
-//		if !LVIsFalse(value) {
-//			infoList = append(infoList, replaceInfo{[]int{match.Capture(0), match.Capture(1)}, LVAsString(value)})
-//		}
-//	}
-//	return strGsubDoReplace(str, infoList)
-//}
-//
-//func strGsubFunc(L *LuaState, str string, repl *LuaFunction, matches []*pm.MatchData) string {
-//	infoList := make([]replaceInfo, 0, len(matches))
-//	for _, match := range matches {
-//		start, end := match.Capture(0), match.Capture(1)
-//		L.Push(repl)
-//		nargs := 0
-//		if match.CaptureLength() > 2 { // has captures
-//			for i := 2; i < match.CaptureLength(); i += 2 {
-//				if match.IsPosCapture(i) {
-//					L.Push(LNumber(match.Capture(i)))
-//				} else {
-//					L.Push(LString(capturedString(L, match, str, i)))
-//				}
-//				nargs++
-//			}
-//		} else {
-//			L.Push(LString(capturedString(L, match, str, 0)))
-//			nargs++
-//		}
-//		L.Call(nargs, 1)
-//		ret := L.reg.Pop()
-//		if !LVIsFalse(ret) {
-//			infoList = append(infoList, replaceInfo{[]int{start, end}, LVAsString(ret)})
-//		}
-//	}
-//	return strGsubDoReplace(str, infoList)
-//}
-
-func _compile(pattern string) (*regexp.Regexp, string) {
-	re, err := regexp.Compile(pattern)
-	if err != nil {
-		return nil, err.Error() // todo
-	} else {
-		return re, ""
-	}
-}
\ No newline at end of file
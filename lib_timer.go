@@ -0,0 +1,101 @@
+package golua
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const LUA_TIMER = "timer"
+
+var timerFuncs = map[string]GoFunction{
+	"sleep":  timerSleep,
+	"after":  timerAfter,
+	"every":  timerEvery,
+	"cancel": timerCancel,
+}
+
+func OpenTimerLib(ls *LuaState) int {
+	ls.NewLib(timerFuncs)
+	luaNewMetatable(ls, LUA_TIMER) /* metatable for timers */
+	luaPushValue(ls, -1)
+	luaSetField(ls, -2, "__index") /* metatable.__index = metatable */
+	ls.SetFuncs(FuncReg{
+		"cancel":     timerCancel,
+		"__tostring": timerToString,
+	}, 0)
+	luaPop(ls, 1)
+	return 1
+}
+
+// returns argument arg, in seconds, as a duration
+func checkDuration(ls *LuaState, arg int) time.Duration {
+	s := ls.CheckNumber(arg)
+	ls.ArgCheck(s >= 0 && s*float64(time.Second) < math.MaxInt64, arg, "duration out of range")
+	return time.Duration(s * float64(time.Second))
+}
+
+// the event loop that runs ls, for starting timers
+func checkLoop(ls *LuaState) *eventLoop {
+	l := runningLoop(ls)
+	if l == nil {
+		ls.Error2("no event loop is running")
+	}
+	return l
+}
+
+// timer.sleep (s)
+// Suspends the running coroutine of the event loop for s seconds, or
+// sleeps outside it.
+func timerSleep(ls *LuaState) int {
+	d := checkDuration(ls, 1)
+	if l := runningLoop(ls); l != nil && l.sleep(ls, d) {
+		ls.yieldFrame()
+	} else {
+		<-ls.getClock().After(d)
+	}
+	return 0
+}
+
+// timer.after (s, f)
+// Calls f in a new coroutine of the event loop after s seconds.
+func timerAfter(ls *LuaState) int {
+	return startTimer(ls, checkDuration(ls, 1), 0)
+}
+
+// timer.every (s, f)
+// Calls f in a new coroutine of the event loop every s seconds.
+func timerEvery(ls *LuaState) int {
+	d := checkDuration(ls, 1)
+	ls.ArgCheck(d > 0, 1, "interval must be positive")
+	return startTimer(ls, d, d)
+}
+
+func startTimer(ls *LuaState, d, period time.Duration) int {
+	luaCheckType(ls, 2, LUA_TCLOSURE)
+	l := checkLoop(ls)
+	t := &luaTimer{when: l.clock.Now().Add(d), period: period, fn: ls.CheckAny(2)}
+	l.start(t)
+	ls.Push(&LuaUserData{Value: t})
+	luaSetMetatable2(ls, LUA_TIMER)
+	return 1
+}
+
+// timer.cancel (t)
+// t:cancel ()
+// Stops t, returns whether it was pending.
+func timerCancel(ls *LuaState) int {
+	t := luaCheckUData(ls, 1, LUA_TIMER).Value.(*luaTimer)
+	stopped := false
+	if l := runningLoop(ls); l != nil {
+		stopped = l.stop(t)
+	}
+	ls.Push(LuaBool(stopped))
+	return 1
+}
+
+func timerToString(ls *LuaState) int {
+	t := luaCheckUData(ls, 1, LUA_TIMER).Value.(*luaTimer)
+	ls.Push(LuaString(fmt.Sprintf("timer (%p)", t)))
+	return 1
+}
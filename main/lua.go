@@ -1,20 +1,399 @@
 package main
 
 import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
 	"golua"
+	"golua/dap"
 	"os"
-	"fmt"
+	"strings"
 )
 
+var cpuprofile = flag.String("cpuprofile", "", "write a Lua CPU profile to `file`")
+var debug = flag.Bool("dap", false, "serve the Debug Adapter Protocol on stdio, or on the -listen address")
+var listen = flag.String("listen", "", "TCP `address` of the -dap server")
+var coverage = flag.String("coverage", "", "write line coverage to `file`, as HTML if it ends in .html, lcov otherwise")
+var interactive = flag.Bool("i", false, "enter interactive mode after executing the script")
+var version = flag.Bool("v", false, "show version information")
+var noEnv = flag.Bool("E", false, "ignore environment variables")
+
+const luaVersion = "Lua 5.3 (golua)"
+
+var progName = os.Args[0]
+
+// -e and -l options, run in the order they are given
+type option struct{ name, arg string }
+
+var options []option
+
+type optionFlag string
+
+func (f optionFlag) String() string { return "" }
+func (f optionFlag) Set(arg string) error {
+	options = append(options, option{string(f), arg})
+	return nil
+}
+
+func init() {
+	flag.Var(optionFlag("e"), "e", "execute string `stat`")
+	flag.Var(optionFlag("l"), "l", "require library `mod` into global 'mod'")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] [script [args]]\n", progName)
+		flag.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "  -   stop handling options and execute stdin")
+	}
+}
+
 func main() {
-	if len(os.Args) > 1 {
+	flag.Parse()
+	if *debug {
 		ls := golua.NewLuaState()
 		ls.OpenLibs()
-		ls.LoadFile(os.Args[1])
-		//ls.Call(0, 0)
-		if err := ls.PCall(0, 0, 0); err != nil {
-			fmt.Println(err)
+		var err error
+		if *listen != "" {
+			err = dap.ListenAndServe(ls, *listen, flag.Arg(0))
+		} else {
+			err = dap.Serve(ls, os.Stdin, os.Stdout, flag.Arg(0))
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	os.Exit(run())
+}
+
+// lua-5.3.4/src/lua.c#pmain()
+func run() int {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			message(err.Error())
+			return 1
+		}
+		defer f.Close()
+		ls.StartProfile(f)
+		defer func() {
+			if err := ls.StopProfile(); err != nil {
+				message(err.Error())
+			}
+		}()
+	}
+	if *coverage != "" {
+		ls.StartCoverage()
+		defer writeCoverage(ls, *coverage)
+	}
+	createArgTable(ls)
+	if *version || *interactive { /* -i implies -v */
+		fmt.Println(luaVersion)
+	}
+	if !*noEnv && !report(ls, handleInit(ls)) {
+		return 1
+	}
+	for _, opt := range options {
+		var err error
+		if opt.name == "e" {
+			err = doString(ls, opt.arg, "=(command line)")
+		} else {
+			err = doLibrary(ls, opt.arg)
+		}
+		if !report(ls, err) {
+			return 1
+		}
+	}
+	if flag.NArg() > 0 && !report(ls, handleScript(ls, flag.Args())) {
+		return 1
+	}
+	if *interactive {
+		doREPL(ls)
+	} else if flag.NArg() == 0 && len(options) == 0 && !*version {
+		if stdinIsTTY() {
+			fmt.Println(luaVersion)
+			doREPL(ls)
+		} else if !report(ls, doFile(ls, "")) { /* executes stdin as a file */
+			return 1
+		}
+	}
+	return 0
+}
+
+// arg[0] is the script name, its arguments follow and the interpreter with
+// its options go to negative indices
+// lua-5.3.4/src/lua.c#createargtable()
+func createArgTable(ls *golua.LuaState) {
+	script := len(os.Args) - flag.NArg()
+	if flag.NArg() == 0 { /* no script name? */
+		script = 0
+	}
+	t := ls.NewTable()
+	for i, arg := range os.Args {
+		t.Set(golua.LuaNumber(i-script), golua.LuaString(arg))
+	}
+	ls.SetGlobal("arg", t)
+	ls.Pop(1)
+}
+
+// lua-5.3.4/src/lua.c#handle_luainit()
+func handleInit(ls *golua.LuaState) error {
+	name := "LUA_INIT_5_3"
+	init, ok := os.LookupEnv(name)
+	if !ok {
+		name = "LUA_INIT"
+		init = os.Getenv(name)
+	}
+	if init == "" {
+		return nil
+	} else if init[0] == '@' {
+		return doFile(ls, init[1:])
+	}
+	return doString(ls, init, "="+name)
+}
+
+// loads a chunk, syntax errors are returned instead of pushed
+func load(ls *golua.LuaState, chunk []byte, chunkName string) error {
+	if ls.Load(chunk, chunkName) != golua.LUA_OK {
+		msg := ls.CheckString(-1)
+		ls.Pop(1)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// runs the chunk on top of the stack under nArgs arguments
+// lua-5.3.4/src/lua.c#docall()
+func doCall(ls *golua.LuaState, nArgs, nResults int) error {
+	return ls.PCall(nArgs, nResults, 0)
+}
+
+// name is "" for stdin
+// lua-5.3.4/src/lua.c#dofile()
+func doFile(ls *golua.LuaState, name string) error {
+	if err := loadFile(ls, name); err != nil {
+		return err
+	}
+	return doCall(ls, 0, 0)
+}
+
+// loads a file, "" for stdin, as load does a chunk
+func loadFile(ls *golua.LuaState, name string) error {
+	if ls.LoadFileX(name, "bt") != golua.LUA_OK {
+		msg := ls.CheckString(-1)
+		ls.Pop(1)
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// lua-5.3.4/src/lua.c#dostring()
+func doString(ls *golua.LuaState, s, chunkName string) error {
+	if err := load(ls, []byte(s), chunkName); err != nil {
+		return err
+	}
+	return doCall(ls, 0, 0)
+}
+
+// calls 'require(name)' and stores the result in a global variable
+// lua-5.3.4/src/lua.c#dolibrary()
+func doLibrary(ls *golua.LuaState, name string) error {
+	ls.Push(ls.GetGlobal("require"))
+	ls.Push(golua.LuaString(name))
+	if err := doCall(ls, 1, 1); err != nil {
+		return err
+	}
+	ls.SetGlobal(name, ls.CheckAny(-1))
+	ls.Pop(1)
+	return nil
+}
+
+// lua-5.3.4/src/lua.c#handle_script()
+func handleScript(ls *golua.LuaState, args []string) error {
+	name := args[0]
+	if name == "-" && os.Args[len(os.Args)-len(args)-1] != "--" {
+		name = "" /* stdin */
+	}
+	if err := loadFile(ls, name); err != nil {
+		return err
+	}
+	for _, arg := range args[1:] { /* push arguments */
+		ls.Push(golua.LuaString(arg))
+	}
+	return doCall(ls, len(args)-1, golua.LUA_MULTRET)
+}
+
+// prints an error message, the program name is left out in the REPL
+// lua-5.3.4/src/lua.c#l_message()
+func message(msg string) {
+	if progName != "" {
+		fmt.Fprintf(os.Stderr, "%s: ", progName)
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// reports err if not nil, returns whether there was none
+// lua-5.3.4/src/lua.c#report()
+func report(ls *golua.LuaState, err error) bool {
+	if err != nil {
+		message(errorMessage(ls, err))
+	}
+	return err == nil
+}
+
+// the message of an error with its traceback
+// lua-5.3.4/src/lua.c#msghandler()
+func errorMessage(ls *golua.LuaState, err error) string {
+	luaErr, ok := err.(*golua.LuaError)
+	if !ok {
+		return err.Error()
+	}
+	var msg string
+	switch v := luaErr.Value.(type) {
+	case golua.LuaString, golua.LuaNumber:
+		msg = v.String()
+	default: /* does it have a metamethod that produces a string? */
+		if golua.GetMetafield(ls, v, "__tostring") != golua.LuaNil {
+			ls.Push(ls.GetGlobal("tostring"))
+			ls.Push(v)
+			if ls.PCall(1, 1, 0) == nil {
+				msg = ls.CheckAny(-1).String()
+				ls.Pop(1)
+				break
+			}
+		}
+		msg = fmt.Sprintf("(error object is a %s value)", v.Type())
+	}
+	return msg + "\n" + luaErr.Traceback
+}
+
+func stdinIsTTY() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+/* REPL */
+
+// lua-5.3.4/src/lua.c#doREPL()
+func doREPL(ls *golua.LuaState) {
+	oldProgName := progName
+	progName = "" /* no 'progname' on errors in interactive mode */
+	in := bufio.NewReader(os.Stdin)
+	for {
+		err, ok := loadLine(ls, in)
+		if !ok {
+			break
+		}
+		if err == nil {
+			base := ls.GetTop()
+			if err = doCall(ls, 0, golua.LUA_MULTRET); err == nil {
+				printResults(ls, ls.GetTop()-base+1)
+			}
+		}
+		report(ls, err)
+	}
+	fmt.Println()
+	progName = oldProgName
+}
+
+// the prompt in _PROMPT or _PROMPT2
+// lua-5.3.4/src/lua.c#get_prompt()
+func getPrompt(ls *golua.LuaState, firstLine bool) string {
+	name, prompt := "_PROMPT", "> "
+	if !firstLine {
+		name, prompt = "_PROMPT2", ">> "
+	}
+	switch p := ls.GetGlobal(name).(type) {
+	case golua.LuaString, golua.LuaNumber:
+		return p.String()
+	}
+	return prompt
+}
+
+// prompts for and reads a line, ok is false at the end of the input
+// lua-5.3.4/src/lua.c#pushline()
+func readLine(ls *golua.LuaState, in *bufio.Reader, firstLine bool) (line string, ok bool) {
+	fmt.Print(getPrompt(ls, firstLine))
+	line, err := in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false /* no input */
+	}
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	if firstLine && strings.HasPrefix(line, "=") { /* for compatibility with 5.2, ... */
+		line = "return " + line[1:] /* change '=' to 'return' */
+	}
+	return line, true
+}
+
+// reads a line and compiles it, first as an expression whose values are
+// printed, then as statements, reading more lines while the chunk is
+// incomplete. ok is false at the end of the input.
+// lua-5.3.4/src/lua.c#loadline()
+func loadLine(ls *golua.LuaState, in *bufio.Reader) (err error, ok bool) {
+	line, ok := readLine(ls, in, true)
+	if !ok {
+		return nil, false
+	}
+	/* try to compile it as 'return <line>' */
+	if load(ls, []byte("return "+line), "=stdin") == nil {
+		return nil, true
+	}
+	for { /* repeat until gets a complete statement */
+		err = load(ls, []byte(line), "=stdin")
+		if !incomplete(err) {
+			return err, true
+		}
+		more, ok := readLine(ls, in, false)
+		if !ok { /* no more input? */
+			return err, true
 		}
-		fmt.Println("")
+		line += "\n" + more
+	}
+}
+
+// the error of a chunk that could be completed by more input
+// lua-5.3.4/src/lua.c#incomplete()
+func incomplete(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), "<eof>")
+}
+
+// calls print with the n values on top of the stack
+// lua-5.3.4/src/lua.c#l_print()
+func printResults(ls *golua.LuaState, n int) {
+	if n <= 0 {
+		return
+	}
+	args := make([]golua.LuaValue, n)
+	for i := range args {
+		args[i] = ls.CheckAny(i - n)
+	}
+	ls.Pop(n)
+	ls.Push(ls.GetGlobal("print"))
+	for _, arg := range args {
+		ls.Push(arg)
+	}
+	if err := ls.PCall(n, 0, 0); err != nil {
+		message(fmt.Sprintf("error calling 'print' (%s)", errorMessage(ls, err)))
+	}
+}
+
+func writeCoverage(ls *golua.LuaState, filename string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer f.Close()
+	c := ls.StopCoverage()
+	if strings.HasSuffix(filename, ".html") {
+		err = c.WriteHTML(f)
+	} else {
+		err = c.WriteLcov(f)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 	}
 }
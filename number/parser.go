@@ -59,6 +59,9 @@ func ParseFloat(str string) (float64, bool) {
 		return -f, ok
 	}
 	f, err := strconv.ParseFloat(str, 64)
+	if e, ok := err.(*strconv.NumError); ok && e.Err == strconv.ErrRange {
+		return f, true /* overflow gives ±HUGE_VAL, as strtod */
+	}
 	return f, err == nil
 }
 
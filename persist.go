@@ -0,0 +1,456 @@
+package golua
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golua/compiler"
+	"math"
+	"runtime"
+)
+
+/*
+** Persist and Unpersist save Lua values to bytes and back, in the spirit
+** of Pluto and Eris: tables keep their metatables, a table or closure
+** reached twice is written once, so shared references and cycles come
+** back as they were, and Lua closures are written with their upvalues
+** and their prototypes as binary chunks. Go functions, coroutines and
+** the values of the host cannot be written out; they go through the
+** permanents of the state, see SetPermanents.
+ */
+
+const persistSignature = "\x1bGLP\x01"
+
+/* tags of persisted values */
+const (
+	persistNil = iota
+	persistFalse
+	persistTrue
+	persistNumber
+	persistString
+	persistRef       // a value or upvalue written before, by number
+	persistPermanent // a permanent, by name
+	persistTable
+	persistClosure
+	persistUserData
+	persistProto
+	persistUpvalue
+)
+
+// Permanents are the values that Persist writes by name instead of by
+// content and that Unpersist looks up by name, such as Go functions or
+// the global table, and the hooks that write the Go values of userdata.
+// The state that unpersists needs permanents with the same names.
+type Permanents struct {
+	values map[string]LuaValue
+	names  map[LuaValue]string
+	hooks  []namedUserDataHook
+}
+
+// A UserDataHook writes the Go values of userdata, their metatables and
+// environments are persisted along. Persist reports false for the values
+// it does not handle, Unpersist makes a value back from the bytes.
+type UserDataHook struct {
+	Persist   func(v interface{}) ([]byte, bool)
+	Unpersist func(data []byte) (interface{}, error)
+}
+
+type namedUserDataHook struct {
+	name string
+	UserDataHook
+}
+
+// NewPermanents returns permanents without values or hooks.
+func NewPermanents() *Permanents {
+	return &Permanents{
+		values: map[string]LuaValue{},
+		names:  map[LuaValue]string{},
+	}
+}
+
+// Add makes v, a table, function, userdata or coroutine, the permanent
+// called name.
+func (p *Permanents) Add(name string, v LuaValue) {
+	if old, ok := p.values[name]; ok {
+		delete(p.names, old)
+	}
+	p.values[name] = v
+	p.names[v] = name
+}
+
+// AddUserData adds the hook called name, hooks are tried in the order
+// they were added.
+func (p *Permanents) AddUserData(name string, h UserDataHook) {
+	p.hooks = append(p.hooks, namedUserDataHook{name, h})
+}
+
+func (p *Permanents) hook(name string) *namedUserDataHook {
+	for i := range p.hooks {
+		if p.hooks[i].name == name {
+			return &p.hooks[i]
+		}
+	}
+	return nil
+}
+
+// SetPermanents makes p the permanents of Persist and Unpersist on the
+// state, nil leaves none. Coroutines created afterwards share them.
+func (ls *LuaState) SetPermanents(p *Permanents) {
+	ls.perms = p
+}
+
+type persistError string
+
+func (e persistError) Error() string { return string(e) }
+
+// Persist writes v, and all the values it refers to, to bytes that
+// Unpersist restores.
+func Persist(ls *LuaState, v LuaValue) (data []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(persistError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	p := &persister{perms: ls.perms, refs: map[interface{}]uint64{}}
+	if p.perms == nil {
+		p.perms = NewPermanents()
+	}
+	p.data = append(p.data, persistSignature...)
+	p.writeValue(valueOf(v))
+	return p.data, nil
+}
+
+// Unpersist restores a value that Persist wrote. Its closures get fresh
+// upvalues, shared as they were by the persisted ones.
+func Unpersist(ls *LuaState, data []byte) (v LuaValue, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch e := r.(type) {
+			case persistError:
+				err = e
+			case runtime.Error:
+				err = errors.New("unpersist: truncated data")
+			default:
+				err = fmt.Errorf("unpersist: %v", r) /* from the chunk reader */
+			}
+		}
+	}()
+	u := &unpersister{ls: ls, perms: ls.perms, data: data}
+	if u.perms == nil {
+		u.perms = NewPermanents()
+	}
+	if len(data) < len(persistSignature) || string(data[:len(persistSignature)]) != persistSignature {
+		return nil, errors.New("unpersist: not persisted data")
+	}
+	u.data = u.data[len(persistSignature):]
+	val := u.readValue()
+	if len(u.data) > 0 {
+		return nil, errors.New("unpersist: extra data after the value")
+	}
+	return val.luaValue(), nil
+}
+
+type persister struct {
+	perms *Permanents
+	data  []byte
+	refs  map[interface{}]uint64 // tables, closures, userdata, protos and upvalues written
+}
+
+func (p *persister) writeUint(x uint64) {
+	p.data = binary.AppendUvarint(p.data, x)
+}
+
+func (p *persister) writeString(s string) {
+	p.writeUint(uint64(len(s)))
+	p.data = append(p.data, s...)
+}
+
+// writes the tag of a reference to obj if it was written before, else
+// reports false
+func (p *persister) writeRef(obj interface{}) bool {
+	id, ok := p.refs[obj]
+	if ok {
+		p.data = append(p.data, persistRef)
+		p.writeUint(id)
+	}
+	return ok
+}
+
+// gives obj the next number, in the order Unpersist creates the objects
+func (p *persister) addRef(obj interface{}) {
+	p.refs[obj] = uint64(len(p.refs))
+}
+
+func (p *persister) writeValue(v value) {
+	switch x := v.o.(type) {
+	case nil:
+		p.data = append(p.data, persistNil)
+		return
+	case LuaBool:
+		if x {
+			p.data = append(p.data, persistTrue)
+		} else {
+			p.data = append(p.data, persistFalse)
+		}
+		return
+	case LuaString:
+		p.data = append(p.data, persistString)
+		p.writeString(string(x))
+		return
+	}
+	if v.isNumber() {
+		p.data = append(p.data, persistNumber)
+		p.data = binary.LittleEndian.AppendUint64(p.data, math.Float64bits(v.n))
+		return
+	}
+	if name, ok := p.perms.names[v.o]; ok {
+		p.data = append(p.data, persistPermanent)
+		p.writeString(name)
+		return
+	}
+	if p.writeRef(v.o) {
+		return
+	}
+	switch x := v.o.(type) {
+	case *LuaTable:
+		p.writeTable(x)
+	case *LuaClosure:
+		p.writeClosure(x)
+	case *LuaUserData:
+		p.writeUserData(x)
+	default:
+		panic(persistError(fmt.Sprintf("persist: cannot persist a %s", v.valueType())))
+	}
+}
+
+func (p *persister) writeTable(tb *LuaTable) {
+	p.data = append(p.data, persistTable)
+	p.addRef(tb)
+	p.writeOptTable(tb.metatable)
+	for k, v, ok := tb.nextKey(nilValue); ok && !k.isNil(); k, v, ok = tb.nextKey(k) {
+		p.writeValue(k)
+		p.writeValue(v)
+	}
+	p.data = append(p.data, persistNil) /* end of the pairs */
+}
+
+func (p *persister) writeOptTable(mt *LuaTable) {
+	if mt == nil {
+		p.writeValue(nilValue)
+	} else {
+		p.writeValue(value{o: mt})
+	}
+}
+
+func (p *persister) writeClosure(c *LuaClosure) {
+	if c.goFunc != nil {
+		panic(persistError(fmt.Sprintf("persist: cannot persist Go function %p, it is not a permanent", c)))
+	}
+	p.data = append(p.data, persistClosure)
+	p.writeProto(c.proto)
+	p.addRef(c)
+	p.writeUint(uint64(len(c.upvals)))
+	for _, uv := range c.upvals {
+		if uv == nil {
+			p.data = append(p.data, persistNil)
+		} else if !p.writeRef(uv) {
+			p.data = append(p.data, persistUpvalue)
+			p.addRef(uv)
+			p.writeValue(*uv.val)
+		}
+	}
+}
+
+func (p *persister) writeProto(proto *luaProto) {
+	if p.writeRef(proto) {
+		return
+	}
+	p.data = append(p.data, persistProto)
+	p.addRef(proto)
+	p.writeString(string(compiler.Dump(proto.FunctionProto)))
+}
+
+func (p *persister) writeUserData(ud *LuaUserData) {
+	for _, h := range p.perms.hooks {
+		if data, ok := h.Persist(ud.Value); ok {
+			p.data = append(p.data, persistUserData)
+			p.writeString(h.name)
+			p.writeString(string(data))
+			p.addRef(ud)
+			p.writeOptTable(ud.Metatable)
+			p.writeOptTable(ud.Env)
+			return
+		}
+	}
+	panic(persistError(fmt.Sprintf("persist: no hook persists userdata of %T", ud.Value)))
+}
+
+type unpersister struct {
+	ls    *LuaState
+	perms *Permanents
+	data  []byte
+	refs  []interface{} // in the order of persister.addRef
+}
+
+func (u *unpersister) readByte() byte {
+	b := u.data[0]
+	u.data = u.data[1:]
+	return b
+}
+
+func (u *unpersister) readUint() uint64 {
+	x, n := binary.Uvarint(u.data)
+	if n <= 0 {
+		panic(persistError("unpersist: truncated data"))
+	}
+	u.data = u.data[n:]
+	return x
+}
+
+func (u *unpersister) readString() string {
+	n := u.readUint()
+	if n > uint64(len(u.data)) {
+		panic(persistError("unpersist: truncated data"))
+	}
+	s := string(u.data[:n])
+	u.data = u.data[n:]
+	return s
+}
+
+// the object numbered by the reference that follows
+func (u *unpersister) readRef() interface{} {
+	id := u.readUint()
+	if id >= uint64(len(u.refs)) {
+		panic(persistError(fmt.Sprintf("unpersist: bad reference %d", id)))
+	}
+	return u.refs[id]
+}
+
+func (u *unpersister) readValue() value {
+	switch tag := u.readByte(); tag {
+	case persistNil:
+		return nilValue
+	case persistFalse:
+		return boolValue(false)
+	case persistTrue:
+		return boolValue(true)
+	case persistNumber:
+		n := math.Float64frombits(binary.LittleEndian.Uint64(u.data))
+		u.data = u.data[8:]
+		return numberValue(n)
+	case persistString:
+		return value{o: LuaString(u.readString())}
+	case persistRef:
+		if v, ok := u.readRef().(LuaValue); ok {
+			return value{o: v}
+		}
+	case persistPermanent:
+		name := u.readString()
+		v, ok := u.perms.values[name]
+		if !ok {
+			panic(persistError(fmt.Sprintf("unpersist: no permanent '%s'", name)))
+		}
+		return valueOf(v)
+	case persistTable:
+		return value{o: u.readTable()}
+	case persistClosure:
+		return value{o: u.readClosure()}
+	case persistUserData:
+		return value{o: u.readUserData()}
+	}
+	panic(persistError("unpersist: corrupted data"))
+}
+
+func (u *unpersister) readTable() *LuaTable {
+	tb := newLuaTable(0, 0)
+	u.refs = append(u.refs, tb)
+	tb.metatable = u.readOptTable()
+	for {
+		k := u.readValue()
+		if k.isNil() {
+			return tb
+		}
+		tb.set(k, u.readValue())
+	}
+}
+
+func (u *unpersister) readOptTable() *LuaTable {
+	switch x := u.readValue().o.(type) {
+	case nil:
+		return nil
+	case *LuaTable:
+		return x
+	default:
+		panic(persistError("unpersist: corrupted data"))
+	}
+}
+
+func (u *unpersister) readClosure() *LuaClosure {
+	c := newLuaClosure(u.readProto())
+	u.refs = append(u.refs, c)
+	if n := u.readUint(); n != uint64(len(c.upvals)) {
+		panic(persistError("unpersist: corrupted data"))
+	}
+	for i := range c.upvals {
+		switch u.readByte() {
+		case persistNil:
+		case persistRef:
+			uv, ok := u.readRef().(*upvalue)
+			if !ok {
+				panic(persistError("unpersist: corrupted data"))
+			}
+			c.upvals[i] = uv
+		case persistUpvalue:
+			uv := &upvalue{val: new(value)}
+			u.refs = append(u.refs, uv)
+			*uv.val = u.readValue()
+			c.upvals[i] = uv
+		default:
+			panic(persistError("unpersist: corrupted data"))
+		}
+	}
+	return c
+}
+
+func (u *unpersister) readProto() *luaProto {
+	switch u.readByte() {
+	case persistRef:
+		if proto, ok := u.readRef().(*luaProto); ok {
+			return proto
+		}
+	case persistProto:
+		chunk := []byte(u.readString())
+		if len(chunk) == 0 || chunk[0] != compiler.LUA_SIGNATURE[0] {
+			break /* not a binary chunk, Compile would parse it */
+		}
+		proto := newLuaProto(compiler.Compile(chunk, "=?"))
+		if u.ls.cover != nil {
+			u.ls.cover.add(proto)
+		}
+		u.refs = append(u.refs, proto)
+		return proto
+	}
+	panic(persistError("unpersist: corrupted data"))
+}
+
+func (u *unpersister) readUserData() *LuaUserData {
+	name := u.readString()
+	data := []byte(u.readString())
+	h := u.perms.hook(name)
+	if h == nil {
+		panic(persistError(fmt.Sprintf("unpersist: no userdata hook '%s'", name)))
+	}
+	v, err := h.Unpersist(data)
+	if err != nil {
+		panic(persistError(fmt.Sprintf("unpersist: %s: %v", name, err)))
+	}
+	ud := &LuaUserData{Value: v}
+	u.refs = append(u.refs, ud)
+	ud.Metatable = u.readOptTable()
+	ud.Env = u.readOptTable()
+	return ud
+}
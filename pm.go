@@ -2,637 +2,775 @@
 package golua
 
 import (
+	"container/list"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
-const EOS = -1
-const _UNKNOWN = -2
+/*
+** {======================================================
+** PATTERN MATCHING
+** =======================================================
+ */
 
-/* Error {{{ */
+const (
+	LUA_MAXCAPTURES = 32  /* maximum number of captures that a pattern can do during pattern-matching */
+	MAXCCALLS       = 200 /* maximum recursion depth for 'match' */
 
-type Error struct {
-	Pos     int
-	Message string
-}
+	CAP_UNFINISHED = -1
+	CAP_POSITION   = -2
 
-func newError(pos int, message string, args ...interface{}) *Error {
-	if len(args) == 0 {
-		return &Error{pos, message}
-	}
-	return &Error{pos, fmt.Sprintf(message, args...)}
-}
-
-func (e *Error) Error() string {
-	switch e.Pos {
-	case EOS:
-		return fmt.Sprintf("%s at EOS", e.Message)
-	case _UNKNOWN:
-		return fmt.Sprintf("%s", e.Message)
-	default:
-		return fmt.Sprintf("%s at %d", e.Message, e.Pos)
-	}
-}
+	SPECIALS = "^$*+?.([%-" /* pattern has no special characters? */
+)
 
-/* }}} */
+// a pattern error raised by a matcher without a state
+type patternError string
 
-/* MatchData {{{ */
+func (e patternError) Error() string { return string(e) }
 
-type MatchData struct {
-	// captured positions
-	// layout
-	// xxxx xxxx xxxx xxx0 : caputured positions
-	// xxxx xxxx xxxx xxx1 : position captured positions
-	captures []uint32
+type capture struct {
+	init int /* index of the capture in src */
+	len  int /* its length, or CAP_UNFINISHED, CAP_POSITION */
 }
 
-func newMatchState() *MatchData { return &MatchData{[]uint32{}} }
-
-func (st *MatchData) addPosCapture(s, pos int) {
-	for s+1 >= len(st.captures) {
-		st.captures = append(st.captures, 0)
-	}
-	st.captures[s] = (uint32(pos) << 1) | 1
-	st.captures[s+1] = (uint32(pos) << 1) | 1
+// lua-5.3.4/src/lstrlib.c#MatchState
+type matchState struct {
+	src        string /* the subject */
+	p          string /* the pattern */
+	ends       []int  /* cached classEnd of p, 0 where unknown */
+	level      int    /* total number of captures (finished or unfinished) */
+	matchdepth int    /* control for recursive depth (to avoid C stack overflow) */
+	capture    [LUA_MAXCAPTURES]capture
+	ls         *LuaState /* nil outside of the string library */
 }
 
-func (st *MatchData) setCapture(s, pos int) uint32 {
-	for s >= len(st.captures) {
-		st.captures = append(st.captures, 0)
-	}
-	v := st.captures[s]
-	st.captures[s] = (uint32(pos) << 1)
-	return v
+// lua-5.3.4/src/lstrlib.c#prepstate()
+func (pat *Pattern) newMatchState(ls *LuaState, s string) *matchState {
+	return &matchState{src: s, p: pat.expr, ends: pat.ends, matchdepth: MAXCCALLS, ls: ls}
 }
 
-func (st *MatchData) restoreCapture(s int, pos uint32) { st.captures[s] = pos }
-
-func (st *MatchData) CaptureLength() int { return len(st.captures) }
-
-func (st *MatchData) IsPosCapture(idx int) bool { return (st.captures[idx] & 1) == 1 }
-
-func (st *MatchData) Capture(idx int) int { return int(st.captures[idx] >> 1) }
-
-/* }}} */
-
-/* scanner {{{ */
-
-type scannerState struct {
-	Pos     int
-	started bool
+// lua-5.3.4/src/lstrlib.c#reprepstate()
+func (ms *matchState) reprepstate() {
+	ms.level = 0
+	ms.matchdepth = MAXCCALLS
 }
 
-type scanner struct {
-	src   []byte
-	State scannerState
-	saved scannerState
+// raises a pattern error as luaL_error does, or panics with a
+// patternError when there is no state
+func (ms *matchState) error(format string, a ...interface{}) {
+	if ms.ls != nil {
+		ms.ls.Error2(format, a...)
+	}
+	panic(patternError(fmt.Sprintf(format, a...)))
 }
 
-func newScanner(src []byte) *scanner {
-	return &scanner{
-		src: src,
-		State: scannerState{
-			Pos:     0,
-			started: false,
-		},
-		saved: scannerState{},
+// the pattern char at p, '\0' past its end as in C
+func (ms *matchState) pat(p int) byte {
+	if p < len(ms.p) {
+		return ms.p[p]
 	}
+	return 0
 }
 
-func (sc *scanner) Length() int { return len(sc.src) }
+// lua-5.3.4/src/lstrlib.c#check_capture()
+func (ms *matchState) checkCapture(l int) int {
+	l -= '1'
+	if l < 0 || l >= ms.level || ms.capture[l].len == CAP_UNFINISHED {
+		ms.error("invalid capture index %%%d", l+1)
+	}
+	return l
+}
 
-func (sc *scanner) Next() int {
-	if !sc.State.started {
-		sc.State.started = true
-		if len(sc.src) == 0 {
-			sc.State.Pos = EOS
+// lua-5.3.4/src/lstrlib.c#capture_to_close()
+func (ms *matchState) captureToClose() int {
+	level := ms.level
+	for level--; level >= 0; level-- {
+		if ms.capture[level].len == CAP_UNFINISHED {
+			return level
 		}
-	} else {
-		sc.State.Pos = sc.NextPos()
-	}
-	if sc.State.Pos == EOS {
-		return EOS
 	}
-	return int(sc.src[sc.State.Pos])
+	ms.error("invalid pattern capture")
+	return 0
 }
 
-func (sc *scanner) CurrentPos() int {
-	return sc.State.Pos
+// lua-5.3.4/src/lstrlib.c#classEnd()
+func (ms *matchState) classEnd(p int) int {
+	if ms.ends != nil && ms.ends[p] != 0 {
+		return ms.ends[p]
+	}
+	c := ms.p[p]
+	p++
+	switch c {
+	case L_ESC:
+		if p == len(ms.p) {
+			ms.error("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if ms.pat(p) == '^' {
+			p++
+		}
+		for { /* look for a ']' */
+			if p == len(ms.p) {
+				ms.error("malformed pattern (missing ']')")
+			}
+			c := ms.p[p]
+			p++
+			if c == L_ESC && p < len(ms.p) {
+				p++ /* skip escapes (e.g. '%]') */
+			}
+			if ms.pat(p) == ']' {
+				break
+			}
+		}
+		return p + 1
+	default:
+		return p
+	}
 }
 
-func (sc *scanner) NextPos() int {
-	if sc.State.Pos == EOS || sc.State.Pos >= len(sc.src)-1 {
-		return EOS
+// lua-5.3.4/src/lstrlib.c#match_class()
+func matchClass(c, cl int) bool {
+	var res bool
+	switch tolower(cl) {
+	case 'a':
+		res = isalpha(c)
+	case 'c':
+		res = iscntrl(c)
+	case 'd':
+		res = isdigit(c)
+	case 'g':
+		res = isgraph(c)
+	case 'l':
+		res = islower(c)
+	case 'p':
+		res = ispunct(c)
+	case 's':
+		res = isspace(c)
+	case 'u':
+		res = isupper(c)
+	case 'w':
+		res = isalnum(c)
+	case 'x':
+		res = isxdigit(c)
+	case 'z':
+		res = c == 0 /* deprecated option */
+	default:
+		return cl == c
 	}
-	if !sc.State.started {
-		return 0
-	} else {
-		return sc.State.Pos + 1
+	if isupper(cl) {
+		return !res
 	}
+	return res
 }
 
-func (sc *scanner) Peek() int {
-	cureof := sc.State.Pos == EOS
-	ch := sc.Next()
-	if !cureof {
-		if sc.State.Pos == EOS {
-			sc.State.Pos = len(sc.src) - 1
-		} else {
-			sc.State.Pos--
-			if sc.State.Pos < 0 {
-				sc.State.Pos = 0
-				sc.State.started = false
+// the set [...] from p to its closing ']' at ec
+// lua-5.3.4/src/lstrlib.c#matchbracketclass()
+func (ms *matchState) matchBracketClass(c, p, ec int) bool {
+	sig := true
+	if ms.p[p+1] == '^' {
+		sig = false
+		p++ /* skip the '^' */
+	}
+	for p++; p < ec; p++ {
+		if ms.p[p] == L_ESC {
+			p++
+			if matchClass(c, int(ms.p[p])) {
+				return sig
 			}
+		} else if ms.p[p+1] == '-' && p+2 < ec {
+			p += 2
+			if int(ms.p[p-2]) <= c && c <= int(ms.p[p]) {
+				return sig
+			}
+		} else if int(ms.p[p]) == c {
+			return sig
 		}
 	}
-	return ch
+	return !sig
 }
 
-func (sc *scanner) Save() { sc.saved = sc.State }
-
-func (sc *scanner) Restore() { sc.State = sc.saved }
-
-/* }}} */
-
-/* bytecode {{{ */
-
-type opCode int
-
-const (
-	opChar opCode = iota
-	opMatch
-	opTailMatch
-	opJmp
-	opSplit
-	opSave
-	opPSave
-	opBrace
-	opNumber
-)
-
-type inst struct {
-	OpCode   opCode
-	Class    class
-	Operand1 int
-	Operand2 int
-}
-
-/* }}} */
-
-/* classes {{{ */
-
-type class interface {
-	Matches(ch int) bool
+// lua-5.3.4/src/lstrlib.c#singlematch()
+func (ms *matchState) singleMatch(s, p, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := int(ms.src[s])
+	switch ms.p[p] {
+	case '.':
+		return true /* matches any char */
+	case L_ESC:
+		return matchClass(c, int(ms.p[p+1]))
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	default:
+		return int(ms.p[p]) == c
+	}
 }
 
-type dotClass struct{}
-
-func (pn *dotClass) Matches(ch int) bool { return true }
-
-type charClass struct {
-	Ch int
+// lua-5.3.4/src/lstrlib.c#matchbalance()
+func (ms *matchState) matchBalance(s, p int) int {
+	if p >= len(ms.p)-1 {
+		ms.error("malformed pattern (missing arguments to '%%b')")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.p[p] {
+		return -1
+	}
+	b, e := ms.p[p], ms.p[p+1]
+	cont := 1
+	for s++; s < len(ms.src); s++ {
+		if ms.src[s] == e {
+			if cont--; cont == 0 {
+				return s + 1
+			}
+		} else if ms.src[s] == b {
+			cont++
+		}
+	}
+	return -1
 }
 
-func (pn *charClass) Matches(ch int) bool { return pn.Ch == ch }
-
-type singleClass struct {
-	Class int
+// lua-5.3.4/src/lstrlib.c#max_expand()
+func (ms *matchState) maxExpand(s, p, ep int) int {
+	i := 0 /* counts maximum expand for item */
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	/* keeps trying to match with the maximum repetitions */
+	for ; i >= 0; i-- {
+		if res := ms.match(s+i, ep+1); res != -1 {
+			return res
+		}
+	}
+	return -1
 }
 
-func (pn *singleClass) Matches(ch int) bool {
-	ret := false
-	switch pn.Class {
-	case 'a', 'A':
-		ret = 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z'
-	case 'c', 'C':
-		ret = (0x00 <= ch && ch <= 0x1F) || ch == 0x7F
-	case 'd', 'D':
-		ret = '0' <= ch && ch <= '9'
-	case 'l', 'L':
-		ret = 'a' <= ch && ch <= 'z'
-	case 'p', 'P':
-		ret = (0x21 <= ch && ch <= 0x2f) || (0x30 <= ch && ch <= 0x40) || (0x5b <= ch && ch <= 0x60) || (0x7b <= ch && ch <= 0x7e)
-	case 's', 'S':
-		switch ch {
-		case ' ', '\f', '\n', '\r', '\t', '\v':
-			ret = true
+// lua-5.3.4/src/lstrlib.c#min_expand()
+func (ms *matchState) minExpand(s, p, ep int) int {
+	for {
+		if res := ms.match(s, ep+1); res != -1 {
+			return res
+		} else if ms.singleMatch(s, p, ep) {
+			s++ /* try with one more repetition */
+		} else {
+			return -1
 		}
-	case 'u', 'U':
-		ret = 'A' <= ch && ch <= 'Z'
-	case 'w', 'W':
-		ret = '0' <= ch && ch <= '9' || 'A' <= ch && ch <= 'Z' || 'a' <= ch && ch <= 'z'
-	case 'x', 'X':
-		ret = '0' <= ch && ch <= '9' || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
-	case 'z', 'Z':
-		ret = ch == 0
-	default:
-		return ch == pn.Class
-	}
-	if 'A' <= pn.Class && pn.Class <= 'Z' {
-		return !ret
 	}
-	return ret
 }
 
-type setClass struct {
-	IsNot   bool
-	Classes []class
+// lua-5.3.4/src/lstrlib.c#start_capture()
+func (ms *matchState) startCapture(s, p, what int) int {
+	level := ms.level
+	if level >= LUA_MAXCAPTURES {
+		ms.error("too many captures")
+	}
+	ms.capture[level].init = s
+	ms.capture[level].len = what
+	ms.level = level + 1
+	res := ms.match(s, p)
+	if res == -1 { /* match failed? */
+		ms.level-- /* undo capture */
+	}
+	return res
 }
 
-func (pn *setClass) Matches(ch int) bool {
-	for _, class := range pn.Classes {
-		if class.Matches(ch) {
-			return !pn.IsNot
-		}
+// lua-5.3.4/src/lstrlib.c#end_capture()
+func (ms *matchState) endCapture(s, p int) int {
+	l := ms.captureToClose()
+	ms.capture[l].len = s - ms.capture[l].init /* close capture */
+	res := ms.match(s, p)
+	if res == -1 { /* match failed? */
+		ms.capture[l].len = CAP_UNFINISHED /* undo capture */
 	}
-	return pn.IsNot
+	return res
 }
 
-type rangeClass struct {
-	Begin class
-	End   class
+// lua-5.3.4/src/lstrlib.c#match_capture()
+func (ms *matchState) matchCapture(s, l int) int {
+	l = ms.checkCapture(l)
+	init, n := ms.capture[l].init, ms.capture[l].len
+	if n >= 0 && len(ms.src)-s >= n && ms.src[init:init+n] == ms.src[s:s+n] {
+		return s + n
+	}
+	return -1
 }
 
-func (pn *rangeClass) Matches(ch int) bool {
-	switch begin := pn.Begin.(type) {
-	case *charClass:
-		end, ok := pn.End.(*charClass)
-		if !ok {
-			return false
+// match returns the end of the match of the pattern from p against the
+// subject from s, or -1
+// lua-5.3.4/src/lstrlib.c#match()
+func (ms *matchState) match(s, p int) int {
+	if ms.matchdepth == 0 {
+		ms.error("pattern too complex")
+	}
+	ms.matchdepth--
+init: /* using continue to optimize tail recursion */
+	for p != len(ms.p) { /* end of pattern? */
+		switch ms.p[p] {
+		case '(': /* start capture */
+			if ms.pat(p+1) == ')' { /* position capture? */
+				s = ms.startCapture(s, p+2, CAP_POSITION)
+			} else {
+				s = ms.startCapture(s, p+1, CAP_UNFINISHED)
+			}
+			break init
+		case ')': /* end capture */
+			s = ms.endCapture(s, p+1)
+			break init
+		case '$':
+			if p+1 == len(ms.p) { /* is the '$' the last char in pattern? */
+				if s != len(ms.src) { /* check end of string */
+					s = -1
+				}
+				break init
+			} /* else go to default */
+		case L_ESC: /* escaped sequences not in the format class[*+?-]? */
+			switch ms.pat(p + 1) {
+			case 'b': /* balanced string? */
+				if s = ms.matchBalance(s, p+2); s != -1 {
+					p += 4
+					continue /* return match(ms, s, p + 4); */
+				} /* else fail (s == -1) */
+				break init
+			case 'f': /* frontier? */
+				p += 2
+				if ms.pat(p) != '[' {
+					ms.error("missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p) /* points to what is next */
+				previous, current := 0, 0
+				if s != 0 {
+					previous = int(ms.src[s-1])
+				}
+				if s < len(ms.src) {
+					current = int(ms.src[s])
+				}
+				if !ms.matchBracketClass(previous, p, ep-1) &&
+					ms.matchBracketClass(current, p, ep-1) {
+					p = ep
+					continue /* return match(ms, s, ep); */
+				}
+				s = -1 /* match failed */
+				break init
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9': /* capture results (%0-%9)? */
+				if s = ms.matchCapture(s, int(ms.p[p+1])); s != -1 {
+					p += 2
+					continue /* return match(ms, s, p + 2) */
+				}
+				break init
+			} /* else go to default */
+		}
+		/* default: pattern class plus optional suffix */
+		ep := ms.classEnd(p)           /* points to optional suffix */
+		if !ms.singleMatch(s, p, ep) { /* does not match at least once? */
+			if c := ms.pat(ep); c == '*' || c == '?' || c == '-' { /* accept empty? */
+				p = ep + 1
+				continue /* return match(ms, s, ep + 1); */
+			}
+			s = -1 /* '+' or no suffix, fail */
+			break
+		}
+		/* matched once */
+		switch ms.pat(ep) { /* handle optional suffix */
+		case '?': /* optional */
+			if res := ms.match(s+1, ep+1); res != -1 {
+				s = res
+			} else {
+				p = ep + 1
+				continue /* else return match(ms, s, ep + 1); */
+			}
+		case '+': /* 1 or more repetitions */
+			s = ms.maxExpand(s+1, p, ep) /* 1 match already done */
+		case '*': /* 0 or more repetitions */
+			s = ms.maxExpand(s, p, ep)
+		case '-': /* 0 or more repetitions (minimum) */
+			s = ms.minExpand(s, p, ep)
+		default: /* no suffix */
+			s++
+			p = ep
+			continue /* return match(ms, s + 1, ep); */
 		}
-		return begin.Ch <= ch && ch <= end.Ch
+		break
 	}
-	return false
+	ms.matchdepth++
+	return s
 }
 
-// }}}
-
-// patterns {{{
-
-type pattern interface{}
-
-type singlePattern struct {
-	Class class
+// getCapture returns capture i of the match from s to e: a substring, or
+// a 1-based position when pos is true
+// lua-5.3.4/src/lstrlib.c#push_onecapture()
+func (ms *matchState) getCapture(i, s, e int) (str string, p int, pos bool) {
+	if i >= ms.level {
+		if i != 0 {
+			ms.error("invalid capture index %%%d", i+1)
+		}
+		return ms.src[s:e], 0, false /* add whole match */
+	}
+	l := ms.capture[i].len
+	if l == CAP_UNFINISHED {
+		ms.error("unfinished capture")
+	}
+	if l == CAP_POSITION {
+		return "", ms.capture[i].init + 1, true
+	}
+	return ms.src[ms.capture[i].init : ms.capture[i].init+l], 0, false
 }
 
-type seqPattern struct {
-	MustHead bool
-	MustTail bool
-	Patterns []pattern
+// the number of captures of the match from s, s is -1 when only the
+// explicit captures count
+// lua-5.3.4/src/lstrlib.c#push_captures()
+func (ms *matchState) nlevels(s int) int {
+	if ms.level == 0 && s != -1 {
+		return 1
+	}
+	return ms.level
 }
 
-type repeatPattern struct {
-	Type  int
-	Class class
+// find looks for the pattern in the subject from init on, a 0-based
+// position, and returns where the match starts and ends, or -1
+// lua-5.3.4/src/lstrlib.c#str_find_aux()
+func (ms *matchState) find(init int, anchor bool) (int, int) {
+	p := 0
+	if anchor {
+		p = 1 /* skip anchor character */
+	}
+	for s1 := init; ; s1++ {
+		ms.reprepstate()
+		if e := ms.match(s1, p); e != -1 {
+			return s1, e
+		}
+		if s1 >= len(ms.src) || anchor {
+			return -1, -1
+		}
+	}
 }
 
-type posCapPattern struct{}
-
-type capPattern struct {
-	Pattern pattern
+// gsub calls f with where each match of the pattern in the subject starts
+// and ends, at most n of them, and returns how many there were
+// lua-5.3.4/src/lstrlib.c#str_gsub()
+func (ms *matchState) gsub(anchor bool, n int64, f func(s, e int)) int64 {
+	p := 0
+	if anchor {
+		p = 1 /* skip anchor character */
+	}
+	lastmatch := -1 /* end of last match */
+	s, count := 0, int64(0)
+	for count < n {
+		ms.reprepstate()                                    /* (re)prepare state for new match */
+		if e := ms.match(s, p); e != -1 && e != lastmatch { /* match? */
+			count++
+			f(s, e)
+			s, lastmatch = e, e
+		} else if s < len(ms.src) { /* otherwise, skip one character */
+			s++
+		} else {
+			break /* end of subject */
+		}
+		if anchor {
+			break
+		}
+	}
+	return count
 }
 
-type numberPattern struct {
-	N int
+// addS appends the replacement string news for the match from s to e,
+// where %0-%9 stand for its captures
+// lua-5.3.4/src/lstrlib.c#add_s()
+func (ms *matchState) addS(b *strings.Builder, news string, s, e int) {
+	for i := 0; i < len(news); i++ {
+		if news[i] != L_ESC {
+			b.WriteByte(news[i])
+			continue
+		}
+		i++ /* skip ESC */
+		if i == len(news) || !isdigit(int(news[i])) {
+			if i == len(news) || news[i] != L_ESC {
+				ms.error("invalid use of '%c' in replacement string", L_ESC)
+			}
+			b.WriteByte(news[i])
+		} else if news[i] == '0' {
+			b.WriteString(ms.src[s:e])
+		} else if str, p, pos := ms.getCapture(int(news[i]-'1'), s, e); pos {
+			b.WriteString(strconv.Itoa(p)) /* if number, convert it to string */
+		} else {
+			b.WriteString(str)
+		}
+	}
 }
 
-type bracePattern struct {
-	Begin int
-	End   int
+// lua-5.3.4/src/lstrlib.c#nospecials()
+func nospecials(p string) bool {
+	for i := 0; i < len(p); i++ {
+		if strings.IndexByte(SPECIALS, p[i]) >= 0 {
+			return false /* pattern has a special character */
+		}
+	}
+	return true /* no special chars found */
 }
 
-// }}}
+/* }====================================================== */
 
-/* parse {{{ */
+// A Pattern is a compiled Lua pattern, as string.find and the other
+// functions of the string library take them. It is safe for concurrent
+// use. Positions are 0-based byte offsets, as Go slices strings.
+type Pattern struct {
+	expr   string
+	anchor bool  /* whether the pattern starts with '^' */
+	ends   []int /* where each class of expr ends, 0 where unknown */
+}
 
-func parseClass(sc *scanner, allowset bool) class {
-	ch := sc.Next()
-	switch ch {
-	case '%':
-		return &singleClass{sc.Next()}
-	case '.':
-		if allowset {
-			return &dotClass{}
-		}
-		return &charClass{ch}
-	case '[':
-		if allowset {
-			return parseClassSet(sc)
-		}
-		return &charClass{ch}
-	//case '^' '$', '(', ')', ']', '*', '+', '-', '?':
-	//	panic(newError(sc.CurrentPos(), "invalid %c", ch))
-	case EOS:
-		panic(newError(sc.CurrentPos(), "unexpected EOS"))
-	default:
-		return &charClass{ch}
+// CompilePattern parses a Lua pattern, and returns an error for the
+// malformed ones, which the string library only raises when matching
+// reaches the bad spot.
+func CompilePattern(expr string) (*Pattern, error) {
+	pat, err := compilePattern(expr)
+	if err != nil {
+		return nil, err
 	}
+	return pat, nil
 }
 
-func parseClassSet(sc *scanner) class {
-	set := &setClass{false, []class{}}
-	if sc.Peek() == '^' {
-		set.IsNot = true
-		sc.Next()
+// compilePattern walks the items of the pattern the way match does,
+// caching where its classes end; err is the first error it meets
+func compilePattern(expr string) (pat *Pattern, err error) {
+	pat = &Pattern{expr: expr, ends: make([]int, len(expr))}
+	pat.anchor = len(expr) > 0 && expr[0] == '^'
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(patternError)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+	ms := &matchState{p: expr}
+	var caps []bool /* whether each capture is closed */
+	p := 0
+	if pat.anchor {
+		p = 1 /* skip anchor character */
 	}
-	isrange := false
-	for {
-		ch := sc.Peek()
-		switch ch {
-		// case '[':
-		// 	panic(newError(sc.CurrentPos(), "'[' can not be nested"))
-		case EOS:
-			panic(newError(sc.CurrentPos(), "unexpected EOS"))
-		case ']':
-			if len(set.Classes) > 0 {
-				sc.Next()
-				goto exit
+	for p < len(expr) {
+		switch expr[p] {
+		case '(':
+			if len(caps) >= LUA_MAXCAPTURES {
+				ms.error("too many captures")
+			}
+			if ms.pat(p+1) == ')' { /* position capture? */
+				caps = append(caps, true)
+				p += 2
+			} else {
+				caps = append(caps, false)
+				p++
+			}
+			continue
+		case ')':
+			l := len(caps) - 1
+			for l >= 0 && caps[l] {
+				l--
+			}
+			if l < 0 {
+				ms.error("invalid pattern capture")
 			}
-			fallthrough
-		case '-':
-			if len(set.Classes) > 0 {
-				sc.Next()
-				isrange = true
+			caps[l] = true
+			p++
+			continue
+		case '$':
+			if p+1 == len(expr) {
+				p++
+				continue
+			}
+		case L_ESC:
+			switch ms.pat(p + 1) {
+			case 'b':
+				if p+2 >= len(expr)-1 {
+					ms.error("malformed pattern (missing arguments to '%%b')")
+				}
+				p += 4
+				continue
+			case 'f':
+				p += 2
+				if ms.pat(p) != '[' {
+					ms.error("missing '[' after '%%f' in pattern")
+				}
+				pat.ends[p] = ms.classEnd(p)
+				p = pat.ends[p]
+				continue
+			case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+				if l := int(expr[p+1]) - '1'; l < 0 || l >= len(caps) || !caps[l] {
+					ms.error("invalid capture index %%%d", l+1)
+				}
+				p += 2
 				continue
 			}
-			fallthrough
-		default:
-			set.Classes = append(set.Classes, parseClass(sc, false))
 		}
-		if isrange {
-			begin := set.Classes[len(set.Classes)-2]
-			end := set.Classes[len(set.Classes)-1]
-			set.Classes = set.Classes[0 : len(set.Classes)-2]
-			set.Classes = append(set.Classes, &rangeClass{begin, end})
-			isrange = false
+		ep := ms.classEnd(p)
+		pat.ends[p] = ep
+		if c := ms.pat(ep); c == '*' || c == '+' || c == '-' || c == '?' {
+			ep++ /* skip the suffix */
 		}
+		p = ep
 	}
-exit:
-	if isrange {
-		set.Classes = append(set.Classes, &charClass{'-'})
+	for _, closed := range caps {
+		if !closed {
+			ms.error("unfinished capture")
+		}
 	}
+	return pat, nil
+}
 
-	return set
+// String returns the source text of the pattern.
+func (pat *Pattern) String() string {
+	return pat.expr
 }
 
-func parsePattern(sc *scanner, toplevel bool) *seqPattern {
-	pat := &seqPattern{}
-	if toplevel {
-		if sc.Peek() == '^' {
-			sc.Next()
-			pat.MustHead = true
-		}
-	}
-	for {
-		ch := sc.Peek()
-		switch ch {
-		case '%':
-			sc.Save()
-			sc.Next()
-			switch sc.Peek() {
-			case '0':
-				panic(newError(sc.CurrentPos(), "invalid capture index"))
-			case '1', '2', '3', '4', '5', '6', '7', '8', '9':
-				pat.Patterns = append(pat.Patterns, &numberPattern{sc.Next() - 48})
-			case 'b':
-				sc.Next()
-				pat.Patterns = append(pat.Patterns, &bracePattern{sc.Next(), sc.Next()})
-			default:
-				sc.Restore()
-				pat.Patterns = append(pat.Patterns, &singlePattern{parseClass(sc, true)})
-			}
-		case '.', '[', ']':
-			pat.Patterns = append(pat.Patterns, &singlePattern{parseClass(sc, true)})
-		//case ']':
-		//	panic(newError(sc.CurrentPos(), "invalid ']'"))
-		case ')':
-			if toplevel {
-				panic(newError(sc.CurrentPos(), "invalid ')'"))
-			}
-			return pat
-		case '(':
-			sc.Next()
-			if sc.Peek() == ')' {
-				sc.Next()
-				pat.Patterns = append(pat.Patterns, &posCapPattern{})
-			} else {
-				ret := &capPattern{parsePattern(sc, false)}
-				if sc.Peek() != ')' {
-					panic(newError(sc.CurrentPos(), "unfinished capture"))
-				}
-				sc.Next()
-				pat.Patterns = append(pat.Patterns, ret)
-			}
-		case '*', '+', '-', '?':
-			sc.Next()
-			if len(pat.Patterns) > 0 {
-				spat, ok := pat.Patterns[len(pat.Patterns)-1].(*singlePattern)
-				if ok {
-					pat.Patterns = pat.Patterns[0 : len(pat.Patterns)-1]
-					pat.Patterns = append(pat.Patterns, &repeatPattern{ch, spat.Class})
-					continue
-				}
-			}
-			pat.Patterns = append(pat.Patterns, &singlePattern{&charClass{ch}})
-		case '$':
-			if toplevel && (sc.NextPos() == sc.Length()-1 || sc.NextPos() == EOS) {
-				pat.MustTail = true
-			} else {
-				pat.Patterns = append(pat.Patterns, &singlePattern{&charClass{ch}})
+// run matches the pattern against s in f, turning the errors of the
+// matcher, like "pattern too complex", into err
+func (pat *Pattern) run(s string, f func(ms *matchState)) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(patternError)
+			if !ok {
+				panic(r)
 			}
-			sc.Next()
-		case EOS:
-			sc.Next()
-			goto exit
-		default:
-			sc.Next()
-			pat.Patterns = append(pat.Patterns, &singlePattern{&charClass{ch}})
+			err = e
 		}
+	}()
+	f(pat.newMatchState(nil, s))
+	return nil
+}
+
+// Find returns the location of the first match in s at or after init,
+// as string.find does: s[loc[0]:loc[1]] is the match. It returns nil if
+// there is none.
+func (pat *Pattern) Find(s string, init int) (loc []int, err error) {
+	if init < 0 {
+		init = 0
+	} else if init > len(s) { /* start after string's end? */
+		return nil, nil
 	}
-exit:
-	return pat
+	err = pat.run(s, func(ms *matchState) {
+		if start, end := ms.find(init, pat.anchor); start != -1 {
+			loc = []int{start, end}
+		}
+	})
+	return
 }
 
-type iptr struct {
-	insts   []inst
-	capture int
+// FindAll returns the locations of the successive matches in s, at most
+// n of them, or all if n < 0. They are those string.gsub replaces.
+func (pat *Pattern) FindAll(s string, n int) (locs [][]int, err error) {
+	max := int64(n)
+	if n < 0 {
+		max = int64(len(s) + 1)
+	}
+	err = pat.run(s, func(ms *matchState) {
+		ms.gsub(pat.anchor, max, func(s, e int) {
+			locs = append(locs, []int{s, e})
+		})
+	})
+	return
 }
 
-func compilePattern(p pattern, ps ...*iptr) []inst {
-	var ptr *iptr
-	toplevel := false
-	if len(ps) == 0 {
-		toplevel = true
-		ptr = &iptr{[]inst{inst{opSave, nil, 0, -1}}, 2}
-	} else {
-		ptr = ps[0]
+// Match returns the captures of the first match in s at or after init,
+// or the whole match when the pattern has none, as string.match does. A
+// position capture is its 1-based position in decimal. It returns nil if
+// there is no match.
+func (pat *Pattern) Match(s string, init int) (captures []string, err error) {
+	if init < 0 {
+		init = 0
+	} else if init > len(s) { /* start after string's end? */
+		return nil, nil
 	}
-	switch pat := p.(type) {
-	case *singlePattern:
-		ptr.insts = append(ptr.insts, inst{opChar, pat.Class, -1, -1})
-	case *seqPattern:
-		for _, cp := range pat.Patterns {
-			compilePattern(cp, ptr)
-		}
-	case *repeatPattern:
-		idx := len(ptr.insts)
-		switch pat.Type {
-		case '*':
-			ptr.insts = append(ptr.insts,
-				inst{opSplit, nil, idx + 1, idx + 3},
-				inst{opChar, pat.Class, -1, -1},
-				inst{opJmp, nil, idx, -1})
-		case '+':
-			ptr.insts = append(ptr.insts,
-				inst{opChar, pat.Class, -1, -1},
-				inst{opSplit, nil, idx, idx + 2})
-		case '-':
-			ptr.insts = append(ptr.insts,
-				inst{opSplit, nil, idx + 3, idx + 1},
-				inst{opChar, pat.Class, -1, -1},
-				inst{opJmp, nil, idx, -1})
-		case '?':
-			ptr.insts = append(ptr.insts,
-				inst{opSplit, nil, idx + 1, idx + 2},
-				inst{opChar, pat.Class, -1, -1})
+	err = pat.run(s, func(ms *matchState) {
+		start, end := ms.find(init, pat.anchor)
+		if start == -1 {
+			return
 		}
-	case *posCapPattern:
-		ptr.insts = append(ptr.insts, inst{opPSave, nil, ptr.capture, -1})
-		ptr.capture += 2
-	case *capPattern:
-		c0, c1 := ptr.capture, ptr.capture+1
-		ptr.capture += 2
-		ptr.insts = append(ptr.insts, inst{opSave, nil, c0, -1})
-		compilePattern(pat.Pattern, ptr)
-		ptr.insts = append(ptr.insts, inst{opSave, nil, c1, -1})
-	case *bracePattern:
-		ptr.insts = append(ptr.insts, inst{opBrace, nil, pat.Begin, pat.End})
-	case *numberPattern:
-		ptr.insts = append(ptr.insts, inst{opNumber, nil, pat.N, -1})
-	}
-	if toplevel {
-		if p.(*seqPattern).MustTail {
-			ptr.insts = append(ptr.insts, inst{opSave, nil, 1, -1}, inst{opTailMatch, nil, -1, -1})
+		captures = make([]string, ms.nlevels(start))
+		for i := range captures {
+			if str, p, pos := ms.getCapture(i, start, end); pos {
+				captures[i] = strconv.Itoa(p)
+			} else {
+				captures[i] = str
+			}
 		}
-		ptr.insts = append(ptr.insts, inst{opSave, nil, 1, -1}, inst{opMatch, nil, -1, -1})
+	})
+	return
+}
+
+// Replace replaces the matches in s with repl, at most n of them, or all
+// if n < 0, as string.gsub does with a string: %0 in repl stands for the
+// match, %1-%9 for its captures and %% for a %. It returns the result and
+// the number of matches replaced.
+func (pat *Pattern) Replace(s, repl string, n int) (string, int, error) {
+	max := int64(n)
+	if n < 0 {
+		max = int64(len(s) + 1)
+	}
+	b := &strings.Builder{}
+	count := int64(0)
+	err := pat.run(s, func(ms *matchState) {
+		copied := 0
+		count = ms.gsub(pat.anchor, max, func(s, e int) {
+			b.WriteString(ms.src[copied:s])
+			ms.addS(b, repl, s, e)
+			copied = e
+		})
+		b.WriteString(ms.src[copied:])
+	})
+	if err != nil {
+		return "", 0, err
 	}
-	return ptr.insts
+	return b.String(), int(count), nil
 }
 
-/* }}} parse */
+/* the patterns the string library compiled last */
 
-/* VM {{{ */
+const patternCacheSize = 64
 
-// Simple recursive virtual machine based on the
-// "Regular Expression Matching: the Virtual Machine Approach" (https://swtch.com/~rsc/regexp/regexp2.html)
-func recursiveVM(src []byte, insts []inst, pc, sp int, ms ...*MatchData) (bool, int, *MatchData) {
-	var m *MatchData
-	if len(ms) == 0 {
-		m = newMatchState()
-	} else {
-		m = ms[0]
+// a state and its coroutines share one, they never run at the same time
+type patternCache struct {
+	lru     *list.List /* of *Pattern, the most recently used first */
+	entries map[string]*list.Element
+}
+
+func newPatternCache() *patternCache {
+	return &patternCache{lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// cachedPattern returns expr compiled, from the cache of the state when
+// it was used lately. Errors are left to the matcher, which raises them
+// as Lua does.
+func (ls *LuaState) cachedPattern(expr string) *Pattern {
+	c := ls.patterns
+	if el, ok := c.entries[expr]; ok {
+		c.lru.MoveToFront(el)
+		return el.Value.(*Pattern)
 	}
-redo:
-	inst := insts[pc]
-	switch inst.OpCode {
-	case opChar:
-		if sp >= len(src) || !inst.Class.Matches(int(src[sp])) {
-			return false, sp, m
-		}
-		pc++
-		sp++
-		goto redo
-	case opMatch:
-		return true, sp, m
-	case opTailMatch:
-		return sp >= len(src), sp, m
-	case opJmp:
-		pc = inst.Operand1
-		goto redo
-	case opSplit:
-		if ok, nsp, _ := recursiveVM(src, insts, inst.Operand1, sp, m); ok {
-			return true, nsp, m
-		}
-		pc = inst.Operand2
-		goto redo
-	case opSave:
-		s := m.setCapture(inst.Operand1, sp)
-		if ok, nsp, _ := recursiveVM(src, insts, pc+1, sp, m); ok {
-			return true, nsp, m
-		}
-		m.restoreCapture(inst.Operand1, s)
-		return false, sp, m
-	case opPSave:
-		m.addPosCapture(inst.Operand1, sp+1)
-		pc++
-		goto redo
-	case opBrace:
-		if sp >= len(src) || int(src[sp]) != inst.Operand1 {
-			return false, sp, m
-		}
-		count := 1
-		for sp = sp + 1; sp < len(src); sp++ {
-			if int(src[sp]) == inst.Operand2 {
-				count--
-			}
-			if count == 0 {
-				pc++
-				sp++
-				goto redo
-			}
-			if int(src[sp]) == inst.Operand1 {
-				count++
-			}
-		}
-		return false, sp, m
-	case opNumber:
-		idx := inst.Operand1 * 2
-		if idx >= m.CaptureLength()-1 {
-			panic(newError(_UNKNOWN, "invalid capture index"))
-		}
-		capture := src[m.Capture(idx):m.Capture(idx+1)]
-		for i := 0; i < len(capture); i++ {
-			if i+sp >= len(src) || capture[i] != src[i+sp] {
-				return false, sp, m
-			}
-		}
-		pc++
-		sp += len(capture)
-		goto redo
+	pat, _ := compilePattern(expr)
+	c.entries[expr] = c.lru.PushFront(pat)
+	if c.lru.Len() > patternCacheSize { /* evict the least recently used */
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*Pattern).expr)
 	}
-	panic("should not reach here")
+	return pat
 }
 
-/* }}} */
+/* ctype of the "C" locale */
 
-/* API {{{ */
+func isalpha(c int) bool { return islower(c) || isupper(c) }
+func iscntrl(c int) bool { return c >= 0 && c < ' ' || c == 0x7f }
+func isgraph(c int) bool { return c > ' ' && c < 0x7f }
+func islower(c int) bool { return c >= 'a' && c <= 'z' }
+func isupper(c int) bool { return c >= 'A' && c <= 'Z' }
+func isalnum(c int) bool { return isalpha(c) || isdigit(c) }
+func ispunct(c int) bool { return isgraph(c) && !isalnum(c) }
 
-func Find(p string, src []byte, offset, limit int) (matches []*MatchData, err error) {
-	defer func() {
-		if v := recover(); v != nil {
-			if perr, ok := v.(*Error); ok {
-				err = perr
-			} else {
-				panic(v)
-			}
-		}
-	}()
-	pat := parsePattern(newScanner([]byte(p)), true)
-	insts := compilePattern(pat)
-	matches = []*MatchData{}
-	for sp := offset; sp <= len(src); {
-		ok, nsp, ms := recursiveVM(src, insts, 0, sp)
-		sp++
-		if ok {
-			if sp < nsp {
-				sp = nsp
-			}
-			matches = append(matches, ms)
-		}
-		if len(matches) == limit || pat.MustHead {
-			break
-		}
+func tolower(c int) int {
+	if isupper(c) {
+		return c + ('a' - 'A')
 	}
-	return
+	return c
 }
-
-/* }}} */
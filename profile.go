@@ -0,0 +1,311 @@
+package golua
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// sampling period of the profiler
+const profilePeriod = 10 * time.Millisecond
+
+type profLocKey struct {
+	fn   int
+	line int
+}
+
+type profFuncKey struct {
+	name   string
+	source string
+	line   int
+}
+
+// a Lua-level CPU profile in the making
+type luaProfiler struct {
+	w       io.Writer
+	start   time.Time
+	last    time.Time // time of the previous sample
+	done    chan struct{}
+	stopped chan struct{}
+	/* profile.proto tables */
+	strings []string
+	strIdx  map[string]int
+	funcs   map[profFuncKey]int
+	locs    map[profLocKey]int
+	locList []profLocKey
+	samples map[string]*profSample
+	order   []string
+}
+
+type profSample struct {
+	locs  []int
+	count int64
+	nanos int64
+}
+
+// StartProfile enables Lua-level CPU profiling of this state. While the
+// profile is running, the Lua call stack is sampled about every 10ms and the
+// profile is written to w in the profile.proto format understood by
+// `go tool pprof` when StopProfile is called. Time spent in coroutines is
+// accounted to the coroutine.resume call of this state.
+func (ls *LuaState) StartProfile(w io.Writer) error {
+	if ls.prof != nil {
+		return errors.New("lua profiling already in use")
+	}
+	p := &luaProfiler{
+		w:       w,
+		start:   time.Now(),
+		last:    time.Now(),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		strings: []string{""},
+		strIdx:  map[string]int{"": 0},
+		funcs:   map[profFuncKey]int{},
+		locs:    map[profLocKey]int{},
+		samples: map[string]*profSample{},
+	}
+	ls.prof = p
+	go func() {
+		defer close(p.stopped)
+		ticker := time.NewTicker(profilePeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				ls.setHook(hookSample)
+			}
+		}
+	}()
+	return nil
+}
+
+// StopProfile stops the profile started by StartProfile and writes it out.
+func (ls *LuaState) StopProfile() error {
+	p := ls.prof
+	if p == nil {
+		return nil
+	}
+	close(p.done)
+	<-p.stopped
+	ls.clearHook(hookSample)
+	ls.prof = nil
+	return p.write(time.Since(p.start))
+}
+
+// takes the sample asked for by the ticker
+func (p *luaProfiler) tick(ls *LuaState) {
+	now := time.Now()
+	p.sample(ls, now.Sub(p.last))
+	p.last = now
+}
+
+// records the current call stack, leaf first, charging it with the time
+// elapsed since the previous sample: the ticker goroutine may not get to run
+// on time while the interpreter is busy
+func (p *luaProfiler) sample(ls *LuaState, elapsed time.Duration) {
+	var locs []int
+	var key []byte
+	for stack := ls.stack; stack != nil; stack = stack.prev {
+		c := stack.closure
+		if c == nil {
+			continue
+		}
+		fk := profFuncKey{}
+		line := 0
+		if proto := c.proto; proto != nil {
+			fk.source = chunkSourceName(proto.Source)
+			fk.line = int(proto.LineDefined)
+			if proto.LineDefined == 0 {
+				fk.name = "main chunk"
+			} else {
+				fk.name = profFuncName(ls, stack)
+			}
+			if pc := stack.pc - 1; pc >= 0 && pc < len(proto.DbgSourcePositions) {
+				line = int(proto.DbgSourcePositions[pc])
+			}
+		} else {
+			fk.name = profFuncName(ls, stack)
+			fk.source = "[G]"
+		}
+		id := p.location(fk, line)
+		locs = append(locs, id)
+		key = appendVarint(key, uint64(id))
+	}
+	if len(locs) == 0 {
+		return
+	}
+	s := p.samples[string(key)]
+	if s == nil {
+		s = &profSample{locs: locs}
+		p.samples[string(key)] = s
+		p.order = append(p.order, string(key))
+	}
+	s.count++
+	s.nanos += int64(elapsed)
+}
+
+func (p *luaProfiler) str(s string) int {
+	if i, ok := p.strIdx[s]; ok {
+		return i
+	}
+	i := len(p.strings)
+	p.strings = append(p.strings, s)
+	p.strIdx[s] = i
+	return i
+}
+
+func (p *luaProfiler) location(fk profFuncKey, line int) int {
+	fn, ok := p.funcs[fk]
+	if !ok {
+		fn = len(p.funcs) + 1
+		p.funcs[fk] = fn
+	}
+	lk := profLocKey{fn, line}
+	id, ok := p.locs[lk]
+	if !ok {
+		p.locList = append(p.locList, lk)
+		id = len(p.locList)
+		p.locs[lk] = id
+	}
+	return id
+}
+
+// pprof drops anything between angle brackets from function names, so
+// anonymous functions are named source:line instead of <source:line>
+func profFuncName(ls *LuaState, stack *luaStack) string {
+	if _, name := getFuncName(stack); name != "" {
+		return name
+	}
+	if proto := stack.closure.proto; proto != nil {
+		return fmt.Sprintf("%v:%v", chunkSourceName(proto.Source), proto.LineDefined)
+	}
+	return "?"
+}
+
+// the name of a chunk as shown to the user, without the '@' or '=' prefix
+func chunkSourceName(source string) string {
+	if len(source) > 0 && (source[0] == '@' || source[0] == '=') {
+		return source[1:]
+	}
+	return source
+}
+
+/* profile.proto field numbers, see github.com/google/pprof/proto/profile.proto */
+const (
+	profSampleType    = 1
+	profSampleField   = 2
+	profLocation      = 4
+	profFunction      = 5
+	profStringTable   = 6
+	profTimeNanos     = 9
+	profDurationNanos = 10
+	profPeriodType    = 11
+	profPeriod        = 12
+)
+
+// encodes the profile and writes it gzipped to p.w
+func (p *luaProfiler) write(duration time.Duration) error {
+	var b protoBuf
+	sampleType := func(field int, typ, unit string) {
+		var vt protoBuf
+		vt.int(1, int64(p.str(typ)))
+		vt.int(2, int64(p.str(unit)))
+		b.msg(field, &vt)
+	}
+	sampleType(profSampleType, "samples", "count")
+	sampleType(profSampleType, "cpu", "nanoseconds")
+	for _, key := range p.order {
+		s := p.samples[key]
+		var sb protoBuf
+		ids := make([]uint64, len(s.locs))
+		for i, id := range s.locs {
+			ids[i] = uint64(id)
+		}
+		sb.packed(1, ids...)
+		sb.packed(2, uint64(s.count), uint64(s.nanos))
+		b.msg(profSampleField, &sb)
+	}
+	for i, lk := range p.locList {
+		var lb, line protoBuf
+		line.int(1, int64(lk.fn))
+		line.int(2, int64(lk.line))
+		lb.int(1, int64(i+1))
+		lb.msg(4, &line)
+		b.msg(profLocation, &lb)
+	}
+	funcs := make([]profFuncKey, len(p.funcs))
+	for fk, id := range p.funcs {
+		funcs[id-1] = fk
+	}
+	for i, fk := range funcs {
+		var fb protoBuf
+		fb.int(1, int64(i+1))
+		fb.int(2, int64(p.str(fk.name)))
+		fb.int(3, int64(p.str(fk.name)))
+		fb.int(4, int64(p.str(fk.source)))
+		fb.int(5, int64(fk.line))
+		b.msg(profFunction, &fb)
+	}
+	sampleType(profPeriodType, "cpu", "nanoseconds")
+	b.int(profTimeNanos, p.start.UnixNano())
+	b.int(profDurationNanos, int64(duration))
+	b.int(profPeriod, int64(profilePeriod))
+	for _, s := range p.strings { /* after the other fields, they add strings */
+		b.bytes(profStringTable, []byte(s))
+	}
+
+	zw := gzip.NewWriter(p.w)
+	if _, err := zw.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// minimal protocol buffers encoder
+type protoBuf struct {
+	bytes.Buffer
+}
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func (b *protoBuf) varint(x uint64) {
+	var buf [10]byte
+	b.Write(appendVarint(buf[:0], x))
+}
+
+func (b *protoBuf) int(field int, x int64) {
+	if x == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 0)
+	b.varint(uint64(x))
+}
+
+func (b *protoBuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protoBuf) msg(field int, m *protoBuf) {
+	b.bytes(field, m.Bytes())
+}
+
+func (b *protoBuf) packed(field int, xs ...uint64) {
+	var buf []byte
+	for _, x := range xs {
+		buf = appendVarint(buf, x)
+	}
+	b.bytes(field, buf)
+}
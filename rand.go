@@ -0,0 +1,99 @@
+package golua
+
+import (
+	"math/bits"
+	"time"
+	"unsafe"
+)
+
+// A RandSource makes the numbers of math.random. Uint64 returns the next
+// 64 random bits and Seed restarts the sequence, as math.randomseed(n1,
+// n2) does. Sources need not be safe for concurrent use.
+type RandSource interface {
+	Uint64() uint64
+	Seed(n1, n2 uint64)
+}
+
+// NewRandSource returns the generator of Lua 5.4, xoshiro256**, seeded
+// with n1 and n2: its numbers are those of the reference implementation
+// after math.randomseed(n1, n2).
+func NewRandSource(n1, n2 uint64) RandSource {
+	x := &xoshiro256{}
+	x.Seed(n1, n2)
+	return x
+}
+
+// SetRandSource makes src the source of math.random and math.randomseed
+// of the state, a host can make scripts repeatable with its own seeds or
+// numbers. nil restores a randomly seeded NewRandSource. Coroutines
+// created afterwards share it.
+func (ls *LuaState) SetRandSource(src RandSource) {
+	if src == nil {
+		src = &xoshiro256{}
+		randSeed(ls, src)
+	}
+	ls.rand = src
+}
+
+// seeds src from the time and the address of the state, as Lua seeds
+// new states, and returns the seeds
+// lua-5.4.6/src/lmathlib.c#randseed()
+func randSeed(ls *LuaState, src RandSource) (uint64, uint64) {
+	seed1 := uint64(time.Now().Unix())
+	seed2 := uint64(uintptr(unsafe.Pointer(ls)))
+	src.Seed(seed1, seed2)
+	return seed1, seed2
+}
+
+// lua-5.4.6/src/lmathlib.c#Rand64
+type xoshiro256 [4]uint64
+
+// lua-5.4.6/src/lmathlib.c#nextrand()
+func (s *xoshiro256) Uint64() uint64 {
+	state0, state1 := s[0], s[1]
+	state2, state3 := s[2]^state0, s[3]^state1
+	res := bits.RotateLeft64(state1*5, 7) * 9
+	s[0] = state0 ^ state3
+	s[1] = state1 ^ state2
+	s[2] = state2 ^ (state1 << 17)
+	s[3] = bits.RotateLeft64(state3, 45)
+	return res
+}
+
+// lua-5.4.6/src/lmathlib.c#setseed()
+func (s *xoshiro256) Seed(n1, n2 uint64) {
+	s[0] = n1
+	s[1] = 0xff /* avoid a zero state */
+	s[2] = n2
+	s[3] = 0
+	for i := 0; i < 16; i++ {
+		s.Uint64() /* discard initial values to "spread" seed */
+	}
+}
+
+// a float in [0, 1) from the 53 higher bits of x
+// lua-5.4.6/src/lmathlib.c#I2d()
+func i2d(x uint64) float64 {
+	return float64(x>>11) * 0x1p-53
+}
+
+// projects a random integer into the interval [0, n], drawing again from
+// src while it is out of it, so that the result has no bias
+// lua-5.4.6/src/lmathlib.c#project()
+func project(ran, n uint64, src RandSource) uint64 {
+	if n&(n+1) == 0 { /* is 'n + 1' a power of 2? */
+		return ran & n /* no bias */
+	}
+	lim := n
+	/* compute the smallest (2^b - 1) not smaller than n */
+	lim |= lim >> 1
+	lim |= lim >> 2
+	lim |= lim >> 4
+	lim |= lim >> 8
+	lim |= lim >> 16
+	lim |= lim >> 32
+	for ran &= lim; ran > n; ran &= lim { /* project 'ran' into [0, lim] */
+		ran = src.Uint64() /* not inside [0, n]? Try again */
+	}
+	return ran
+}
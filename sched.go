@@ -0,0 +1,332 @@
+package golua
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+/*
+** A Scheduler runs coroutines of a state that wait for Go, such as a
+** channel receive, so that one of them waiting does not stop the others:
+** the Go function that would block hands its wait to the scheduler and
+** its coroutine yields until the wait is over. RunLoop runs one.
+ */
+type Scheduler interface {
+	// Suspend takes over wait for co, which yields right after, and
+	// resumes co without values once wait has returned. It reports
+	// false if co does not run under the scheduler. The scheduler
+	// closes quit when it stops, wait then gives up and co is never
+	// resumed.
+	Suspend(co *LuaState, wait func(quit <-chan struct{})) bool
+}
+
+// SetScheduler makes s the scheduler of the state, nil removes it.
+// Coroutines created afterwards share it.
+func (ls *LuaState) SetScheduler(s Scheduler) {
+	ls.sched = s
+}
+
+// block runs wait, which blocks until some Go event or until quit is
+// closed. A coroutine that runs under the scheduler of the state yields
+// meanwhile instead of stopping the state; the calling Go function goes
+// on when it is resumed, its stack as it left it. Elsewhere quit is nil.
+func (ls *LuaState) block(wait func(quit <-chan struct{})) {
+	if ls.sched == nil || !luaIsYieldable(ls) || !ls.sched.Suspend(ls, wait) {
+		wait(nil)
+		return
+	}
+	ls.yieldFrame()
+}
+
+// yields no values, keeping the frame of the calling Go function aside
+// until the coroutine is resumed
+func (ls *LuaState) yieldFrame() {
+	saved := ls.stack.popN(luaGetTop(ls))
+	luaYield(ls, 0)
+	luaSetTop(ls, 0)
+	ls.stack.pushN(saved, -1)
+}
+
+// Await runs f on a goroutine of its own and returns its results. Called
+// by a Go function that runs in a coroutine of RunLoop, the coroutine
+// waits for f without stopping the others; anywhere else Await just
+// calls f. f is not interrupted when RunLoop returns, its results are
+// then dropped.
+func (ls *LuaState) Await(f func() (LuaValue, error)) (LuaValue, error) {
+	var v LuaValue
+	var err error
+	ls.block(func(<-chan struct{}) { v, err = f() })
+	return v, err
+}
+
+// A Clock tells the time to the timers of a state. Tests can run them
+// with a fake clock, whose After fires once the clock has been advanced,
+// instead of waiting.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// SetClock makes c the clock of the timers of the state, nil restores the
+// real one. Coroutines created afterwards share it.
+func (ls *LuaState) SetClock(c Clock) {
+	ls.clock = c
+}
+
+func (ls *LuaState) getClock() Clock {
+	if ls.clock == nil {
+		return realClock{}
+	}
+	return ls.clock
+}
+
+// RunLoop pops the function at the top of the stack and runs it in a
+// coroutine, along with the coroutines it starts with timer.after and
+// timer.every, until all of them have ended. Coroutines wait for timers,
+// channels and Await without stopping each other, one that calls
+// coroutine.yield runs again after the others. RunLoop returns the first
+// error that a coroutine raises, or the error of ctx once it is done;
+// coroutines that did not end then stay suspended, and those waiting for
+// channels stop waiting.
+func (ls *LuaState) RunLoop(ctx context.Context) error {
+	if ls.sched != nil {
+		return errors.New("RunLoop: the state already has a scheduler")
+	}
+	l := &eventLoop{
+		ls:    ls,
+		clock: ls.getClock(),
+		tasks: map[*LuaState]bool{},
+		wake:  make(chan struct{}, 1),
+		quit:  make(chan struct{}),
+	}
+	ls.sched = l
+	defer func() {
+		ls.sched = nil
+		l.tasks = nil /* let Suspend refuse the coroutines left */
+		for _, t := range l.timers {
+			t.index = -1 /* and stop cancel from finding the timers left */
+		}
+		close(l.quit) /* and give up their waits */
+	}()
+	l.spawn(ls.stack.pop())
+	return l.run(ctx)
+}
+
+// the scheduler of RunLoop
+type eventLoop struct {
+	ls     *LuaState
+	clock  Clock
+	tasks  map[*LuaState]bool // coroutines of the loop, true while waiting
+	ready  []*LuaState        // coroutines to resume, in order
+	timers timerHeap
+	seq    uint64 // orders timers due at the same time
+	waits  int    // waits running on goroutines
+	mu     sync.Mutex
+	done   []*LuaState   // coroutines whose wait is over, under mu
+	wake   chan struct{} // signals done
+	quit   chan struct{} // closed when RunLoop returns
+}
+
+// the loop a timer function called by ls belongs to, or nil
+func runningLoop(ls *LuaState) *eventLoop {
+	l, _ := ls.sched.(*eventLoop)
+	if l != nil && l.tasks == nil {
+		return nil /* RunLoop has returned */
+	}
+	return l
+}
+
+// starts fn in a new coroutine of the loop
+func (l *eventLoop) spawn(fn LuaValue) {
+	co := luaNewThread(l.ls)
+	luaPop(l.ls, 1)
+	co.stack.push(fn)
+	l.tasks[co] = false
+	l.ready = append(l.ready, co)
+}
+
+func (l *eventLoop) Suspend(co *LuaState, wait func(quit <-chan struct{})) bool {
+	if _, ok := l.tasks[co]; !ok {
+		return false
+	}
+	l.tasks[co] = true
+	l.waits++
+	go func() {
+		wait(l.quit)
+		select {
+		case <-l.quit:
+			return /* nobody resumes co */
+		default:
+		}
+		l.mu.Lock()
+		l.done = append(l.done, co)
+		l.mu.Unlock()
+		select {
+		case l.wake <- struct{}{}:
+		default:
+		}
+	}()
+	return true
+}
+
+// makes co wait for d on the timers of the loop, false if co does not run
+// under the loop
+func (l *eventLoop) sleep(co *LuaState, d time.Duration) bool {
+	if _, ok := l.tasks[co]; !ok || !luaIsYieldable(co) {
+		return false
+	}
+	l.tasks[co] = true
+	l.start(&luaTimer{when: l.clock.Now().Add(d), co: co})
+	return true
+}
+
+func (l *eventLoop) run(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if len(l.ready) > 0 {
+			co := l.ready[0]
+			l.ready = l.ready[1:]
+			yielded, err := l.resume(co)
+			if err != nil {
+				return err
+			}
+			l.fire() /* timers that came due go first */
+			if yielded {
+				l.ready = append(l.ready, co) /* run it again after the others */
+			}
+			continue
+		}
+		l.mu.Lock()
+		done := l.done
+		l.done = nil
+		l.mu.Unlock()
+		if len(done) > 0 {
+			l.waits -= len(done)
+			l.ready = append(l.ready, done...)
+			continue
+		}
+		if len(l.timers) == 0 && l.waits == 0 {
+			return nil /* nothing left to run */
+		}
+		var timeout <-chan time.Time
+		if len(l.timers) > 0 {
+			d := l.timers[0].when.Sub(l.clock.Now())
+			if d <= 0 {
+				l.fire()
+				continue
+			}
+			timeout = l.clock.After(d)
+		}
+		select {
+		case <-ctx.Done():
+		case <-l.wake:
+		case <-timeout:
+		}
+	}
+}
+
+// resumes co, reporting whether it called coroutine.yield
+func (l *eventLoop) resume(co *LuaState) (bool, error) {
+	l.tasks[co] = false
+	switch luaResume(co, l.ls, 0) {
+	case LUA_OK:
+		delete(l.tasks, co)
+	case LUA_YIELD:
+		luaPop(co, luaGetTop(co)) /* values of coroutine.yield */
+		return !l.tasks[co], nil
+	default:
+		delete(l.tasks, co)
+		if co.coErr == nil {
+			return false, &LuaError{Value: co.stack.pop()}
+		}
+		return false, co.coErr
+	}
+	return false, nil
+}
+
+// runs the timers that are due
+func (l *eventLoop) fire() {
+	now := l.clock.Now()
+	for len(l.timers) > 0 && !l.timers[0].when.After(now) {
+		t := heap.Pop(&l.timers).(*luaTimer)
+		if t.co != nil {
+			l.ready = append(l.ready, t.co) /* end of a sleep */
+			continue
+		}
+		l.spawn(t.fn)
+		if t.period > 0 {
+			t.when = t.when.Add(t.period)
+			l.start(t)
+		}
+	}
+}
+
+// adds t to the pending timers
+func (l *eventLoop) start(t *luaTimer) {
+	t.loop = l
+	l.seq++
+	t.seq = l.seq
+	heap.Push(&l.timers, t)
+}
+
+// stops t, reporting whether it was pending in l
+func (l *eventLoop) stop(t *luaTimer) bool {
+	if t.loop != l || t.index < 0 {
+		return false
+	}
+	heap.Remove(&l.timers, t.index)
+	return true
+}
+
+type luaTimer struct {
+	when   time.Time
+	period time.Duration // timer.every
+	fn     LuaValue      // function to start
+	co     *LuaState     // or coroutine to resume, for timer.sleep
+	seq    uint64
+	loop   *eventLoop // that started it
+	index  int        // in timerHeap, -1 when not pending
+}
+
+// pending timers, by time
+type timerHeap []*luaTimer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*luaTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	t.index = -1
+	*h = old[:len(old)-1]
+	return t
+}
@@ -2,14 +2,15 @@ package golua
 
 type luaStack struct {
 	/* virtual stack */
-	slots []LuaValue
+	slots []value
 	top   int
 	/* call info */
 	state   *LuaState
 	closure *LuaClosure
-	varargs []LuaValue
+	varargs []value
 	openuvs map[int]*upvalue
 	pc      int
+	oldpc   int // pc of the last instruction traced, see traceExec
 	/* linked list */
 	prev *luaStack
 	// tail call
@@ -18,7 +19,7 @@ type luaStack struct {
 
 func newLuaStack(size int, state *LuaState) *luaStack {
 	return &luaStack{
-		slots: make([]LuaValue, size),
+		slots: make([]value, size),
 		top:   0,
 		state: state,
 	}
@@ -26,55 +27,113 @@ func newLuaStack(size int, state *LuaState) *luaStack {
 
 func (self *luaStack) check(n int) {
 	free := len(self.slots) - self.top
-	for i := free; i < n; i++ {
-		self.slots = append(self.slots, LuaNil)
+	if free >= n {
+		return
+	}
+	ls := self.state
+	if ls.stackSize+n-free > ls.maxStack {
+		ls.runError("stack overflow")
+	}
+	ls.stackSize += n - free
+	slots := make([]value, self.top+n)
+	copy(slots, self.slots)
+	self.slots = slots
+	for idx, uv := range self.openuvs { /* open upvalues follow the slots */
+		uv.val = &slots[idx]
 	}
 }
 
 func (self *luaStack) push(val LuaValue) {
+	self.pushv(valueOf(val))
+}
+
+func (self *luaStack) pushv(v value) {
 	if self.top == len(self.slots) {
-		panic("stack overflow!")
-	}
-	if val == nil {
-		val = LuaNil
+		self.check(LUA_MINSTACK)
 	}
-	self.slots[self.top] = val
+	self.slots[self.top] = v
 	self.top++
 }
 
 func (self *luaStack) pop() LuaValue {
+	return self.popv().luaValue()
+}
+
+func (self *luaStack) popv() value {
 	if self.top < 1 {
 		panic("stack underflow")
 	}
 	self.top--
-	val := self.slots[self.top]
-	self.slots[self.top] = LuaNil
-	return val
+	v := self.slots[self.top]
+	self.slots[self.top] = nilValue
+	return v
 }
 
-func (self *luaStack) pushN(vals []LuaValue, n int) {
+func (self *luaStack) pushN(vals []value, n int) {
 	nVals := len(vals)
 	if n < 0 {
 		n = nVals
 	}
 
 	for i := 0; i < n; i++ {
-		if i < nVals && vals[i] != nil {
-			self.push(vals[i])
+		if i < nVals {
+			self.pushv(vals[i])
 		} else {
-			self.push(LuaNil)
+			self.pushv(nilValue)
 		}
 	}
 }
 
-func (self *luaStack) popN(n int) []LuaValue {
-	vals := make([]LuaValue, n)
+func (self *luaStack) popN(n int) []value {
+	vals := make([]value, n)
 	for i := n - 1; i >= 0; i-- {
-		vals[i] = self.pop()
+		vals[i] = self.popv()
 	}
 	return vals
 }
 
+// pops n values without returning them
+func (self *luaStack) drop(n int) {
+	if self.top < n {
+		panic("stack underflow")
+	}
+	for i := self.top - n; i < self.top; i++ {
+		self.slots[i] = nilValue
+	}
+	self.top -= n
+}
+
+// moves the values from.slots[base:from.top] onto this stack, adjusted to
+// n values unless n is negative
+func (self *luaStack) moveResults(from *luaStack, base, n int) {
+	results := from.slots[base:from.top]
+	if n < 0 {
+		n = len(results)
+	}
+	self.check(n)
+	self.pushN(results, n)
+	from.drop(len(results))
+}
+
+// closes the open upvalues of the slots from idx upwards
+func (self *luaStack) closeUpvalues(idx int) {
+	for i, openuv := range self.openuvs {
+		if i >= idx {
+			val := *openuv.val
+			openuv.val = &val
+			delete(self.openuvs, i)
+		}
+	}
+}
+
+// register or constant operand of a decoded instruction
+func (self *luaStack) rk(k []value, x int32) value {
+	if x < 0 {
+		return k[^x]
+	}
+	return self.slots[x]
+}
+
 func (self *luaStack) absIndex(idx int) int {
 	if idx >= 0 || idx <= LUA_REGISTRYINDEX {
 		return idx
@@ -96,47 +155,52 @@ func (self *luaStack) isValid(idx int) bool {
 }
 
 func (self *luaStack) get(idx int) LuaValue {
+	return self.getv(idx).luaValue()
+}
+
+func (self *luaStack) getv(idx int) value {
 	if idx < LUA_REGISTRYINDEX { /* upvalues */
 		uvIdx := LUA_REGISTRYINDEX - idx - 1
 		c := self.closure
 		if c == nil || uvIdx >= len(c.upvals) {
-			return LuaNil
+			return nilValue
 		}
 		return *(c.upvals[uvIdx].val)
 	}
 
 	if idx == LUA_REGISTRYINDEX {
-		return self.state.registry
+		return value{o: self.state.registry}
 	}
 
 	absIdx := self.absIndex(idx)
 	if absIdx > 0 && absIdx <= self.top {
 		return self.slots[absIdx-1]
 	}
-	return LuaNil
+	return nilValue
 }
 
 func (self *luaStack) set(idx int, val LuaValue) {
-	if val == nil {
-		val = LuaNil
-	}
+	self.setv(idx, valueOf(val))
+}
+
+func (self *luaStack) setv(idx int, v value) {
 	if idx < LUA_REGISTRYINDEX { /* upvalues */
 		uvIdx := LUA_REGISTRYINDEX - idx - 1
 		c := self.closure
 		if c != nil && uvIdx < len(c.upvals) {
-			*(c.upvals[uvIdx].val) = val
+			*(c.upvals[uvIdx].val) = v
 		}
 		return
 	}
 
 	if idx == LUA_REGISTRYINDEX {
-		self.state.registry = val.(*LuaTable)
+		self.state.registry = v.o.(*LuaTable)
 		return
 	}
 
 	absIdx := self.absIndex(idx)
 	if absIdx > 0 && absIdx <= self.top {
-		self.slots[absIdx-1] = val
+		self.slots[absIdx-1] = v
 		return
 	}
 	panic("invalid index!idx:%v val:%v")
@@ -1,14 +1,19 @@
 package golua
 
 import (
+	"bytes"
 	"fmt"
 	"golua/compiler"
 	"io/ioutil"
+	"os"
+	"runtime"
 	"strings"
 )
 
 const LUA_MINSTACK = 20
 const LUAI_MAXSTACK = 1000000
+const LUAI_MAXCALLS = 200000 // nested calls, each one also uses the Go stack
+const LUAI_MAXCCALLS = 200   // nested calls made from Go functions and metamethods
 const LUA_REGISTRYINDEX = -LUAI_MAXSTACK - 1000
 const LUA_RIDX_MAINTHREAD LuaNumber = 1
 const LUA_RIDX_GLOBALS LuaNumber = 2
@@ -16,38 +21,91 @@ const LUA_MULTRET = -1
 
 /* Debug {{{ */
 
-type luaDebug struct {
+// DebugInfo describes an active function, see GetInfo.
+// http://www.lua.org/manual/5.3/manual.html#lua_Debug
+type DebugInfo struct {
 	stack           *luaStack
-	Name            string
-	What            string
+	Name            string // a reasonable name for the function, may be empty
+	NameWhat        string // "global", "local", "method", "field", "upvalue", "metamethod", "for iterator" or ""
+	What            string // "Lua", "Go" or "main"
 	Source          string
-	CurrentLine     int
+	ShortSrc        string // a printable version of Source
+	CurrentLine     int    // -1 for Go functions
 	NUpvalues       int
+	NParams         int
+	IsVararg        bool
 	LineDefined     int
 	LastLineDefined int
+	Func            LuaValue
 }
 
 func NewLuaState() *LuaState {
-	ls := &LuaState{}
+	ls := &LuaState{maxCalls: LUAI_MAXCALLS, maxStack: LUAI_MAXSTACK, fsys: DirFS(""),
+		patterns: newPatternCache()}
 	registry := newLuaTable(8, 0)
 	registry.Set(LUA_RIDX_MAINTHREAD, ls)
 	registry.Set(LUA_RIDX_GLOBALS, newLuaTable(0, 20))
 	ls.registry = registry
 	ls.pushLuaStack(newLuaStack(LUA_MINSTACK, ls))
+	ls.SetRandSource(nil)
 	return ls
 }
 
+// Limits the number of nested calls and the number of stack slots they may
+// use together, exceeding either raises a "stack overflow" error. The
+// defaults are LUAI_MAXCALLS and LUAI_MAXSTACK. Lua calls recurse on the
+// Go stack, so a high call limit may need a larger debug.SetMaxStack.
+func (ls *LuaState) SetLimits(maxCalls, maxStack int) {
+	ls.maxCalls = maxCalls
+	ls.maxStack = maxStack
+}
+
 func (ls *LuaState) pushLuaStack(stack *luaStack) {
+	if ls.nCalls >= ls.maxCalls || ls.stackSize+len(stack.slots) > ls.maxStack {
+		ls.runError("stack overflow")
+	}
+	ls.nCalls++
+	ls.stackSize += len(stack.slots)
 	stack.prev = ls.stack
 	ls.stack = stack
 }
 
 func (ls *LuaState) popLuaStack() {
 	stack := ls.stack
+	ls.nCalls--
+	ls.stackSize -= len(stack.slots)
 	ls.stack = stack.prev
 	stack.prev = nil
 }
 
+// returns a call frame with at least size slots, reusing a returned one
+// when possible
+func (ls *LuaState) newFrame(size int) *luaStack {
+	stack := ls.free
+	if stack == nil {
+		return newLuaStack(size, ls)
+	}
+	ls.free = stack.prev
+	stack.prev = nil
+	if len(stack.slots) < size {
+		stack.slots = make([]value, size)
+	}
+	return stack
+}
+
+// gives back a frame that returned normally, its upvalues must be closed
+func (ls *LuaState) freeFrame(stack *luaStack) {
+	stack.drop(stack.top)
+	stack.closure = nil
+	stack.varargs = nil
+	stack.openuvs = nil
+	stack.pc = 0
+	stack.oldpc = 0
+	stack.tailCall = 0
+	stack.prev = ls.free
+	ls.free = stack
+}
+
 func (ls *LuaState) isMainThread() bool {
 	return ls.registry.Get(LUA_RIDX_MAINTHREAD) == ls
 }
@@ -56,6 +114,12 @@ func (ls *LuaState) Push(value LuaValue) {
 	ls.stack.push(value)
 }
 
+// [-n, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_pop
+func (ls *LuaState) Pop(n int) {
+	luaPop(ls, n)
+}
+
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_pushcfunction
 func (ls *LuaState) PushGoFunction(f GoFunction) {
@@ -67,8 +131,8 @@ func (ls *LuaState) PushGoFunction(f GoFunction) {
 func (ls *LuaState) PushGoClosure(f GoFunction, n int) {
 	closure := newGoClosure(f, n)
 	for i := n; i > 0; i-- {
-		val := ls.stack.pop()
-		closure.upvals[i-1] = &upvalue{&val}
+		val := ls.stack.popv()
+		closure.upvals[i-1] = &upvalue{val: &val}
 	}
 	ls.stack.push(closure)
 }
@@ -159,9 +223,22 @@ func (ls *LuaState) CheckUserData(idx int) *LuaUserData {
 	return nil
 }
 
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#lua_gettop
+func (ls *LuaState) GetTop() int {
+	return luaGetTop(ls)
+}
+
+// [-0, +0, e]
+// http://www.lua.org/manual/5.3/manual.html#lua_getglobal
+func (ls *LuaState) GetGlobal(name string) LuaValue {
+	luaGetGlobal(ls, name)
+	return ls.stack.pop()
+}
+
 func (ls *LuaState) SetGlobal(name string, v LuaValue) {
-	t := ls.registry.Get(LUA_RIDX_GLOBALS)
-	luaSetTable_(ls, t, LuaString(name), v, false)
+	t := ls.registry.get(numberValue(float64(LUA_RIDX_GLOBALS)))
+	luaSetTable_(ls, t, value{o: LuaString(name)}, valueOf(v), false)
 }
 
 // [-0, +0, e]
@@ -174,16 +251,60 @@ func (ls *LuaState) Register(name string, f GoFunction) {
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_load
 func (ls *LuaState) Load(chunk []byte, chunkName string) int {
-	proto := compiler.Compile(chunk, chunkName)
+	return ls.load(chunk, chunkName, "bt")
+}
+
+// Loads a chunk as Load does, with the first upvalue of the function,
+// the _ENV of text chunks, set to env as the env argument of load sets
+// it. mode tells what chunks may load: "b" binary ones, "t" text ones,
+// "bt" both.
+// http://www.lua.org/manual/5.3/manual.html#pdf-load
+func (ls *LuaState) LoadWithEnv(chunk []byte, chunkName, mode string, env LuaValue) int {
+	status := ls.load(chunk, chunkName, mode)
+	if status == LUA_OK {
+		ls.SetUpvalue(ls.CheckAny(-1), 1, env)
+	}
+	return status
+}
+
+// pushes the function of the chunk, or the message of a syntax error
+// lua-5.3.4/src/ldo.c#f_parser()
+func (ls *LuaState) load(chunk []byte, chunkName, mode string) (status int) {
+	binary := len(chunk) > 0 && chunk[0] == compiler.LUA_SIGNATURE[0]
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(runtime.Error); (ok || r == compiler.ErrTruncated) && binary {
+				r = compiler.ChunkID(chunkName) + ": truncated precompiled chunk"
+			}
+			ls.Push(LuaString(fmt.Sprint(r)))
+			status = LUA_ERRSYNTAX
+		}
+	}()
+	if binary {
+		checkLoadMode(mode, "binary")
+	} else {
+		checkLoadMode(mode, "text")
+	}
+	proto := newLuaProto(compiler.Compile(chunk, chunkName))
+	if ls.cover != nil {
+		ls.cover.add(proto)
+	}
 	c := newLuaClosure(proto)
 	ls.stack.push(c)
 	if len(proto.Upvalues) > 0 {
-		env := ls.registry.Get(LUA_RIDX_GLOBALS)
-		c.upvals[0] = &upvalue{&env}
+		env := ls.registry.get(numberValue(float64(LUA_RIDX_GLOBALS)))
+		c.upvals[0] = &upvalue{val: &env}
 	}
 	return LUA_OK
 }
 
+// lua-5.3.4/src/ldo.c#checkmode()
+func checkLoadMode(mode, x string) {
+	if strings.IndexByte(mode, x[0]) < 0 {
+		panic(fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode))
+	}
+}
+
 // [-0, +?, e]
 // http://www.lua.org/manual/5.3/manual.html#luaL_dofile
 func (ls *LuaState) DoFile(filename string) bool {
@@ -201,16 +322,43 @@ func (ls *LuaState) DoString(str string) bool {
 // [-0, +1, m]
 // http://www.lua.org/manual/5.3/manual.html#luaL_loadfile
 func (ls *LuaState) LoadFile(filename string) int {
-	return ls.LoadFileX(filename)
+	return ls.LoadFileX(filename, "bt")
 }
 
 // [-0, +1, m]
+// An empty filename loads the standard input.
 // http://www.lua.org/manual/5.3/manual.html#luaL_loadfilex
-func (ls *LuaState) LoadFileX(filename string) int {
-	if data, err := ioutil.ReadFile(filename); err == nil {
-		return ls.Load(data, "@"+filename)
+// lua-5.3.4/src/lauxlib.c#luaL_loadfilex()
+func (ls *LuaState) LoadFileX(filename, mode string) int {
+	if filename == "" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			msg, _ := errorString(err)
+			luaPushFString(ls, "cannot read stdin: %s", msg)
+			return LUA_ERRFILE
+		}
+		return ls.load(skipComment(data), "=stdin", mode)
+	}
+	data, err := ls.readFile(filename)
+	if err != nil {
+		msg, _ := errorString(err)
+		luaPushFString(ls, "cannot open %s: %s", filename, msg)
+		return LUA_ERRFILE
+	}
+	return ls.load(skipComment(data), "@"+filename, mode)
+}
+
+// blanks out a first line starting with '#', as in Unix exec. files,
+// keeping the newline so that line numbers are right
+// lua-5.3.4/src/lauxlib.c#skipcomment()
+func skipComment(data []byte) []byte {
+	if len(data) == 0 || data[0] != '#' {
+		return data
+	}
+	if i := bytes.IndexByte(data, '\n'); i >= 0 {
+		return data[i:]
 	}
-	return LUA_ERRFILE
+	return nil
 }
 
 // [-0, +1, –]
@@ -241,7 +389,19 @@ func (ls *LuaState) RequireF(modname string, openf GoFunction, glb bool) {
 
 // [-(nargs+1), +nresults, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_call
+// lua-5.3.4/src/ldo.c#luaD_call()
 func (ls *LuaState) Call(nArgs, nResults int) {
+	if ls.nCcalls >= LUAI_MAXCCALLS {
+		ls.runError("C stack overflow")
+	}
+	ls.nCcalls++
+	ls.call(nArgs, nResults)
+	ls.nCcalls--
+}
+
+// calls made by the VM, which count only towards maxCalls; Go functions
+// and metamethods call through Call, whose nesting LUAI_MAXCCALLS limits
+func (ls *LuaState) call(nArgs, nResults int) {
 	val := ls.stack.get(-(nArgs + 1))
 
 	c, ok := val.(*LuaClosure)
@@ -263,33 +423,32 @@ func (ls *LuaState) Call(nArgs, nResults int) {
 			ls.callGoClosure(nArgs, nResults, c)
 		}
 	} else {
-		panic("not function!")
+		ls.opTypeError(valueOf(val), "call")
 	}
 }
 
 func (ls *LuaState) callGoClosure(nArgs, nResults int, c *LuaClosure) {
 	// create new lua stack
-	newStack := newLuaStack(nArgs+LUA_MINSTACK, ls)
+	newStack := ls.newFrame(nArgs + LUA_MINSTACK)
 	newStack.closure = c
 
 	// pass args, pop func
-	if nArgs > 0 {
-		args := ls.stack.popN(nArgs)
-		newStack.pushN(args, nArgs)
-	}
-	ls.stack.pop()
+	args := ls.stack.slots[ls.stack.top-nArgs : ls.stack.top]
+	newStack.top = copy(newStack.slots, args)
+	ls.stack.drop(nArgs + 1)
 
 	// run Closure
 	ls.pushLuaStack(newStack)
+	ls.callFrameHook(LUA_HOOKCALL)
 	r := c.goFunc(ls)
+	ls.callFrameHook(LUA_HOOKRET)
 	ls.popLuaStack()
 
 	// return results
 	if nResults != 0 {
-		results := newStack.popN(r)
-		ls.stack.check(len(results))
-		ls.stack.pushN(results, nResults)
+		ls.stack.moveResults(newStack, newStack.top-r, nResults)
 	}
+	ls.freeFrame(newStack)
 }
 
 func (ls *LuaState) callLuaClosure(nArgs, nResults int, c *LuaClosure) {
@@ -298,37 +457,57 @@ func (ls *LuaState) callLuaClosure(nArgs, nResults int, c *LuaClosure) {
 	isVararg := c.proto.IsVararg == 1
 
 	// create new lua stack
-	newStack := newLuaStack(nRegs+LUA_MINSTACK, ls)
+	newStack := ls.newFrame(nRegs + LUA_MINSTACK)
 	newStack.closure = c
 
 	// pass args, pop func
-	funcAndArgs := ls.stack.popN(nArgs + 1)
-	newStack.pushN(funcAndArgs[1:], nParams)
-	newStack.top = nRegs
-	if nArgs > nParams && isVararg {
-		newStack.varargs = funcAndArgs[nParams+1:]
+	args := ls.stack.slots[ls.stack.top-nArgs : ls.stack.top]
+	if nArgs > nParams {
+		copy(newStack.slots, args[:nParams])
+		if isVararg {
+			newStack.varargs = append([]value(nil), args[nParams:]...)
+		}
+	} else {
+		copy(newStack.slots, args)
 	}
+	newStack.top = nRegs
+	ls.stack.drop(nArgs + 1)
 
 	// run Closure
 	ls.pushLuaStack(newStack)
-	ls.runLuaClosure()
+	ls.callFrameHook(LUA_HOOKCALL)
+	ls.execute()
+	ls.callFrameHook(LUA_HOOKRET)
 	ls.popLuaStack()
 
 	// return results
 	if nResults != 0 {
-		results := newStack.popN(newStack.top - nRegs)
-		ls.stack.check(len(results))
-		ls.stack.pushN(results, nResults)
+		ls.stack.moveResults(newStack, nRegs, nResults)
 	}
+	newStack.closeUpvalues(0)
+	ls.freeFrame(newStack)
 }
 
-func (ls *LuaState) runLuaClosure() {
-	for {
-		inst := Instruction(ls.fetch())
-		inst.Execute(ls)
-		if inst.Opcode() == compiler.OP_RETURN {
-			break
-		}
+// LuaError is the error returned by PCall, Value is the error object and
+// Traceback the stack where it was raised.
+type LuaError struct {
+	Value     LuaValue
+	Traceback string
+}
+
+func (e *LuaError) Error() string {
+	return e.Value.String() + "\n" + e.Traceback
+}
+
+// the error object of a recovered panic
+func errorValue(rcv interface{}) LuaValue {
+	switch x := rcv.(type) {
+	case LuaValue:
+		return x
+	case error:
+		return LuaString(x.Error())
+	default:
+		return LuaString(fmt.Sprint(x))
 	}
 }
 
@@ -336,6 +515,8 @@ func (ls *LuaState) runLuaClosure() {
 // http://www.lua.org/manual/5.3/manual.html#lua_pcall
 func (ls *LuaState) PCall(nArgs, nResults, msgh int) (err error) {
 	caller := ls.stack
+	base := caller.top - (nArgs + 1)
+	nCcalls := ls.nCcalls
 
 	// catch error
 	defer func() {
@@ -343,31 +524,14 @@ func (ls *LuaState) PCall(nArgs, nResults, msgh int) (err error) {
 			if msgh != 0 {
 				panic(rcv)
 			}
-			first := true
-			for stack := ls.stack; stack!=nil; stack = stack.prev {
-				if stack.closure != nil {
-					if proto := stack.closure.proto; proto != nil {
-						if first {
-							err = fmt.Errorf("%v:%v %v", proto.Source, proto.DbgSourcePositions[stack.pc], rcv)
-							first = false
-							if prev := stack.prev; prev != nil && prev.closure != nil {
-								if proto := prev.closure.proto; proto != nil {
-									err = fmt.Errorf("%v\nstack traceback:\n", err)
-								}
-							}
-						}else{
-							err = fmt.Errorf("%v\t%v:%v\n", err, proto.Source, proto.DbgSourcePositions[stack.pc])
-						}
-					}else {
-						//if gofunc := stack.Closure.goFunc; gofunc != nil {
-						//	fmt.Println("go function:", gofunc)
-						//}
-					}
-				}
-			}
+			err = &LuaError{Value: errorValue(rcv), Traceback: ls.stackTrace(0)}
 			for ls.stack != caller {
 				ls.popLuaStack()
 			}
+			ls.nCcalls = nCcalls
+			if caller.top > base { /* the function was not called */
+				caller.drop(caller.top - base)
+			}
 		}
 	}()
 
@@ -386,15 +550,62 @@ func (ls *LuaState) Error() int {
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_error
 func (ls *LuaState) Error2(fmt string, a ...interface{}) int {
-	luaPushFString(ls, fmt, a...) // todo
+	ls.Push(LuaString(ls.where(1, false)))
+	luaPushFString(ls, fmt, a...)
+	luaConcat(ls, 2)
 	return ls.Error()
 }
 
 // [-0, +0, v]
 // http://www.lua.org/manual/5.3/manual.html#luaL_argerror
 func (ls *LuaState) ArgError(arg int, extraMsg string) int {
-	// bad argument #arg to 'funcname' (extramsg)
-	return ls.Error2("bad argument #%d (%s)", arg, extraMsg) // todo
+	dbg := ls.GetInfo(0)
+	if dbg == nil { /* no stack frame? */
+		return ls.Error2("bad argument #%d (%s)", arg, extraMsg)
+	}
+	if dbg.NameWhat == "method" {
+		arg-- /* do not count 'self' */
+		if arg == 0 { /* error is in the self argument itself? */
+			return ls.Error2("calling '%s' on bad self (%s)", dbg.Name, extraMsg)
+		}
+	}
+	name := dbg.Name
+	if name == "" {
+		if name = ls.globalFuncName(dbg.Func); name == "" {
+			name = "?"
+		}
+	}
+	return ls.Error2("bad argument #%d to '%s' (%s)", arg, name, extraMsg)
+}
+
+// the name under which a loaded module holds f, like "string.upper" or
+// "print" for a global, or "" if there is none
+// lua-5.3.4/src/lauxlib.c#pushglobalfuncname()
+func (ls *LuaState) globalFuncName(f LuaValue) string {
+	loaded, ok := ls.registry.Get(LuaString(LUA_LOADED_TABLE)).(*LuaTable)
+	if !ok {
+		return ""
+	}
+	return strings.TrimPrefix(findField(loaded, f, 2), "_G.")
+}
+
+// lua-5.3.4/src/lauxlib.c#findfield()
+func findField(tb *LuaTable, f LuaValue, level int) string {
+	for k, v := tb.Next(LuaNil); k != LuaNil; k, v = tb.Next(k) {
+		name, ok := k.(LuaString)
+		if !ok {
+			continue
+		}
+		if v == f {
+			return string(name)
+		}
+		if t, ok := v.(*LuaTable); ok && level > 1 {
+			if field := findField(t, f, level-1); field != "" {
+				return string(name) + "." + field
+			}
+		}
+	}
+	return ""
 }
 
 func (ls *LuaState) raiseError(level int, format string, args ...interface{}) {
@@ -403,22 +614,22 @@ func (ls *LuaState) raiseError(level int, format string, args ...interface{}) {
 		message = fmt.Sprintf(format, args...)
 	}
 	if level > 0 {
-		message = fmt.Sprintf("%v %v", ls.where(level-1, true), message)
+		message = ls.where(level-1, true) + message
 	}
 	// ls.stack.push(LuaString(message))
 	panic(message)
 }
 
-func (ls *LuaState) getDebug(level int) *luaDebug {
+func (ls *LuaState) getDebug(level int) *DebugInfo {
 	stack := ls.stack
 	for ; level > 0 && stack != nil; stack = stack.prev {
 		level--
 		// todo tail call
 	}
 	if level == 0 && stack != nil {
-		return &luaDebug{stack: stack}
+		return &DebugInfo{stack: stack}
 	} else if level < 0 {
-		return &luaDebug{stack: ls.stack}
+		return &DebugInfo{stack: ls.stack}
 	}
 	return nil
 }
@@ -449,27 +660,25 @@ func (ls *LuaState) typeError(arg int, tname string) int {
 	return ls.ArgError(arg, msg)
 }
 
+// position of the function at the given level as "chunkname:currentline: ",
+// skipg skips Go functions to report the nearest Lua caller
+// lua-5.3.4/src/lauxlib.c#luaL_where()
 func (ls *LuaState) where(level int, skipg bool) string {
 	dbg := ls.getDebug(level)
 	if dbg == nil {
 		return ""
 	}
 	stack := dbg.stack
-	sourcename := "[G]"
-	var proto *compiler.FunctionProto = nil
-	if stack.closure != nil {
-		proto = stack.closure.proto
-	}
-	if proto != nil {
-		sourcename = proto.Source
-	} else if skipg {
-		return ls.where(level+1, skipg)
+	if stack.closure == nil || stack.closure.proto == nil {
+		if skipg && stack.closure != nil {
+			return ls.where(level+1, skipg)
+		}
+		return "" /* else, no information available... */
 	}
-	line := ""
-	if proto != nil {
-		line = fmt.Sprintf("%v:", proto.DbgSourcePositions[dbg.stack.pc-1])
+	if line := currentLine(stack); line > 0 { /* is there info? */
+		return fmt.Sprintf("%s:%d: ", compiler.ChunkID(stack.closure.proto.Source), line)
 	}
-	return fmt.Sprintf("%v:%v", sourcename, line)
+	return ""
 }
 
 func (ls *LuaState) findLocal(stack *luaStack, no int) string {
@@ -483,67 +692,51 @@ func (ls *LuaState) findLocal(stack *luaStack, no int) string {
 	return ""
 }
 
+// lua-5.3.4/src/lauxlib.c#luaL_traceback()
 func (ls *LuaState) stackTrace(level int) string {
-	buf := []string{}
-	header := "stack traceback:"
-	if ls.stack != nil {
-		i := 0
-		for dbg := ls.getDebug(i); dbg!=nil; dbg = ls.getDebug(i) {
-			s := dbg.stack
-			buf = append(buf, fmt.Sprintf("\t%v in %v", ls.where(i, false), ls.formattedFrameFuncName(s)))
-			if c := s.closure; c != nil && c.proto != nil && s.tailCall>0 {
-				for tc := s.tailCall; tc > 0; tc-- {
-					buf = append(buf, "\t(tailcall): ?")
-					i++
-				}
+	const levels1, levels2 = 10, 11 /* size of the first and second part of the stack */
+	var frames []*luaStack          /* walked once, the stack may be deep after an overflow */
+	for stack := ls.stack; stack != nil && stack.closure != nil; stack = stack.prev {
+		frames = append(frames, stack)
+	}
+	if level > len(frames) {
+		level = len(frames)
+	}
+	frames = frames[level:]
+	buf := []string{"stack traceback:"}
+	for i, stack := range frames {
+		if len(frames) > levels1+levels2 && i >= levels1 && i < len(frames)-levels2 {
+			if i == levels1 { /* too many levels? */
+				buf = append(buf, "\n\t...")
 			}
-			i++
+			continue
 		}
-	}
-	buf = append(buf, fmt.Sprintf("\t%v: %v", "[G]", "?"))
-	buf = buf[intMax(0, intMin(level, len(buf))):len(buf)]
-	if len(buf) > 20 {
-		newbuf := make([]string, 0, 20)
-		newbuf = append(newbuf, buf[0:7]...)
-		newbuf = append(newbuf, "\t...")
-		newbuf = append(newbuf, buf[len(buf)-7:len(buf)]...)
-		buf = newbuf
-	}
-	return fmt.Sprintf("%s\n%s", header, strings.Join(buf, "\n"))
-}
-
-func (ls *LuaState) formattedFrameFuncName(stack *luaStack) string {
-	name, ischunk := ls.frameFuncName(stack)
-	if ischunk {
-		return name
-	}
-	if name[0] != '(' && name[0] != '<' {
-		return fmt.Sprintf("function '%s'", name)
-	}
-	return fmt.Sprintf("function %s", name)
-}
-
-func (ls *LuaState) frameFuncName(stack *luaStack) (string, bool) {
-	fstack := stack.prev
-	if fstack == nil {
-		return "main chunk", true
-	}
-	if c := fstack.closure; c != nil && c.proto != nil {
-		pc := fstack.pc - 1
-		for _, call := range c.proto.DbgCalls {
-			if call.Pc == pc {
-				name := call.Name
-				if name == "?" {
-					if c0 := stack.closure; c0!=nil && c0.proto != nil {
-						name = fmt.Sprintf("<%v:%v>", c0.proto.Source, c0.proto.LineDefined)
-					}
-				}
-				return name, false
-			}
+		dbg := &DebugInfo{stack: stack}
+		ls.funcInfo(dbg, stack.closure)
+		line := fmt.Sprintf("\n\t%s:", dbg.ShortSrc)
+		if dbg.CurrentLine > 0 {
+			line += fmt.Sprintf("%d:", dbg.CurrentLine)
+		}
+		buf = append(buf, line, " in ", funcDescription(dbg))
+		if stack.tailCall > 0 {
+			buf = append(buf, "\n\t(...tail calls...)")
 		}
 	}
-	if c := stack.closure; c!=nil && c.proto != nil {
-		return fmt.Sprintf("<%v:%v>", c.proto.Source, c.proto.LineDefined), false
+	return strings.Join(buf, "")
+}
+
+// lua-5.3.4/src/lauxlib.c#pushfuncname()
+func funcDescription(dbg *DebugInfo) string {
+	switch {
+	case dbg.NameWhat != "": /* is there a name from code? */
+		return fmt.Sprintf("%s '%s'", dbg.NameWhat, dbg.Name)
+	case dbg.Name != "":
+		return fmt.Sprintf("function '%s'", dbg.Name)
+	case dbg.What == "main":
+		return "main chunk"
+	case dbg.What != "Go": /* for Lua functions, use <file:line> */
+		return fmt.Sprintf("function <%s:%d>", dbg.ShortSrc, dbg.LineDefined)
+	default: /* nothing left... */
+		return "?"
 	}
-	return "(anonymous)", false
 }
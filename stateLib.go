@@ -10,8 +10,12 @@ func (ls *LuaState) OpenLibs() {
 	 	"string":    OpenStringLib,
 	 	"utf8":      OpenUTF8Lib,
 	 	"os":        OpenOSLib,
+	 	"io":        OpenIOLib,
 	 	"package":   OpenPackageLib,
 	 	"coroutine": OpenCoroutineLib,
+	 	"debug":     OpenDebugLib,
+	 	"channel":   OpenChannelLib,
+	 	"timer":     OpenTimerLib,
 	 }
 
 	 for name, fun := range libs {
@@ -2,15 +2,18 @@ package golua
 
 import (
 	"fmt"
-	"luago/number"
+	"golua/number"
+	"os"
+	"os/exec"
 	"strings"
+	"syscall"
 )
 
 // [-n, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_pop
 func luaPop(ls *LuaState, n int) {
 	for i := 0; i < n; i++ {
-		ls.stack.pop()
+		ls.stack.popv()
 	}
 }
 
@@ -29,7 +32,11 @@ func luaAbsIndex(ls *LuaState, idx int) int {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_checkstack
 func luaCheckStack(ls *LuaState, n int) bool {
-	ls.stack.check(n)
+	stack := ls.stack
+	if free := len(stack.slots) - stack.top; free < n && ls.stackSize+n-free > ls.maxStack {
+		return false /* would overflow */
+	}
+	stack.check(n)
 	return true
 }
 
@@ -37,8 +44,7 @@ func luaCheckStack(ls *LuaState, n int) bool {
 // http://www.lua.org/manual/5.3/manual.html#lua_type
 func luaType(ls *LuaState, idx int) LuaValueType {
 	if ls.stack.isValid(idx) {
-		val := ls.stack.get(idx)
-		return val.Type()
+		return ls.stack.getv(idx).valueType()
 	}
 	return LUA_TNONE
 }
@@ -46,35 +52,30 @@ func luaType(ls *LuaState, idx int) LuaValueType {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_isinteger
 func luaIsInteger(ls *LuaState, idx int) bool {
-	val := ls.stack.get(idx)
-	switch val.Type() {
-	case LUA_TNUMBER:
-		_, ok := floatToInteger(val.(LuaNumber))
+	v := ls.stack.getv(idx)
+	if v.isNumber() {
+		_, ok := number.FloatToInteger(v.n)
 		return ok
-	default:
-		return false
 	}
+	return false
 }
 
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_copy
 func luaCopy(ls *LuaState, fromIdx, toIdx int) {
-	val := ls.stack.get(fromIdx)
-	ls.stack.set(toIdx, val)
+	ls.stack.setv(toIdx, ls.stack.getv(fromIdx))
 }
 
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_pushvalue
 func luaPushValue(ls *LuaState, idx int) {
-	val := ls.stack.get(idx)
-	ls.stack.push(val)
+	ls.stack.pushv(ls.stack.getv(idx))
 }
 
 // [-1, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_replace
 func luaReplace(ls *LuaState, idx int) {
-	val := ls.stack.pop()
-	ls.stack.set(idx, val)
+	ls.stack.setv(idx, ls.stack.popv())
 }
 
 // [-1, +1, –]
@@ -117,11 +118,11 @@ func luaSetTop(ls *LuaState, idx int) {
 	n := ls.stack.top - newTop
 	if n > 0 {
 		for i := 0; i < n; i++ {
-			ls.stack.pop()
+			ls.stack.popv()
 		}
 	} else if n < 0 {
 		for i := 0; i > n; i-- {
-			ls.stack.push(nil)
+			ls.stack.pushv(nilValue)
 		}
 	}
 }
@@ -136,8 +137,10 @@ func luaXMove(ls *LuaState, to *LuaState, n int) {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_rawlen
 func luaRawLen(ls *LuaState, idx int) int {
-	val := ls.stack.get(idx)
-	return val.Len()
+	if v := ls.stack.getv(idx); !v.isNumber() && !v.isNil() {
+		return v.o.Len()
+	}
+	return 0
 }
 
 // [-0, +0, –]
@@ -209,8 +212,7 @@ func luaIsGoFunction(ls *LuaState, idx int) bool {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_toboolean
 func luaToBoolean(ls *LuaState, idx int) bool {
-	val := ls.stack.get(idx)
-	return convertToBoolean(val)
+	return ls.stack.getv(idx).toBoolean()
 }
 
 // [-0, +0, –]
@@ -223,8 +225,7 @@ func luaToInteger(ls *LuaState, idx int) int64 {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_tointegerx
 func luaToIntegerX(ls *LuaState, idx int) (int64, bool) {
-	val := ls.stack.get(idx)
-	return convertToInteger(val)
+	return ls.stack.getv(idx).toInteger()
 }
 
 // [-0, +0, –]
@@ -237,8 +238,7 @@ func luaToNumber(ls *LuaState, idx int) float64 {
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_tonumberx
 func luaToNumberX(ls *LuaState, idx int) (float64, bool) {
-	val := ls.stack.get(idx)
-	return convertToFloat(val)
+	return ls.stack.getv(idx).toFloat()
 }
 
 // [-0, +0, m]
@@ -298,8 +298,8 @@ func luaRawEqual(ls *LuaState, idx1, idx2 int) bool {
 		return false
 	}
 
-	a := ls.stack.get(idx1)
-	b := ls.stack.get(idx2)
+	a := ls.stack.getv(idx1)
+	b := ls.stack.getv(idx2)
 	return _eq(a, b, nil)
 }
 
@@ -310,8 +310,8 @@ func luaCompare(ls *LuaState, idx1, idx2 int, op CompareOp) bool {
 		return false
 	}
 
-	a := ls.stack.get(idx1)
-	b := ls.stack.get(idx2)
+	a := ls.stack.getv(idx1)
+	b := ls.stack.getv(idx2)
 	switch op {
 	case LUA_OPEQ:
 		return _eq(a, b, ls)
@@ -325,81 +325,52 @@ func luaCompare(ls *LuaState, idx1, idx2 int, op CompareOp) bool {
 	return false
 }
 
-func _eq(a, b LuaValue, ls *LuaState) bool {
-	switch a.Type() {
-	case LUA_TNIL:
-		return b.Type() == LUA_TNIL
-	case LUA_TBOOLEAN:
-		ba := bool(a.(LuaBool))
-		y, ok := b.(LuaBool)
-		return ok && ba == bool(y)
-	case LUA_TSTRING:
-		y, ok := b.(LuaString)
-		return ok && a.String() == y.String()
-	case LUA_TNUMBER:
-		_, ok := b.(LuaNumber)
-		if !ok {
-			return false
-		}
-		switch b.Type() {
-		case LUA_TNUMBER:
-			fa, _ := convertToFloat(a)
-			fb, _ := convertToFloat(b)
-			return fa == fb
-		default:
-			return false
-		}
-	case LUA_TTABLE:
-		if b.Type() == LUA_TTABLE && a != b && ls != nil {
-			if result, ok := callMetamethod(ls, a, b, "__eq"); ok {
+func _eq(a, b value, ls *LuaState) bool {
+	if a.isNumber() || b.isNumber() {
+		return a.isNumber() && b.isNumber() && a.n == b.n
+	}
+	switch x := a.o.(type) {
+	case LuaString:
+		y, ok := b.o.(LuaString)
+		return ok && x == y
+	case *LuaTable:
+		if y, ok := b.o.(*LuaTable); ok && x != y && ls != nil {
+			if result, ok := callMetamethod(ls, x, y, "__eq"); ok {
 				return convertToBoolean(result)
 			}
 		}
-		return a == b
+		return a.o == b.o
 	default:
-		return a == b
+		return a.o == b.o
 	}
 }
 
-func _lt(a, b LuaValue, ls *LuaState) bool {
-	switch a.Type() {
-	case LUA_TSTRING:
-		if b.Type() == LUA_TSTRING {
-			return a.String() < b.String()
-		}
-		return false
-	case LUA_TNUMBER:
-		if b.Type() == LUA_TNUMBER {
-			x, _ := convertToFloat(a)
-			y, _ := convertToFloat(b)
+func _lt(a, b value, ls *LuaState) bool {
+	if a.isNumber() && b.isNumber() {
+		return a.n < b.n
+	}
+	if x, ok := a.o.(LuaString); ok {
+		if y, ok := b.o.(LuaString); ok {
 			return x < y
 		}
-		return false
 	}
-
-	if result, ok := callMetamethod(ls, a, b, "__lt"); ok {
+	if result, ok := callMetamethod(ls, a.luaValue(), b.luaValue(), "__lt"); ok {
 		return convertToBoolean(result)
 	}
-	panic("comparison error!")
+	ls.orderError(a, b)
 	return false
 }
 
-func _le(a, b LuaValue, ls *LuaState) bool {
-	switch a.Type() {
-	case LUA_TSTRING:
-		if b.Type() == LUA_TSTRING {
-			return a.String() <= b.String()
-		}
-		return false
-	case LUA_TNUMBER:
-		if b.Type() == LUA_TNUMBER {
-			x, _ := convertToFloat(a)
-			y, _ := convertToFloat(b)
+func _le(a, b value, ls *LuaState) bool {
+	if a.isNumber() && b.isNumber() {
+		return a.n <= b.n
+	}
+	if x, ok := a.o.(LuaString); ok {
+		if y, ok := b.o.(LuaString); ok {
 			return x <= y
 		}
-		return false
 	}
-	if result, ok := callMetamethod(ls, a, b, "__le"); ok {
+	if result, ok := callMetamethod(ls, a.luaValue(), b.luaValue(), "__le"); ok {
 		return convertToBoolean(result)
 	}
 	if _lt(a, b, ls) == true {
@@ -408,81 +379,80 @@ func _le(a, b LuaValue, ls *LuaState) bool {
 	if _eq(a, b, ls) == true {
 		return true
 	}
-	panic("comparison error!")
+	ls.orderError(a, b)
 	return false
 }
 
 // [-1, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_gettable
 func luaGetTable(ls *LuaState, idx int) LuaValueType {
-	t := ls.stack.get(idx)
-	k := ls.stack.pop()
+	t := ls.stack.getv(idx)
+	k := ls.stack.popv()
 	return luaGetTable_(ls, t, k, false)
 }
 
 // push(t[k])
-func luaGetTable_(ls *LuaState, t, k LuaValue, raw bool) LuaValueType {
-	if tbl, ok := t.(*LuaTable); ok {
-		v := tbl.Get(k)
-		if raw || v != nil || !tbl.hasMetafield("__index") {
-			ls.stack.push(v)
-			return v.Type()
+func luaGetTable_(ls *LuaState, t, k value, raw bool) LuaValueType {
+	if tbl, ok := t.o.(*LuaTable); ok {
+		v := tbl.get(k)
+		if raw || !v.isNil() || !tbl.hasMetafield("__index") {
+			ls.stack.pushv(v)
+			return v.valueType()
 		}
 	}
 
 	if !raw {
-		if mf := GetMetafield(ls, t, "__index"); mf != nil {
+		if mf := GetMetafield(ls, t.luaValue(), "__index"); mf != nil {
 			switch x := mf.(type) {
 			case *LuaTable:
-				return luaGetTable_(ls, x, k, false)
+				return luaGetTable_(ls, value{o: x}, k, false)
 			case *LuaClosure:
 				ls.stack.push(mf)
-				ls.stack.push(t)
-				ls.stack.push(k)
+				ls.stack.pushv(t)
+				ls.stack.pushv(k)
 				ls.Call(2, 1)
-				v := ls.stack.get(-1)
-				return v.Type()
+				return ls.stack.getv(-1).valueType()
 			}
 		}
 	}
-	panic("index error!")
+	ls.opTypeError(t, "index")
 	return LUA_TNIL
 }
 
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_getfield
 func luaGetField(ls *LuaState, idx int, k string) LuaValueType {
-	t := ls.stack.get(idx)
-	return luaGetTable_(ls, t, LuaString(k), false)
+	t := ls.stack.getv(idx)
+	return luaGetTable_(ls, t, value{o: LuaString(k)}, false)
 }
 
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_geti
 func luaGetI(ls *LuaState, idx int, i int64) LuaValueType {
-	t := ls.stack.get(idx)
-	return luaGetTable_(ls, t, LuaNumber(i), false)
+	t := ls.stack.getv(idx)
+	return luaGetTable_(ls, t, numberValue(float64(i)), false)
 }
 
 // [-1, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_rawget
 func luaRawGet(ls *LuaState, idx int) LuaValueType {
-	t := ls.stack.get(idx)
-	k := ls.stack.pop()
+	t := ls.stack.getv(idx)
+	k := ls.stack.popv()
 	return luaGetTable_(ls, t, k, true)
 }
 
 // [-0, +1, –]
 // http://www.lua.org/manual/5.3/manual.html#lua_rawgeti
 func luaRawGetI(ls *LuaState, idx int, i int64) LuaValueType {
-	t := ls.stack.get(idx)
-	return luaGetTable_(ls, t, LuaNumber(i), true)
+	t := ls.stack.getv(idx)
+	return luaGetTable_(ls, t, numberValue(float64(i)), true)
 }
 
 // [-0, +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_getglobal
 func luaGetGlobal(ls *LuaState, name string) LuaValueType {
-	t := ls.registry.Get(LUA_RIDX_GLOBALS)
-	return luaGetTable_(ls, t, LuaString(name), false)
+	t := ls.registry.get(numberValue(float64(LUA_RIDX_GLOBALS)))
+	return luaGetTable_(ls, t, value{o: LuaString(name)}, false)
 }
 
 // [-0, +(0|1), –]
@@ -502,14 +472,14 @@ func luaGetMetatable(ls *LuaState, idx int) bool {
 // http://www.lua.org/manual/5.3/manual.html#lua_len
 func luaLen(ls *LuaState, idx int) {
 	val := ls.stack.get(idx)
-	if val.Type() == LUA_TSTRING {
-		ls.stack.push(LuaNumber(val.Len()))
+	if s, ok := val.(LuaString); ok {
+		ls.stack.pushv(numberValue(float64(len(s))))
 	} else if result, ok := callMetamethod(ls, val, val, "__len"); ok {
 		ls.stack.push(result)
 	} else if val.Type() == LUA_TTABLE {
-		ls.stack.push(LuaNumber(val.Len()))
+		ls.stack.pushv(numberValue(float64(val.Len())))
 	} else {
-		panic("length error!")
+		ls.opTypeError(valueOf(val), "get length of")
 	}
 }
 
@@ -536,7 +506,7 @@ func luaConcat(ls *LuaState, n int) {
 				continue
 			}
 
-			panic("concatenation error!")
+			ls.concatError(valueOf(a), valueOf(b))
 		}
 	}
 	// n == 1, do nothing
@@ -547,10 +517,14 @@ func luaConcat(ls *LuaState, n int) {
 func luaNext(ls *LuaState, idx int) bool {
 	val := ls.stack.get(idx)
 	if t, ok := val.(*LuaTable); ok {
-		key := ls.stack.pop()
-		if nextKey, v := t.nextKey(key); nextKey != nil {
-			ls.stack.push(nextKey)
-			ls.stack.push(v)
+		key := ls.stack.popv()
+		nextKey, v, ok := t.nextKey(key)
+		if !ok {
+			ls.Error2("invalid key to 'next'")
+		}
+		if !nextKey.isNil() {
+			ls.stack.pushv(nextKey)
+			ls.stack.pushv(v)
 			return true
 		}
 		return false
@@ -596,51 +570,51 @@ func luaPushThread(ls *LuaState) bool {
 // [-2, +0, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_settable
 func luaSetTable(ls *LuaState, idx int) {
-	t := ls.stack.get(idx)
-	v := ls.stack.pop()
-	k := ls.stack.pop()
+	t := ls.stack.getv(idx)
+	v := ls.stack.popv()
+	k := ls.stack.popv()
 	luaSetTable_(ls, t, k, v, false)
 }
 
 // [-1, +0, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_setfield
 func luaSetField(ls *LuaState, idx int, k string) {
-	t := ls.stack.get(idx)
-	v := ls.stack.pop()
-	luaSetTable_(ls, t, LuaString(k), v, false)
+	t := ls.stack.getv(idx)
+	v := ls.stack.popv()
+	luaSetTable_(ls, t, value{o: LuaString(k)}, v, false)
 }
 
 // [-1, +0, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_seti
 func luaSetI(ls *LuaState, idx int, i int64) {
-	t := ls.stack.get(idx)
-	v := ls.stack.pop()
-	luaSetTable_(ls, t, LuaNumber(i), v, false)
+	t := ls.stack.getv(idx)
+	v := ls.stack.popv()
+	luaSetTable_(ls, t, numberValue(float64(i)), v, false)
 }
 
 // [-2, +0, m]
 // http://www.lua.org/manual/5.3/manual.html#lua_rawset
 func luaRawSet(ls *LuaState, idx int) {
-	t := ls.stack.get(idx)
-	v := ls.stack.pop()
-	k := ls.stack.pop()
+	t := ls.stack.getv(idx)
+	v := ls.stack.popv()
+	k := ls.stack.popv()
 	luaSetTable_(ls, t, k, v, true)
 }
 
 // [-1, +0, m]
 // http://www.lua.org/manual/5.3/manual.html#lua_rawseti
 func luaRawSetI(ls *LuaState, idx int, i int64) {
-	t := ls.stack.get(idx)
-	v := ls.stack.pop()
-	luaSetTable_(ls, t, LuaNumber(i), v, true)
+	t := ls.stack.getv(idx)
+	v := ls.stack.popv()
+	luaSetTable_(ls, t, numberValue(float64(i)), v, true)
 }
 
 // [-1, +0, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_setglobal
 func luaSetGlobal(ls *LuaState, name string) {
-	t := ls.registry.Get(LUA_RIDX_GLOBALS)
-	v := ls.stack.pop()
-	luaSetTable_(ls, t, LuaString(name), v, false)
+	t := ls.registry.get(numberValue(float64(LUA_RIDX_GLOBALS)))
+	v := ls.stack.popv()
+	luaSetTable_(ls, t, value{o: LuaString(name)}, v, false)
 }
 
 // [-1, +0, –]
@@ -649,7 +623,7 @@ func luaSetMetatable(ls *LuaState, idx int) {
 	val := ls.stack.get(idx)
 	mtVal := ls.stack.pop()
 
-	if mtVal == nil {
+	if mtVal == LuaNil {
 		SetMetatable(ls, val, nil)
 	} else if mt, ok := mtVal.(*LuaTable); ok {
 		SetMetatable(ls, val, mt)
@@ -659,32 +633,31 @@ func luaSetMetatable(ls *LuaState, idx int) {
 }
 
 // t[k]=v
-func luaSetTable_(ls *LuaState, t, k, v LuaValue, raw bool) {
-	if tb, ok := t.(*LuaTable); ok {
-		if raw || tb.Get(k) != LuaNil || !tb.hasMetafield("__newindex") {
-			tb.Set(k, v)
+func luaSetTable_(ls *LuaState, t, k, v value, raw bool) {
+	if tb, ok := t.o.(*LuaTable); ok {
+		if raw || !tb.get(k).isNil() || !tb.hasMetafield("__newindex") {
+			tb.set(k, v)
 			return
 		}
 	}
 
 	if !raw {
-		if mf := GetMetafield(ls, t, "__newindex"); mf != nil {
+		if mf := GetMetafield(ls, t.luaValue(), "__newindex"); mf != nil {
 			switch x := mf.(type) {
 			case *LuaTable:
-				luaSetTable_(ls, x, k, v, false)
+				luaSetTable_(ls, value{o: x}, k, v, false)
 				return
 			case *LuaClosure:
 				ls.stack.push(mf)
-				ls.stack.push(t)
-				ls.stack.push(k)
-				ls.stack.push(v)
+				ls.stack.pushv(t)
+				ls.stack.pushv(k)
+				ls.stack.pushv(v)
 				ls.Call(3, 0)
 				return
 			}
 		}
 	}
-	// todo
-	panic("index error!")
+	ls.opTypeError(t, "index")
 }
 
 // [-0, +0, v]
@@ -748,6 +721,126 @@ func luaOptString(ls *LuaState, arg int, def string) string {
 	return ls.CheckString(arg)
 }
 
+// [-0, +0, v]
+// http://www.lua.org/manual/5.3/manual.html#luaL_checkoption
+func luaCheckOption(ls *LuaState, arg int, def string, lst []string) int {
+	var name string
+	if def != "" {
+		name = luaOptString(ls, arg, def)
+	} else {
+		name = ls.CheckString(arg)
+	}
+	for i, opt := range lst {
+		if opt == name {
+			return i
+		}
+	}
+	return ls.ArgError(arg, fmt.Sprintf("invalid option '%s'", name))
+}
+
+// [-0, +1, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_newmetatable
+func luaNewMetatable(ls *LuaState, tname string) bool {
+	if luaGetField(ls, LUA_REGISTRYINDEX, tname) != LUA_TNIL { /* name already in use? */
+		return false /* leave previous value on top, but return false */
+	}
+	luaPop(ls, 1)
+	mt := ls.createTable(0, 2) /* create metatable */
+	mt.Set(LuaString("__name"), LuaString(tname)) /* metatable.__name = tname */
+	luaPushValue(ls, -1)
+	luaSetField(ls, LUA_REGISTRYINDEX, tname) /* registry.name = metatable */
+	return true
+}
+
+// [-0, +0, –]
+// http://www.lua.org/manual/5.3/manual.html#luaL_setmetatable
+func luaSetMetatable2(ls *LuaState, tname string) {
+	luaGetField(ls, LUA_REGISTRYINDEX, tname)
+	luaSetMetatable(ls, -2)
+}
+
+// [-0, +0, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_testudata
+func luaTestUData(ls *LuaState, ud int, tname string) *LuaUserData {
+	u, ok := ls.stack.get(ud).(*LuaUserData)
+	if !ok || u.Metatable == nil {
+		return nil
+	}
+	if mt, ok := ls.registry.Get(LuaString(tname)).(*LuaTable); !ok || mt != u.Metatable {
+		return nil /* not the same as the expected metatable */
+	}
+	return u
+}
+
+// [-0, +0, v]
+// http://www.lua.org/manual/5.3/manual.html#luaL_checkudata
+func luaCheckUData(ls *LuaState, ud int, tname string) *LuaUserData {
+	u := luaTestUData(ls, ud, tname)
+	if u == nil {
+		ls.typeError(ud, tname)
+	}
+	return u
+}
+
+// [-0, +(1|3), m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_fileresult
+func luaFileResult(ls *LuaState, err error, fname string) int {
+	if err == nil {
+		ls.Push(LuaTrue)
+		return 1
+	}
+	msg, en := errorString(err)
+	ls.Push(LuaNil)
+	if fname != "" {
+		luaPushFString(ls, "%s: %s", fname, msg)
+	} else {
+		ls.Push(LuaString(msg))
+	}
+	ls.Push(LuaNumber(en))
+	return 3
+}
+
+// [-0, +3, m]
+// http://www.lua.org/manual/5.3/manual.html#luaL_execresult
+func luaExecResult(ls *LuaState, err error) int {
+	what, stat := "exit", 0 /* type of termination, status code */
+	if err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok { /* error with an 'errno'? */
+			return luaFileResult(ls, err, "")
+		}
+		stat = ee.ExitCode()
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			what, stat = "signal", int(ws.Signal())
+		}
+	}
+	if what == "exit" && stat == 0 { /* successful termination? */
+		ls.Push(LuaTrue)
+	} else {
+		ls.Push(LuaNil)
+	}
+	ls.Push(LuaString(what))
+	ls.Push(LuaNumber(stat))
+	return 3 /* return true/nil,what,code */
+}
+
+// strerror(errno) and errno for a Go error
+func errorString(err error) (string, int) {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	case *os.SyscallError:
+		err = e.Err
+	}
+	if en, ok := err.(syscall.Errno); ok {
+		msg := err.Error() /* capitalized, as strerror writes it */
+		return strings.ToUpper(msg[:1]) + msg[1:], int(en)
+	}
+	return err.Error(), 0
+}
+
 // [-0, +0, –]
 // http://www.lua.org/manual/5.3/manual.html#luaL_typename
 func luaTypeName2(ls *LuaState, idx int) string {
@@ -813,8 +906,11 @@ func luaToString2(ls *LuaState, idx int) string {
 // http://www.lua.org/manual/5.3/manual.html#lua_newthread
 // lua-5.3.4/src/lstate.c#lua_newthread()
 func luaNewThread(ls *LuaState) *LuaState {
-	t := &LuaState{registry: ls.registry}
+	t := &LuaState{registry: ls.registry, maxCalls: ls.maxCalls, maxStack: ls.maxStack,
+		fsys: ls.fsys, cmdHook: ls.cmdHook, rand: ls.rand, sched: ls.sched,
+		clock: ls.clock, perms: ls.perms, patterns: ls.patterns}
 	t.pushLuaStack(newLuaStack(LUA_MINSTACK, t))
+	ls.inheritHooks(t)
 	ls.stack.push(t)
 	return t
 }
@@ -822,26 +918,14 @@ func luaNewThread(ls *LuaState) *LuaState {
 // [-(2|1), +1, e]
 // http://www.lua.org/manual/5.3/manual.html#lua_arith
 func luaArith(ls *LuaState, op ArithOp) {
-	var a, b LuaValue // operands
-	b = ls.stack.pop()
+	var a, b value // operands
+	b = ls.stack.popv()
 	if op != LUA_OPUNM && op != LUA_OPBNOT {
-		a = ls.stack.pop()
+		a = ls.stack.popv()
 	} else {
 		a = b
 	}
-	operator := operators[op]
-	fmt.Printf("a:%v b:%v op:%v\n", a, b, operator.metamethod)
-	if result := _arith(a, b, operator); result != LuaNil {
-		ls.stack.push(result)
-		return
-	}
-
-	mm := operator.metamethod
-	if result, ok := callMetamethod(ls, a, b, mm); ok {
-		ls.stack.push(result)
-		return
-	}
-	panic("arithmetic error")
+	ls.stack.pushv(ls.arith(a, b, op))
 }
 
 // [-0, +1, e]
@@ -4,179 +4,510 @@ import (
 	"fmt"
 	"golua/number"
 	"math"
+	"unsafe"
 )
 
+/*
+** A table has an array part and a hash part, like lua-5.3.4/src/ltable.c.
+** The array part holds the values of the integer keys 1..len(arr) and may
+** contain nil holes. The hash part is an open addressing table with
+** linear probing whose size is always a power of 2.
+**
+** A key whose value is set to nil stays in its slot as a dead key until the
+** next rehash, so that 'next' can continue a traversal from it. Rehashing
+** only happens when a new key is inserted, which Lua does not allow during
+** a traversal anyway.
+ */
+
+const MAXABITS = 31 /* largest power of 2 tried for the array part */
+
+type luaNode struct {
+	key value /* nil: empty slot */
+	val value /* nil: dead key */
+}
+
 func newLuaTable(nArr, nRec int) *LuaTable {
 	t := &LuaTable{}
 	if nArr > 0 {
-		t.arr = make([]LuaValue, 0, nArr)
+		t.arr = make([]value, 0, nArr)
 	}
 	if nRec > 0 {
-		t.map_ = make(map[LuaValue]LuaValue, nRec)
+		t.resizeHash(nRec)
 	}
 	return t
 }
 
 func (tb *LuaTable) hasMetafield(fieldName string) bool {
-	return tb.metatable != nil && tb.metatable.Get(LuaString(fieldName)) != LuaNil
+	return tb.metatable != nil && !tb.metatable.getStr(fieldName).isNil()
 }
 
-func (tb *LuaTable) Get(key LuaValue) LuaValue {
-	if key == nil || key == LuaNil {
-		return LuaNil
+/* hash */
+
+// lua-5.3.4/src/lstring.c#luaS_hash()
+func hashString(s string) uint32 {
+	l := len(s)
+	h := uint32(0x2545F491) ^ uint32(l)
+	step := (l >> 5) + 1
+	for ; l >= step; l -= step {
+		h ^= (h << 5) + (h >> 2) + uint32(s[l-1])
 	}
-	if key.Type() == LUA_TNUMBER {
-		if idx, ok := floatToInteger(key.(LuaNumber)); ok {
-			if idx >= 1 && idx <= int64(len(tb.arr)) {
-				return tb.arr[idx-1]
-			}
+	return h
+}
+
+func hashUint64(x uint64) uint32 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	return uint32(x)
+}
+
+func hashPointer(p unsafe.Pointer) uint32 {
+	return hashUint64(uint64(uintptr(p)))
+}
+
+func hashNumber(n float64) uint32 {
+	if n == 0 {
+		return 0 /* -0 and 0 are the same key */
+	}
+	return hashUint64(math.Float64bits(n))
+}
+
+func hashValue(key value) uint32 {
+	switch k := key.o.(type) {
+	case *numberTag:
+		return hashNumber(key.n)
+	case LuaString:
+		return hashString(string(k))
+	case LuaBool:
+		if k {
+			return 1
 		}
+		return 0
+	case *LuaTable:
+		return hashPointer(unsafe.Pointer(k))
+	case *LuaClosure:
+		return hashPointer(unsafe.Pointer(k))
+	case *LuaUserData:
+		return hashPointer(unsafe.Pointer(k))
+	case *LuaState:
+		return hashPointer(unsafe.Pointer(k))
+	default:
+		return uint32(k.Type())
 	}
-	if v, ok := tb.map_[key]; ok {
-		return v
+}
+
+/* hash part */
+
+// returns the slot of key in the hash part, or -1
+func (tb *LuaTable) findSlot(key value) int {
+	if len(tb.node) == 0 {
+		return -1
+	}
+	mask := len(tb.node) - 1
+	for i := int(hashValue(key)) & mask; ; i = (i + 1) & mask {
+		k := tb.node[i].key
+		if k.isNil() {
+			return -1
+		}
+		if rawEquals(k, key) {
+			return i
+		}
 	}
-	return LuaNil
 }
 
-func (tb *LuaTable) Set(key, val LuaValue) {
-	if key == nil || key == LuaNil {
-		return
+func (tb *LuaTable) getHash(key value) value {
+	if i := tb.findSlot(key); i >= 0 {
+		return tb.node[i].val
 	}
-	if val == nil {
-		val = LuaNil
+	return nilValue
+}
+
+func (tb *LuaTable) getStr(key string) value {
+	if i := tb.findStr(key); i >= 0 {
+		return tb.node[i].val
 	}
-	if key.Type() == LUA_TNUMBER {
-		f, _ := key.(LuaNumber)
-		if math.IsNaN(float64(f)) {
-			return
+	return nilValue
+}
+
+// returns the slot of the string key in the hash part, or -1
+func (tb *LuaTable) findStr(key string) int {
+	if len(tb.node) == 0 {
+		return -1
+	}
+	mask := len(tb.node) - 1
+	for i := int(hashString(key)) & mask; ; i = (i + 1) & mask {
+		k := tb.node[i].key.o
+		if k == nil {
+			return -1
 		}
-		tb.changed = true
-		if idx, ok := number.FloatToInteger(float64(f)); ok && idx > 0 {
-			arrLen := int64(len(tb.arr))
-			if idx <= arrLen {
-				tb.arr[idx-1] = val
-				if idx == arrLen && val == LuaNil {
-					tb.shrinkArray()
+		if s, ok := k.(LuaString); ok && string(s) == key {
+			return i
+		}
+	}
+}
+
+/*
+** fieldCache remembers the slot of a constant string key in the last
+** table it was looked up in. The slot stays valid as long as the version
+** of the table doesn't change, and it is read on every hit, so stores to
+** existing keys need no invalidation.
+ */
+type fieldCache struct {
+	key     string
+	t       *LuaTable
+	version uint32
+	slot    int
+}
+
+// raw t[c.key] through the cache c
+func (tb *LuaTable) getCached(c *fieldCache) value {
+	if c.t == tb && c.version == tb.version {
+		return tb.node[c.slot].val
+	}
+	i := tb.findStr(c.key)
+	if i < 0 {
+		return nilValue
+	}
+	c.t, c.version, c.slot = tb, tb.version, i
+	return tb.node[i].val
+}
+
+func (tb *LuaTable) setHash(key, val value) {
+	if len(tb.node) > 0 {
+		mask := len(tb.node) - 1
+		free := -1
+		for i := int(hashValue(key)) & mask; ; i = (i + 1) & mask {
+			k := tb.node[i].key
+			if k.isNil() {
+				if free < 0 {
+					free = i
 				}
-				return
+				break
 			}
-			if idx == arrLen+1 {
-				delete(tb.map_, key)
-				if val != LuaNil {
-					tb.arr = append(tb.arr, val)
-					tb.expandArray()
-				}
+			if rawEquals(k, key) {
+				tb.node[i].val = val
 				return
 			}
+			if free < 0 && tb.node[i].val.isNil() {
+				free = i /* reuse a dead key */
+			}
 		}
-		if val != LuaNil {
-			if tb.map_ == nil {
-				tb.map_ = make(map[LuaValue]LuaValue, 8)
+		if val.isNil() {
+			return /* absent key, nothing to remove */
+		}
+		if !tb.node[free].key.isNil() || int(tb.nodeUsed) < len(tb.node)-len(tb.node)>>2 {
+			if tb.node[free].key.isNil() {
+				tb.nodeUsed++
+			} else {
+				tb.version++ /* another key takes the slot */
 			}
-			tb.map_[key] = val
-		} else {
-			delete(tb.map_, key)
+			tb.node[free] = luaNode{key, val}
+			return
 		}
+	} else if val.isNil() {
 		return
 	}
-	tb.changed = true
-	if val != LuaNil {
-		if tb.map_ == nil {
-			tb.map_ = make(map[LuaValue]LuaValue, 8)
+	tb.rehash(key)
+	tb.set(key, val)
+}
+
+func (tb *LuaTable) resizeHash(n int) {
+	size := 0
+	if n > 0 {
+		size = 4
+		for size-size>>2 < n { /* keep load factor under 3/4 */
+			size <<= 1
+		}
+	}
+	old := tb.node
+	tb.node = nil
+	tb.nodeUsed = 0
+	tb.version++
+	if size > 0 {
+		tb.node = make([]luaNode, size)
+	}
+	for _, n := range old {
+		if !n.key.isNil() && !n.val.isNil() {
+			tb.set(n.key, n.val)
 		}
-		tb.map_[key] = val
-	} else {
-		delete(tb.map_, key)
 	}
 }
 
-func (tb *LuaTable) MaxN() int {
-	if len(tb.arr) == 0 {
-		return 0
+/* array part */
+
+// lua-5.3.4/src/ltable.c#computesizes()
+func computeSizes(nums []int, na int) (optimal, naInArr int) {
+	a := 0 /* number of elements smaller than 2^i */
+	twotoi := 1
+	for i := 0; twotoi > 0 && na > twotoi/2; i, twotoi = i+1, twotoi*2 {
+		if nums[i] > 0 {
+			a += nums[i]
+			if a > twotoi/2 { /* more than half elements present? */
+				optimal = twotoi /* optimal size (till now) */
+				naInArr = a      /* all elements up to 'optimal' will go to array part */
+			}
+		}
 	}
-	for i := len(tb.arr) - 1; i >= 0; i-- {
-		if tb.arr[i] != LuaNil {
-			return i + 1
+	return
+}
+
+func ceilLog2(x uint64) int {
+	l := 0
+	for x--; x > 0; x >>= 1 {
+		l++
+	}
+	return l
+}
+
+func countInt(key value, nums []int) int {
+	if key.isNumber() {
+		if k, ok := number.FloatToInteger(key.n); ok && k > 0 && k <= 1<<MAXABITS {
+			nums[ceilLog2(uint64(k))]++
+			return 1
 		}
 	}
 	return 0
 }
 
-func (tb *LuaTable) ForEach(cb func(LuaValue, LuaValue)) {
+// lua-5.3.4/src/ltable.c#rehash()
+func (tb *LuaTable) rehash(extraKey value) {
+	nums := make([]int, MAXABITS+1)
+	na := 0 /* number of integer keys */
 	for i, v := range tb.arr {
-		if v != LuaNil {
-			cb(LuaNumber(i+1), v)
+		if !v.isNil() {
+			nums[ceilLog2(uint64(i+1))]++
+			na++
 		}
 	}
-	for key, val := range tb.map_ {
-		cb(key, val)
+	total := na
+	for _, n := range tb.node {
+		if !n.key.isNil() && !n.val.isNil() {
+			na += countInt(n.key, nums)
+			total++
+		}
 	}
+	na += countInt(extraKey, nums)
+	total++
+	asize, naInArr := computeSizes(nums, na)
+	tb.resize(asize, total-naInArr)
 }
 
-func (tb *LuaTable) shrinkArray() {
-	for i := len(tb.arr) - 1; i >= 0; i-- {
-		if tb.arr[i] == nil {
-			tb.arr = tb.arr[0:i]
+func (tb *LuaTable) resize(nArr, nHash int) {
+	oldArr := tb.arr
+	oldNode := tb.node
+	if nArr < len(oldArr) {
+		tb.arr = oldArr[:nArr:nArr]
+	} else if nArr > len(oldArr) {
+		tb.arr = make([]value, nArr)
+		copy(tb.arr, oldArr)
+	}
+	tb.node = nil
+	tb.nodeUsed = 0
+	tb.resizeHash(nHash)
+	for i := nArr; i < len(oldArr); i++ { /* re-insert vanishing slice */
+		if !oldArr[i].isNil() {
+			tb.set(numberValue(float64(i+1)), oldArr[i])
+		}
+	}
+	for _, n := range oldNode {
+		if !n.key.isNil() && !n.val.isNil() {
+			tb.set(n.key, n.val)
 		}
 	}
 }
 
+/* move keys len(arr)+1, len(arr)+2, ... from the hash part to the array part */
 func (tb *LuaTable) expandArray() {
-	for idx := int64(len(tb.arr)) + 1; true; idx++ {
-		key := LuaNumber(idx)
-		if val, found := tb.map_[key]; found {
-			delete(tb.map_, key)
-			tb.arr = append(tb.arr, val)
-		} else {
+	for len(tb.node) > 0 {
+		i := tb.findSlot(numberValue(float64(len(tb.arr) + 1)))
+		if i < 0 || tb.node[i].val.isNil() {
 			break
 		}
+		tb.arr = append(tb.arr, tb.node[i].val)
+		tb.node[i].val = nilValue
+	}
+}
+
+/* get & set */
+
+func (tb *LuaTable) Get(key LuaValue) LuaValue {
+	if key == nil {
+		return LuaNil
 	}
+	return tb.get(valueOf(key)).luaValue()
 }
 
-func (tb *LuaTable) nextKey(key LuaValue) (LuaValue, LuaValue) {
-	if tb.keys == nil || (key == LuaNil && tb.changed) {
-		tb.initKeys()
-		tb.changed = false
+func (tb *LuaTable) Set(key, val LuaValue) {
+	if key == nil {
+		return
 	}
-	if key == LuaNil && len(tb.arr) > 0 {
-		key = LuaNumber(0)
+	tb.set(valueOf(key), valueOf(val))
+}
+
+func (tb *LuaTable) get(key value) value {
+	switch k := key.o.(type) {
+	case *numberTag:
+		return tb.getNum(key.n)
+	case LuaString:
+		return tb.getStr(string(k))
+	case nil:
+		return nilValue
 	}
-	if key.Type() == LUA_TNUMBER {
-		if idx, ok := floatToInteger(key.(LuaNumber)); ok && idx > 0 {
-			if idx < int64(len(tb.arr)) {
-				val := tb.arr[idx]
-				return LuaNumber(idx + 1), val
+	return tb.getHash(key)
+}
+
+func (tb *LuaTable) getNum(n float64) value {
+	if idx := int64(n); float64(idx) == n && uint64(idx-1) < uint64(len(tb.arr)) {
+		return tb.arr[idx-1]
+	}
+	return tb.getHash(numberValue(n))
+}
+
+func (tb *LuaTable) set(key, val value) {
+	if key.isNumber() {
+		if math.IsNaN(key.n) {
+			return
+		}
+		if idx, ok := number.FloatToInteger(key.n); ok && idx > 0 {
+			arrLen := int64(len(tb.arr))
+			if idx <= arrLen {
+				tb.arr[idx-1] = val
+				return
+			}
+			if idx == arrLen+1 && !val.isNil() {
+				if i := tb.findSlot(key); i >= 0 {
+					tb.node[i].val = nilValue
+				}
+				tb.arr = append(tb.arr, val)
+				tb.expandArray()
+				return
 			}
-			if idx == int64(len(tb.arr)) {
-				key = LuaNil
+		}
+	} else if key.isNil() {
+		return
+	}
+	tb.setHash(key, val)
+}
+
+/* length */
+
+// Len returns a border of the table, like the '#' operator.
+// lua-5.3.4/src/ltable.c#luaH_getn()
+func (tb *LuaTable) Len() int {
+	j := len(tb.arr)
+	if j > 0 && tb.arr[j-1].isNil() {
+		/* there is a border in the array part: binary search for it */
+		i := 0
+		for j-i > 1 {
+			m := (i + j) / 2
+			if tb.arr[m-1].isNil() {
+				j = m
+			} else {
+				i = m
 			}
 		}
+		return i
 	}
-	if key == LuaNil {
-		ok := true
-		if key, ok = tb.keys[key]; !ok {
-			return LuaNil, LuaNil
+	if len(tb.node) == 0 {
+		return j
+	}
+	return tb.unboundSearch(j)
+}
+
+// lua-5.3.4/src/ltable.c#unbound_search()
+func (tb *LuaTable) unboundSearch(j int) int {
+	i := j /* i is zero or a present index */
+	j++
+	/* find 'i' and 'j' such that i is present and j is not */
+	for !tb.getHash(numberValue(float64(j))).isNil() {
+		i = j
+		if j > math.MaxInt32/2 { /* overflow? */
+			/* table was built with bad purposes: resort to linear search */
+			i = 1
+			for !tb.getNum(float64(i)).isNil() {
+				i++
+			}
+			return i - 1
 		}
+		j *= 2
 	}
-	if val, ok := tb.map_[key]; ok {
-		if nextKey, ok := tb.keys[key]; ok {
-			return nextKey, val
+	/* now do a binary search between them */
+	for j-i > 1 {
+		m := (i + j) / 2
+		if tb.getNum(float64(m)).isNil() {
+			j = m
 		} else {
-			return LuaNil, val
+			i = m
+		}
+	}
+	return i
+}
+
+func (tb *LuaTable) MaxN() int {
+	for i := len(tb.arr) - 1; i >= 0; i-- {
+		if !tb.arr[i].isNil() {
+			return i + 1
 		}
 	}
-	return LuaNil, LuaNil
+	return 0
 }
 
-func (tb *LuaTable) initKeys() {
-	tb.keys = make(map[LuaValue]LuaValue)
-	var key LuaValue = LuaNil
-	for k, v := range tb.map_ {
-		if v != LuaNil {
-			tb.keys[key] = k
-			key = k
+/* traversal */
+
+func (tb *LuaTable) ForEach(cb func(LuaValue, LuaValue)) {
+	for i, v := range tb.arr {
+		if !v.isNil() {
+			cb(LuaNumber(i+1), v.luaValue())
 		}
 	}
+	for _, n := range tb.node {
+		if !n.key.isNil() && !n.val.isNil() {
+			cb(n.key.luaValue(), n.val.luaValue())
+		}
+	}
+}
+
+// Next returns the key/value pair following key, or LuaNil, LuaNil when the
+// traversal is over. Fields may be cleared while traversing. Number keys and
+// values are boxed on return, so traversing numbers allocates.
+func (tb *LuaTable) Next(key LuaValue) (LuaValue, LuaValue) {
+	k, v, _ := tb.nextKey(valueOf(key))
+	return k.luaValue(), v.luaValue()
+}
+
+// lua-5.3.4/src/ltable.c#luaH_next()
+func (tb *LuaTable) nextKey(key value) (value, value, bool) {
+	i, ok := tb.findIndex(key)
+	if !ok {
+		return nilValue, nilValue, false
+	}
+	for ; i < len(tb.arr); i++ {
+		if v := tb.arr[i]; !v.isNil() {
+			return numberValue(float64(i + 1)), v, true
+		}
+	}
+	for i -= len(tb.arr); i < len(tb.node); i++ {
+		if n := tb.node[i]; !n.key.isNil() && !n.val.isNil() {
+			return n.key, n.val, true
+		}
+	}
+	return nilValue, nilValue, true
+}
+
+/* returns the traversal index following key */
+func (tb *LuaTable) findIndex(key value) (int, bool) {
+	if key.isNil() {
+		return 0, true /* first iteration */
+	}
+	if key.isNumber() {
+		if idx, ok := number.FloatToInteger(key.n); ok && uint64(idx-1) < uint64(len(tb.arr)) {
+			return int(idx), true
+		}
+	}
+	if i := tb.findSlot(key); i >= 0 {
+		return len(tb.arr) + i + 1, true
+	}
+	return 0, false /* key not found */
 }
 
 /* metatable */
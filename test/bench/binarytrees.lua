@@ -0,0 +1,30 @@
+-- binary-trees: allocation of many small tables and recursive traversal
+local function bottomUpTree(depth)
+    if depth > 0 then
+        depth = depth - 1
+        return { bottomUpTree(depth), bottomUpTree(depth) }
+    end
+    return {}
+end
+
+local function itemCheck(tree)
+    if tree[1] then
+        return 1 + itemCheck(tree[1]) + itemCheck(tree[2])
+    end
+    return 1
+end
+
+local N = tonumber(arg and arg[1]) or 12
+local mindepth = 4
+local maxdepth = N
+
+local longlived = bottomUpTree(maxdepth)
+for depth = mindepth, maxdepth, 2 do
+    local iterations = 2 ^ (maxdepth - depth + mindepth)
+    local check = 0
+    for i = 1, iterations do
+        check = check + itemCheck(bottomUpTree(depth))
+    end
+    assert(check == iterations * (2 ^ (depth + 1) - 1))
+end
+assert(itemCheck(longlived) == 2 ^ (maxdepth + 1) - 1)
@@ -0,0 +1,10 @@
+-- naive recursive fibonacci
+local function fib(n)
+    if n < 2 then
+        return n
+    end
+    return fib(n - 1) + fib(n - 2)
+end
+
+local n = tonumber(arg and arg[1]) or 27
+assert(fib(n) == 196418 or n ~= 27)
@@ -0,0 +1,20 @@
+-- global and constant-key field lookups in a loop
+local Point = {}
+Point.__index = Point
+
+function Point.new(x, y)
+    return setmetatable({x = x, y = y}, Point)
+end
+
+function Point:norm1()
+    return math.abs(self.x) + math.abs(self.y)
+end
+
+local N = tonumber(arg and arg[1]) or 200000
+local p = Point.new(3, -4)
+local sum = 0
+for i = 1, N do
+    sum = sum + p:norm1() + math.floor(i / 2) - math.max(p.x, p.y)
+end
+local half = N // 2
+assert(N % 2 == 1 or sum == N * 7 + half * half - 3 * N)
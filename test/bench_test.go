@@ -0,0 +1,27 @@
+package compiler
+
+import (
+	"golua"
+	"testing"
+)
+
+// go test -test.run xxx -test.bench Lua -test.benchmem
+func benchmarkFile(b *testing.B, filename string) {
+	for i := 0; i < b.N; i++ {
+		ls := golua.NewLuaState()
+		ls.OpenLibs()
+		if ls.LoadFile(filename) != golua.LUA_OK {
+			b.Fatalf("cannot load %s", filename)
+		}
+		if err := ls.PCall(0, 0, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLuaFib(b *testing.B)          { benchmarkFile(b, "bench/fib.lua") }
+func BenchmarkLuaNBody(b *testing.B)        { benchmarkFile(b, "bench/nbody.lua") }
+func BenchmarkLuaSpectralNorm(b *testing.B) { benchmarkFile(b, "bench/spectralnorm.lua") }
+func BenchmarkLuaBinaryTrees(b *testing.B)  { benchmarkFile(b, "bench/binarytrees.lua") }
+func BenchmarkLuaFannkuch(b *testing.B)     { benchmarkFile(b, "bench/fannkuch.lua") }
+func BenchmarkLuaFields(b *testing.B)       { benchmarkFile(b, "bench/fields.lua") }
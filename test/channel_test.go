@@ -0,0 +1,159 @@
+package compiler
+
+import (
+	"golua"
+	"sync"
+	"testing"
+)
+
+// go test -v -test.run TestChannel
+func TestChannel(t *testing.T) {
+	runScript(t, `
+		local ch = channel.make(2)
+		ch:send(1)
+		channel.send(ch, "two")
+		assert(#ch == 2)
+		assert(tostring(ch):find("^channel %(0x"))
+		local v, ok = ch:receive()
+		assert(v == 1 and ok == true)
+		ch:send({x = 1})
+		assert(ch:receive() == "two")
+		v = channel.receive(ch)
+		assert(v.x == 1)
+
+		-- select with a default never blocks
+		assert(channel.select({"|<-", ch}, {"default"}) == 2)
+		local i, v, ok = channel.select({"<-|", ch, "a"}, {"default"})
+		assert(i == 1 and v == nil)
+		i, v, ok = channel.select({"|<-", channel.make()}, {"|<-", ch})
+		assert(i == 2 and v == "a" and ok)
+
+		ch:send(nil)
+		v, ok = ch:receive()
+		assert(v == nil and ok == true)
+		ch:send(false)
+		ch:close()
+		assert(select(2, ch:receive()) == true)
+		v, ok = ch:receive()
+		assert(v == nil and ok == false)
+		i, v, ok = channel.select({"|<-", ch})
+		assert(i == 1 and v == nil and ok == false)
+
+		local function err(msg, f, ...)
+			local ok, m = pcall(f, ...)
+			assert(not ok and m:find(msg, 1, true), m)
+		end
+		err("send on closed channel", ch.send, ch, 1)
+		err("close of closed channel", ch.close, ch)
+		err("invalid select case", channel.select, {"<-", ch})
+		err("multiple defaults in select", channel.select, {"default"}, {"default"})
+		err("channel expected", channel.send, {}, 1)
+		err("size out of range", channel.make, -1)
+	`)
+}
+
+// go test -v -test.run TestPushChannel
+func TestPushChannel(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	in := make(chan int)
+	out := make(chan string, 10)
+	var recvOnly <-chan int = in
+	ls.PushChannel(in)
+	ls.SetGlobal("input", ls.CheckAny(-1))
+	ls.Pop(1)
+	ls.PushChannel(out)
+	ls.SetGlobal("output", ls.CheckAny(-1))
+	ls.Pop(1)
+	ls.PushChannel(recvOnly)
+	ls.SetGlobal("ro", ls.CheckAny(-1))
+	ls.Pop(1)
+	go func() {
+		for i := 1; i <= 3; i++ {
+			in <- i
+		}
+		close(in)
+	}()
+	if ls.LoadString(`
+		local sum = 0
+		for v in function() return (input:receive()) end do
+			sum = sum + v
+			output:send("got " .. v)
+		end
+		output:send(tostring(sum))
+		assert(not pcall(output.send, output, 1))
+		assert(not pcall(input.send, input, 1.5))
+		assert(select(2, pcall(ro.send, ro, 1)):find("send on receive-only channel", 1, true))
+		assert(select(2, pcall(ro.close, ro)):find("close of receive-only channel", 1, true))
+	`) != golua.LUA_OK {
+		t.Fatal(ls.CheckString(-1))
+	}
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	close(out)
+	var got []string
+	for s := range out {
+		got = append(got, s)
+	}
+	if len(got) != 4 || got[0] != "got 1" || got[3] != "6" {
+		t.Fatal(got)
+	}
+}
+
+// a Scheduler that runs each wait on a goroutine of its own
+type goScheduler struct {
+	waits sync.WaitGroup
+}
+
+func (s *goScheduler) Suspend(co *golua.LuaState, wait func(quit <-chan struct{})) bool {
+	s.waits.Add(1)
+	go func() {
+		defer s.waits.Done()
+		wait(nil)
+	}()
+	return true
+}
+
+// go test -v -test.run TestChannelYield
+func TestChannelYield(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	s := &goScheduler{}
+	ls.SetScheduler(s)
+	ls.Register("settle", func(ls *golua.LuaState) int {
+		s.waits.Wait()
+		return 0
+	})
+	if ls.LoadString(`
+		local ch = channel.make()
+		local co = coroutine.create(function() return ch:receive() end)
+		assert(coroutine.resume(co)) -- yields instead of blocking
+		assert(coroutine.status(co) == "suspended")
+		ch:send(42) -- the main thread cannot yield, it blocks
+		settle()
+		local ok, v, recvd = coroutine.resume(co)
+		assert(ok and v == 42 and recvd == true)
+		assert(coroutine.status(co) == "dead")
+
+		co = coroutine.create(function() ch:send("sent"); return "done" end)
+		assert(coroutine.resume(co))
+		assert(ch:receive() == "sent")
+		settle()
+		assert(select(2, coroutine.resume(co)) == "done")
+
+		co = coroutine.create(function()
+			return channel.select({"|<-", ch}, {"<-|", channel.make(), 1})
+		end)
+		assert(coroutine.resume(co))
+		ch:send("selected")
+		settle()
+		local ok, i, v = coroutine.resume(co)
+		assert(ok and i == 1 and v == "selected")
+	`) != golua.LUA_OK {
+		t.Fatal(ls.CheckString(-1))
+	}
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
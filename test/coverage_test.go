@@ -0,0 +1,62 @@
+package compiler
+
+import (
+	"bytes"
+	"golua"
+	"strings"
+	"testing"
+)
+
+// go test -v -test.run TestCoverage
+func TestCoverage(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.StartCoverage()
+	ls.Load([]byte(`local function used(x)
+	if x > 0 then
+		return x
+	end
+	return -x
+end
+local function unused()
+	return 1
+end
+for i = 1, 3 do
+	used(i)
+end
+`), "@cover.lua")
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	c := ls.StopCoverage()
+	if files := c.Files(); len(files) != 1 || files[0] != "cover.lua" {
+		t.Fatalf("files: %v", files)
+	}
+	lines := c.Lines("cover.lua")
+	for line, want := range map[int]int{2: 3, 3: 3, 5: 0, 8: 0, 11: 3} {
+		if n, ok := lines[line]; !ok || n != want {
+			t.Errorf("line %d: got %d (%v), want %d", line, n, ok, want)
+		}
+	}
+	if _, ok := lines[4]; ok {
+		t.Errorf("line 4 holds no code")
+	}
+
+	var buf bytes.Buffer
+	if err := c.WriteLcov(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lcov := buf.String()
+	for _, s := range []string{"SF:cover.lua\n", "DA:3,3\n", "DA:8,0\n", "end_of_record\n"} {
+		if !strings.Contains(lcov, s) {
+			t.Errorf("lcov lacks %q:\n%s", s, lcov)
+		}
+	}
+	buf.Reset()
+	if err := c.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "cover.lua") {
+		t.Errorf("html lacks the file name")
+	}
+}
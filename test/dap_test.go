@@ -0,0 +1,224 @@
+package compiler
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"golua"
+	"golua/dap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const dapScript = `local function add(a, b)
+	local sum = a + b
+	return sum
+end
+local total = 0
+for i = 1, 3 do
+	total = add(total, i)
+end
+print("total", total)
+`
+
+// a scripted DAP client
+type dapClient struct {
+	t    *testing.T
+	ls   *golua.LuaState // debugged, look at it only while it is stopped
+	w    io.Writer
+	seq  int
+	msgs chan map[string]interface{}
+	out  string
+}
+
+func newDapClient(t *testing.T, program string) (*dapClient, chan error) {
+	cr, sw := io.Pipe()
+	sr, cw := io.Pipe()
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	c := &dapClient{t: t, ls: ls, w: cw, msgs: make(chan map[string]interface{}, 100)}
+	done := make(chan error, 1)
+	go func() {
+		done <- dap.Serve(ls, sr, sw, program)
+		sw.Close()
+	}()
+	go func() {
+		r := bufio.NewReader(cr)
+		for {
+			var length int
+			if _, err := fmt.Fscanf(r, "Content-Length: %d\r\n\r\n", &length); err != nil {
+				close(c.msgs)
+				return
+			}
+			data := make([]byte, length)
+			io.ReadFull(r, data)
+			var msg map[string]interface{}
+			json.Unmarshal(data, &msg)
+			c.msgs <- msg
+		}
+	}()
+	return c, done
+}
+
+func (c *dapClient) send(command string, args interface{}) {
+	c.seq++
+	data, _ := json.Marshal(map[string]interface{}{
+		"seq": c.seq, "type": "request", "command": command, "arguments": args})
+	fmt.Fprintf(c.w, "Content-Length: %d\r\n\r\n%s", len(data), data)
+}
+
+// waits for the response to command or the event named so
+func (c *dapClient) wait(kind, name string) map[string]interface{} {
+	c.t.Helper()
+	key := "command"
+	if kind == "event" {
+		key = "event"
+	}
+	for {
+		select {
+		case msg, ok := <-c.msgs:
+			if !ok {
+				c.t.Fatalf("connection closed waiting for %v %v", kind, name)
+			}
+			if msg["event"] == "output" {
+				c.out += msg["body"].(map[string]interface{})["output"].(string)
+			}
+			if msg["type"] == kind && msg[key] == name {
+				if kind == "response" && msg["success"] != true {
+					c.t.Fatalf("%v failed: %v", name, msg["message"])
+				}
+				body, _ := msg["body"].(map[string]interface{})
+				return body
+			}
+		case <-time.After(5 * time.Second):
+			c.t.Fatalf("timeout waiting for %v %v", kind, name)
+		}
+	}
+}
+
+func (c *dapClient) request(command string, args interface{}) map[string]interface{} {
+	c.t.Helper()
+	c.send(command, args)
+	return c.wait("response", command)
+}
+
+// expects a stop and returns the name and line of the top frame
+func (c *dapClient) stopped(reason string) (string, int) {
+	c.t.Helper()
+	body := c.wait("event", "stopped")
+	if body["reason"] != reason {
+		c.t.Fatalf("stopped for %v, want %v", body["reason"], reason)
+	}
+	frames := c.request("stackTrace", map[string]int{"threadId": 1})["stackFrames"].([]interface{})
+	top := frames[0].(map[string]interface{})
+	return top["name"].(string), int(top["line"].(float64))
+}
+
+func (c *dapClient) evaluate(expr string, frame int) string {
+	c.t.Helper()
+	body := c.request("evaluate", map[string]interface{}{"expression": expr, "frameId": frame})
+	return body["result"].(string)
+}
+
+func (c *dapClient) variables(ref float64) map[string]string {
+	c.t.Helper()
+	vars := map[string]string{}
+	body := c.request("variables", map[string]interface{}{"variablesReference": ref})
+	for _, v := range body["variables"].([]interface{}) {
+		v := v.(map[string]interface{})
+		vars[v["name"].(string)] = v["value"].(string)
+	}
+	return vars
+}
+
+// go test -v -test.run TestDAP
+func TestDAP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	program := filepath.Join(dir, "add.lua")
+	if err := ioutil.WriteFile(program, []byte(dapScript), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, done := newDapClient(t, "")
+	c.request("initialize", map[string]string{"adapterID": "golua"})
+	c.wait("event", "initialized")
+	c.request("launch", map[string]string{"program": program})
+	c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]string{"path": program},
+		"breakpoints": []map[string]interface{}{{"line": 2, "condition": "a == 1"}},
+	})
+	c.request("configurationDone", nil)
+
+	/* conditional breakpoint, stack, scopes and evaluation */
+	if name, line := c.stopped("breakpoint"); name == "main chunk" || line != 2 {
+		t.Fatalf("stopped in %v:%v", name, line)
+	}
+	scopes := c.request("scopes", map[string]int{"frameId": 1})["scopes"].([]interface{})
+	locals := c.variables(scopes[0].(map[string]interface{})["variablesReference"].(float64))
+	if locals["a"] != "1" || locals["b"] != "2" {
+		t.Errorf("locals: %v", locals)
+	}
+	if v := c.evaluate("a + b", 1); v != "3" {
+		t.Errorf("a + b = %v", v)
+	}
+	if v := c.evaluate("total * 10", 2); v != "10" {
+		t.Errorf("total * 10 = %v", v)
+	}
+	if v := c.evaluate("string.rep('ab', a + 1)", 1); v != strconv.Quote("abab") {
+		t.Errorf("string.rep = %v", v)
+	}
+	top := c.ls.GetTop()
+	for i := 0; i < 3; i++ {
+		c.evaluate("a * b", 1)
+		c.evaluate("b = b", 1)
+	}
+	if n := c.ls.GetTop() - top; n != 0 {
+		t.Errorf("evaluate left %d values on the stack", n)
+	}
+
+	/* stepping */
+	c.request("next", map[string]int{"threadId": 1})
+	if name, line := c.stopped("step"); name == "main chunk" || line != 3 {
+		t.Fatalf("next: stopped in %v:%v", name, line)
+	}
+	if v := c.evaluate("sum", 1); v != "3" {
+		t.Errorf("sum = %v", v)
+	}
+	c.request("stepOut", map[string]int{"threadId": 1})
+	if name, line := c.stopped("step"); name != "main chunk" || line != 6 {
+		t.Fatalf("stepOut: stopped in %v:%v", name, line)
+	}
+	c.request("stepIn", map[string]int{"threadId": 1})
+	if name, line := c.stopped("step"); name != "main chunk" || line != 7 {
+		t.Fatalf("stepIn: stopped in %v:%v", name, line)
+	}
+	c.request("stepIn", map[string]int{"threadId": 1})
+	if name, line := c.stopped("step"); name == "main chunk" || line != 2 {
+		t.Fatalf("stepIn: stopped in %v:%v", name, line)
+	}
+
+	/* assignments go to the paused frame */
+	c.evaluate("a = 100", 1)
+	c.request("setBreakpoints", map[string]interface{}{
+		"source": map[string]string{"path": program}, "breakpoints": []interface{}{}})
+	c.request("continue", map[string]int{"threadId": 1})
+	c.wait("event", "exited")
+	c.wait("event", "terminated")
+	if !strings.Contains(c.out, "total\t103\n") {
+		t.Errorf("output: %q", c.out)
+	}
+	c.request("disconnect", nil)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
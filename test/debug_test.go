@@ -0,0 +1,88 @@
+package compiler
+
+import (
+	"golua"
+	"strings"
+	"testing"
+)
+
+// go test -v -test.run TestDebugLib
+func TestDebugLib(t *testing.T) {
+	runScript(t, `
+		local function f(a, b)
+			local c = a + b
+			local info = debug.getinfo(1, "Slu")
+			assert(info.what == "Lua" and info.currentline == 4 and info.linedefined == 2)
+			assert(info.nparams == 2 and not info.isvararg)
+			assert(debug.getlocal(1, 3) == "c")
+			assert(select(2, debug.getlocal(1, 1)) == a)
+			assert(debug.setlocal(1, 3, 42) == "c")
+			assert(debug.getlocal(1, 300) == nil)
+			return c
+		end
+		assert(f(1, 2) == 42)
+		assert(debug.getlocal(f, 2) == "b" and debug.getlocal(f, 3) == nil)
+		assert(debug.getinfo(1, "S").what == "main")
+		assert(debug.getinfo(print).what == "Go")
+		assert(debug.getinfo(f, "L").activelines[3])
+		assert(debug.getinfo(100) == nil)
+
+		local x, y = 1, 2
+		local function g() return x end
+		local function h() return y end
+		assert(debug.getupvalue(g, 1) == "x")
+		assert(debug.setupvalue(g, 1, 10) == "x" and x == 10)
+		assert(debug.getupvalue(g, 2) == nil)
+		assert(debug.upvalueid(g, 1) ~= debug.upvalueid(h, 1))
+		debug.upvaluejoin(g, 1, h, 1)
+		assert(g() == 2 and debug.upvalueid(g, 1) == debug.upvalueid(h, 1))
+
+		assert(debug.getmetatable("").__index == string)
+		debug.setmetatable(0, {__index = {twice = function(n) return n * 2 end}})
+		assert((5):twice() == 10)
+		debug.setmetatable(0, nil)
+		assert(type(debug.getregistry()) == "table")
+		assert(debug.getuservalue(1) == nil)
+
+		local lines = {}
+		local here = debug.getinfo(1, "l").currentline
+		debug.sethook(function(ev, line) lines[#lines + 1] = line end, "l")
+		local z = 1
+		debug.sethook()
+		assert(lines[1] == here + 2 and debug.gethook() == nil)
+
+		local tb = debug.traceback("msg")
+		assert(tb:find("^msg\nstack traceback:\n"), tb)
+		assert(debug.traceback(tb) ~= tb and debug.traceback(tb, 100) == tb .. "\nstack traceback:")
+		assert(debug.traceback(f) == f)
+	`)
+}
+
+// go test -v -test.run TestGetInfo
+func TestGetInfo(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	var info *golua.DebugInfo
+	var locals []string
+	ls.Register("inspect", func(ls *golua.LuaState) int {
+		info = ls.GetInfo(1)
+		for n := 1; ; n++ {
+			name, v := ls.GetLocal(1, n)
+			if name == "" || strings.HasPrefix(name, "(") {
+				break
+			}
+			locals = append(locals, name+"="+v.String())
+		}
+		return 0
+	})
+	ls.Load([]byte("local a, b = 1, 'x'\ninspect()\n"), "@chunk.lua")
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if info == nil || info.What != "main" || info.ShortSrc != "chunk.lua" || info.CurrentLine != 2 {
+		t.Fatalf("info: %+v", info)
+	}
+	if strings.Join(locals, " ") != "a=1 b=x" {
+		t.Errorf("locals: %v", locals)
+	}
+}
@@ -0,0 +1,147 @@
+package compiler
+
+import (
+	"golua"
+	"strings"
+	"testing"
+)
+
+// go test -v -test.run TestErrorMessages
+func TestErrorMessages(t *testing.T) {
+	tests := []struct{ chunk, msg string }{
+		{"return cfg.port", "t:1: attempt to index a nil value (global 'cfg')"},
+		{"local conn = {}\nconn:send('hi')", "t:2: attempt to call a nil value (method 'send')"},
+		{"local p = {}\nreturn p.x * 2", "t:2: attempt to perform arithmetic on a nil value (field 'x')"},
+		{"local t = {a = {}}\nreturn t.a.b.c", "t:2: attempt to index a nil value (field 'b')"},
+		{"local u\nlocal function f() return u.x end\nf()", "t:2: attempt to index a nil value (upvalue 'u')"},
+		{"local f\nf()", "t:2: attempt to call a nil value (local 'f')"},
+		{"undefined()", "t:1: attempt to call a nil value (global 'undefined')"},
+		{"return 'a' .. {}", "t:1: attempt to concatenate a table value"},
+		{"local s = {}\nreturn 'a' .. s", "t:2: attempt to concatenate a table value (local 's')"},
+		{"return #nil", "t:1: attempt to get length of a nil value"},
+		{"return 1 < {}", "t:1: attempt to compare number with table"},
+		{"return {} <= {}", "t:1: attempt to compare two table values"},
+		{"local x = 1.5\nreturn x | 1", "t:2: number (local 'x') has no integer representation"},
+		{"local b = true\nreturn b & 1", "t:2: attempt to perform bitwise operation on a boolean value (local 'b')"},
+		{"for i = 1, 'x' do end", "t:1: 'for' limit must be a number"},
+		{"local t = setmetatable({}, {__name = 'Point'})\nreturn t + 1", "t:2: attempt to perform arithmetic on a Point value (local 't')"},
+		{"error('boom')", "t:1: boom"},
+		{"('x'):rep({})", "t:1: bad argument #1 to 'rep' (number expected, got table)"},
+		{"string.rep()", "t:1: bad argument #1 to 'rep' (string expected, got no value)"},
+		{"error(select(2, pcall(string.upper)), 0)", "bad argument #1 to 'string.upper' (string expected, got no value)"},
+		{"error(select(2, pcall(math.floor)), 0)", "bad argument #1 to 'math.floor' (number expected, got no value)"},
+		{"error(select(2, pcall(setmetatable)), 0)", "bad argument #1 to 'setmetatable' (table expected, got no value)"},
+	}
+	for _, test := range tests {
+		ls := golua.NewLuaState()
+		ls.OpenLibs()
+		ls.Load([]byte(test.chunk), "=t")
+		err := ls.PCall(0, 0, 0)
+		if err == nil {
+			t.Errorf("%q: no error", test.chunk)
+			continue
+		}
+		if msg := strings.SplitN(err.Error(), "\n", 2)[0]; msg != test.msg {
+			t.Errorf("%q: got %q, want %q", test.chunk, msg, test.msg)
+		}
+	}
+}
+
+// go test -v -test.run TestErrorTraceback
+func TestErrorTraceback(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.Load([]byte(`
+		local obj = {}
+		function obj:run() local v = nil; return v.x end
+		local function start() obj:run() end
+		start()`), "=t")
+	err := ls.PCall(0, 0, 0)
+	if err == nil {
+		t.Fatal("no error")
+	}
+	want := "t:3: attempt to index a nil value (local 'v')\n" +
+		"stack traceback:\n" +
+		"\tt:3: in method 'run'\n" +
+		"\tt:4: in local 'start'\n" +
+		"\tt:5: in main chunk"
+	if err.Error() != want {
+		t.Errorf("got:\n%s\nwant:\n%s", err, want)
+	}
+}
+
+// go test -v -test.run TestStackOverflow
+func TestStackOverflow(t *testing.T) {
+	runScript(t, `
+		local function f(n) return 1 + f(n + 1) end
+		local ok, err = pcall(f, 1)
+		assert(not ok and err:find("stack overflow"), err)
+		local mt = {}
+		mt.__index = function(t, k) return t[k] end
+		ok, err = pcall(function() return setmetatable({}, mt).x end)
+		assert(not ok and err:find("stack overflow"), err)
+		local function g(...) return g(1, ...) end
+		ok, err = pcall(g)
+		assert(not ok and err:find("stack overflow"), err)
+		assert(f ~= nil and pcall(f, 1) == false) -- still usable
+		local function r()
+			local ok, e = coroutine.resume(coroutine.create(r))
+			if not ok then error(e, 0) end
+		end
+		ok, err = pcall(r)
+		assert(not ok and err == "C stack overflow", err)
+	`)
+
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.SetLimits(100, golua.LUAI_MAXSTACK)
+	ls.LoadString(`
+		depth = 0
+		local function f() depth = depth + 1; f() end
+		f()`)
+	err := ls.PCall(0, 0, 0)
+	luaErr, ok := err.(*golua.LuaError)
+	if !ok {
+		t.Fatalf("err: %v", err)
+	}
+	if msg := luaErr.Value.String(); !strings.HasSuffix(msg, ": stack overflow") {
+		t.Errorf("msg: %q", msg)
+	}
+	if !strings.Contains(luaErr.Traceback, "\n\t...\n") {
+		t.Errorf("traceback: %s", luaErr.Traceback)
+	}
+	ls.LoadString("return depth")
+	ls.Call(0, 1)
+	if depth := ls.CheckInteger(-1); depth != 98 {
+		t.Errorf("depth: %v", depth)
+	}
+}
+
+// go test -v -test.run TestCStackOverflow
+func TestCStackOverflow(t *testing.T) {
+	for _, script := range []string{
+		`local function f() assert(pcall(f)) end
+		f()`,
+		`local t = setmetatable({}, {__index = function(t, k) return t[k] end})
+		return t.x`,
+	} {
+		ls := golua.NewLuaState()
+		ls.OpenLibs()
+		ls.LoadString(script)
+		err := ls.PCall(0, 0, 0)
+		luaErr, ok := err.(*golua.LuaError)
+		if !ok {
+			t.Errorf("%s: err: %v", script, err)
+			continue
+		}
+		if msg := luaErr.Value.String(); !strings.HasSuffix(msg, "C stack overflow") {
+			t.Errorf("%s: msg: %q", script, msg)
+		}
+	}
+
+	runScript(t, `
+		local function f() return pcall(f) end
+		local n = select("#", f())
+		assert(n > 2 and n < 1000, n) -- about LUAI_MAXCCALLS
+	`)
+}
@@ -0,0 +1,70 @@
+package compiler
+
+import (
+	"errors"
+	"golua"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// go test -v -test.run TestExecute
+func TestExecute(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+	runScript(t, `
+		assert(os.execute() == true)
+		local ok, what, code = os.execute("exit 3")
+		assert(ok == nil and what == "exit" and code == 3)
+		ok, what, code = os.execute("true")
+		assert(ok == true and what == "exit" and code == 0)
+		ok, what, code = os.execute("kill -9 $$")
+		assert(ok == nil and what == "signal" and code == 9)
+
+		local f = assert(io.popen("echo hello; echo world"))
+		assert(f:read("l") == "hello" and f:read("a") == "world\n")
+		ok, what, code = f:close()
+		assert(ok == true and what == "exit" and code == 0)
+		f = io.popen("exit 2")
+		assert(f:read("a") == "" and select(3, f:close()) == 2)
+
+		f = assert(io.popen("tr a-z A-Z > /dev/null; exit 5", "w"))
+		assert(f:write("abc") == f and f:read() == nil)
+		assert(select(3, f:close()) == 5)
+		assert(not pcall(io.popen, "true", "rw"))
+	`)
+}
+
+// go test -v -test.run TestCommandHook
+func TestCommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs a Unix shell")
+	}
+	var commands []string
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.SetCommandHook(func(command string) (*exec.Cmd, error) {
+		commands = append(commands, command)
+		if strings.HasPrefix(command, "rm ") {
+			return nil, errors.New("command not allowed")
+		}
+		return exec.Command("echo", "-n", "ran", command), nil
+	})
+	ls.LoadString(`
+		local ok, msg = os.execute("rm -rf /")
+		assert(ok == nil and msg == "command not allowed")
+		local f = assert(io.popen("date"))
+		assert(f:read("a") == "ran date")
+		f:close()
+		local co = coroutine.create(function() return io.popen("ls"):read("a") end)
+		assert(select(2, coroutine.resume(co)) == "ran ls")
+	`)
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(commands, ",") != "rm -rf /,date,ls" {
+		t.Errorf("commands: %q", commands)
+	}
+}
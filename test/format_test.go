@@ -0,0 +1,81 @@
+package compiler
+
+import (
+	"golua"
+	"strings"
+	"testing"
+)
+
+// go test -v -test.run TestStringFormat
+func TestStringFormat(t *testing.T) {
+	tests := []struct{ args, want string }{
+		{`"%5.2f|%-5d|%05d|%+d|% d|%.3d", 3.14159, 42, 42, 5, 5, 7`, " 3.14|42   |00042|+5| 5|007"},
+		{`"%i %u %o %x %X %#x %x", 10, 10, 8, 255, 255, 255, -1`, "10 10 10 ff FF 0xff ffffffffffffffff"},
+		{`"%e|%E|%.2e|%12.3e", 12345.678, 12345.678, 0.000123, -1.5`, "1.234568e+04|1.234568E+04|1.23e-04|  -1.500e+00"},
+		{`"%g|%g|%g|%g|%g|%.3g|%#.3g|%G", 100000, 1e20, 0.0001, 0.00001, 2^53, 3.14159, 1, 1e-10`, "100000|1e+20|0.0001|1e-05|9.0072e+15|3.14|1.00|1E-10"},
+		{`"%f|%e|%g|%5.1f|%-6g|", 1/0, -1/0, 0/0 ~= 0/0 and 1/0, -1/0, 1/0`, "inf|-inf|inf| -inf|inf   |"},
+		{`"%a|%A|%.3a|%a|%a|%10a|%-10a|%010a|%+a", 1, 0.5, 1, -0.1, 0, 1, 1, 1, 1e300`, "0x1p+0|0X1P-1|0x1.000p+0|-0x1.999999999999ap-4|0x0p+0|    0x1p+0|0x1p+0    |0x00001p+0|+0x1.7e43c8800759cp+996"},
+		{`"%c%c%c|%5c|%-3c|", 76, 117, 97, 65, 66`, "Lua|    A|B  |"},
+		{`"%s|%5s|%-5s|%.2s|%5.1s|%s|%s", "ab", "ab", "ab", "abc", "abc", nil, true`, "ab|   ab|ab   |ab|    a|nil|true"},
+		{`"%s|%6s", setmetatable({}, {__tostring = function() return "obj" end}), setmetatable({}, {__tostring = function() return "obj" end})`, "obj|   obj"},
+		{`"%s", ("x"):rep(200)`, strings.Repeat("x", 200)},
+		{`"%q", 'a\n"b"\\\0c\1\0001\r\127'`, "\"a\\\n\\\"b\\\"\\\\\\0c\\1\\0001\\13\\127\""},
+		{`"%q|%q|%q|%q|%q|%q|%q|%q", 1/0, -1/0, 0/0, 0.1, 42, math.mininteger, nil, false`, "1e9999|-1e9999|(0/0)|0x1.999999999999ap-4|42|0x8000000000000000|nil|false"},
+		{`"%%|%d%%", 3`, "%|3%"},
+	}
+	for _, test := range tests {
+		ls := golua.NewLuaState()
+		ls.OpenLibs()
+		ls.LoadString("return string.format(" + test.args + ")")
+		if err := ls.PCall(0, 1, 0); err != nil {
+			t.Errorf("%s: %v", test.args, err)
+			continue
+		}
+		if got := ls.CheckString(-1); got != test.want {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.args, got, test.want)
+		}
+	}
+
+	runScript(t, `
+		for _, x in ipairs{0.1, 1/3, -2.5, 1e300, 2^-1074, 1/0, -1/0, "a\0\r\n\"\\z", 42, -7, true} do
+			local y = load("return " .. string.format("%q", x))()
+			assert(x == y and math.type(x) == math.type(y), x)
+		end
+		local nan = load("return " .. string.format("%q", 0/0))()
+		assert(nan ~= nan)
+	`)
+}
+
+// go test -v -test.run TestStringFormatErrors
+func TestStringFormatErrors(t *testing.T) {
+	tests := []struct{ args, msg string }{
+		{`"%d", 1.5`, "bad argument #2 to 'format' (number has no integer representation)"},
+		{`"%x", 3.2`, "bad argument #2 to 'format' (number has no integer representation)"},
+		{`"%c", 65.5`, "bad argument #2 to 'format' (number has no integer representation)"},
+		{`"%5d %d", 1, "x"`, "bad argument #3 to 'format' (number expected, got string)"},
+		{`"%f", {}`, "bad argument #2 to 'format' (number expected, got table)"},
+		{`"%d %d", 1`, "bad argument #3 to 'format' (no value)"},
+		{`"%123d", 1`, "invalid format (width or precision too long)"},
+		{`"%.123f", 1`, "invalid format (width or precision too long)"},
+		{`"%------d", 1`, "invalid format (repeated flags)"},
+		{`"%y", 1`, "invalid option '%y' to 'format'"},
+		{`"%ld", 1`, "invalid option '%l' to 'format'"},
+		{`"%5%", 1`, "invalid option '%5%' to 'format'"},
+		{`"%5%"`, "invalid option '%5%' to 'format'"},
+		{`"%q", {}`, "bad argument #2 to 'format' (value has no literal form)"},
+		{`"%10s", "a\0b"`, "bad argument #2 to 'format' (string contains zeros)"},
+	}
+	for _, test := range tests {
+		ls := golua.NewLuaState()
+		ls.OpenLibs()
+		ls.Load([]byte("return string.format("+test.args+")"), "=t")
+		err := ls.PCall(0, 1, 0)
+		if err == nil {
+			t.Errorf("%s: no error", test.args)
+			continue
+		}
+		if msg := strings.SplitN(err.Error(), "\n", 2)[0]; msg != "t:1: "+test.msg {
+			t.Errorf("%s:\ngot  %q\nwant %q", test.args, msg, "t:1: "+test.msg)
+		}
+	}
+}
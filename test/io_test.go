@@ -0,0 +1,87 @@
+package compiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// go test -v -test.run TestIOFile
+func TestIOFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "data.txt")
+
+	runScript(t, fmt.Sprintf(`
+		local name = %q
+		local f = assert(io.open(name, "w"))
+		assert(io.type(f) == "file" and tostring(f):sub(1, 6) == "file (")
+		assert(f:write("10 0x1F -3.5e2\n", "line2\n", 42, " ", 1.5, "\nlast") == f)
+		assert(f:close())
+		assert(io.type(f) == "closed file" and tostring(f) == "file (closed)")
+		assert(not pcall(f.read, f))
+		assert(io.type(io.stdout) == "file" and io.type({}) == nil)
+
+		f = assert(io.open(name))
+		local a, b, c = f:read("n", "n", "n")
+		assert(a == 10 and b == 31 and c == -350)
+		assert(f:read("l") == "")
+		assert(f:read("L") == "line2\n")
+		assert(f:read("*l") == "42 1.5")
+		assert(f:read(2) == "la" and f:read(0) == "")
+		assert(f:read("a") == "st" and f:read("a") == "")
+		assert(f:read(0) == nil and f:read("l") == nil and f:read("n") == nil)
+		assert(f:seek("set", 3) == 3 and f:read(4) == "0x1F")
+		assert(f:seek() == 7 and f:seek("end") == 32)
+		assert(not pcall(f.read, f, "x"))
+		f:close()
+
+		local lines = {}
+		for l in io.lines(name) do lines[#lines + 1] = l end
+		assert(#lines == 4 and lines[2] == "line2" and lines[4] == "last")
+		for a, b in io.lines(name, 1, "l") do assert(a == "1" and b == "0 0x1F -3.5e2") break end
+
+		local r, msg, errno = io.open(name .. ".missing")
+		assert(r == nil and msg:find("missing") and errno > 0)
+		assert(not pcall(io.lines, name .. ".missing"))
+		assert(not pcall(io.open, name, "rw"))
+
+		io.output(name)
+		io.write("one\n", 2, "\n")
+		assert(io.close())
+		assert(io.input(name) == io.input())
+		assert(io.read() == "one" and io.read("n") == 2)
+		io.input():close()
+		assert(not pcall(io.read))
+		io.input(io.stdin)
+
+		f = assert(io.open(name, "a+"))
+		f:setvbuf("no")
+		f:write("three")
+		f:seek("set")
+		assert(f:read("a") == "one\n2\nthree")
+		getmetatable(f).__gc(f)
+		assert(io.type(f) == "closed file")
+		local ok, err = io.stdout:close()
+		assert(not ok and err == "cannot close standard file")
+	`, name))
+}
+
+// go test -v -test.run TestIOTmpFile
+func TestIOTmpFile(t *testing.T) {
+	runScript(t, `
+		local f = assert(io.tmpfile())
+		f:write("hello", "\n", "world")
+		assert(f:seek("set") == 0)
+		assert(f:read("l") == "hello")
+		f:write("!")
+		f:seek("set")
+		assert(f:read("a") == "hello\n!orld")
+		f:close()
+	`)
+}
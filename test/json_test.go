@@ -0,0 +1,113 @@
+package compiler
+
+import (
+	"golua"
+	"testing"
+)
+
+// json is not among the standard libraries, hosts open it
+func openJSON(ls *golua.LuaState) {
+	ls.RequireF("json", golua.OpenJSONLib, true)
+	ls.Pop(1)
+}
+
+// go test -v -test.run TestJSONEncode
+func TestJSONEncode(t *testing.T) {
+	runScript(t, `
+		local e = json.encode
+		assert(e(nil) == "null" and e(true) == "true" and e(json.null) == "null")
+		assert(e(3) == "3" and e(-0.5) == "-0.5" and e(2^53) == "9007199254740992")
+		assert(e(1/3) == "0.33333333333333")
+		assert(e("a\"b\\c/d\n\1") == [["a\"b\\c\/d\n\u0001"]])
+		assert(e({1, 2, "x"}) == '[1,2,"x"]')
+		assert(e({[1] = 1, [3] = 3}) == "[1,null,3]")
+		assert(e({}) == "{}" and e(json.empty_array) == "[]")
+		assert(e(setmetatable({}, json.array_mt)) == "[]")
+		assert(e(setmetatable({1, 2}, json.object_mt)) == '{"1":1,"2":2}')
+		assert(e({a = {b = {}}}) == '{"a":{"b":{}}}')
+
+		-- a table with integer keys in its hash part is still an array
+		local t = {}
+		for i = 10, 1, -1 do t[i] = i end
+		assert(e(t) == "[1,2,3,4,5,6,7,8,9,10]")
+
+		json.encode_sort_keys(true)
+		assert(e({b = 1, a = {d = 2, c = 3}, [5] = 0}) == '{"5":0,"a":{"c":3,"d":2},"b":1}')
+		json.encode_indent("  ")
+		assert(e({a = {1, 2}, b = {}}) == '{\n  "a": [\n    1,\n    2\n  ],\n  "b": {}\n}')
+		assert(json.encode_indent("") == "" and json.encode_sort_keys(false) == false)
+
+		local c = {1}
+		c[2] = {c}
+		local ok, msg = pcall(e, c)
+		assert(not ok and msg:find("Cannot serialise table: reference cycle", 1, true))
+		local shared = {}
+		assert(e({shared, shared}) == "[{},{}]")
+
+		assert(not pcall(e, {[1000] = 1}))
+		assert(select(2, pcall(e, print)):find("Cannot serialise " .. type(print) .. ": type not supported", 1, true))
+		assert(select(2, pcall(e, 0/0)):find("must not be NaN or Infinity", 1, true))
+		assert(json.encode_invalid_numbers("null") == "null" and e(1/0) == "null")
+		assert(json.encode_invalid_numbers(true) == true and e(-1/0) == "-inf")
+
+		assert(json.encode_number_precision(3) == 3 and e(math.pi) == "3.14")
+		assert(e(1e15) == "1000000000000000")
+		assert(json.encode_integers(false) == false and e(1e15) == "1e+15")
+		assert(not pcall(json.encode_number_precision, 17))
+
+		local j = json.new()
+		assert(j.encode_number_precision() == 14 and j.null == json.null)
+		assert(not pcall(j.encode, {[1000] = 1, [1] = 1}))
+		assert(j.encode_sparse_array(true) == true)
+		assert(j.encode({[1000] = 1}) == '{"1000":1}')
+		assert(j.encode_max_depth(2) == 2)
+		assert(select(2, pcall(j.encode, {{{}}})):find("excessive nesting (3)", 1, true))
+	`, openJSON)
+}
+
+// go test -v -test.run TestJSONDecode
+func TestJSONDecode(t *testing.T) {
+	runScript(t, `
+		local d = json.decode
+		local v = d(' {"a": [1, 2.5, -3e2, true, false, null], "b": {"c": "x\\u00e9\\ud83d\\ude00\\n"}} ')
+		assert(v.a[1] == 1 and v.a[2] == 2.5 and v.a[3] == -300)
+		assert(v.a[4] == true and v.a[5] == false and v.a[6] == json.null and #v.a == 6)
+		assert(v.b.c == "x\u{e9}\u{1f600}\n")
+		assert(d("[]") and next(d("{}")) == nil and d('"s"') == "s" and d("null") == json.null)
+
+		local function err(s, msg)
+			local ok, m = pcall(d, s)
+			assert(not ok and m:find(msg, 1, true), m)
+		end
+		err("", "Expected value but found T_END at character 1")
+		err("[1,]", "Expected value but found T_ARR_END at character 4")
+		err('{"a" 1}', "Expected colon but found T_NUMBER at character 6")
+		err("{1:2}", "Expected object key string but found T_NUMBER at character 2")
+		err("[1 2]", "Expected comma or array end but found T_NUMBER at character 4")
+		err("1 2", "Expected the end but found T_NUMBER at character 3")
+		err("[x]", "Expected value but found invalid token at character 2")
+		err('"abc', "unexpected end of string")
+		err('"\\q"', "invalid escape code")
+		err('"\\ud800"', "invalid unicode escape code")
+
+		assert(d("nan") ~= d("nan") and d("-inf") == -1/0)
+		json.decode_invalid_numbers(false)
+		err("[1.]", "invalid number")
+		err("01", "invalid number")
+		err("nan", "invalid token")
+
+		json.decode_max_depth(2)
+		assert(d("[[1]]"))
+		err("[[[1]]]", "Found too many nested data structures (3) at character 3")
+		json.decode_max_depth(1000)
+
+		json.decode_array_with_array_mt(true)
+		local a = d('{"x": []}')
+		assert(getmetatable(a) == nil and getmetatable(a.x) == json.array_mt)
+		assert(json.encode(a) == '{"x":[]}')
+
+		local s = '{"list":[1,"two",{"three":3}],"n":null,"ok":true}'
+		json.encode_sort_keys(true)
+		assert(json.encode(d(s)) == s)
+	`, openJSON)
+}
@@ -0,0 +1,96 @@
+package compiler
+
+import (
+	"golua"
+	"testing"
+)
+
+// go test -v -test.run TestLoad
+func TestLoad(t *testing.T) {
+	runScript(t, `
+		-- reader functions
+		local parts = {"local a = ... ", "return a ", "+ x", nil}
+		local i = 0
+		local f = assert(load(function() i = i + 1; return parts[i] end, "=parts", "t", {x = 1}))
+		assert(f(41) == 42 and i == 4)
+		i = 0
+		f = assert(load(function() i = i + 1; return i == 1 and "return 2" or "" end))
+		assert(f() == 2 and i == 2)
+		assert(load(function() end)() == nil)
+		local f, msg = load(function() return {} end)
+		assert(f == nil and msg == "reader function must return a string")
+		f, msg = load(function() error("boom", 0) end)
+		assert(f == nil and msg == "boom")
+		f, msg = load(function() error({}) end)
+		assert(f == nil and type(msg) == "table")
+		assert(not pcall(load, {}))
+
+		-- chunk names
+		f, msg = load("x =")
+		assert(f == nil and msg:find('^%[string "x ="%]:1:'))
+		f, msg = load("x =", "=name")
+		assert(f == nil and msg:find("^name:1:"))
+		local n = 0
+		f, msg = load(function() n = n + 1; return n == 1 and "x =" or nil end)
+		assert(f == nil and msg:find("^%(load%):1:"))
+
+		-- modes
+		assert(load("return 1", "c", "t")() == 1)
+		assert(load("return 1", "c", "bt")() == 1)
+		f, msg = load("return 1", "c", "b")
+		assert(f == nil and msg == "attempt to load a text chunk (mode is 'b')")
+		f, msg = load("\27Lua", "=c", "t")
+		assert(f == nil and msg == "attempt to load a binary chunk (mode is 't')")
+		f, msg = load("\27Lua", "=c")
+		assert(f == nil and msg == "c: truncated precompiled chunk")
+
+		-- environments
+		local env = {}
+		f = load("y = 5; return y, print", "=y", "t", env)
+		local y, p = f()
+		assert(y == 5 and p == nil and env.y == 5 and _G.y == nil)
+		assert(load("return _ENV", nil, nil, nil)() == nil)
+		assert(load("return _ENV")() == _G)
+		assert(load("return 1", nil, nil, env)() == 1) -- no upvalues
+		assert(debug.getupvalue(load("return x", nil, "t", env), 1) == "_ENV")
+	`)
+}
+
+// go test -v -test.run TestLoadWithEnv
+func TestLoadWithEnv(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	top := ls.GetTop()
+	env := ls.NewTable()
+	ls.Pop(1)
+	env.Set(golua.LuaString("x"), golua.LuaNumber(2))
+	if ls.LoadWithEnv([]byte("y = x * 21; return y"), "=env", "t", env) != golua.LUA_OK {
+		t.Fatal(ls.CheckString(-1))
+	}
+	if err := ls.PCall(0, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if y := ls.CheckInteger(-1); y != 42 || env.Get(golua.LuaString("y")) != golua.LuaNumber(42) {
+		t.Errorf("y: %v", y)
+	}
+	if ls.GetGlobal("y") != golua.LuaNil {
+		t.Errorf("global y: %v", ls.GetGlobal("y"))
+	}
+	ls.Pop(1)
+
+	if ls.LoadWithEnv([]byte("return 1"), "=env", "b", env) != golua.LUA_ERRSYNTAX {
+		t.Error("text chunk loaded in mode b")
+	} else if msg := ls.CheckString(-1); msg != "attempt to load a text chunk (mode is 'b')" {
+		t.Errorf("mode error: %q", msg)
+	}
+	ls.Pop(1)
+	if ls.Load([]byte("return return"), "=bad") != golua.LUA_ERRSYNTAX {
+		t.Error("syntax error not reported")
+	} else if msg := ls.CheckString(-1); msg[:6] != "bad:1:" {
+		t.Errorf("syntax error: %q", msg)
+	}
+	ls.Pop(1)
+	if ls.GetTop() != top {
+		t.Errorf("top: %d, want %d", ls.GetTop(), top)
+	}
+}
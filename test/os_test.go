@@ -0,0 +1,80 @@
+package compiler
+
+import "testing"
+
+// go test -v -test.run TestOSDate
+func TestOSDate(t *testing.T) {
+	runScript(t, `
+		local t = 1000000000 -- 2001-09-09 01:46:40 UTC
+		assert(os.date("!%a %A %b %B %h", t) == "Sun Sunday Sep September Sep")
+		assert(os.date("!%c", t) == "Sun Sep  9 01:46:40 2001")
+		assert(os.date("!%C %d %D %e %F", t) == "20 09 09/09/01  9 2001-09-09")
+		assert(os.date("!%g %G %H %I %j", t) == "01 2001 01 01 252")
+		assert(os.date("!%m %M %p %r %R", t) == "09 46 AM 01:46:40 AM 01:46")
+		assert(os.date("!%S %T %u %U %V", t) == "40 01:46:40 7 36 36")
+		assert(os.date("!%w %W %x %X %y %Y", t) == "0 36 09/09/01 01:46:40 01 2001")
+		assert(os.date("!%Ec %Oy %%", t) == "Sun Sep  9 01:46:40 2001 01 %")
+		assert(os.date("!%G-%V %g %U %W %j %a", 1104537600) == "2004-53 04 00 00 001 Sat")
+		assert(os.date("!%n%t|", t) == "\n\t|")
+		assert(os.date("!", t) == "")
+		assert(type(os.date()) == "string")
+
+		local d = os.date("!*t", t)
+		assert(d.year == 2001 and d.month == 9 and d.day == 9)
+		assert(d.hour == 1 and d.min == 46 and d.sec == 40)
+		assert(d.wday == 1 and d.yday == 252 and d.isdst == false)
+
+		for _, f in ipairs{"%", "%Ez", "%q", "%E", "%O%"} do
+			local ok, msg = pcall(os.date, f)
+			assert(not ok and string.find(msg, "invalid conversion specifier '" .. f .. "'", 1, true))
+		end
+		assert(not pcall(os.date, "%c", 1.5))
+	`)
+}
+
+// go test -v -test.run TestOSTime
+func TestOSTime(t *testing.T) {
+	runScript(t, `
+		local t = os.time()
+		assert(math.type(t) == "integer")
+		assert(os.time(os.date("*t", t)) == t)
+
+		-- out-of-range fields are normalized and written back
+		local d = {year = 2000, month = 14, day = 31, hour = 25, min = -1, sec = 0}
+		local t1 = os.time(d)
+		assert(d.year == 2001 and d.month == 3 and d.day == 4)
+		assert(d.hour == 0 and d.min == 59 and d.sec == 0)
+		assert(d.wday == 1 and d.yday == 63 and type(d.isdst) == "boolean")
+		assert(os.time(d) == t1)
+		assert(os.time({year = 2001, month = 3, day = 3, hour = 12}) ==
+			os.time({year = 2001, month = 3, day = 3}))
+
+		assert(not pcall(os.time, {year = 2000, month = 1}))
+		assert(not pcall(os.time, {year = 2000, month = 1, day = "x"}))
+		assert(not pcall(os.time, {year = 2000, month = 1, day = 1.5}))
+		assert(not pcall(os.time, {year = 2000, month = 1, day = 2^40}))
+	`)
+}
+
+// go test -v -test.run TestOSSetLocale
+func TestOSSetLocale(t *testing.T) {
+	runScript(t, `
+		assert(os.setlocale() == "C")
+		assert(os.setlocale(nil, "numeric") == "C")
+		assert(os.setlocale("C") == "C")
+		assert(os.setlocale("POSIX", "time") == "C")
+		assert(os.setlocale("") == "C")
+		assert(os.setlocale("xx_YY") == nil)
+		assert(not pcall(os.setlocale, "C", "bogus"))
+	`)
+}
+
+// go test -v -test.run TestOSRename
+func TestOSRename(t *testing.T) {
+	runScript(t, `
+		local ok, msg, code = os.rename("no-such-file", "b")
+		assert(ok == nil and msg == "no-such-file: No such file or directory" and code == 2, msg)
+		ok, msg = os.remove("no-such-file")
+		assert(ok == nil and msg == "no-such-file: No such file or directory", msg)
+	`)
+}
@@ -0,0 +1,137 @@
+package compiler
+
+import (
+	"golua"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// go test -v -test.run TestCompilePattern
+func TestCompilePattern(t *testing.T) {
+	pat, err := golua.CompilePattern("(%w+)=(%w+)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc, _ := pat.Find("  a=1, bb=22", 0); !reflect.DeepEqual(loc, []int{2, 5}) {
+		t.Errorf("Find: %v", loc)
+	}
+	if loc, _ := pat.Find("  a=1, bb=22", 3); !reflect.DeepEqual(loc, []int{7, 12}) {
+		t.Errorf("Find from 3: %v", loc)
+	}
+	if loc, _ := pat.Find("a=1", 4); loc != nil {
+		t.Errorf("Find past the end: %v", loc)
+	}
+	if locs, _ := pat.FindAll("a=1, bb=22, c=3", -1); !reflect.DeepEqual(locs, [][]int{{0, 3}, {5, 10}, {12, 15}}) {
+		t.Errorf("FindAll: %v", locs)
+	}
+	if locs, _ := pat.FindAll("a=1, bb=22, c=3", 2); len(locs) != 2 {
+		t.Errorf("FindAll 2: %v", locs)
+	}
+	if caps, _ := pat.Match("x, key=value", 0); !reflect.DeepEqual(caps, []string{"key", "value"}) {
+		t.Errorf("Match: %q", caps)
+	}
+	if caps, _ := pat.Match("no pairs", 0); caps != nil {
+		t.Errorf("Match none: %q", caps)
+	}
+	if s, n, _ := pat.Replace("a=1, bb=22", "%2=%1", -1); s != "1=a, 22=bb" || n != 2 {
+		t.Errorf("Replace: %q %d", s, n)
+	}
+	if pat.String() != "(%w+)=(%w+)" {
+		t.Errorf("String: %q", pat.String())
+	}
+
+	pat, _ = golua.CompilePattern("^%s*()")
+	if caps, _ := pat.Match("   x", 0); !reflect.DeepEqual(caps, []string{"4"}) {
+		t.Errorf("position capture: %q", caps)
+	}
+	if s, n, _ := pat.Replace("  x  ", "[%0]", -1); s != "[  ]x  " || n != 1 {
+		t.Errorf("anchored Replace: %q %d", s, n)
+	}
+	pat, _ = golua.CompilePattern("%f[%w]%w+")
+	if locs, _ := pat.FindAll("THE (quick) fox", -1); !reflect.DeepEqual(locs, [][]int{{0, 3}, {5, 10}, {12, 15}}) {
+		t.Errorf("frontier: %v", locs)
+	}
+	pat, _ = golua.CompilePattern("x*")
+	if s, n, _ := pat.Replace("abc", "-", -1); s != "-a-b-c-" || n != 4 {
+		t.Errorf("empty matches: %q %d", s, n)
+	}
+
+	pat, _ = golua.CompilePattern("(.)")
+	if _, _, err := pat.Replace("abc", "%2", -1); err == nil || err.Error() != "invalid capture index %2" {
+		t.Errorf("Replace error: %v", err)
+	}
+	pat, _ = golua.CompilePattern(strings.Repeat("a?", 300) + strings.Repeat("a", 300))
+	if _, err := pat.Find(strings.Repeat("a", 300), 0); err == nil || err.Error() != "pattern too complex" {
+		t.Errorf("Find error: %v", err)
+	}
+
+	for expr, msg := range map[string]string{
+		"%":                      "malformed pattern (ends with '%')",
+		"[a":                     "malformed pattern (missing ']')",
+		"[]":                     "malformed pattern (missing ']')",
+		"x%b":                    "malformed pattern (missing arguments to '%b')",
+		"%fa":                    "missing '[' after '%f' in pattern",
+		"(a":                     "unfinished capture",
+		"a)":                     "invalid pattern capture",
+		"(a%1)":                  "invalid capture index %1",
+		"%0":                     "invalid capture index %0",
+		"()%1":                   "",
+		strings.Repeat("()", 33): "too many captures",
+	} {
+		_, err := golua.CompilePattern(expr)
+		if msg == "" && err != nil || msg != "" && (err == nil || err.Error() != msg) {
+			t.Errorf("%q: got %v, want %q", expr, err, msg)
+		}
+	}
+}
+
+// go test -v -test.run TestPatternCache
+func TestPatternCache(t *testing.T) {
+	runScript(t, `
+		-- errors stay lazy: only matches that reach the bad spot raise them
+		assert(string.find("b", "a[") == nil)
+		assert(not pcall(string.find, "a", "a["))
+		assert(string.find("b", "(a") == nil)
+		assert(not pcall(string.find, "a", "(a"))
+		for i = 1, 200 do
+			local p = "(%d+)" .. string.rep("x", i % 70)
+			assert(string.match("12" .. string.rep("x", i % 70), p) == "12")
+		end
+		assert(string.gsub("hello world", "o", "0") == "hell0 w0rld")
+		assert(string.find("^x", "^x") == nil and string.find("x", "^x") == 1)
+		local t = {}
+		for w in string.gmatch("^a ^b", "^%a") do t[#t + 1] = w end
+		assert(#t == 2 and t[2] == "^b")
+	`)
+}
+
+// each state has its own cache, run with -race
+// go test -race -v -test.run TestPatternCacheParallel
+func TestPatternCacheParallel(t *testing.T) {
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ls := golua.NewLuaState()
+			ls.OpenLibs()
+			ls.LoadString(`
+				for i = 1, 300 do
+					local p = "(%d+)" .. string.rep("y", i % 100)
+					local s = "34" .. string.rep("y", i % 100)
+					assert(string.match(s, p) == "34" and string.find(s, p) == 1)
+					assert(select(2, string.gsub(s, p, "")) == 1)
+					for d in string.gmatch(s, p) do assert(d == "34") end
+				end
+				local ok, err = pcall(string.find, "a", "(a")
+				assert(not ok and err:find("unfinished capture"))
+			`)
+			if err := ls.PCall(0, 0, 0); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+}
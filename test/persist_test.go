@@ -0,0 +1,134 @@
+package compiler
+
+import (
+	"golua"
+	"testing"
+)
+
+type point struct{ x, y int }
+
+// registers persist and unpersist, which return nil and the message on
+// errors, and makes the global saved the data persisted last in *data
+func openPersist(ls *golua.LuaState, data *string) {
+	ls.Register("persist", func(ls *golua.LuaState) int {
+		b, err := golua.Persist(ls, ls.CheckAny(1))
+		if err != nil {
+			ls.Push(golua.LuaNil)
+			ls.Push(golua.LuaString(err.Error()))
+			return 2
+		}
+		*data = string(b)
+		ls.Push(golua.LuaString(b))
+		return 1
+	})
+	ls.Register("unpersist", func(ls *golua.LuaState) int {
+		v, err := golua.Unpersist(ls, []byte(ls.CheckString(1)))
+		if err != nil {
+			ls.Push(golua.LuaNil)
+			ls.Push(golua.LuaString(err.Error()))
+			return 2
+		}
+		ls.Push(v)
+		return 1
+	})
+	ls.SetGlobal("saved", golua.LuaString(*data))
+}
+
+// a setup whose globals and print are permanents, with a hook for points
+func persistSetup(data *string) func(ls *golua.LuaState) {
+	return func(ls *golua.LuaState) {
+		perms := golua.NewPermanents()
+		perms.Add("_G", ls.GetGlobal("_G"))
+		perms.Add("print", ls.GetGlobal("print"))
+		perms.AddUserData("point", golua.UserDataHook{
+			Persist: func(v interface{}) ([]byte, bool) {
+				p, ok := v.(point)
+				return []byte{byte(p.x), byte(p.y)}, ok
+			},
+			Unpersist: func(data []byte) (interface{}, error) {
+				return point{int(data[0]), int(data[1])}, nil
+			},
+		})
+		ls.SetPermanents(perms)
+		ls.Register("point", func(ls *golua.LuaState) int {
+			ls.Push(&golua.LuaUserData{Value: point{int(ls.CheckInteger(1)), int(ls.CheckInteger(2))}})
+			return 1
+		})
+		ls.Register("coords", func(ls *golua.LuaState) int {
+			p := ls.CheckUserData(1).Value.(point)
+			ls.Push(golua.LuaNumber(p.x))
+			ls.Push(golua.LuaNumber(p.y))
+			return 2
+		})
+		openPersist(ls, data)
+	}
+}
+
+// go test -v -test.run TestPersist
+func TestPersist(t *testing.T) {
+	var data string
+	runScript(t, `
+		local shared = {"shared"}
+		local t = {a = shared, b = shared, n = 1.5, s = "str", f = false, [1] = true}
+		t.self = t
+		setmetatable(t, {__index = function(_, k) return k .. "?" end})
+
+		local n = 0
+		t.inc = function() n = n + 1; return n end
+		t.get = function() return n end
+		t.inc()
+
+		local function fib(i) if i < 2 then return i end return fib(i-1) + fib(i-2) end
+		t.fib = fib
+		t.print = print -- a permanent
+		t.p = point(3, 4)
+		assert(persist(t))
+	`, persistSetup(&data))
+
+	runScript(t, `
+		local t = assert(unpersist(saved))
+		assert(t.a[1] == "shared" and t.a == t.b and t.self == t)
+		assert(t.n == 1.5 and t.s == "str" and t.f == false and t[1] == true)
+		assert(t.missing == "missing?")
+		assert(t.get() == 1 and t.inc() == 2 and t.get() == 2)
+		assert(t.fib(10) == 55)
+		assert(t.print == print)
+		local x, y = coords(t.p)
+		assert(x == 3 and y == 4)
+	`, persistSetup(&data))
+}
+
+// go test -v -test.run TestPersistErrors
+func TestPersistErrors(t *testing.T) {
+	var data string
+	runScript(t, `
+		for _, c in ipairs({
+			{os.time, "cannot persist Go function"},
+			{coroutine.create(print), "cannot persist a state"},
+			{io.stdout, "no hook persists userdata"},
+		}) do
+			local s, err = persist({c[1]})
+			assert(s == nil and err:find(c[2], 1, true), err)
+		end
+		local s = assert(persist({print, {}}))
+		local v, err = unpersist(s:sub(1, -3))
+		assert(v == nil and err:find("truncated"), err)
+
+		-- corrupt data fails, whatever byte it is
+		local n = 0
+		local function f(x) n = n + x; return n end
+		s = assert(persist({f, {1.5, "s", true}, print}))
+		for i = 1, #s do
+			for _, mask in ipairs({0xff, 0x01, 0x80}) do
+				local c = string.char(s:byte(i) ~ mask)
+				local v, err = unpersist(s:sub(1, i - 1) .. c .. s:sub(i + 1))
+				assert(v ~= nil or err ~= nil)
+			end
+		end
+	`, persistSetup(&data))
+
+	runScript(t, `
+		local v, err = unpersist(saved)
+		assert(v == nil and err:find("no permanent 'print'"), err)
+	`, func(ls *golua.LuaState) { openPersist(ls, &data) })
+}
@@ -0,0 +1,55 @@
+package compiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"golua"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// go test -v -test.run TestProfile
+func TestProfile(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	start := time.Now()
+	ls.Register("elapsed", func(ls *golua.LuaState) int {
+		ls.Push(golua.LuaNumber(time.Since(start).Seconds()))
+		return 1
+	})
+	var buf bytes.Buffer
+	if err := ls.StartProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if ls.StartProfile(&buf) == nil {
+		t.Fatal("profile started twice")
+	}
+	ls.LoadString(`
+		local function hotspot(n)
+			local s = 0
+			for i = 1, n do s = s + i % 7 end
+			return s
+		end
+		while elapsed() < 0.2 do hotspot(1000) end
+	`)
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := ls.StopProfile(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"hotspot", "main chunk", "cpu", "nanoseconds"} {
+		if !bytes.Contains(data, []byte(s)) {
+			t.Errorf("profile lacks %q", s)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package compiler
+
+import (
+	"golua"
+	"testing"
+)
+
+// go test -v -test.run TestRandom
+func TestRandom(t *testing.T) {
+	runScript(t, `
+		local a, b = math.randomseed(42)
+		assert(a == 42 and b == 0)
+		-- the numbers of Lua 5.4 after math.randomseed(42)
+		assert(math.random(1, 100) == 50)
+		assert(string.format("%.15g", math.random()) == "0.546883112434215")
+
+		math.randomseed(7, 8)
+		local t = {}
+		for i = 1, 10 do t[i] = math.random(1000) end
+		math.randomseed(7, 8)
+		for i = 1, 10 do assert(math.random(1000) == t[i]) end
+
+		a, b = math.randomseed()
+		assert(math.type(a) == "integer" and math.type(b) == "integer")
+		local x = math.random()
+		math.randomseed(a, b)
+		assert(math.random() == x)
+
+		for i = 1, 1000 do
+			local r = math.random()
+			assert(0 <= r and r < 1)
+			r = math.random(-3, 3)
+			assert(-3 <= r and r <= 3 and math.type(r) == "integer")
+			assert(math.random(5, 5) == 5)
+		end
+		assert(math.type(math.random(0)) == "integer")
+
+		assert(not pcall(math.random, 2, 1))
+		assert(not pcall(math.random, 0.5))
+		assert(not pcall(math.random, 1, 2, 3))
+		assert(not pcall(math.randomseed, 1.5))
+		local co = coroutine.create(function() math.randomseed(99) end)
+		coroutine.resume(co)
+		local y = math.random(1000000)
+		math.randomseed(99)
+		assert(math.random(1000000) == y)
+	`)
+}
+
+type countingSource struct{ n uint64 }
+
+func (s *countingSource) Uint64() uint64     { s.n++; return s.n << 11 }
+func (s *countingSource) Seed(n1, n2 uint64) { s.n = n1 + n2 }
+
+// go test -v -test.run TestRandSource
+func TestRandSource(t *testing.T) {
+	random := func(ls *golua.LuaState, script string) string {
+		if ls.LoadString(script) != golua.LUA_OK {
+			t.Fatal(ls.CheckString(-1))
+		}
+		if err := ls.PCall(0, 1, 0); err != nil {
+			t.Fatal(err)
+		}
+		defer ls.Pop(1)
+		return ls.CheckString(-1)
+	}
+	const script = `local t = {} for i = 1, 5 do t[i] = math.random(100) end return table.concat(t, " ")`
+
+	ls1, ls2 := golua.NewLuaState(), golua.NewLuaState()
+	ls1.OpenLibs()
+	ls2.OpenLibs()
+	ls1.SetRandSource(golua.NewRandSource(1, 2))
+	ls2.SetRandSource(golua.NewRandSource(1, 2))
+	s1 := random(ls1, script)
+	random(ls1, `math.randomseed(3) return ""`) /* does not reseed ls2 */
+	if s2 := random(ls2, script); s1 != s2 {
+		t.Errorf("same seeds, different numbers: %q %q", s1, s2)
+	}
+	if s1 == random(ls1, script) {
+		t.Errorf("randomseed(3) repeats randomseed(1, 2): %q", s1)
+	}
+
+	ls1.SetRandSource(&countingSource{})
+	if s := random(ls1, `return math.random(100) .. " " .. math.random() * 2^53`); s != "1 2" {
+		t.Errorf("counting source: %q", s)
+	}
+	if s := random(ls1, `math.randomseed(10, 20) return math.random(0)`); s != "63488" {
+		t.Errorf("counting source reseeded: %q", s)
+	}
+}
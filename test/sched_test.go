@@ -0,0 +1,240 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"golua"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a clock whose After advances it at once, so timers fire without waiting
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.now = c.now.Add(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.now
+	return ch
+}
+
+func newLoopState(t *testing.T, script string) (*golua.LuaState, *fakeClock) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	clock := &fakeClock{now: time.Unix(1000, 0)}
+	ls.SetClock(clock)
+	ls.Register("now", func(ls *golua.LuaState) int {
+		ls.Push(golua.LuaNumber(clock.now.Sub(time.Unix(1000, 0)).Seconds()))
+		return 1
+	})
+	if ls.LoadString(script) != golua.LUA_OK {
+		t.Fatal(ls.CheckString(-1))
+	}
+	return ls, clock
+}
+
+func runLoop(t *testing.T, script string) *fakeClock {
+	ls, clock := newLoopState(t, script)
+	if err := ls.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return clock
+}
+
+// go test -v -test.run TestTimers
+func TestTimers(t *testing.T) {
+	clock := runLoop(t, `
+		local log = {}
+		timer.after(2, function() log[#log + 1] = "after " .. now() end)
+		local every = timer.every(1, function() log[#log + 1] = "every " .. now() end)
+		timer.after(3.5, function()
+			assert(every:cancel() == true and timer.cancel(every) == false)
+			assert(table.concat(log, ",") == "slept 0.5,every 1,after 2,every 2,every 3")
+		end)
+		local t = timer.after(1, function() error("cancelled timer ran") end)
+		assert(timer.cancel(t) and tostring(t):find("^timer"))
+		timer.sleep(0.5)
+		log[#log + 1] = "slept " .. now()
+		assert(not pcall(timer.every, 0, print))
+		assert(not pcall(timer.after, -1, print))
+	`)
+	if d := clock.now.Sub(time.Unix(1000, 0)); d != 3500*time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+// go test -v -test.run TestLoopCoroutines
+func TestLoopCoroutines(t *testing.T) {
+	runLoop(t, `
+		local log = {}
+		timer.after(0, function()
+			for i = 1, 3 do log[#log + 1] = "b" .. i; coroutine.yield() end
+		end)
+		for i = 1, 3 do log[#log + 1] = "a" .. i; coroutine.yield() end
+		timer.sleep(1)
+		assert(table.concat(log, " ") == "a1 b1 a2 b2 a3 b3", table.concat(log, " "))
+
+		-- a receive waits for the sender without stopping the loop
+		local ch, fin = channel.make(), channel.make()
+		local got = {}
+		timer.after(0, function()
+			for v in function() return (ch:receive()) end do got[#got + 1] = v end
+			fin:send(true)
+		end)
+		for i = 1, 3 do ch:send(i) end
+		ch:close()
+		fin:receive()
+		assert(#got == 3 and got[3] == 3)
+
+		-- nested coroutines are not those of the loop
+		local co = coroutine.create(function() timer.sleep(0.1); return "done" end)
+		assert(select(2, coroutine.resume(co)) == "done")
+	`)
+}
+
+// go test -v -test.run TestAwait
+func TestAwait(t *testing.T) {
+	ls, _ := newLoopState(t, `
+		local log = ""
+		timer.after(0, function() log = log .. "B"; open_gate() end)
+		log = log .. "A"
+		local v = wait_gate()
+		log = log .. v
+		assert(log == "ABopen", log)
+		local ok, msg = pcall(wait_gate, "fail")
+		assert(not ok and msg:find("future failed", 1, true))
+	`)
+	gate := make(chan struct{})
+	ls.Register("open_gate", func(ls *golua.LuaState) int {
+		close(gate)
+		return 0
+	})
+	ls.Register("wait_gate", func(ls *golua.LuaState) int {
+		fail := ls.GetTop() > 0
+		v, err := ls.Await(func() (golua.LuaValue, error) {
+			<-gate
+			if fail {
+				return nil, errors.New("future failed")
+			}
+			return golua.LuaString("open"), nil
+		})
+		if err != nil {
+			ls.Error2("%s", err.Error())
+		}
+		ls.Push(v)
+		return 1
+	})
+	if err := ls.RunLoop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// outside the loop Await just calls the function
+	v, err := ls.Await(func() (golua.LuaValue, error) { return golua.LuaNumber(1), nil })
+	if v != golua.LuaNumber(1) || err != nil {
+		t.Fatal(v, err)
+	}
+}
+
+// go test -v -test.run TestRunLoopErrors
+func TestRunLoopErrors(t *testing.T) {
+	ls, _ := newLoopState(t, `
+		timer.after(1, function() error("boom") end)
+		timer.sleep(5)
+		error("not reached")
+	`)
+	err := ls.RunLoop(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatal(err)
+	}
+
+	ls, _ = newLoopState(t, `
+		local n = 0
+		timer.every(1, function()
+			n = n + 1
+			if n == 3 then cancel() end
+		end)
+	`)
+	ctx, cancel := context.WithCancel(context.Background())
+	ls.Register("cancel", func(ls *golua.LuaState) int {
+		cancel()
+		return 0
+	})
+	if err := ls.RunLoop(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+
+	ls, _ = newLoopState(t, `assert(not pcall(timer.after, 1, print))`)
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test -v -test.run TestTimerOfStoppedLoop
+func TestTimerOfStoppedLoop(t *testing.T) {
+	ls, _ := newLoopState(t, `
+		old = timer.after(100, function() error("old timer ran") end)
+		cancel()
+	`)
+	ctx, cancel := context.WithCancel(context.Background())
+	ls.Register("cancel", func(ls *golua.LuaState) int {
+		cancel()
+		return 0
+	})
+	if err := ls.RunLoop(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	for _, script := range []string{`
+		timer.after(0.05, function() fired = true end)
+		assert(old:cancel() == false)
+	`, `
+		assert(fired)
+		assert(timer.cancel(old) == false)
+	`} {
+		if ls.LoadString(script) != golua.LUA_OK {
+			t.Fatal(ls.CheckString(-1))
+		}
+		if err := ls.RunLoop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// go test -v -test.run TestRunLoopCancelWaits
+func TestRunLoopCancelWaits(t *testing.T) {
+	ls, _ := newLoopState(t, `
+		timer.after(0, function()
+			cancel()
+			outbox:send(1)
+			error("sent")
+		end)
+		inbox:receive()
+		error("received")
+	`)
+	ctx, cancel := context.WithCancel(context.Background())
+	ls.Register("cancel", func(ls *golua.LuaState) int {
+		cancel()
+		return 0
+	})
+	in, out := make(chan golua.LuaValue), make(chan golua.LuaValue)
+	for name, ch := range map[string]chan golua.LuaValue{"inbox": in, "outbox": out} {
+		ls.PushChannel(ch)
+		ls.SetGlobal(name, ls.CheckAny(-1))
+		ls.Pop(1)
+	}
+	if err := ls.RunLoop(ctx); err != context.Canceled {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond) /* for the waits left to get to their channels */
+	select {
+	case in <- golua.LuaNumber(42):
+		t.Error("the receive of the stopped loop took the value")
+	default:
+	}
+	select {
+	case v := <-out:
+		t.Errorf("the send of the stopped loop delivered %v", v)
+	default:
+	}
+}
@@ -0,0 +1,149 @@
+package compiler
+
+import (
+	"fmt"
+	"golua"
+	"testing"
+)
+
+// runs script on a new state with the standard libraries, after setup
+// when one is given
+func runScript(t *testing.T, script string, setup ...func(ls *golua.LuaState)) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	for _, f := range setup {
+		f(ls)
+	}
+	if ls.LoadString(script) != golua.LUA_OK {
+		t.Fatal(ls.CheckString(-1))
+	}
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test -v -test.run TestTableBorder
+func TestTableBorder(t *testing.T) {
+	runScript(t, `
+		local t = {}
+		for i = 1, 100 do t[i] = i end
+		assert(#t == 100)
+		t[100] = nil
+		assert(#t == 99)
+		t[50] = nil
+		local n = #t
+		assert(n == 49 or n == 99)
+		local h = {}
+		h[1], h[2], h[3] = 1, 2, 3
+		h.x = "x"
+		assert(#h == 3)
+		assert(#{nil} == 0)
+		assert(#{1, 2, 3, nil} == 3)
+	`)
+}
+
+// go test -v -test.run TestTableNext
+func TestTableNext(t *testing.T) {
+	runScript(t, `
+		local t = {10, 20, 30, a = 1, b = 2, c = 3}
+		local n = 0
+		for k, v in pairs(t) do
+			assert(t[k] == v)
+			t[k] = nil -- clearing fields during traversal is allowed
+			n = n + 1
+		end
+		assert(n == 6)
+		assert(next(t) == nil)
+		local big = {}
+		for i = 1, 1000 do big["k" .. i] = i end
+		local sum = 0
+		for k, v in pairs(big) do sum = sum + v; big[k] = nil end
+		assert(sum == 500500)
+		assert(next(big) == nil)
+		assert(not pcall(next, {}, "missing"))
+	`)
+}
+
+func BenchmarkTableSetGetArray(b *testing.B) {
+	ls := golua.NewLuaState()
+	for i := 0; i < b.N; i++ {
+		t := ls.NewTable()
+		for j := 1; j <= 1000; j++ {
+			t.Set(golua.LuaNumber(j), golua.LuaNumber(j))
+		}
+		for j := 1; j <= 1000; j++ {
+			t.Get(golua.LuaNumber(j))
+		}
+		ls.Pop(1)
+	}
+}
+
+func BenchmarkTableSetGetHash(b *testing.B) {
+	ls := golua.NewLuaState()
+	keys := make([]golua.LuaValue, 1000)
+	for j := range keys {
+		keys[j] = golua.LuaString(fmt.Sprintf("key%d", j))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t := ls.NewTable()
+		for _, k := range keys {
+			t.Set(k, golua.LuaTrue)
+		}
+		for _, k := range keys {
+			t.Get(k)
+		}
+		ls.Pop(1)
+	}
+}
+
+func BenchmarkTableNext(b *testing.B) {
+	ls := golua.NewLuaState()
+	t := ls.NewTable()
+	for j := 0; j < 1000; j++ {
+		t.Set(golua.LuaString(fmt.Sprintf("key%d", j)), golua.LuaNumber(j))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		t.Set(golua.LuaString("key0"), golua.LuaNumber(i)) // modified between traversals
+		for k, _ := t.Next(golua.LuaNil); k != golua.LuaNil; k, _ = t.Next(k) {
+		}
+	}
+}
+
+// go test -v -test.run TestFieldCache
+func TestFieldCache(t *testing.T) {
+	runScript(t, `
+		local function get(o) return o.x end
+		local a, b = {x = 1}, {y = 0, x = 2}
+		for i = 1, 3 do
+			assert(get(a) == 1 and get(b) == 2)
+		end
+		a.x = 10                      -- store to a cached slot
+		assert(get(a) == 10)
+		for i = 1, 100 do a["k" .. i] = i end -- rehash moves x
+		assert(get(a) == 10)
+		a.x = nil                     -- dead key
+		assert(get(a) == nil)
+		a.z = 5                       -- may reuse the dead slot
+		assert(get(a) == nil and a.z == 5)
+		setmetatable(a, {__index = {x = "meta"}})
+		assert(get(a) == "meta")
+		a.x = 11
+		assert(get(a) == 11)
+
+		counter = 0
+		for i = 1, 10 do counter = counter + 1 end
+		assert(counter == 10)
+		counter = nil
+		setmetatable(_ENV, {__index = function(_, k) return k end})
+		assert(counter == "counter")
+		setmetatable(_ENV, nil)
+
+		local obj = {n = 0}
+		function obj:inc() self.n = self.n + 1 end
+		local other = setmetatable({n = 100}, {__index = obj})
+		for i = 1, 3 do obj:inc(); other:inc() end
+		assert(obj.n == 3 and other.n == 103)
+	`)
+}
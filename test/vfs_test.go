@@ -0,0 +1,76 @@
+package compiler
+
+import (
+	"golua"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// go test -v -test.run TestMapFS
+func TestMapFS(t *testing.T) {
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.SetFS(fstest.MapFS{
+		"main.lua":         {Data: []byte("#!/usr/bin/lua\nreturn require('util.strings').upper('x'), ...")},
+		"util/strings.lua": {Data: []byte("return {upper = string.upper}")},
+		"data.txt":         {Data: []byte("line1\nline2\n")},
+	})
+	ls.LoadString(`
+		assert(dofile("main.lua") == "X")
+		assert(loadfile("/main.lua")(1) == "X")
+		assert(package.searchpath("util.strings", package.path) == "./util/strings.lua")
+		local f = assert(io.open("data.txt"))
+		assert(f:read("a") == "line1\nline2\n")
+		f:close()
+		local n = 0
+		for l in io.lines("./data.txt") do n = n + 1 end
+		assert(n == 2)
+		assert(select(2, loadfile("missing.lua")):find("cannot open missing.lua"))
+		assert(not pcall(require, "missing"))
+		local ok, msg = io.open("new.txt", "w")
+		assert(not ok and msg:find("Read-only file system", 1, true), msg)
+		assert(os.remove("data.txt") == nil)
+		assert(io.tmpfile() == nil)
+	`)
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// go test -v -test.run TestDirFS
+func TestDirFS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "golua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ls := golua.NewLuaState()
+	ls.OpenLibs()
+	ls.SetFS(golua.DirFS(dir))
+	ls.LoadString(`
+		local f = assert(io.open("/a.txt", "w"))
+		f:write("return 42")
+		f:close()
+		assert(os.rename("a.txt", "../../b.lua"))
+		assert(dofile("b.lua") == 42)
+		f = assert(io.tmpfile())
+		f:write("tmp")
+		f:close()
+		assert(os.remove("b.lua"))
+		assert(os.remove("b.lua") == nil)
+		f = assert(io.open("kept.txt", "w"))
+		f:write("kept")
+		f:close()
+	`)
+	if err := ls.PCall(0, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) != 1 || filepath.Base(files[0]) != "kept.txt" {
+		t.Errorf("files: %v", files)
+	}
+}
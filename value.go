@@ -2,8 +2,8 @@ package golua
 
 import (
 	"fmt"
-	"golua/compiler"
 	"golua/number"
+	"io/fs"
 )
 
 /* basic types */
@@ -24,6 +24,9 @@ var luaValueTypeNames = [8]string{"nil", "boolean", "number", "string", "table",
 type LuaValueType int
 
 func (vt LuaValueType) String() string {
+	if vt == LUA_TNONE {
+		return "no value"
+	}
 	return luaValueTypeNames[int(vt)]
 }
 
@@ -84,24 +87,46 @@ func floatToInteger(n LuaNumber) (int64, bool) {
 // 表类型
 type LuaTable struct {
 	metatable *LuaTable
-	arr       []LuaValue
-	map_      map[LuaValue]LuaValue
-	keys      map[LuaValue]LuaValue // used by next()
-	changed   bool                  // used by next()
+	arr       []value   // array part
+	node      []luaNode // hash part
+	nodeUsed  int32     // number of non-empty slots in node
+	version   uint32    // changes whenever keys move in node, see fieldCache
 }
 
 func (tb *LuaTable) String() string     { return fmt.Sprintf("table:%p", tb) }
 func (tb *LuaTable) Type() LuaValueType { return LUA_TTABLE }
-func (tb *LuaTable) Len() int           { return len(tb.arr) + len(tb.map_) }
 
 // lua栈
 type LuaState struct {
 	registry *LuaTable
 	stack    *luaStack
+	free     *luaStack // recycled call frames, linked by prev
 	/* coroutine */
 	coStatus int
 	coCaller *LuaState
 	coChan   chan int
+	coErr    *LuaError // the error that ended the coroutine
+	/* limits, see SetLimits */
+	nCalls    int // call frames in use
+	nCcalls   int // nested calls of Call and resumes, see LUAI_MAXCCALLS
+	stackSize int // slots of the call frames in use
+	maxCalls  int
+	maxStack  int
+	fsys      fs.FS         // see SetFS
+	cmdHook   CommandHook   // see SetCommandHook
+	rand      RandSource    // see SetRandSource
+	sched     Scheduler     // see SetScheduler
+	clock     Clock         // see SetClock
+	perms     *Permanents   // see SetPermanents
+	patterns  *patternCache // see cachedPattern
+	/* debug */
+	hookMask      int32        // hook* bits, set asynchronously
+	prof          *luaProfiler // running profile, see StartProfile
+	cover         *Coverage    // see StartCoverage
+	hookFunc      Hook         // see SetHook
+	baseHookCount int
+	hookCounter   int
+	inHook        bool
 }
 
 func (ls *LuaState) String() string     { return fmt.Sprintf("state:%p", ls) }
@@ -120,7 +145,8 @@ func (ud *LuaUserData) Type() LuaValueType { return LUA_TUSERDATA }
 func (ud *LuaUserData) Len() int           { return 0 }
 
 type upvalue struct {
-	val *LuaValue
+	val *value
+	id  *LuaUserData // identity for debug.upvalueid, made on demand
 }
 
 // go function
@@ -128,8 +154,8 @@ type GoFunction func(*LuaState) int
 
 // lua闭包
 type LuaClosure struct {
-	proto  *compiler.FunctionProto // lua Closure
-	goFunc GoFunction              // go Closure
+	proto  *luaProto  // lua Closure
+	goFunc GoFunction // go Closure
 	upvals []*upvalue
 }
 
@@ -137,6 +163,111 @@ func (ud *LuaClosure) String() string     { return fmt.Sprintf("closure:%p", ud)
 func (ud *LuaClosure) Type() LuaValueType { return LUA_TCLOSURE }
 func (ud *LuaClosure) Len() int           { return 0 }
 
+/*
+** value is the unboxed form of a LuaValue, used by the registers of the VM,
+** upvalues and table storage. Numbers are tagged with numTag and kept in n
+** so that arithmetic and table writes don't allocate; every other type is
+** kept in o. The zero value is nil, so fresh slices need no initialization.
+ */
+type value struct {
+	o LuaValue // nil: nil, numTag: number
+	n float64
+}
+
+type numberTag struct{}
+
+func (nt *numberTag) String() string     { return "number" }
+func (nt *numberTag) Type() LuaValueType { return LUA_TNUMBER }
+func (nt *numberTag) Len() int           { return 0 }
+
+var numTag = LuaValue(&numberTag{})
+
+var nilValue = value{}
+
+func numberValue(n float64) value {
+	return value{o: numTag, n: n}
+}
+
+func boolValue(b bool) value {
+	return value{o: LuaBool(b)}
+}
+
+func valueOf(val LuaValue) value {
+	switch x := val.(type) {
+	case LuaNumber:
+		return value{o: numTag, n: float64(x)}
+	case nil, *LuaNilType:
+		return nilValue
+	default:
+		return value{o: val}
+	}
+}
+
+// boxes the value, numbers allocate
+func (v value) luaValue() LuaValue {
+	if v.o == nil {
+		return LuaNil
+	}
+	if v.o == numTag {
+		return LuaNumber(v.n)
+	}
+	return v.o
+}
+
+func (v value) isNumber() bool {
+	return v.o == numTag
+}
+
+func (v value) isNil() bool {
+	return v.o == nil
+}
+
+func (v value) valueType() LuaValueType {
+	if v.o == nil {
+		return LUA_TNIL
+	}
+	return v.o.Type()
+}
+
+func (v value) toBoolean() bool {
+	switch x := v.o.(type) {
+	case nil:
+		return false
+	case LuaBool:
+		return bool(x)
+	default:
+		return true
+	}
+}
+
+func (v value) toFloat() (float64, bool) {
+	if v.o == numTag {
+		return v.n, true
+	}
+	if s, ok := v.o.(LuaString); ok {
+		return number.ParseFloat(string(s))
+	}
+	return 0, false
+}
+
+func (v value) toInteger() (int64, bool) {
+	if v.o == numTag {
+		return number.FloatToInteger(v.n)
+	}
+	if s, ok := v.o.(LuaString); ok {
+		return _stringToInteger(string(s))
+	}
+	return 0, false
+}
+
+// primitive equality, without metamethods
+func rawEquals(a, b value) bool {
+	if a.o == numTag {
+		return b.o == numTag && a.n == b.n
+	}
+	return a.o == b.o
+}
+
 func convertToBoolean(val LuaValue) bool {
 	switch val.Type() {
 	case LUA_TNIL:
@@ -0,0 +1,164 @@
+package golua
+
+import (
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WritableFS is a file system that scripts may also change. io.open in the
+// "w", "a" and "+" modes, io.tmpfile, os.remove and os.rename need one, the
+// rest of file access (load, require, dofile, reading with io) only needs
+// an fs.FS. Files from OpenFile are written and positioned through
+// io.Writer and io.Seeker when they implement them.
+type WritableFS interface {
+	fs.FS
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+}
+
+// DirFS returns the host file system below dir, names cannot reach out of
+// it. An empty dir is the whole host file system with names taken as
+// package os takes them, which is what new states use.
+func DirFS(dir string) WritableFS {
+	return dirFS(dir)
+}
+
+type dirFS string
+
+func (dir dirFS) join(name string) string {
+	if dir == "" {
+		return name
+	}
+	return filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))
+}
+
+func (dir dirFS) Open(name string) (fs.File, error) {
+	return os.Open(dir.join(name))
+}
+
+func (dir dirFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	return os.OpenFile(dir.join(name), flag, perm)
+}
+
+func (dir dirFS) Remove(name string) error {
+	return os.Remove(dir.join(name))
+}
+
+func (dir dirFS) Rename(oldpath, newpath string) error {
+	return os.Rename(dir.join(oldpath), dir.join(newpath))
+}
+
+// SetFS makes fsys the file system of the state: loadfile, dofile,
+// require, and the io and os libraries find their files there, an
+// embed.FS or a testing/fstest.MapFS works. Writing needs a WritableFS.
+// Names are slash-separated and rooted at fsys; nil restores DirFS("").
+// Coroutines created afterwards share it.
+func (ls *LuaState) SetFS(fsys fs.FS) {
+	if fsys == nil {
+		fsys = DirFS("")
+	}
+	ls.fsys = fsys
+}
+
+// FS returns the file system of the state, see SetFS.
+func (ls *LuaState) FS() fs.FS {
+	return ls.fsys
+}
+
+// the name of a script's file in fsys: fs.FS wants unrooted, cleaned,
+// slash-separated paths, while the host file system takes any name
+func fsName(fsys fs.FS, name string) string {
+	if _, ok := fsys.(dirFS); ok {
+		return name
+	}
+	if name = strings.TrimLeft(path.Clean("/"+filepath.ToSlash(name)), "/"); name == "" {
+		return "."
+	}
+	return name
+}
+
+func (ls *LuaState) writableFS(op, name string) (WritableFS, error) {
+	if wfs, ok := ls.fsys.(WritableFS); ok {
+		return wfs, nil
+	}
+	return nil, &fs.PathError{Op: op, Path: name, Err: syscall.EROFS}
+}
+
+// fopen, flag as in os.OpenFile
+func (ls *LuaState) openFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag == os.O_RDONLY {
+		return ls.fsys.Open(fsName(ls.fsys, name))
+	}
+	wfs, err := ls.writableFS("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return wfs.OpenFile(fsName(ls.fsys, name), flag, perm)
+}
+
+func (ls *LuaState) readFile(name string) ([]byte, error) {
+	return fs.ReadFile(ls.fsys, fsName(ls.fsys, name))
+}
+
+// whether the file can be opened for reading, as require wants
+// lua-5.3.4/src/loadlib.c#readable()
+func (ls *LuaState) readable(name string) bool {
+	f, err := ls.fsys.Open(fsName(ls.fsys, name))
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+func (ls *LuaState) removeFile(name string) error {
+	wfs, err := ls.writableFS("remove", name)
+	if err != nil {
+		return err
+	}
+	return wfs.Remove(fsName(ls.fsys, name))
+}
+
+func (ls *LuaState) renameFile(oldpath, newpath string) error {
+	wfs, err := ls.writableFS("rename", oldpath)
+	if err != nil {
+		return err
+	}
+	return wfs.Rename(fsName(ls.fsys, oldpath), fsName(ls.fsys, newpath))
+}
+
+// tmpfile: a new file that is gone once closed. The host file system
+// makes it in its temporary directory, others at their root.
+func (ls *LuaState) tmpFile() (fs.File, error) {
+	if ls.fsys == DirFS("") {
+		f, err := ioutil.TempFile("", "lua_")
+		if err == nil {
+			os.Remove(f.Name()) /* where the system allows it */
+		}
+		return f, err
+	}
+	wfs, err := ls.writableFS("open", "tmpfile")
+	if err != nil {
+		return nil, err
+	}
+	seed := uint64(time.Now().UnixNano())
+	for i := uint64(0); ; i++ {
+		name := "lua_" + strconv.FormatUint(seed+i, 36)
+		f, err := wfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if err == nil {
+			wfs.Remove(name)
+			return f, nil
+		}
+		if !os.IsExist(err) || i == 100 {
+			return nil, err
+		}
+	}
+}
@@ -1,10 +1,10 @@
 package golua
 
 import (
+	. "golua/compiler"
 	"golua/number"
 	"math"
-	"reflect"
-	"fmt"
+	"sync/atomic"
 )
 
 /* arithmetic functions */
@@ -81,28 +81,213 @@ type operator struct {
 	floatFunc   func(float64, float64) float64
 }
 
-func _arith(a, b LuaValue, op operator) LuaValue {
+func _arith(a, b value, op operator) (value, bool) {
 	if op.floatFunc == nil { // bitwise
-		if x, ok := convertToInteger(a); ok {
-			if y, ok := convertToInteger(b); ok {
-				return LuaNumber(op.integerFunc(x, y))
+		if x, ok := a.toInteger(); ok {
+			if y, ok := b.toInteger(); ok {
+				return numberValue(float64(op.integerFunc(x, y))), true
 			}
 		}
 	} else { // arith
 		if op.integerFunc != nil { // add,sub,mul,mod,idiv,unm
-			if x, ok := convertToInteger(a); ok {
-				if y, ok := convertToInteger(b); ok {
-					return LuaNumber(op.integerFunc(x, y))
+			if x, ok := a.toInteger(); ok {
+				if y, ok := b.toInteger(); ok {
+					return numberValue(float64(op.integerFunc(x, y))), true
 				}
 			}
 		}
-		if x, ok := convertToFloat(a); ok {
-			if y, ok := convertToFloat(b); ok {
-				return LuaNumber(op.floatFunc(x, y))
+		if x, ok := a.toFloat(); ok {
+			if y, ok := b.toFloat(); ok {
+				return numberValue(op.floatFunc(x, y)), true
 			}
 		}
 	}
-	return LuaNil
+	return nilValue, false
+}
+
+// runs the current Lua frame until it returns. Registers are accessed
+// directly, instructions that may resize the frame go through the
+// handlers below, which use the stack API.
+// lua-5.3.4/src/lvm.c#luaV_execute()
+func (ls *LuaState) execute() {
+	stack := ls.stack
+	cl := stack.closure
+	code := cl.proto.code
+	k := cl.proto.consts
+	for {
+		i := code[stack.pc]
+		stack.pc++
+		if atomic.LoadInt32(&ls.hookMask) != 0 {
+			ls.hook()
+		}
+		a := int(i.a)
+		switch i.op {
+		case OP_MOVE:
+			stack.slots[a] = stack.slots[i.b]
+		case OP_LOADK:
+			stack.slots[a] = k[i.b]
+		case OP_LOADBOOL:
+			stack.slots[a] = boolValue(i.b != 0)
+			if i.c != 0 {
+				stack.pc++
+			}
+		case OP_LOADNIL:
+			for j := a; j <= a+int(i.b); j++ {
+				stack.slots[j] = nilValue
+			}
+		case OP_GETUPVAL:
+			stack.slots[a] = *cl.upvals[i.b].val
+		case OP_SETUPVAL:
+			*cl.upvals[i.b].val = stack.slots[a]
+		case OP_GETTABUP:
+			t := *cl.upvals[i.b].val
+			v := ls.indexCached(t, stack.rk(k, i.c), i.ic, cl.proto)
+			stack.slots[a] = v
+		case OP_GETTABLE:
+			t := stack.slots[i.b]
+			v := ls.indexCached(t, stack.rk(k, i.c), i.ic, cl.proto)
+			stack.slots[a] = v
+		case OP_SETTABUP:
+			ls.setIndex(*cl.upvals[a].val, stack.rk(k, i.b), stack.rk(k, i.c))
+		case OP_SETTABLE:
+			ls.setIndex(stack.slots[a], stack.rk(k, i.b), stack.rk(k, i.c))
+		case OP_NEWTABLE:
+			stack.slots[a] = value{o: newLuaTable(number.Fb2int(int(i.b)), number.Fb2int(int(i.c)))}
+		case OP_SELF:
+			t := stack.slots[i.b]
+			stack.slots[a+1] = t
+			v := ls.indexCached(t, stack.rk(k, i.c), i.ic, cl.proto)
+			stack.slots[a] = v
+		case OP_ADD, OP_SUB, OP_MUL, OP_MOD, OP_POW, OP_DIV, OP_IDIV,
+			OP_BAND, OP_BOR, OP_BXOR, OP_SHL, OP_SHR:
+			v := ls.arith(stack.rk(k, i.b), stack.rk(k, i.c), int(i.op)-OP_ADD)
+			stack.slots[a] = v
+		case OP_UNM, OP_BNOT:
+			b := stack.slots[i.b]
+			v := ls.arith(b, b, int(i.op)-OP_ADD)
+			stack.slots[a] = v
+		case OP_NOT:
+			stack.slots[a] = boolValue(!stack.slots[i.b].toBoolean())
+		case OP_JMP:
+			stack.pc += int(i.b)
+			if a != 0 {
+				stack.closeUpvalues(a - 1)
+			}
+		case OP_EQ:
+			if _eq(stack.rk(k, i.b), stack.rk(k, i.c), ls) != (a != 0) {
+				stack.pc++
+			}
+		case OP_LT:
+			if _lt(stack.rk(k, i.b), stack.rk(k, i.c), ls) != (a != 0) {
+				stack.pc++
+			}
+		case OP_LE:
+			if _le(stack.rk(k, i.b), stack.rk(k, i.c), ls) != (a != 0) {
+				stack.pc++
+			}
+		case OP_TEST:
+			if stack.slots[a].toBoolean() != (i.c != 0) {
+				stack.pc++
+			}
+		case OP_TESTSET:
+			if b := stack.slots[i.b]; b.toBoolean() == (i.c != 0) {
+				stack.slots[a] = b
+			} else {
+				stack.pc++
+			}
+		case OP_FORLOOP:
+			init, limit, step := stack.slots[a], stack.slots[a+1], stack.slots[a+2]
+			if !init.isNumber() || !limit.isNumber() || !step.isNumber() {
+				forLoop(Instruction(cl.proto.Code[stack.pc-1]), ls)
+				break
+			}
+			idx, _ := _arith(init, step, operators[LUA_OPADD])
+			stack.slots[a] = idx
+			if step.n >= 0 && idx.n <= limit.n || step.n < 0 && limit.n <= idx.n {
+				stack.pc += int(i.b)
+				stack.slots[a+3] = idx
+			}
+		case OP_FORPREP:
+			init, limit, step := stack.slots[a], stack.slots[a+1], stack.slots[a+2]
+			if !init.isNumber() || !limit.isNumber() || !step.isNumber() {
+				forPrep(Instruction(cl.proto.Code[stack.pc-1]), ls)
+				break
+			}
+			stack.slots[a], _ = _arith(init, step, operators[LUA_OPSUB])
+			stack.pc += int(i.b)
+		case OP_TFORLOOP:
+			if v := stack.slots[a+1]; !v.isNil() {
+				stack.slots[a] = v
+				stack.pc += int(i.b)
+			}
+		case OP_RETURN:
+			_return(Instruction(cl.proto.Code[stack.pc-1]), ls)
+			return
+		default:
+			Instruction(cl.proto.Code[stack.pc-1]).Execute(ls)
+		}
+	}
+}
+
+// t[k], tables without __index are read directly
+func (ls *LuaState) index(t, k value) value {
+	if tbl, ok := t.o.(*LuaTable); ok {
+		v := tbl.get(k)
+		if !v.isNil() || tbl.metatable == nil || !tbl.hasMetafield("__index") {
+			return v
+		}
+	}
+	luaGetTable_(ls, t, k, false)
+	return ls.stack.popv()
+}
+
+// t[k] for an instruction with the inline cache ic, see fieldCache
+func (ls *LuaState) indexCached(t, k value, ic uint16, proto *luaProto) value {
+	if ic != 0 {
+		c := &proto.caches[ic-1]
+		tbl, _ := t.o.(*LuaTable)
+		for loop := 0; tbl != nil && loop < 100; loop++ {
+			if v := tbl.getCached(c); !v.isNil() {
+				return v
+			}
+			if tbl.metatable == nil {
+				return nilValue
+			}
+			/* follow __index tables, functions take the slow path */
+			tbl, _ = tbl.metatable.getStr("__index").o.(*LuaTable)
+		}
+	}
+	return ls.index(t, k)
+}
+
+// t[k]=v, tables without metatable are written directly
+func (ls *LuaState) setIndex(t, k, v value) {
+	if tbl, ok := t.o.(*LuaTable); ok && tbl.metatable == nil {
+		tbl.set(k, v)
+		return
+	}
+	luaSetTable_(ls, t, k, v, false)
+}
+
+// a op b, falling back to the metamethod of the operator
+func (ls *LuaState) arith(a, b value, op ArithOp) value {
+	operator := operators[op]
+	if result, ok := _arith(a, b, operator); ok {
+		return result
+	}
+	if result, ok := callMetamethod(ls, a.luaValue(), b.luaValue(), operator.metamethod); ok {
+		return valueOf(result)
+	}
+	if operator.floatFunc == nil { /* bitwise operation */
+		_, ok1 := a.toFloat()
+		_, ok2 := b.toFloat()
+		if ok1 && ok2 {
+			ls.toIntError(a, b)
+		}
+		ls.opIntError(a, b, "perform bitwise operation on")
+	}
+	ls.opIntError(a, b, "perform arithmetic on")
+	return nilValue
 }
 
 func luaUpvalueIndex(i int) int {
@@ -124,21 +309,7 @@ func (ls *LuaState) fetch() uint32 {
 }
 
 func (ls *LuaState) getConst(idx int) {
-	c := ls.stack.closure.proto.Constants[idx]
-	switch x := c.(type) {
-	case nil:
-		ls.stack.push(LuaNil)
-	case string:
-		ls.stack.push(LuaString(x))
-	case int:
-		ls.stack.push(LuaNumber(x))
-	case int64:
-		ls.stack.push(LuaNumber(x))
-	case float64:
-		ls.stack.push(LuaNumber(x))
-	default:
-		panic(fmt.Errorf("const type:%v error", reflect.TypeOf(c).Name()) )
-	}
+	ls.stack.pushv(ls.stack.closure.proto.consts[idx])
 }
 
 func (ls *LuaState) getRK(rk int) {
@@ -164,7 +335,7 @@ func (ls *LuaState) loadVararg(n int) {
 
 func (ls *LuaState) loadProto(idx int) {
 	stack := ls.stack
-	subProto := stack.closure.proto.Protos[idx]
+	subProto := stack.closure.proto.protos[idx]
 	closure := newLuaClosure(subProto)
 	stack.push(closure)
 
@@ -178,7 +349,7 @@ func (ls *LuaState) loadProto(idx int) {
 			if openuv, found := stack.openuvs[uvIdx]; found {
 				closure.upvals[i] = openuv
 			} else {
-				closure.upvals[i] = &upvalue{&stack.slots[uvIdx]}
+				closure.upvals[i] = &upvalue{val: &stack.slots[uvIdx]}
 				stack.openuvs[uvIdx] = closure.upvals[i]
 			}
 		} else {
@@ -189,13 +360,7 @@ func (ls *LuaState) loadProto(idx int) {
 
 // 退出当前域时关闭外部变量表
 func (ls *LuaState) closeUpvalues(a int) {
-	for i, openuv := range ls.stack.openuvs {
-		if i >= a-1 {
-			val := *openuv.val
-			openuv.val = &val
-			delete(ls.stack.openuvs, i)
-		}
-	}
+	ls.stack.closeUpvalues(a - 1)
 }
 
 // R(A+1) := R(B); R(A) := R(B)[RK(C)]
@@ -236,7 +401,7 @@ func tForCall(i Instruction, ls *LuaState) {
 	a += 1
 
 	_pushFuncAndArgs(a, 3, ls)
-	ls.Call(2, c)
+	ls.call(2, c)
 	_popResults(a+3, c+1, ls)
 }
 
@@ -248,7 +413,7 @@ func tailCall(i Instruction, ls *LuaState) {
 	// todo: optimize tail call!
 	c := 0
 	nArgs := _pushFuncAndArgs(a, b, ls)
-	ls.Call(nArgs, c-1)
+	ls.call(nArgs, c-1)
 	_popResults(a, c, ls)
 }
 
@@ -259,7 +424,7 @@ func call(i Instruction, ls *LuaState) {
 
 	// println(":::"+ ls.StackToString())
 	nArgs := _pushFuncAndArgs(a, b, ls)
-	ls.Call(nArgs, c-1)
+	ls.call(nArgs, c-1)
 	_popResults(a, c, ls)
 }
 
@@ -324,6 +489,15 @@ func forPrep(i Instruction, ls *LuaState) {
 	a, sBx := i.AsBx()
 	a += 1
 
+	if !luaIsNumber(ls, a+1) {
+		ls.runError("'for' limit must be a number")
+	}
+	if !luaIsNumber(ls, a+2) {
+		ls.runError("'for' step must be a number")
+	}
+	if !luaIsNumber(ls, a) {
+		ls.runError("'for' initial value must be a number")
+	}
 	if luaType(ls, a) == LUA_TSTRING {
 		ls.Push(LuaNumber(luaToNumber(ls, a)))
 		luaReplace(ls, a)